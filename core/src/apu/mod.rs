@@ -1,6 +1,294 @@
-#[derive(Default)]
-pub struct Apu;
+use std::collections::VecDeque;
+
+pub const SOUND_BASE: u32 = 0x0400_0060;
+pub const SOUND_END: u32 = 0x0400_008F;
+
+/// Output rate of [`Apu::take_samples`], in stereo sample pairs per second.
+pub const SAMPLE_RATE: u32 = 32_768;
+const CYCLES_PER_SAMPLE: u32 = 16_777_216 / SAMPLE_RATE;
+// Samples nobody collects are dropped beyond one second's worth
+const MAX_BUFFERED_SAMPLES: usize = 2 * SAMPLE_RATE as usize;
+
+const SOUNDCNT_H: usize = 0x22;
+const SOUNDCNT_X: usize = 0x24;
+const MASTER_ENABLE: u8 = 1 << 7;
+// PSG registers up to and including SOUNDCNT_L are cleared while sound is off
+const PSG_REGS_END: usize = 0x22;
+
+// The frame sequencer clocks length counters at 256 Hz
+const LENGTH_CLOCK_CYCLES: u32 = 16_777_216 / 256;
+
+// A FIFO holds 32 samples and asks DMA for more once it is down to half of that
+const FIFO_CAPACITY: usize = 32;
+const FIFO_REFILL_LEVEL: usize = 16;
+
+#[derive(Default, Clone, Copy)]
+struct PsgChannel {
+    active: bool,
+    length: u16,
+    length_enabled: bool,
+}
+
+#[derive(Clone)]
+pub struct Apu {
+    regs: [u8; 0x30],
+    channels: [PsgChannel; 4],
+    cycles: u32,
+    // DirectSound FIFO A and B, and the sample each is currently playing
+    fifos: [VecDeque<i8>; 2],
+    fifo_output: [i8; 2],
+    sample_cycles: u32,
+    // Interleaved left/right output waiting to be collected
+    samples: Vec<i16>,
+}
+
+impl Default for Apu {
+    fn default() -> Self {
+        Self {
+            regs: [0; 0x30],
+            channels: [PsgChannel::default(); 4],
+            cycles: 0,
+            fifos: [VecDeque::with_capacity(FIFO_CAPACITY), VecDeque::with_capacity(FIFO_CAPACITY)],
+            fifo_output: [0; 2],
+            sample_cycles: 0,
+            samples: Vec::new(),
+        }
+    }
+}
 
 impl Apu {
-    pub fn new() -> Self { Self }
+    pub fn new() -> Self { Self::default() }
+
+    pub fn master_enabled(&self) -> bool { (self.regs[SOUNDCNT_X] & MASTER_ENABLE) != 0 }
+    pub fn channel_active(&self, ch: usize) -> bool { self.channels[ch].active }
+
+    fn reg16(&self, offset: usize) -> u16 {
+        u16::from_le_bytes([self.regs[offset], self.regs[offset + 1]])
+    }
+
+    /// Timer (0 or 1) that SOUNDCNT_H selects to clock FIFO A (0) or B (1).
+    pub fn fifo_timer(&self, fifo: usize) -> usize { (self.reg16(SOUNDCNT_H) >> (10 + 4 * fifo)) as usize & 1 }
+
+    /// Queues a byte written to FIFO A (0) or B (1); a full FIFO ignores it.
+    pub fn write_fifo(&mut self, fifo: usize, value: u8) {
+        if self.fifos[fifo].len() < FIFO_CAPACITY {
+            self.fifos[fifo].push_back(value as i8);
+        }
+    }
+
+    /// Moves `fifo` on to its next sample, returning whether it now needs a DMA refill.
+    pub fn play_fifo_sample(&mut self, fifo: usize) -> bool {
+        if let Some(sample) = self.fifos[fifo].pop_front() {
+            self.fifo_output[fifo] = sample;
+        }
+        self.fifos[fifo].len() <= FIFO_REFILL_LEVEL
+    }
+
+    /// Takes the interleaved left/right samples mixed since the last call.
+    pub fn take_samples(&mut self) -> Vec<i16> { std::mem::take(&mut self.samples) }
+
+    // Offsets of the length/duty, envelope and trigger registers of each channel
+    fn length_reg(ch: usize) -> usize { [0x02, 0x08, 0x12, 0x18][ch] }
+    fn trigger_reg(ch: usize) -> usize { [0x04, 0x0C, 0x14, 0x1C][ch] }
+
+    // A channel whose DAC is off can never play, regardless of triggers
+    fn dac_enabled(&self, ch: usize) -> bool {
+        match ch {
+            2 => (self.regs[0x10] & 0x80) != 0,
+            _ => (self.reg16(Self::length_reg(ch)) & 0xF800) != 0,
+        }
+    }
+
+    fn max_length(ch: usize) -> u16 { if ch == 2 { 256 } else { 64 } }
+
+    pub fn read8(&self, addr: u32) -> u8 {
+        let offset = (addr - SOUND_BASE) as usize;
+        match offset {
+            SOUNDCNT_X => {
+                let status = self
+                    .channels
+                    .iter()
+                    .enumerate()
+                    .fold(0u8, |acc, (i, ch)| acc | ((ch.active as u8) << i));
+                (self.regs[SOUNDCNT_X] & MASTER_ENABLE) | status
+            }
+            _ => self.regs[offset],
+        }
+    }
+
+    pub fn write8(&mut self, addr: u32, value: u8) {
+        let offset = (addr - SOUND_BASE) as usize;
+        if offset == SOUNDCNT_X {
+            let was_enabled = self.master_enabled();
+            self.regs[SOUNDCNT_X] = value & MASTER_ENABLE;
+            if was_enabled && !self.master_enabled() {
+                self.reset_psg();
+            }
+            return;
+        }
+        if offset < PSG_REGS_END && !self.master_enabled() {
+            return;
+        }
+        if offset == SOUNDCNT_H + 1 {
+            // The FIFO reset bits empty the FIFO and always read back as 0
+            for fifo in 0..2 {
+                if (value & (0x08 << (4 * fifo))) != 0 {
+                    self.fifos[fifo].clear();
+                }
+            }
+            self.regs[offset] = value & 0x77;
+            return;
+        }
+        self.regs[offset] = value;
+
+        for ch in 0..4 {
+            if offset == Self::length_reg(ch) {
+                let bits = if ch == 2 { 0xFF } else { 0x3F };
+                self.channels[ch].length = Self::max_length(ch) - (value as u16 & bits);
+            } else if offset == Self::trigger_reg(ch) + 1 {
+                self.channels[ch].length_enabled = (value & 0x40) != 0;
+                if (value & 0x80) != 0 {
+                    self.trigger(ch);
+                }
+            }
+            if !self.dac_enabled(ch) {
+                self.channels[ch].active = false;
+            }
+        }
+    }
+
+    fn trigger(&mut self, ch: usize) {
+        let dac = self.dac_enabled(ch);
+        let channel = &mut self.channels[ch];
+        if channel.length == 0 {
+            channel.length = Self::max_length(ch);
+        }
+        channel.active = dac;
+    }
+
+    fn reset_psg(&mut self) {
+        self.regs[..PSG_REGS_END].fill(0);
+        self.channels = [PsgChannel::default(); 4];
+        log::debug!("Sound master disabled, PSG registers reset");
+    }
+
+    pub fn step(&mut self, cycles: u32) {
+        self.sample_cycles += cycles;
+        while self.sample_cycles >= CYCLES_PER_SAMPLE {
+            self.sample_cycles -= CYCLES_PER_SAMPLE;
+            if self.samples.len() < MAX_BUFFERED_SAMPLES {
+                let (left, right) = self.mix();
+                self.samples.extend([left, right]);
+            }
+        }
+
+        self.cycles += cycles;
+        while self.cycles >= LENGTH_CLOCK_CYCLES {
+            self.cycles -= LENGTH_CLOCK_CYCLES;
+            self.clock_length();
+        }
+    }
+
+    // Only the DirectSound channels produce output; the PSG channels are silent
+    fn mix(&self) -> (i16, i16) {
+        if !self.master_enabled() {
+            return (0, 0);
+        }
+        let control = self.reg16(SOUNDCNT_H);
+        let (mut left, mut right) = (0i16, 0i16);
+        for fifo in 0..2 {
+            // Full volume uses the whole i16 range, half volume half of it
+            let full = (control >> (2 + fifo)) & 1 != 0;
+            let sample = self.fifo_output[fifo] as i16 * if full { 256 } else { 128 };
+            if (control >> (8 + 4 * fifo)) & 1 != 0 {
+                right = right.saturating_add(sample);
+            }
+            if (control >> (9 + 4 * fifo)) & 1 != 0 {
+                left = left.saturating_add(sample);
+            }
+        }
+        (left, right)
+    }
+
+    fn clock_length(&mut self) {
+        for channel in self.channels.iter_mut().filter(|c| c.length_enabled && c.length > 0) {
+            channel.length -= 1;
+            if channel.length == 0 {
+                channel.active = false;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bus::{Bus, BusAccess};
+
+    const SOUND1CNT_H: u32 = SOUND_BASE + 0x02;
+    const SOUND1CNT_X: u32 = SOUND_BASE + 0x04;
+    const SOUNDCNT_X_ADDR: u32 = SOUND_BASE + 0x24;
+
+    #[test]
+    fn triggered_channel_reports_playing_until_master_disable() {
+        let mut bus = Bus::new();
+        bus.write16(SOUNDCNT_X_ADDR, 0x0080);
+        // Initial volume 15, length 63 (one tick remaining), then trigger with length enabled
+        bus.write16(SOUND1CNT_H, 0xF03F);
+        bus.write16(SOUND1CNT_X, 0xC000);
+        assert_eq!(bus.read16(SOUNDCNT_X_ADDR), 0x0081);
+
+        bus.write16(SOUNDCNT_X_ADDR, 0x0000);
+        assert_eq!(bus.read16(SOUNDCNT_X_ADDR), 0x0000);
+        assert_eq!(bus.read16(SOUND1CNT_H), 0);
+
+        // Registers stay cleared while the master enable is off
+        bus.write16(SOUND1CNT_H, 0xF000);
+        assert_eq!(bus.read16(SOUND1CNT_H), 0);
+    }
+
+    #[test]
+    fn fifo_samples_are_mixed_into_the_output() {
+        let mut apu = Apu::new();
+        apu.write8(SOUNDCNT_X_ADDR, MASTER_ENABLE);
+        // FIFO A at full volume on the left, FIFO B at half volume on both sides
+        apu.write8(SOUND_BASE + SOUNDCNT_H as u32, 1 << 2);
+        apu.write8(SOUND_BASE + SOUNDCNT_H as u32 + 1, (1 << 1) | (1 << 4) | (1 << 5));
+        apu.write_fifo(0, 0x40);
+        apu.write_fifo(0, 0xC0);
+        apu.write_fifo(1, 0x10);
+
+        assert!(apu.play_fifo_sample(0), "a nearly empty FIFO asks for data");
+        apu.play_fifo_sample(1);
+        apu.step(CYCLES_PER_SAMPLE);
+        assert_eq!(apu.take_samples(), [0x4000 + 0x0800, 0x0800]);
+
+        apu.play_fifo_sample(0);
+        apu.write8(SOUND_BASE + SOUNDCNT_H as u32 + 1, (1 << 1) | (1 << 7));
+        apu.step(2 * CYCLES_PER_SAMPLE);
+        assert_eq!(apu.take_samples(), [-0x4000, 0, -0x4000, 0], "FIFO B reset keeps its last sample");
+        assert!(apu.take_samples().is_empty());
+    }
+
+    #[test]
+    fn length_expiry_clears_status_bit() {
+        let mut apu = Apu::new();
+        apu.write8(SOUNDCNT_X_ADDR, MASTER_ENABLE);
+        apu.write8(SOUND1CNT_H, 0x3F);
+        apu.write8(SOUND1CNT_H + 1, 0xF0);
+        apu.write8(SOUND1CNT_X + 1, 0xC0);
+        assert!(apu.channel_active(0));
+
+        apu.step(LENGTH_CLOCK_CYCLES);
+        assert!(!apu.channel_active(0));
+        assert_eq!(apu.read8(SOUNDCNT_X_ADDR), MASTER_ENABLE);
+    }
+
+    #[test]
+    fn channel_without_dac_never_plays() {
+        let mut apu = Apu::new();
+        apu.write8(SOUNDCNT_X_ADDR, MASTER_ENABLE);
+        apu.write8(SOUND1CNT_X + 1, 0x80);
+        assert!(!apu.channel_active(0));
+    }
 }
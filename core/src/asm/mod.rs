@@ -0,0 +1,945 @@
+//! Test-only assembler for the ARM and Thumb subset the instruction tests use,
+//! so tests can say `asm::arm("add r0, r1, r2")` instead of spelling out opcodes.
+//!
+//! Programs are assembled in two passes so branches and PC-relative loads can
+//! name labels (`loop:`). Numeric branch targets are absolute addresses and `.`
+//! is the current instruction. Syntax errors panic with the offending line.
+
+use std::collections::HashMap;
+
+type Result<T> = std::result::Result<T, String>;
+
+const CONDITIONS: [&str; 15] = ["eq", "ne", "cs", "cc", "mi", "pl", "vs", "vc", "hi", "ls", "ge", "lt", "gt", "le", "al"];
+const COND_AL: u32 = 0xE;
+
+const DATA_PROCESSING: [&str; 16] = [
+    "and", "eor", "sub", "rsb", "add", "adc", "sbc", "rsc", "tst", "teq", "cmp", "cmn", "orr", "mov", "bic", "mvn",
+];
+
+// Thumb format 4 register-register ALU operations, by opcode
+const THUMB_ALU: [&str; 16] = [
+    "and", "eor", "lsl", "lsr", "asr", "adc", "sbc", "ror", "tst", "neg", "cmp", "cmn", "orr", "mul", "bic", "mvn",
+];
+
+/// Assembles one ARM instruction placed at address 0.
+pub fn arm(src: &str) -> u32 {
+    let bytes = arm_program(0, src);
+    assert_eq!(bytes.len(), 4, "expected a single ARM instruction: `{}`", src);
+    u32::from_le_bytes([bytes[0], bytes[1], bytes[2], bytes[3]])
+}
+
+/// Assembles one 16-bit Thumb instruction placed at address 0.
+pub fn thumb(src: &str) -> u16 {
+    let bytes = thumb_program(0, src);
+    assert_eq!(bytes.len(), 2, "expected a single 16-bit Thumb instruction: `{}`", src);
+    u16::from_le_bytes([bytes[0], bytes[1]])
+}
+
+/// Assembles ARM source (one instruction per line) loaded at `base`.
+pub fn arm_program(base: u32, src: &str) -> Vec<u8> {
+    assemble(base, src, false)
+}
+
+/// Assembles Thumb source (one instruction per line) loaded at `base`.
+pub fn thumb_program(base: u32, src: &str) -> Vec<u8> {
+    assemble(base, src, true)
+}
+
+struct Line {
+    number: usize,
+    addr: u32,
+    text: String,
+    mnemonic: String,
+    operands: Vec<String>,
+}
+
+struct Ctx<'a> {
+    addr: u32,
+    labels: &'a HashMap<String, u32>,
+}
+
+impl Ctx<'_> {
+    fn target(&self, s: &str) -> Result<u32> {
+        let s = s.trim();
+        let s = s.strip_prefix('#').unwrap_or(s);
+        if s == "." {
+            return Ok(self.addr);
+        }
+        match self.labels.get(s) {
+            Some(&addr) => Ok(addr),
+            None => parse_num(s).map(|n| n as u32).map_err(|_| format!("unknown label `{}`", s)),
+        }
+    }
+}
+
+fn assemble(base: u32, src: &str, thumb: bool) -> Vec<u8> {
+    let mut labels = HashMap::new();
+    let mut lines = Vec::new();
+    let mut addr = base;
+
+    for (idx, raw) in src.lines().enumerate() {
+        let mut text = strip_comment(raw).trim().to_lowercase();
+        while let Some((label, rest)) = text.split_once(':') {
+            let label = label.trim();
+            if label.is_empty() || label.contains(char::is_whitespace) {
+                break;
+            }
+            labels.insert(label.to_string(), addr);
+            text = rest.trim().to_string();
+        }
+        if text.is_empty() {
+            continue;
+        }
+        let (mnemonic, operands) = match text.split_once(char::is_whitespace) {
+            Some((m, ops)) => (m.to_string(), split_operands(ops)),
+            None => (text.clone(), Vec::new()),
+        };
+        let size = match mnemonic.as_str() {
+            ".word" => 4,
+            ".hword" => 2,
+            "bl" if thumb => 4,
+            _ if thumb => 2,
+            _ => 4,
+        };
+        lines.push(Line { number: idx + 1, addr, text, mnemonic, operands });
+        addr += size;
+    }
+
+    let mut out = Vec::new();
+    for line in &lines {
+        let ctx = Ctx { addr: line.addr, labels: &labels };
+        let encoded = if thumb {
+            encode_thumb(&ctx, &line.mnemonic, &line.operands)
+                .map(|halves| halves.iter().flat_map(|h| h.to_le_bytes()).collect::<Vec<u8>>())
+        } else {
+            encode_arm(&ctx, &line.mnemonic, &line.operands).map(|word| word.to_le_bytes().to_vec())
+        };
+        match encoded {
+            Ok(bytes) => out.extend(bytes),
+            Err(err) => panic!("asm line {}: {}: `{}`", line.number, err, line.text),
+        }
+    }
+    out
+}
+
+fn strip_comment(line: &str) -> &str {
+    let end = [";", "@", "//"].iter().filter_map(|marker| line.find(marker)).min().unwrap_or(line.len());
+    &line[..end]
+}
+
+// Splits on commas outside of `[...]` and `{...}`
+fn split_operands(s: &str) -> Vec<String> {
+    let mut out = Vec::new();
+    let mut depth = 0;
+    let mut current = String::new();
+    for ch in s.chars() {
+        match ch {
+            '[' | '{' => {
+                depth += 1;
+                current.push(ch);
+            }
+            ']' | '}' => {
+                depth -= 1;
+                current.push(ch);
+            }
+            ',' if depth == 0 => {
+                out.push(current.trim().to_string());
+                current.clear();
+            }
+            _ => current.push(ch),
+        }
+    }
+    if !current.trim().is_empty() {
+        out.push(current.trim().to_string());
+    }
+    out
+}
+
+fn cond_code(s: &str) -> Option<u32> {
+    match s {
+        "" => Some(COND_AL),
+        "hs" => Some(2),
+        "lo" => Some(3),
+        _ => CONDITIONS.iter().position(|c| *c == s).map(|i| i as u32),
+    }
+}
+
+// Splits a mnemonic tail into a condition and one of `suffixes`, accepting both
+// the pre-UAL (`ldreqb`) and UAL (`ldrbeq`) orders
+fn cond_suffix<'s>(rest: &str, suffixes: &[&'s str]) -> Option<(u32, &'s str)> {
+    for &suffix in suffixes {
+        if let Some(cond) = rest.strip_suffix(suffix).and_then(cond_code) {
+            return Some((cond, suffix));
+        }
+        if let Some(cond) = rest.strip_prefix(suffix).and_then(cond_code) {
+            return Some((cond, suffix));
+        }
+    }
+    None
+}
+
+fn parse_reg(s: &str) -> Result<u32> {
+    match s.trim() {
+        "sp" => Ok(13),
+        "lr" => Ok(14),
+        "pc" => Ok(15),
+        r => r
+            .strip_prefix('r')
+            .and_then(|n| n.parse::<u32>().ok())
+            .filter(|&n| n < 16)
+            .ok_or_else(|| format!("bad register `{}`", s)),
+    }
+}
+
+fn parse_low_reg(s: &str) -> Result<u32> {
+    parse_reg(s).and_then(|r| if r < 8 { Ok(r) } else { Err(format!("`{}` is not a low register", s)) })
+}
+
+fn parse_num(s: &str) -> Result<i64> {
+    let s = s.trim();
+    let (negative, digits) = match s.strip_prefix('-') {
+        Some(rest) => (true, rest),
+        None => (false, s.strip_prefix('+').unwrap_or(s)),
+    };
+    let value = if let Some(hex) = digits.strip_prefix("0x") {
+        i64::from_str_radix(&hex.replace('_', ""), 16)
+    } else if let Some(bin) = digits.strip_prefix("0b") {
+        i64::from_str_radix(&bin.replace('_', ""), 2)
+    } else {
+        digits.replace('_', "").parse::<i64>()
+    }
+    .map_err(|_| format!("bad number `{}`", s))?;
+    Ok(if negative { -value } else { value })
+}
+
+fn parse_imm(s: &str) -> Result<i64> {
+    s.trim()
+        .strip_prefix('#')
+        .ok_or_else(|| format!("expected an immediate, got `{}`", s))
+        .and_then(parse_num)
+}
+
+fn is_imm(s: &str) -> bool { s.trim_start().starts_with('#') }
+
+fn parse_rlist(s: &str) -> Result<u32> {
+    let inner = s
+        .trim()
+        .strip_prefix('{')
+        .and_then(|s| s.strip_suffix('}'))
+        .ok_or_else(|| format!("bad register list `{}`", s))?;
+    let mut list = 0;
+    for part in inner.split(',').map(str::trim).filter(|p| !p.is_empty()) {
+        match part.split_once('-') {
+            Some((lo, hi)) => {
+                for r in parse_reg(lo)?..=parse_reg(hi)? {
+                    list |= 1 << r;
+                }
+            }
+            None => list |= 1 << parse_reg(part)?,
+        }
+    }
+    Ok(list)
+}
+
+fn check_range(value: i64, min: i64, max: i64, what: &str) -> Result<u32> {
+    if value < min || value > max {
+        return Err(format!("{} {} out of range {}..={}", what, value, min, max));
+    }
+    Ok(value as u32)
+}
+
+fn check_aligned(value: i64, align: i64, what: &str) -> Result<i64> {
+    if value % align != 0 {
+        return Err(format!("{} {} is not a multiple of {}", what, value, align));
+    }
+    Ok(value / align)
+}
+
+// ----- ARM -----
+
+fn encode_arm(ctx: &Ctx, m: &str, ops: &[String]) -> Result<u32> {
+    match m {
+        ".word" => return one(ops).and_then(parse_num).map(|n| n as u32),
+        "nop" => return Ok(0xE1A0_0000), // MOV r0, r0
+        _ => {}
+    }
+
+    if let Some(cond) = m.strip_prefix("bx").and_then(cond_code) {
+        return Ok(cond << 28 | 0x012F_FF10 | parse_reg(one(ops)?)?);
+    }
+    for (base, link) in [("bl", true), ("b", false)] {
+        if let Some(cond) = m.strip_prefix(base).and_then(cond_code) {
+            let offset = ctx.target(one(ops)?)? as i64 - (ctx.addr as i64 + 8);
+            let words = check_aligned(offset, 4, "branch offset")?;
+            check_range(words, -(1 << 23), (1 << 23) - 1, "branch offset")?;
+            return Ok(cond << 28 | 0b101 << 25 | (link as u32) << 24 | (words as u32 & 0x00FF_FFFF));
+        }
+    }
+    for base in ["swi", "svc"] {
+        if let Some(cond) = m.strip_prefix(base).and_then(cond_code) {
+            let comment = check_range(parse_imm(one(ops)?)?, 0, 0xFF_FFFF, "SWI number")?;
+            return Ok(cond << 28 | 0x0F00_0000 | comment);
+        }
+    }
+    if let Some(word) = encode_arm_multiply(m, ops)? {
+        return Ok(word);
+    }
+    if let Some((cond, suffix)) = m.strip_prefix("swp").and_then(|r| cond_suffix(r, &["b", ""])) {
+        let [rd, rm, addr] = ops else { return Err("expected rd, rm, [rn]".into()) };
+        let rn = addr.strip_prefix('[').and_then(|a| a.strip_suffix(']')).ok_or("expected [rn]")?;
+        let b = (suffix == "b") as u32;
+        return Ok(cond << 28 | 0x0100_0090 | b << 22 | parse_reg(rn)? << 16 | parse_reg(rd)? << 12 | parse_reg(rm)?);
+    }
+    if let Some(cond) = m.strip_prefix("mrs").and_then(cond_code) {
+        let [rd, psr] = ops else { return Err("expected rd, psr".into()) };
+        let r = match psr.as_str() {
+            "cpsr" => 0,
+            "spsr" => 1,
+            _ => return Err(format!("bad PSR `{}`", psr)),
+        };
+        return Ok(cond << 28 | 0x010F_0000 | r << 22 | parse_reg(rd)? << 12);
+    }
+    if let Some(cond) = m.strip_prefix("msr").and_then(cond_code) {
+        let [psr, src] = ops else { return Err("expected psr_fields, operand".into()) };
+        let (r, mask) = parse_psr_fields(psr)?;
+        let base = cond << 28 | r << 22 | mask << 16;
+        return if is_imm(src) {
+            Ok(base | 0x0320_F000 | encode_rotated(parse_imm(src)? as u32)?)
+        } else {
+            Ok(base | 0x0120_F000 | parse_reg(src)?)
+        };
+    }
+    if let Some(word) = encode_arm_block_transfer(m, ops)? {
+        return Ok(word);
+    }
+    if let Some(word) = encode_arm_single_transfer(ctx, m, ops)? {
+        return Ok(word);
+    }
+    for (op, name) in DATA_PROCESSING.iter().enumerate() {
+        if let Some((cond, s)) = m.strip_prefix(name).and_then(|r| cond_suffix(r, &["s", ""])) {
+            return encode_arm_data_processing(cond, op as u32, s == "s", ops);
+        }
+    }
+    Err(format!("unknown ARM mnemonic `{}`", m))
+}
+
+fn one(ops: &[String]) -> Result<&str> {
+    match ops {
+        [op] => Ok(op),
+        _ => Err(format!("expected one operand, got {}", ops.len())),
+    }
+}
+
+/// Encodes `value` as an 8-bit immediate rotated right by an even amount.
+fn encode_rotated(value: u32) -> Result<u32> {
+    (0..16)
+        .find(|rot| value.rotate_left(rot * 2) <= 0xFF)
+        .map(|rot| rot << 8 | value.rotate_left(rot * 2))
+        .ok_or_else(|| format!("immediate {:#x} cannot be encoded", value))
+}
+
+// Immediate shifts yield bits 11-4 of the operand; register shifts set bit 4
+fn shift_field(s: &str) -> Result<u32> {
+    if s == "rrx" {
+        return Ok(3 << 5);
+    }
+    let (kind, amount) = s.split_once(char::is_whitespace).ok_or_else(|| format!("bad shift `{}`", s))?;
+    let typ = match kind {
+        "lsl" | "asl" => 0,
+        "lsr" => 1,
+        "asr" => 2,
+        "ror" => 3,
+        _ => return Err(format!("bad shift `{}`", kind)),
+    };
+    let amount = amount.trim();
+    if !is_imm(amount) {
+        return Ok(parse_reg(amount)? << 8 | typ << 5 | 1 << 4);
+    }
+    let n = parse_imm(amount)?;
+    // LSR/ASR #32 are encoded as #0; ROR #0 would mean RRX
+    let n = match typ {
+        0 => check_range(n, 0, 31, "shift")?,
+        1 | 2 => check_range(n, 1, 32, "shift")? & 31,
+        _ => check_range(n, 1, 31, "shift")?,
+    };
+    Ok(n << 7 | typ << 5)
+}
+
+fn operand2(ops: &[String]) -> Result<u32> {
+    match ops {
+        [imm] if is_imm(imm) => Ok(1 << 25 | encode_rotated(parse_imm(imm)? as u32)?),
+        [rm] => parse_reg(rm),
+        [rm, shift] => Ok(parse_reg(rm)? | shift_field(shift)?),
+        _ => Err("bad shifter operand".into()),
+    }
+}
+
+fn encode_arm_data_processing(cond: u32, op: u32, s: bool, ops: &[String]) -> Result<u32> {
+    let test = (0x8..=0xB).contains(&op);
+    let (rd, rn, rest) = match op {
+        0xD | 0xF => (parse_reg(&ops[0])?, 0, &ops[1..]),
+        _ if test => (0, parse_reg(&ops[0])?, &ops[1..]),
+        // Two-operand shorthand: `add r0, #1` is `add r0, r0, #1`
+        _ if ops.len() == 2 => (parse_reg(&ops[0])?, parse_reg(&ops[0])?, &ops[1..]),
+        _ => (parse_reg(&ops[0])?, parse_reg(ops.get(1).ok_or("missing operand")?)?, &ops[2..]),
+    };
+    let s = (s || test) as u32;
+    Ok(cond << 28 | op << 21 | s << 20 | rn << 16 | rd << 12 | operand2(rest)?)
+}
+
+fn encode_arm_multiply(m: &str, ops: &[String]) -> Result<Option<u32>> {
+    // Longer names first so `mul` does not swallow `mull`
+    for (name, bits, regs) in [
+        ("umull", 0x0080_0090, 4),
+        ("umlal", 0x00A0_0090, 4),
+        ("smull", 0x00C0_0090, 4),
+        ("smlal", 0x00E0_0090, 4),
+        ("mul", 0x0000_0090, 3),
+        ("mla", 0x0020_0090, 4),
+    ] {
+        let Some((cond, s)) = m.strip_prefix(name).and_then(|r| cond_suffix(r, &["s", ""])) else { continue };
+        if ops.len() != regs {
+            return Err(format!("{} takes {} registers", name, regs));
+        }
+        let r: Vec<u32> = ops.iter().map(|op| parse_reg(op)).collect::<Result<_>>()?;
+        let s = ((s == "s") as u32) << 20;
+        let word = if regs == 4 && name != "mla" {
+            // rdlo, rdhi, rm, rs
+            bits | r[1] << 16 | r[0] << 12 | r[3] << 8 | r[2]
+        } else {
+            // rd, rm, rs[, rn]
+            bits | r[0] << 16 | r.get(3).copied().unwrap_or(0) << 12 | r[2] << 8 | r[1]
+        };
+        return Ok(Some(cond << 28 | s | word));
+    }
+    Ok(None)
+}
+
+fn parse_psr_fields(s: &str) -> Result<(u32, u32)> {
+    let (psr, fields) = s.split_once('_').unwrap_or((s, "fc"));
+    let r = match psr {
+        "cpsr" => 0,
+        "spsr" => 1,
+        _ => return Err(format!("bad PSR `{}`", psr)),
+    };
+    let fields = match fields {
+        "all" => "fsxc",
+        "flg" => "f",
+        "ctl" => "c",
+        f => f,
+    };
+    let mut mask = 0;
+    for field in fields.chars() {
+        mask |= match field {
+            'c' => 1,
+            'x' => 2,
+            's' => 4,
+            'f' => 8,
+            _ => return Err(format!("bad PSR field `{}`", field)),
+        };
+    }
+    Ok((r, mask))
+}
+
+fn encode_arm_block_transfer(m: &str, ops: &[String]) -> Result<Option<u32>> {
+    if let Some(cond) = ["push", "pop"].iter().find_map(|base| m.strip_prefix(base)).and_then(cond_code) {
+        let list = parse_rlist(one(ops)?)?;
+        // STMDB sp! / LDMIA sp!
+        let bits = if m.starts_with("push") { 0x092D_0000 } else { 0x08BD_0000 };
+        return Ok(Some(cond << 28 | bits | list));
+    }
+    let (load, rest) = match (m.strip_prefix("ldm"), m.strip_prefix("stm")) {
+        (Some(rest), _) => (true, rest),
+        (_, Some(rest)) => (false, rest),
+        _ => return Ok(None),
+    };
+    let Some((cond, mode)) = cond_suffix(rest, &["ia", "ib", "da", "db", "fd", "ed", "fa", "ea", ""]) else {
+        return Ok(None);
+    };
+    // Stack aliases describe the stack, so they map to opposite modes for loads and stores
+    let (pre, up) = match (mode, load) {
+        ("ia" | "", _) | ("fd", true) | ("ea", false) => (false, true),
+        ("ib", _) | ("ed", true) | ("fa", false) => (true, true),
+        ("da", _) | ("fa", true) | ("ed", false) => (false, false),
+        _ => (true, false),
+    };
+    let [base, list] = ops else { return Err("expected rn, {registers}".into()) };
+    let (base, writeback) = match base.strip_suffix('!') {
+        Some(b) => (b, true),
+        None => (base.as_str(), false),
+    };
+    let (list, user) = match list.strip_suffix('^') {
+        Some(l) => (l, true),
+        None => (list.as_str(), false),
+    };
+    Ok(Some(
+        cond << 28
+            | 0b100 << 25
+            | (pre as u32) << 24
+            | (up as u32) << 23
+            | (user as u32) << 22
+            | (writeback as u32) << 21
+            | (load as u32) << 20
+            | parse_reg(base)? << 16
+            | parse_rlist(list)?,
+    ))
+}
+
+enum Offset {
+    Imm(u32),
+    Reg(u32, u32),
+}
+
+struct Address {
+    rn: u32,
+    pre: bool,
+    up: bool,
+    writeback: bool,
+    offset: Offset,
+}
+
+fn parse_address(ops: &[String]) -> Result<Address> {
+    let first = ops.first().ok_or("missing address")?;
+    let (bracketed, writeback) = match first.strip_suffix('!') {
+        Some(f) => (f, true),
+        None => (first.as_str(), false),
+    };
+    let inner = bracketed
+        .strip_prefix('[')
+        .and_then(|s| s.strip_suffix(']'))
+        .ok_or_else(|| format!("bad address `{}`", first))?;
+    let parts = split_operands(inner);
+    let rn = parse_reg(parts.first().ok_or("missing base register")?)?;
+    let (pre, offset_parts) = if parts.len() > 1 { (true, &parts[1..]) } else { (ops.len() == 1, &ops[1..]) };
+    if !pre && writeback {
+        return Err("post-indexed addresses always write back".into());
+    }
+    let (up, offset) = match offset_parts {
+        [] => (true, Offset::Imm(0)),
+        [imm] if is_imm(imm) => {
+            let value = parse_imm(imm)?;
+            (value >= 0, Offset::Imm(value.unsigned_abs() as u32))
+        }
+        [reg, shift @ ..] => {
+            let (up, reg) = match reg.strip_prefix('-') {
+                Some(r) => (false, r),
+                None => (true, reg.strip_prefix('+').unwrap_or(reg)),
+            };
+            let shift = match shift {
+                [] => 0,
+                [s] => shift_field(s)?,
+                _ => return Err("bad offset shift".into()),
+            };
+            (up, Offset::Reg(parse_reg(reg)?, shift))
+        }
+    };
+    Ok(Address { rn, pre, up, writeback, offset })
+}
+
+fn encode_arm_single_transfer(ctx: &Ctx, m: &str, ops: &[String]) -> Result<Option<u32>> {
+    let (load, rest) = match (m.strip_prefix("ldr"), m.strip_prefix("str")) {
+        (Some(rest), _) => (true, rest),
+        (_, Some(rest)) => (false, rest),
+        _ => return Ok(None),
+    };
+    let Some((cond, size)) = cond_suffix(rest, &["sb", "sh", "b", "h", ""]) else { return Ok(None) };
+    if !load && matches!(size, "sb" | "sh") {
+        return Err("signed stores do not exist".into());
+    }
+    let rd = parse_reg(ops.first().ok_or("missing rd")?)?;
+    let addr_ops = &ops[1..];
+
+    let addr = match addr_ops {
+        // `ldr r0, label` loads PC-relative
+        [label] if !label.starts_with('[') => {
+            let offset = ctx.target(label)? as i64 - (ctx.addr as i64 + 8);
+            Address { rn: 15, pre: true, up: offset >= 0, writeback: false, offset: Offset::Imm(offset.unsigned_abs() as u32) }
+        }
+        _ => parse_address(addr_ops)?,
+    };
+    let common = cond << 28
+        | (addr.pre as u32) << 24
+        | (addr.up as u32) << 23
+        | (addr.writeback as u32) << 21
+        | (load as u32) << 20
+        | addr.rn << 16
+        | rd << 12;
+
+    if matches!(size, "" | "b") {
+        let offset = match addr.offset {
+            Offset::Imm(imm) => check_range(imm as i64, 0, 0xFFF, "offset")?,
+            Offset::Reg(_, shift) if shift & (1 << 4) != 0 => return Err("register-specified shifts are not allowed".into()),
+            Offset::Reg(rm, shift) => 1 << 25 | shift | rm,
+        };
+        return Ok(Some(common | 1 << 26 | ((size == "b") as u32) << 22 | offset));
+    }
+
+    let sh = match size {
+        "h" => 0b01,
+        "sb" => 0b10,
+        _ => 0b11,
+    };
+    let offset = match addr.offset {
+        Offset::Imm(imm) => {
+            let imm = check_range(imm as i64, 0, 0xFF, "offset")?;
+            1 << 22 | (imm >> 4) << 8 | (imm & 0xF)
+        }
+        Offset::Reg(rm, 0) => rm,
+        Offset::Reg(..) => return Err("halfword transfers cannot shift the offset".into()),
+    };
+    Ok(Some(common | 1 << 7 | sh << 5 | 1 << 4 | offset))
+}
+
+// ----- Thumb -----
+
+fn encode_thumb(ctx: &Ctx, m: &str, ops: &[String]) -> Result<Vec<u16>> {
+    // UAL spells the flag-setting Thumb ALU ops with an `s` suffix
+    let m = match m {
+        "movs" | "adds" | "subs" | "lsls" | "lsrs" | "asrs" | "ands" | "eors" | "adcs" | "sbcs" | "rors" | "orrs"
+        | "muls" | "bics" | "mvns" | "negs" => &m[..m.len() - 1],
+        "ldrsb" => "ldsb",
+        "ldrsh" => "ldsh",
+        "svc" => "swi",
+        _ => m,
+    };
+    let ops: Vec<&str> = ops.iter().map(String::as_str).collect();
+    let half = match (m, ops.as_slice()) {
+        (".hword", [n]) => parse_num(n)? as u16,
+        (".word", [n]) => {
+            let word = parse_num(n)? as u32;
+            return Ok(vec![word as u16, (word >> 16) as u16]);
+        }
+        ("nop", []) => 0x46C0, // MOV r8, r8
+
+        // Format 1: move shifted register
+        ("lsl" | "lsr" | "asr", [rd, rs, imm]) => {
+            let op = ["lsl", "lsr", "asr"].iter().position(|n| *n == m).unwrap() as u16;
+            let amount = match op {
+                0 => check_range(parse_imm(imm)?, 0, 31, "shift")?,
+                _ => check_range(parse_imm(imm)?, 1, 32, "shift")? & 31,
+            };
+            op << 11 | (amount as u16) << 6 | reg3(rs, 3)? | reg3(rd, 0)?
+        }
+
+        // Format 12: load address
+        ("add", [rd, base @ ("pc" | "sp"), imm]) => {
+            let words = check_aligned(parse_imm(imm)?, 4, "offset")?;
+            let sp = (*base == "sp") as u16;
+            0xA000 | sp << 11 | (parse_low_reg(rd)? as u16) << 8 | check_range(words, 0, 0xFF, "offset")? as u16
+        }
+        // Format 13: adjust SP
+        ("add" | "sub", ["sp", imm]) => {
+            let value = parse_imm(imm)? * if m == "sub" { -1 } else { 1 };
+            let words = check_aligned(value.abs(), 4, "offset")?;
+            0xB000 | ((value < 0) as u16) << 7 | check_range(words, 0, 0x7F, "offset")? as u16
+        }
+        // Formats 2 and 3: add/subtract
+        ("add" | "sub", [rd, rs, src]) => {
+            let sub = (m == "sub") as u16;
+            if is_imm(src) {
+                let imm = parse_imm(src)?;
+                if rd == rs && !(0..=7).contains(&imm) {
+                    0x3000 | sub << 11 | (parse_low_reg(rd)? as u16) << 8 | check_range(imm, 0, 0xFF, "immediate")? as u16
+                } else {
+                    0x1C00 | sub << 9 | (check_range(imm, 0, 7, "immediate")? as u16) << 6 | reg3(rs, 3)? | reg3(rd, 0)?
+                }
+            } else {
+                0x1800 | sub << 9 | reg3(src, 6)? | reg3(rs, 3)? | reg3(rd, 0)?
+            }
+        }
+        ("mov" | "cmp" | "add" | "sub", [rd, imm]) if is_imm(imm) => {
+            let op = ["mov", "cmp", "add", "sub"].iter().position(|n| *n == m).unwrap() as u16;
+            0x2000 | op << 11 | (parse_low_reg(rd)? as u16) << 8 | check_range(parse_imm(imm)?, 0, 0xFF, "immediate")? as u16
+        }
+        // Low-register MOV is ADD rd, rs, #0; high registers use format 5
+        ("mov", [rd, rs]) if is_low(rd) && is_low(rs) => 0x1C00 | reg3(rs, 3)? | reg3(rd, 0)?,
+        ("add", [rd, rs]) if is_low(rd) && is_low(rs) => 0x1800 | reg3(rs, 6)? | reg3(rd, 3)? | reg3(rd, 0)?,
+        ("sub", [rd, rs]) => 0x1A00 | reg3(rs, 6)? | reg3(rd, 3)? | reg3(rd, 0)?,
+        ("cmp", [rd, rs]) if is_low(rd) && is_low(rs) => 0x4000 | 0xA << 6 | reg3(rs, 3)? | reg3(rd, 0)?,
+        // Format 5: hi register operations
+        ("add" | "cmp" | "mov", [rd, rs]) => {
+            let op = ["add", "cmp", "mov"].iter().position(|n| *n == m).unwrap() as u16;
+            let (rd, rs) = (parse_reg(rd)? as u16, parse_reg(rs)? as u16);
+            0x4400 | op << 8 | (rd >> 3) << 7 | (rs >> 3) << 6 | (rs & 7) << 3 | (rd & 7)
+        }
+        ("bx", [rs]) => {
+            let rs = parse_reg(rs)? as u16;
+            0x4700 | (rs >> 3) << 6 | (rs & 7) << 3
+        }
+        // Format 4: ALU operations
+        (_, [rd, rs]) if THUMB_ALU.contains(&m) => {
+            let op = THUMB_ALU.iter().position(|n| *n == m).unwrap() as u16;
+            0x4000 | op << 6 | reg3(rs, 3)? | reg3(rd, 0)?
+        }
+
+        ("ldr" | "str" | "ldrb" | "strb" | "ldrh" | "strh" | "ldsb" | "ldsh", [rd, addr @ ..]) => {
+            encode_thumb_transfer(ctx, m, rd, addr)?
+        }
+
+        // Format 14: push/pop
+        ("push", [list]) => {
+            let list = parse_rlist(list)?;
+            if list & !0x40FF != 0 {
+                return Err("PUSH takes r0-r7 and lr".into());
+            }
+            0xB400 | ((list >> 14) as u16 & 1) << 8 | (list & 0xFF) as u16
+        }
+        ("pop", [list]) => {
+            let list = parse_rlist(list)?;
+            if list & !0x80FF != 0 {
+                return Err("POP takes r0-r7 and pc".into());
+            }
+            0xBC00 | ((list >> 15) as u16) << 8 | (list & 0xFF) as u16
+        }
+        // Format 15: multiple load/store
+        ("ldmia" | "stmia" | "ldm" | "stm", [base, list]) => {
+            let base = base.strip_suffix('!').ok_or("Thumb LDM/STM always write back")?;
+            let list = parse_rlist(list)?;
+            if list & !0xFF != 0 {
+                return Err("only r0-r7 can be transferred".into());
+            }
+            let load = m.starts_with("ldm") as u16;
+            0xC000 | load << 11 | (parse_low_reg(base)? as u16) << 8 | list as u16
+        }
+        ("swi", [imm]) => 0xDF00 | check_range(parse_imm(imm)?, 0, 0xFF, "SWI number")? as u16,
+        ("bl", [target]) => {
+            let offset = ctx.target(target)? as i64 - (ctx.addr as i64 + 4);
+            let halves = check_aligned(offset, 2, "branch offset")?;
+            check_range(halves, -(1 << 21), (1 << 21) - 1, "branch offset")?;
+            let offset = offset as u32;
+            return Ok(vec![0xF000 | ((offset >> 12) & 0x7FF) as u16, 0xF800 | ((offset >> 1) & 0x7FF) as u16]);
+        }
+        ("b", [target]) => {
+            let offset = ctx.target(target)? as i64 - (ctx.addr as i64 + 4);
+            let halves = check_aligned(offset, 2, "branch offset")?;
+            0xE000 | (check_range(halves, -(1 << 10), (1 << 10) - 1, "branch offset")? & 0x7FF) as u16
+        }
+        (_, [target]) if m.len() == 3 && m.starts_with('b') && cond_code(&m[1..]).is_some_and(|c| c < COND_AL) => {
+            let cond = cond_code(&m[1..]).unwrap() as u16;
+            let offset = ctx.target(target)? as i64 - (ctx.addr as i64 + 4);
+            let halves = check_aligned(offset, 2, "branch offset")?;
+            0xD000 | cond << 8 | (check_range(halves, -128, 127, "branch offset")? & 0xFF) as u16
+        }
+        _ => return Err(format!("unknown Thumb instruction `{}` with {} operands", m, ops.len())),
+    };
+    Ok(vec![half])
+}
+
+fn is_low(s: &str) -> bool { parse_reg(s).is_ok_and(|r| r < 8) }
+
+fn reg3(s: &str, shift: u16) -> Result<u16> {
+    parse_low_reg(s).map(|r| (r as u16) << shift)
+}
+
+fn encode_thumb_transfer(ctx: &Ctx, m: &str, rd: &str, addr_ops: &[&str]) -> Result<u16> {
+    let load = m.starts_with("ld") as u16;
+    let rd3 = parse_low_reg(rd)? as u16;
+
+    // Format 6: PC-relative load from a label, word aligned
+    if let [label] = addr_ops
+        && !label.starts_with('[')
+    {
+        if m != "ldr" {
+            return Err("only LDR can load PC-relative".into());
+        }
+        let offset = ctx.target(label)? as i64 - ((ctx.addr as i64 + 4) & !2);
+        let words = check_aligned(offset, 4, "offset")?;
+        return Ok(0x4800 | rd3 << 8 | check_range(words, 0, 0xFF, "offset")? as u16);
+    }
+
+    let owned: Vec<String> = addr_ops.iter().map(|s| s.to_string()).collect();
+    let addr = parse_address(&owned)?;
+    if !addr.pre || addr.writeback || !addr.up {
+        return Err("Thumb transfers only take [rb, ro] or [rb, #imm]".into());
+    }
+    match addr.offset {
+        // Formats 7 and 8: register offset
+        Offset::Reg(ro, 0) => {
+            let fields = (ro as u16) << 6 | (low(addr.rn)?) << 3 | rd3;
+            let op = match m {
+                "str" => 0x5000,
+                "strb" => 0x5400,
+                "ldr" => 0x5800,
+                "ldrb" => 0x5C00,
+                "strh" => 0x5200,
+                "ldsb" => 0x5600,
+                "ldrh" => 0x5A00,
+                _ => 0x5E00,
+            };
+            if ro > 7 {
+                return Err("offset register must be r0-r7".into());
+            }
+            Ok(op | fields)
+        }
+        Offset::Reg(..) => Err("Thumb transfers cannot shift the offset".into()),
+        Offset::Imm(imm) => {
+            let imm = imm as i64;
+            match (m, addr.rn) {
+                ("ldr", 15) => {
+                    let words = check_aligned(imm, 4, "offset")?;
+                    Ok(0x4800 | rd3 << 8 | check_range(words, 0, 0xFF, "offset")? as u16)
+                }
+                // Format 11: SP-relative
+                ("ldr" | "str", 13) => {
+                    let words = check_aligned(imm, 4, "offset")?;
+                    Ok(0x9000 | load << 11 | rd3 << 8 | check_range(words, 0, 0xFF, "offset")? as u16)
+                }
+                // Format 9: immediate offset, scaled by the transfer size
+                ("ldr" | "str", rb) => {
+                    let words = check_aligned(imm, 4, "offset")?;
+                    Ok(0x6000 | load << 11 | (check_range(words, 0, 31, "offset")? as u16) << 6 | low(rb)? << 3 | rd3)
+                }
+                ("ldrb" | "strb", rb) => {
+                    Ok(0x7000 | load << 11 | (check_range(imm, 0, 31, "offset")? as u16) << 6 | low(rb)? << 3 | rd3)
+                }
+                // Format 10: halfword immediate offset
+                ("ldrh" | "strh", rb) => {
+                    let halves = check_aligned(imm, 2, "offset")?;
+                    Ok(0x8000 | load << 11 | (check_range(halves, 0, 31, "offset")? as u16) << 6 | low(rb)? << 3 | rd3)
+                }
+                _ => Err("signed loads only take a register offset".into()),
+            }
+        }
+    }
+}
+
+fn low(r: u32) -> Result<u16> {
+    if r < 8 { Ok(r as u16) } else { Err(format!("r{} is not a low register", r)) }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::Emulator;
+
+    #[test]
+    fn arm_encodings_match_reference_opcodes() {
+        let cases: &[(&str, u32)] = &[
+            ("mov r0, #0x06000000", 0xE3A0_0406),
+            ("movs r0, r1, lsr #32", 0xE1B0_0021),
+            ("movs r0, r1, rrx", 0xE1B0_0061),
+            ("add r0, r1, r2", 0xE081_0002),
+            ("addeqs r0, r1, r2, lsl r3", 0x0091_0312),
+            ("subs pc, lr, #4", 0xE25E_F004),
+            ("cmp r0, #0", 0xE350_0000),
+            ("mvn r0, #0", 0xE3E0_0000),
+            ("mul r0, r1, r2", 0xE000_0291),
+            ("mla r0, r1, r2, r3", 0xE020_3291),
+            ("umull r0, r1, r2, r3", 0xE081_0392),
+            ("ldr r0, [r1, #4]", 0xE591_0004),
+            ("ldr r0, [r1], #-4", 0xE411_0004),
+            ("strb r0, [r1, r2, lsl #2]!", 0xE7E1_0102),
+            ("ldrsb r0, [r1, #-0x12]", 0xE151_01D2),
+            ("strh r0, [r1], r2", 0xE081_00B2),
+            ("ldmia r0!, {r1-r3}", 0xE8B0_000E),
+            ("push {r4, lr}", 0xE92D_4010),
+            ("ldmfd sp!, {r4, pc}^", 0xE8FD_8010),
+            ("b .", 0xEAFF_FFFE),
+            ("bleq 0x100", 0x0B00_003E),
+            ("bx lr", 0xE12F_FF1E),
+            ("swi #0x0b", 0xEF00_000B),
+            ("mrs r0, spsr", 0xE14F_0000),
+            ("msr spsr_fc, r1", 0xE169_F001),
+            ("msr cpsr_f, #0xf0000000", 0xE328_F20F),
+            ("swpb r0, r1, [r2]", 0xE142_0091),
+        ];
+        for (src, expected) in cases {
+            assert_eq!(arm(src), *expected, "`{}` assembled to {:#010x}", src, arm(src));
+        }
+    }
+
+    #[test]
+    fn thumb_encodings_match_reference_opcodes() {
+        let cases: &[(&str, u16)] = &[
+            ("lsl r0, r1, #2", 0x0088),
+            ("lsrs r0, r1, #32", 0x0808),
+            ("add r0, r1, r2", 0x1888),
+            ("sub r0, r1, #7", 0x1FC8),
+            ("mov r3, #0xff", 0x23FF),
+            ("add r0, #200", 0x30C8),
+            ("mul r0, r1", 0x4348),
+            ("neg r2, r3", 0x425A),
+            ("add r8, r0", 0x4480),
+            ("mov r0, r0", 0x1C00),
+            ("bx lr", 0x4770),
+            ("ldr r1, [pc, #8]", 0x4902),
+            ("ldsb r0, [r1, r2]", 0x5688),
+            ("ldrsh r0, [r1, r2]", 0x5E88),
+            ("ldrh r0, [r1, #6]", 0x88C8),
+            ("str r0, [r1, #4]", 0x6048),
+            ("ldrb r0, [r1, #3]", 0x78C8),
+            ("str r0, [sp, #16]", 0x9004),
+            ("add r0, sp, #8", 0xA802),
+            ("sub sp, #16", 0xB084),
+            ("push {r0, lr}", 0xB501),
+            ("pop {pc}", 0xBD00),
+            ("stmia r0!, {r1, r2}", 0xC006),
+            ("swi #0x05", 0xDF05),
+            ("b .", 0xE7FE),
+            ("bne .", 0xD1FE),
+        ];
+        for (src, expected) in cases {
+            assert_eq!(thumb(src), *expected, "`{}` assembled to {:#06x}", src, thumb(src));
+        }
+    }
+
+    #[test]
+    fn labels_resolve_forward_and_backward() {
+        let code = thumb_program(0x0800_0000, "
+            start: bl far       ; two halfwords
+                   b start
+            far:   bx lr
+        ");
+        let halves: Vec<u16> = code.chunks(2).map(|c| u16::from_le_bytes([c[0], c[1]])).collect();
+        assert_eq!(halves, vec![0xF000, 0xF801, 0xE7FC, 0x4770]);
+
+        let code = arm_program(0x0800_0000, "ldr r0, value\nb .\nvalue: .word 0xdeadbeef");
+        assert_eq!(&code[0..4], &0xE59F_0000u32.to_le_bytes());
+        assert_eq!(&code[8..12], &0xDEAD_BEEFu32.to_le_bytes());
+    }
+
+    #[test]
+    #[should_panic(expected = "asm line 2")]
+    fn errors_name_the_line() {
+        arm_program(0, "mov r0, #1\nmov r0, #0x101");
+    }
+
+    #[test]
+    fn assembled_arm_program_runs_through_the_decoder() {
+        let mut rom = arm_program(0x0800_0000, "
+                mov r0, #0
+                mov r1, #10
+            loop:
+                add r0, r0, r1          @ sum 10 + 9 + ... + 1
+                subs r1, r1, #1
+                bne loop
+                mov r3, #0x03000000
+                str r0, [r3, #4]!
+                ldrb r4, [r3], #1
+                ldr r5, value
+                mov r6, r5, ror #8
+                stmdb sp!, {r0, r5}
+                ldmia sp!, {r7, r8}
+            done:
+                b done
+            value:
+                .word 0x11223344
+        ");
+        rom.resize(0x200, 0);
+
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        for _ in 0..64 {
+            emu.step_cpu();
+        }
+
+        let regs: Vec<u32> = (0..9).map(|r| emu.cpu.read_reg(r)).collect();
+        assert_eq!(regs[0], 55);
+        assert_eq!(regs[1], 0);
+        assert_eq!(regs[3], 0x0300_0005);
+        assert_eq!(regs[4], 55);
+        assert_eq!(regs[5], 0x1122_3344);
+        assert_eq!(regs[6], 0x4411_2233);
+        assert_eq!((regs[7], regs[8]), (55, 0x1122_3344));
+    }
+}
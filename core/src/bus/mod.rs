@@ -1,23 +1,14 @@
+use std::time::{Duration, Instant};
+
+use crate::coverage::{Access, Coverage};
+use crate::debug_port::{DEBUG_BASE, DEBUG_END};
 use crate::mem::{Mem, BIOS_SIZE, EWRAM_SIZE, IWRAM_SIZE, VRAM_SIZE, PALETTE_SIZE, OAM_SIZE};
+use crate::eeprom::Eeprom;
 use crate::io::Io;
-
-fn io_register_name(addr: u32) -> Option<&'static str> {
-    match addr {
-        0x0400_0000..=0x0400_0001 => Some("DISPCNT"),
-        0x0400_0004..=0x0400_0005 => Some("DISPSTAT"),
-        0x0400_0006..=0x0400_0007 => Some("VCOUNT"),
-        0x0400_0008..=0x0400_0009 => Some("BG0CNT"),
-        0x0400_000A..=0x0400_000B => Some("BG1CNT"),
-        0x0400_000C..=0x0400_000D => Some("BG2CNT"),
-        0x0400_000E..=0x0400_000F => Some("BG3CNT"),
-        0x0400_004C..=0x0400_004D => Some("MOSAIC"),
-        0x0400_0050..=0x0400_0051 => Some("BLDCNT"),
-        0x0400_0200..=0x0400_0201 => Some("IE"),
-        0x0400_0202..=0x0400_0203 => Some("IF"),
-        0x0400_0208..=0x0400_0209 => Some("IME"),
-        _ => None,
-    }
-}
+use crate::log_buffer::trace_bus;
+use crate::dma::{DmaTiming, DMA_BASE, DMA_END, FIFO_A, FIFO_B};
+use crate::timer::{TIMER_BASE, TIMER_END};
+use crate::timing::Scheduler;
 
 pub trait BusAccess {
     fn read32(&mut self, addr: u32) -> u32;
@@ -37,15 +28,34 @@ const VRAM_BASE: u32 = 0x0600_0000;
 const OAM_BASE: u32 = 0x0700_0000;
 const SRAM_BASE: u32 = 0x0E00_0000;
 
+#[derive(Clone)]
 pub struct Bus {
     pub mem: Mem,
     pub io: Io,
+    pub scheduler: Scheduler,
+    pub coverage: Option<Coverage>,
+    // Time spent in DMA transfers, measured only while profiling
+    pub dma_time: Option<Duration>,
     ppu_rendering: bool,
     can_access_vram: bool,
     can_access_palette: bool,
     can_access_oam: bool,
     bios_readable: bool,
     last_bios_read: u32,
+    // Last value seen by a CPU-side halfword or word read; this is the prefetched
+    // opcode while an instruction executes
+    open_bus: u32,
+    /// Old value of every memory byte written, kept while the debugger records history
+    pub write_log: Option<Vec<(u32, u8)>>,
+    /// Writes outside RAM, IO and save memory, collected while sandboxed
+    pub write_violations: Option<Vec<WriteViolation>>,
+}
+
+/// A byte written to a region the GBA cannot store to, such as the BIOS or cartridge ROM.
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub struct WriteViolation {
+    pub addr: u32,
+    pub value: u8,
 }
 
 impl Default for Bus {
@@ -53,12 +63,18 @@ impl Default for Bus {
         Self {
             mem: Mem::new(),
             io: Io::new(),
+            scheduler: Scheduler::new(),
+            coverage: None,
+            dma_time: None,
             ppu_rendering: false,
             can_access_vram: true,
             can_access_palette: true,
             can_access_oam: true,
             bios_readable: true,
             last_bios_read: 0,
+            open_bus: 0,
+            write_log: None,
+            write_violations: None,
         }
     }
 }
@@ -100,24 +116,137 @@ impl Bus {
     pub fn load_rom(&mut self, data: &[u8]) {
         log::info!("Bus: loading ROM ({} bytes, {} KB)", data.len(), data.len() / 1024);
         self.mem.load_rom(data);
+        self.mem.eeprom = Eeprom::detect(data).then(Eeprom::new);
+    }
+
+    /// Starts every enabled DMA channel waiting on `timing`. Special timing means
+    /// something different per channel; sound FIFOs go through `trigger_fifo_dma`.
+    pub fn trigger_dma(&mut self, timing: DmaTiming) {
+        for ch in 0..4 {
+            let channel = &self.io.dma.channels[ch];
+            if channel.enabled() && channel.timing() == timing {
+                self.run_dma(ch);
+            }
+        }
+    }
+
+    /// Refills sound FIFO A (0) or B (1) from the DMA1 or DMA2 channel in special
+    /// timing that targets it. DMA0 and DMA3 never serve the FIFOs.
+    pub fn trigger_fifo_dma(&mut self, fifo: usize) {
+        let target = [FIFO_A, FIFO_B][fifo];
+        for ch in 1..=2 {
+            let channel = &self.io.dma.channels[ch];
+            if channel.enabled() && channel.timing() == DmaTiming::Special && (channel.dad & !3) == target {
+                self.run_dma(ch);
+            }
+        }
+    }
+
+    /// Handles a scheduled overflow of timer `idx` that was due at cycle `at`.
+    pub fn timer_overflow(&mut self, idx: usize, at: u64) {
+        let overflow = self.io.timers.overflow(idx, at, &mut self.scheduler);
+        if overflow.irq != 0 {
+            self.io.request_interrupt(overflow.irq);
+        }
+        // Each overflow of the timer SOUNDCNT_H picks for a FIFO plays one of its
+        // samples, including overflows carried into a count-up timer
+        for fifo in 0..2 {
+            if overflow.includes(self.io.apu.fifo_timer(fifo)) && self.io.apu.play_fifo_sample(fifo) {
+                self.trigger_fifo_dma(fifo);
+            }
+        }
+    }
+
+    /// Reads the stored value of an IO register byte without side effects, including
+    /// registers the CPU cannot read back.
+    pub fn peek_io8(&self, addr: u32) -> u8 {
+        if (TIMER_BASE..=TIMER_END).contains(&addr) {
+            self.io.timers.read8(addr, self.scheduler.now())
+        } else if (DMA_BASE..=DMA_END).contains(&addr) {
+            self.io.dma.peek8(addr)
+        } else {
+            self.io.read8(addr)
+        }
+    }
+
+    /// Puts back the bytes recorded in a write log, newest first.
+    pub fn undo_writes(&mut self, log: &[(u32, u8)]) {
+        for &(addr, value) in log.iter().rev() {
+            if let Some(byte) = self.backing_byte(addr) {
+                *byte = value;
+            }
+        }
+    }
+
+    fn log_write(&mut self, addr: u32) {
+        if self.write_log.is_some()
+            && let Some(old) = self.backing_byte(addr).map(|b| *b)
+            && let Some(log) = &mut self.write_log
+        {
+            log.push((addr, old));
+        }
+    }
+
+    fn report_violation(&mut self, addr: u32, value: u8) {
+        if let Some(violations) = &mut self.write_violations {
+            log::warn!("Bus: write to read-only {:#010x} = {:#04x}", addr, value);
+            violations.push(WriteViolation { addr, value });
+        }
+    }
+
+    // Storage behind a writable memory address, ignoring access restrictions
+    fn backing_byte(&mut self, addr: u32) -> Option<&mut u8> {
+        let mem = &mut self.mem;
+        match addr >> 24 {
+            0x02 => Some(&mut mem.ewram[((addr - EWRAM_BASE) as usize) % EWRAM_SIZE]),
+            0x03 => Some(&mut mem.iwram[((addr - IWRAM_BASE) as usize) % IWRAM_SIZE]),
+            0x05 => Some(&mut mem.palette[((addr - PALETTE_BASE) as usize) % PALETTE_SIZE]),
+            0x06 => {
+                let raw_off = (addr - VRAM_BASE) as usize;
+                let off = if raw_off >= 0x18000 {
+                    0x10000 + ((raw_off - 0x10000) % 0x8000)
+                } else {
+                    raw_off % VRAM_SIZE
+                };
+                Some(&mut mem.vram[off])
+            }
+            0x07 => Some(&mut mem.oam[((addr - OAM_BASE) as usize) % OAM_SIZE]),
+            0x0E | 0x0F => {
+                let len = mem.sram.len();
+                Some(&mut mem.sram[((addr - SRAM_BASE) as usize) % len])
+            }
+            _ => None,
+        }
+    }
+
+    fn run_dma(&mut self, ch: usize) {
+        let started = self.dma_time.is_some().then(Instant::now);
+        let mut channel = self.io.dma.channels[ch];
+        let irq = channel.transfer(ch, self);
+        if let (Some(total), Some(started)) = (&mut self.dma_time, started) {
+            *total += started.elapsed();
+        }
+        self.io.dma.channels[ch] = channel;
+        if irq {
+            self.io.request_interrupt(1 << (8 + ch));
+        }
     }
 }
 
 impl BusAccess for Bus {
     fn read32(&mut self, addr: u32) -> u32 {
         let aligned = addr & !3;
-        let lo = self.read16(aligned) as u32;
-        let hi = self.read16(aligned.wrapping_add(2)) as u32;
+        let lo = self.read16_aligned(aligned) as u32;
+        let hi = self.read16_aligned(aligned.wrapping_add(2)) as u32;
         let value = lo | (hi << 16);
+        self.latch_open_bus(value);
         let rotation = (addr & 3) * 8;
         value.rotate_right(rotation)
     }
 
     fn read16(&mut self, addr: u32) -> u16 {
-        let aligned = addr & !1;
-        let b0 = self.read8(aligned) as u16;
-        let b1 = self.read8(aligned + 1) as u16;
-        let value = b0 | (b1 << 8);
+        let value = self.read16_aligned(addr & !1);
+        self.latch_open_bus(value as u32 | ((value as u32) << 16));
         if addr & 1 != 0 {
             value.rotate_right(8)
         } else {
@@ -126,6 +255,9 @@ impl BusAccess for Bus {
     }
 
     fn read8(&mut self, addr: u32) -> u8 {
+        if let Some(coverage) = &mut self.coverage {
+            coverage.record(Access::Read, addr);
+        }
         match addr >> 24 {
             0x00 => {
                 if addr < BIOS_SIZE as u32 {
@@ -149,8 +281,14 @@ impl BusAccess for Bus {
                 self.mem.iwram[off]
             }
             0x04 => {
-                if addr < IO_BASE + 0x400 {
+                if (TIMER_BASE..=TIMER_END).contains(&addr) {
+                    self.io.timers.read8(addr, self.scheduler.now())
+                } else if self.reads_open_bus(addr) {
+                    (self.open_bus >> ((addr & 3) * 8)) as u8
+                } else if addr < IO_BASE + 0x400 {
                     self.io.read8(addr)
+                } else if (DEBUG_BASE..=DEBUG_END).contains(&addr) {
+                    self.io.debug.read8(addr)
                 } else {
                     0
                 }
@@ -206,13 +344,31 @@ impl BusAccess for Bus {
 
     fn write16(&mut self, addr: u32, value: u16) {
         let aligned = addr & !1;
+        if aligned >> 24 == 0x05 {
+            if let Some(coverage) = &mut self.coverage {
+                coverage.record(Access::Write, aligned);
+            }
+            self.write_palette16(aligned, value);
+            return;
+        }
+        if aligned >> 24 == 0x04 {
+            self.write_io16(aligned, value);
+            return;
+        }
+        if aligned >> 24 == 0x0D && let Some(eeprom) = &mut self.mem.eeprom {
+            eeprom.write_bit(value & 1 != 0);
+            return;
+        }
         self.write8(aligned, (value & 0xFF) as u8);
         self.write8(aligned.wrapping_add(1), (value >> 8) as u8);
     }
 
     fn write8(&mut self, addr: u32, value: u8) {
+        if let Some(coverage) = &mut self.coverage {
+            coverage.record(Access::Write, addr);
+        }
+        self.log_write(addr);
         match addr >> 24 {
-            0x00 => {}
             0x02 => {
                 let off = ((addr - EWRAM_BASE) as usize) % EWRAM_SIZE;
                 self.mem.ewram[off] = value;
@@ -223,18 +379,25 @@ impl BusAccess for Bus {
             }
             0x04 => {
                 if addr < IO_BASE + 0x400 {
-                    if let Some(name) = io_register_name(addr) {
-                        log::trace!("IO write8 {} ({:#010x}) = {:#04x}", name, addr, value);
+                    trace_bus!("IO write8 {} ({:#010x}) = {:#04x}", crate::io::registers::lookup(addr).map_or("?", |r| r.name), addr, value);
+                    if (TIMER_BASE..=TIMER_END).contains(&addr) {
+                        self.io.timers.write8(addr, value, &mut self.scheduler);
+                    } else {
+                        self.io.write8(addr, value);
+                    }
+                    while let Some(ch) = self.io.dma.take_pending() {
+                        self.run_dma(ch);
                     }
-                    self.io.write8(addr, value);
+                } else if (DEBUG_BASE..=DEBUG_END).contains(&addr) {
+                    self.io.debug.write8(addr, value);
                 }
             }
             0x05 => {
                 if !self.check_palette_access() {
                     return;
                 }
-                let off = ((addr - PALETTE_BASE) as usize) % PALETTE_SIZE;
-                self.mem.palette[off] = value;
+                // The palette bus is 16 bits wide: a byte write lands in both halves
+                self.write_palette16(addr & !1, u16::from_le_bytes([value, value]));
             }
             0x06 => {
                 if !self.check_vram_access() {
@@ -255,12 +418,11 @@ impl BusAccess for Bus {
                 let off = ((addr - OAM_BASE) as usize) % OAM_SIZE;
                 self.mem.oam[off] = value;
             }
-            0x08..=0x0D => {}
             0x0E | 0x0F => {
                 let off = ((addr - SRAM_BASE) as usize) % self.mem.sram.len();
                 self.mem.sram[off] = value;
             }
-            _ => {}
+            _ => self.report_violation(addr, value),
         }
     }
 
@@ -270,6 +432,83 @@ impl BusAccess for Bus {
 }
 
 impl Bus {
+    fn read16_aligned(&mut self, addr: u32) -> u16 {
+        if addr >> 24 == 0x04 {
+            self.read_io16(addr)
+        } else if addr >> 24 == 0x0D && let Some(eeprom) = &mut self.mem.eeprom {
+            eeprom.read_bit()
+        } else {
+            let b0 = self.read8(addr) as u16;
+            let b1 = self.read8(addr + 1) as u16;
+            b0 | (b1 << 8)
+        }
+    }
+
+    fn latch_open_bus(&mut self, value: u32) {
+        if !self.ppu_rendering {
+            self.open_bus = value;
+        }
+    }
+
+    // Scroll, affine, window bounds, MOSAIC and BLDY cannot be read back by the
+    // CPU; the PPU itself still sees the written values while rendering
+    fn reads_open_bus(&self, addr: u32) -> bool {
+        !self.ppu_rendering
+            && matches!(addr - IO_BASE, 0x10..=0x47 | 0x4C..=0x4D | 0x54..=0x55)
+    }
+
+    // IO registers are accessed whole rather than byte by byte, so registers
+    // with side effects see a single access with the full value
+    fn read_io16(&mut self, addr: u32) -> u16 {
+        if let Some(coverage) = &mut self.coverage {
+            coverage.record(Access::Read, addr);
+        }
+        if (TIMER_BASE..=TIMER_END).contains(&addr) {
+            self.io.timers.read16(addr, self.scheduler.now())
+        } else if self.reads_open_bus(addr) {
+            (self.open_bus >> ((addr & 2) * 8)) as u16
+        } else if addr < IO_BASE + 0x400 {
+            self.io.read16(addr)
+        } else if (DEBUG_BASE..=DEBUG_END).contains(&addr) {
+            self.io.debug.read8(addr) as u16 | ((self.io.debug.read8(addr + 1) as u16) << 8)
+        } else {
+            0
+        }
+    }
+
+    fn write_io16(&mut self, addr: u32, value: u16) {
+        if let Some(coverage) = &mut self.coverage {
+            coverage.record(Access::Write, addr);
+        }
+        if (DEBUG_BASE..=DEBUG_END).contains(&addr) {
+            self.io.debug.write8(addr, value as u8);
+            self.io.debug.write8(addr + 1, (value >> 8) as u8);
+            return;
+        }
+        if addr >= IO_BASE + 0x400 {
+            return;
+        }
+        trace_bus!("IO write16 {} ({:#010x}) = {:#06x}", crate::io::registers::lookup(addr).map_or("?", |r| r.name), addr, value);
+        if (TIMER_BASE..=TIMER_END).contains(&addr) {
+            self.io.timers.write16(addr, value, &mut self.scheduler);
+        } else {
+            self.io.write16(addr, value);
+        }
+        while let Some(ch) = self.io.dma.take_pending() {
+            self.run_dma(ch);
+        }
+    }
+
+    fn write_palette16(&mut self, addr: u32, value: u16) {
+        if !self.check_palette_access() {
+            return;
+        }
+        self.log_write(addr);
+        self.log_write(addr + 1);
+        let off = ((addr - PALETTE_BASE) as usize) % PALETTE_SIZE;
+        self.mem.palette[off..off + 2].copy_from_slice(&value.to_le_bytes());
+    }
+
     fn read32_direct_bios(&self, addr: u32) -> u32 {
         if addr as usize + 3 < self.mem.bios.len() {
             let b0 = self.mem.bios[addr as usize] as u32;
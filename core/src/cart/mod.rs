@@ -1,6 +1,266 @@
+use std::io::{Error, ErrorKind};
+
+use crate::mem::ROM_MAX_SIZE;
+
 #[derive(Default)]
 pub struct Cart;
 
 impl Cart {
     pub fn new() -> Self { Self }
 }
+
+const HEADER_TITLE: usize = 0xA0;
+const HEADER_GAME_CODE: usize = 0xAC;
+const HEADER_MAKER_CODE: usize = 0xB0;
+const HEADER_VERSION: usize = 0xBC;
+const HEADER_SIZE: usize = 0xC0;
+
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum Region { Japan, Usa, Europe, Unknown }
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct RomHeader {
+    pub title: String,
+    pub game_code: String,
+    pub maker_code: String,
+    pub version: u8,
+}
+
+impl RomHeader {
+    pub fn parse(rom: &[u8]) -> Option<Self> {
+        if rom.len() < HEADER_SIZE {
+            return None;
+        }
+        let text = |start: usize, len: usize| {
+            String::from_utf8_lossy(&rom[start..start + len])
+                .trim_end_matches('\0')
+                .trim()
+                .to_string()
+        };
+        Some(Self {
+            title: text(HEADER_TITLE, 12),
+            game_code: text(HEADER_GAME_CODE, 4),
+            maker_code: text(HEADER_MAKER_CODE, 2),
+            version: rom[HEADER_VERSION],
+        })
+    }
+
+    // The last character of the game code is the destination region
+    pub fn region(&self) -> Region {
+        match self.game_code.chars().nth(3) {
+            Some('J') => Region::Japan,
+            Some('E') => Region::Usa,
+            Some('P' | 'D' | 'F' | 'I' | 'S' | 'X' | 'Y') => Region::Europe,
+            _ => Region::Unknown,
+        }
+    }
+
+    /// Whether the cartridge carries a real-time clock, going by the game code:
+    /// 'U' titles (Boktai) have one next to their solar sensor, and so do the
+    /// Pokémon Ruby, Sapphire and Emerald carts.
+    pub fn has_rtc(&self) -> bool {
+        self.game_code.starts_with('U') || ["AXV", "AXP", "BPE"].iter().any(|code| self.game_code.starts_with(code))
+    }
+}
+
+const ZIP_LOCAL_HEADER: u32 = 0x0403_4B50;
+const ZIP_CENTRAL_HEADER: u32 = 0x0201_4B50;
+const ZIP_END_OF_DIRECTORY: u32 = 0x0605_4B50;
+
+fn le16(data: &[u8], at: usize) -> Option<usize> {
+    data.get(at..at + 2).map(|b| u16::from_le_bytes([b[0], b[1]]) as usize)
+}
+
+fn le32(data: &[u8], at: usize) -> Option<u32> {
+    data.get(at..at + 4).map(|b| u32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+}
+
+fn invalid(msg: &str) -> Error {
+    Error::new(ErrorKind::InvalidData, msg.to_string())
+}
+
+pub fn is_zip(data: &[u8]) -> bool {
+    le32(data, 0) == Some(ZIP_LOCAL_HEADER)
+}
+
+/// Returns the ROM image in `data`, extracting the single `.gba` entry if it is a zip archive.
+pub fn unpack_rom(data: Vec<u8>) -> Result<Vec<u8>, Error> {
+    if is_zip(&data) { extract_gba_from_zip(&data) } else { Ok(data) }
+}
+
+pub fn extract_gba_from_zip(data: &[u8]) -> Result<Vec<u8>, Error> {
+    // End of central directory record is at least 22 bytes, followed by an optional comment
+    let eocd = (0..=data.len().saturating_sub(22))
+        .rev()
+        .find(|&i| le32(data, i) == Some(ZIP_END_OF_DIRECTORY))
+        .ok_or_else(|| invalid("zip: missing end of central directory"))?;
+    let entries = le16(data, eocd + 10).ok_or_else(|| invalid("zip: truncated directory"))?;
+    let mut at = le32(data, eocd + 16).ok_or_else(|| invalid("zip: truncated directory"))? as usize;
+
+    let mut found: Option<(String, usize, usize, usize, usize)> = None;
+    for _ in 0..entries {
+        if le32(data, at) != Some(ZIP_CENTRAL_HEADER) {
+            return Err(invalid("zip: corrupt central directory"));
+        }
+        let field = |off: usize| le16(data, at + off).ok_or_else(|| invalid("zip: truncated entry"));
+        let method = field(10)?;
+        let comp_size = le32(data, at + 20).ok_or_else(|| invalid("zip: truncated entry"))? as usize;
+        let size = le32(data, at + 24).ok_or_else(|| invalid("zip: truncated entry"))? as usize;
+        let name_len = field(28)?;
+        let extra_len = field(30)?;
+        let comment_len = field(32)?;
+        let local = le32(data, at + 42).ok_or_else(|| invalid("zip: truncated entry"))? as usize;
+        let name = data
+            .get(at + 46..at + 46 + name_len)
+            .map(|n| String::from_utf8_lossy(n).into_owned())
+            .ok_or_else(|| invalid("zip: truncated entry"))?;
+
+        if name.to_ascii_lowercase().ends_with(".gba") {
+            if let Some((first, ..)) = &found {
+                return Err(invalid(&format!("zip: multiple ROMs in archive ({} and {})", first, name)));
+            }
+            found = Some((name, method, comp_size, size, local));
+        }
+        at += 46 + name_len + extra_len + comment_len;
+    }
+
+    let (name, method, comp_size, size, local) = found.ok_or_else(|| invalid("zip: no .gba file in archive"))?;
+    if size > ROM_MAX_SIZE {
+        return Err(invalid(&format!("zip: {} is {} bytes, larger than any ROM", name, size)));
+    }
+    if le32(data, local) != Some(ZIP_LOCAL_HEADER) {
+        return Err(invalid("zip: corrupt local header"));
+    }
+    let name_len = le16(data, local + 26).ok_or_else(|| invalid("zip: truncated entry"))?;
+    let extra_len = le16(data, local + 28).ok_or_else(|| invalid("zip: truncated entry"))?;
+    let start = local + 30 + name_len + extra_len;
+    let payload = data
+        .get(start..start + comp_size)
+        .ok_or_else(|| invalid("zip: truncated file data"))?;
+
+    log::info!("Extracting {} from zip archive", name);
+    match method {
+        0 => Ok(payload.to_vec()),
+        // The declared size caps the output, so a corrupt or hostile entry cannot
+        // inflate without bound
+        8 => miniz_oxide::inflate::decompress_to_vec_with_limit(payload, size)
+            .map_err(|e| invalid(&format!("zip: failed to inflate {}: {:?}", name, e.status))),
+        m => Err(invalid(&format!("zip: unsupported compression method {}", m))),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Builds a minimal zip archive; `deflate` selects method 8 over stored
+    fn build_zip(files: &[(&str, &[u8])], deflate: bool) -> Vec<u8> {
+        let mut out = Vec::new();
+        let mut central = Vec::new();
+        for (name, contents) in files {
+            let payload = if deflate {
+                miniz_oxide::deflate::compress_to_vec(contents, 6)
+            } else {
+                contents.to_vec()
+            };
+            let method: u16 = if deflate { 8 } else { 0 };
+            let offset = out.len() as u32;
+
+            out.extend_from_slice(&ZIP_LOCAL_HEADER.to_le_bytes());
+            out.extend_from_slice(&[20, 0, 0, 0]);
+            out.extend_from_slice(&method.to_le_bytes());
+            out.extend_from_slice(&[0; 8]); // time, date, crc
+            out.extend_from_slice(&(payload.len() as u32).to_le_bytes());
+            out.extend_from_slice(&(contents.len() as u32).to_le_bytes());
+            out.extend_from_slice(&(name.len() as u16).to_le_bytes());
+            out.extend_from_slice(&[0, 0]);
+            out.extend_from_slice(name.as_bytes());
+            out.extend_from_slice(&payload);
+
+            central.extend_from_slice(&ZIP_CENTRAL_HEADER.to_le_bytes());
+            central.extend_from_slice(&[20, 0, 20, 0, 0, 0]);
+            central.extend_from_slice(&method.to_le_bytes());
+            central.extend_from_slice(&[0; 8]);
+            central.extend_from_slice(&(payload.len() as u32).to_le_bytes());
+            central.extend_from_slice(&(contents.len() as u32).to_le_bytes());
+            central.extend_from_slice(&(name.len() as u16).to_le_bytes());
+            central.extend_from_slice(&[0; 12]);
+            central.extend_from_slice(&offset.to_le_bytes());
+            central.extend_from_slice(name.as_bytes());
+        }
+        let cd_offset = out.len() as u32;
+        out.extend_from_slice(&central);
+        out.extend_from_slice(&ZIP_END_OF_DIRECTORY.to_le_bytes());
+        out.extend_from_slice(&[0; 4]);
+        out.extend_from_slice(&(files.len() as u16).to_le_bytes());
+        out.extend_from_slice(&(files.len() as u16).to_le_bytes());
+        out.extend_from_slice(&(central.len() as u32).to_le_bytes());
+        out.extend_from_slice(&cd_offset.to_le_bytes());
+        out.extend_from_slice(&[0, 0]);
+        out
+    }
+
+    #[test]
+    fn parses_header_fields_and_region() {
+        let mut rom = vec![0u8; 0x200];
+        rom[HEADER_TITLE..HEADER_TITLE + 6].copy_from_slice(b"POKEMO");
+        rom[HEADER_GAME_CODE..HEADER_GAME_CODE + 4].copy_from_slice(b"BPEE");
+        rom[HEADER_MAKER_CODE..HEADER_MAKER_CODE + 2].copy_from_slice(b"01");
+        rom[HEADER_VERSION] = 1;
+
+        let header = RomHeader::parse(&rom).unwrap();
+        assert_eq!(header.title, "POKEMO");
+        assert_eq!(header.game_code, "BPEE");
+        assert_eq!(header.maker_code, "01");
+        assert_eq!(header.version, 1);
+        assert_eq!(header.region(), Region::Usa);
+        assert!(header.has_rtc());
+
+        rom[HEADER_GAME_CODE..HEADER_GAME_CODE + 4].copy_from_slice(b"U3IJ");
+        assert!(RomHeader::parse(&rom).unwrap().has_rtc());
+        rom[HEADER_GAME_CODE..HEADER_GAME_CODE + 4].copy_from_slice(b"BPRE");
+        assert!(!RomHeader::parse(&rom).unwrap().has_rtc());
+
+        assert!(RomHeader::parse(&rom[..0x40]).is_none());
+    }
+
+    #[test]
+    fn extracts_stored_and_deflated_roms() {
+        let rom: Vec<u8> = (0..4096u32).map(|i| (i * 7) as u8).collect();
+        for deflate in [false, true] {
+            let zip = build_zip(&[("readme.txt", b"hello"), ("Game.GBA", &rom)], deflate);
+            assert!(is_zip(&zip));
+            assert_eq!(unpack_rom(zip).unwrap(), rom);
+        }
+    }
+
+    #[test]
+    fn plain_rom_passes_through() {
+        let rom = vec![0x2E, 0x00, 0x00, 0xEA];
+        assert_eq!(unpack_rom(rom.clone()).unwrap(), rom);
+    }
+
+    #[test]
+    fn rejects_archives_without_single_rom() {
+        let none = build_zip(&[("readme.txt", b"hello")], false);
+        assert!(extract_gba_from_zip(&none).is_err());
+
+        let two = build_zip(&[("a.gba", b"one"), ("b.gba", b"two")], false);
+        assert!(extract_gba_from_zip(&two).is_err());
+    }
+
+    #[test]
+    fn rejects_entries_larger_than_declared_or_than_a_rom() {
+        let rom = vec![0u8; 64 * 1024];
+        let mut zip = build_zip(&[("bomb.gba", &rom)], true);
+        let eocd = zip.len() - 22;
+        let central = u32::from_le_bytes(zip[eocd + 16..eocd + 20].try_into().unwrap()) as usize;
+
+        // Inflating stops at the declared size instead of producing the whole stream
+        zip[central + 24..central + 28].copy_from_slice(&16u32.to_le_bytes());
+        assert!(extract_gba_from_zip(&zip).is_err());
+
+        zip[central + 24..central + 28].copy_from_slice(&(ROM_MAX_SIZE as u32 + 1).to_le_bytes());
+        assert!(extract_gba_from_zip(&zip).is_err());
+    }
+}
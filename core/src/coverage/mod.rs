@@ -0,0 +1,109 @@
+use std::collections::BTreeSet;
+use std::fmt::Write;
+
+// Addresses are tracked per word to keep the sets small
+const GRANULE: u32 = 4;
+
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum Access { Read, Write, Execute }
+
+/// Records which parts of the memory map a ROM touches over a run.
+#[derive(Default, Clone)]
+pub struct Coverage {
+    read: BTreeSet<u32>,
+    written: BTreeSet<u32>,
+    executed: BTreeSet<u32>,
+}
+
+fn region_name(addr: u32) -> &'static str {
+    match addr >> 24 {
+        0x00 => "BIOS",
+        0x02 => "EWRAM",
+        0x03 => "IWRAM",
+        0x04 => "IO",
+        0x05 => "PALETTE",
+        0x06 => "VRAM",
+        0x07 => "OAM",
+        0x08..=0x0D => "ROM",
+        0x0E | 0x0F => "SRAM",
+        _ => "UNMAPPED",
+    }
+}
+
+impl Coverage {
+    pub fn new() -> Self { Self::default() }
+
+    fn set(&self, access: Access) -> &BTreeSet<u32> {
+        match access {
+            Access::Read => &self.read,
+            Access::Write => &self.written,
+            Access::Execute => &self.executed,
+        }
+    }
+
+    pub fn record(&mut self, access: Access, addr: u32) {
+        let granule = addr & !(GRANULE - 1);
+        match access {
+            Access::Read => self.read.insert(granule),
+            Access::Write => self.written.insert(granule),
+            Access::Execute => self.executed.insert(granule),
+        };
+    }
+
+    pub fn contains(&self, access: Access, addr: u32) -> bool {
+        self.set(access).contains(&(addr & !(GRANULE - 1)))
+    }
+
+    /// Merges the touched granules into inclusive `(start, end)` ranges, split at region boundaries.
+    pub fn ranges(&self, access: Access) -> Vec<(u32, u32)> {
+        let mut ranges: Vec<(u32, u32)> = Vec::new();
+        for &addr in self.set(access) {
+            match ranges.last_mut() {
+                Some((start, end)) if *end + 1 == addr && region_name(*start) == region_name(addr) => {
+                    *end = addr + GRANULE - 1;
+                }
+                _ => ranges.push((addr, addr + GRANULE - 1)),
+            }
+        }
+        ranges
+    }
+
+    pub fn report(&self) -> String {
+        let mut out = String::new();
+        for (access, verb) in [(Access::Execute, "executed"), (Access::Read, "read"), (Access::Write, "wrote")] {
+            for (start, end) in self.ranges(access) {
+                let _ = writeln!(out, "{} {} {:#010x}-{:#010x}", verb, region_name(start), start, end);
+            }
+        }
+        out
+    }
+
+    pub fn clear(&mut self) {
+        self.read.clear();
+        self.written.clear();
+        self.executed.clear();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn adjacent_accesses_merge_per_region() {
+        let mut coverage = Coverage::new();
+        for addr in (0x0800_0000..0x0800_0010).step_by(2) {
+            coverage.record(Access::Execute, addr);
+        }
+        coverage.record(Access::Execute, 0x0800_0100);
+        coverage.record(Access::Write, 0x05FF_FFFE);
+        coverage.record(Access::Write, 0x0600_0000);
+
+        assert_eq!(
+            coverage.ranges(Access::Execute),
+            vec![(0x0800_0000, 0x0800_000F), (0x0800_0100, 0x0800_0103)]
+        );
+        assert_eq!(coverage.ranges(Access::Write).len(), 2);
+        assert!(coverage.report().contains("wrote VRAM 0x06000000-0x06000003"));
+    }
+}
@@ -1,5 +1,6 @@
 use std::fmt;
 use crate::bus::BusAccess;
+use crate::log_buffer::trace_cpu;
 
 #[derive(Copy, Clone, Eq, PartialEq, Debug)]
 pub enum CpuState { Arm, Thumb }
@@ -52,19 +53,126 @@ impl Exception {
     pub const fn disables_fiq(self) -> bool {
         matches!(self, Exception::Reset | Exception::Fiq)
     }
+
+    // Lower value wins: reset > data abort > FIQ > IRQ > prefetch abort > undefined/SWI
+    pub const fn priority(self) -> u8 {
+        match self {
+            Exception::Reset => 0,
+            Exception::DataAbort => 1,
+            Exception::Fiq => 2,
+            Exception::Irq => 3,
+            Exception::PrefetchAbort => 4,
+            Exception::Undefined | Exception::Swi => 5,
+        }
+    }
+
+    const ALL: [Exception; 7] = [
+        Exception::Reset,
+        Exception::Undefined,
+        Exception::Swi,
+        Exception::PrefetchAbort,
+        Exception::DataAbort,
+        Exception::Irq,
+        Exception::Fiq,
+    ];
+
+    const fn pending_bit(self) -> u8 { 1 << (self.vector() >> 2) }
+}
+
+/// The instruction formats of the ARM7TDMI Thumb set, numbered as in its data sheet.
+#[derive(Copy, Clone, Eq, PartialEq, Debug)]
+pub enum ThumbFormat {
+    MoveShiftedRegister,
+    AddSubtract,
+    MoveCompareAddSubtractImmediate,
+    AluOperation,
+    HiRegisterOperationBranchExchange,
+    PcRelativeLoad,
+    LoadStoreRegisterOffset,
+    LoadStoreSignExtended,
+    LoadStoreImmediateOffset,
+    LoadStoreHalfword,
+    SpRelativeLoadStore,
+    LoadAddress,
+    AddOffsetToSp,
+    PushPopRegisters,
+    MultipleLoadStore,
+    ConditionalBranch,
+    SoftwareInterrupt,
+    UnconditionalBranch,
+    LongBranchWithLink,
+    /// BKPT, BLX, B with condition AL and the other encodings ARMv4T leaves undefined
+    Undefined,
+}
+
+impl ThumbFormat {
+    pub fn decode(instr: u16) -> Self {
+        match instr >> 8 {
+            0x00..=0x17 => ThumbFormat::MoveShiftedRegister,
+            0x18..=0x1F => ThumbFormat::AddSubtract,
+            0x20..=0x3F => ThumbFormat::MoveCompareAddSubtractImmediate,
+            0x40..=0x43 => ThumbFormat::AluOperation,
+            0x44..=0x47 => ThumbFormat::HiRegisterOperationBranchExchange,
+            0x48..=0x4F => ThumbFormat::PcRelativeLoad,
+            0x50..=0x5F if instr & (1 << 9) == 0 => ThumbFormat::LoadStoreRegisterOffset,
+            0x50..=0x5F => ThumbFormat::LoadStoreSignExtended,
+            0x60..=0x7F => ThumbFormat::LoadStoreImmediateOffset,
+            0x80..=0x8F => ThumbFormat::LoadStoreHalfword,
+            0x90..=0x9F => ThumbFormat::SpRelativeLoadStore,
+            0xA0..=0xAF => ThumbFormat::LoadAddress,
+            0xB0 => ThumbFormat::AddOffsetToSp,
+            0xB4 | 0xB5 | 0xBC | 0xBD => ThumbFormat::PushPopRegisters,
+            0xC0..=0xCF => ThumbFormat::MultipleLoadStore,
+            0xD0..=0xDD => ThumbFormat::ConditionalBranch,
+            0xDF => ThumbFormat::SoftwareInterrupt,
+            0xE0..=0xE7 => ThumbFormat::UnconditionalBranch,
+            0xF0..=0xFF => ThumbFormat::LongBranchWithLink,
+            _ => ThumbFormat::Undefined,
+        }
+    }
+
+    /// Format number in the data sheet, 1 to 19; 0 when undefined.
+    pub fn number(self) -> u8 {
+        match self {
+            ThumbFormat::MoveShiftedRegister => 1,
+            ThumbFormat::AddSubtract => 2,
+            ThumbFormat::MoveCompareAddSubtractImmediate => 3,
+            ThumbFormat::AluOperation => 4,
+            ThumbFormat::HiRegisterOperationBranchExchange => 5,
+            ThumbFormat::PcRelativeLoad => 6,
+            ThumbFormat::LoadStoreRegisterOffset => 7,
+            ThumbFormat::LoadStoreSignExtended => 8,
+            ThumbFormat::LoadStoreImmediateOffset => 9,
+            ThumbFormat::LoadStoreHalfword => 10,
+            ThumbFormat::SpRelativeLoadStore => 11,
+            ThumbFormat::LoadAddress => 12,
+            ThumbFormat::AddOffsetToSp => 13,
+            ThumbFormat::PushPopRegisters => 14,
+            ThumbFormat::MultipleLoadStore => 15,
+            ThumbFormat::ConditionalBranch => 16,
+            ThumbFormat::SoftwareInterrupt => 17,
+            ThumbFormat::UnconditionalBranch => 18,
+            ThumbFormat::LongBranchWithLink => 19,
+            ThumbFormat::Undefined => 0,
+        }
+    }
 }
 
 impl CpuMode {
     fn from_bits(bits: u32) -> Self {
+        Self::try_from_bits(bits).unwrap_or(CpuMode::User)
+    }
+
+    fn try_from_bits(bits: u32) -> Option<Self> {
         match bits & 0x1F {
-            0b10000 => CpuMode::User,
-            0b10001 => CpuMode::Fiq,
-            0b10010 => CpuMode::Irq,
-            0b10011 => CpuMode::Supervisor,
-            0b10111 => CpuMode::Abort,
-            0b11011 => CpuMode::Undefined,
-            0b11111 => CpuMode::System,
-            _ => CpuMode::User,
+            0b10000 => Some(CpuMode::User),
+            0b10001 => Some(CpuMode::Fiq),
+            0b10010 => Some(CpuMode::Irq),
+            0b10011 => Some(CpuMode::Supervisor),
+            0b10111 => Some(CpuMode::Abort),
+            0b11011 => Some(CpuMode::Undefined),
+            0b11111 => Some(CpuMode::System),
+            _ => None,
         }
     }
 
@@ -166,6 +274,36 @@ struct ThumbPipeline {
     valid: bool,
 }
 
+/// An opcode the core has no implementation for, with the address it was fetched from.
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub struct UnimplementedInstruction {
+    pub opcode: u32,
+    pub pc: u32,
+    pub thumb: bool,
+}
+
+/// Complete CPU register and pipeline state, for savestates and debugger inspection.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct CpuSnapshot {
+    pub regs: [u32; 16],
+    pub cpsr: u32,
+    pub r8_fiq: [u32; 5],
+    pub r8_shared: [u32; 5],
+    pub r13_banked: [u32; 7],
+    pub r14_banked: [u32; 7],
+    pub spsr_banked: [u32; 6],
+    pub arm_fetch: u32,
+    pub arm_decode: u32,
+    pub arm_pipe_valid: bool,
+    pub thumb_fetch: u16,
+    pub thumb_decode: u16,
+    pub thumb_pipe_valid: bool,
+    pub swi_hle: bool,
+    pub cycles: u64,
+    pub pending_exceptions: u8,
+}
+
+#[derive(Clone)]
 pub struct Cpu {
     regs: [u32; 16],
     cpsr: Cpsr,
@@ -173,6 +311,14 @@ pub struct Cpu {
     arm_pipe: ArmPipeline,
     thumb_pipe: ThumbPipeline,
     swi_hle: bool,
+    cycles: u64,
+    pending_exceptions: u8,
+    // Set when the executing instruction wrote R15; step() then refills the pipeline
+    pc_written: bool,
+    strict: bool,
+    strict_violations: Vec<String>,
+    unimplemented: Option<UnimplementedInstruction>,
+    trap_undefined: bool,
 }
 
 impl Default for Cpu {
@@ -184,6 +330,13 @@ impl Default for Cpu {
             arm_pipe: ArmPipeline::default(),
             thumb_pipe: ThumbPipeline::default(),
             swi_hle: false,
+            cycles: 0,
+            pending_exceptions: 0,
+            pc_written: false,
+            strict: false,
+            strict_violations: Vec::new(),
+            unimplemented: None,
+            trap_undefined: true,
         };
         cpu.cpsr.set_mode(CpuMode::System);
         cpu.banked.r8_shared.copy_from_slice(&cpu.regs[8..=12]);
@@ -200,9 +353,131 @@ impl Cpu {
     pub fn read_reg(&self, index: usize) -> u32 { self.regs[index] }
     pub fn write_reg(&mut self, index: usize, value: u32) { self.regs[index] = value; }
 
+    /// Reads a register from the User bank regardless of the current mode.
+    pub fn user_reg(&self, index: usize) -> u32 {
+        match index {
+            8..=12 if self.mode() == CpuMode::Fiq => self.banked.r8_shared[index - 8],
+            13 | 14 if !matches!(self.mode(), CpuMode::User | CpuMode::System) => {
+                if index == 13 { self.banked.r13_banked[0] } else { self.banked.r14_banked[0] }
+            }
+            _ => self.regs[index],
+        }
+    }
+
+    pub fn set_user_reg(&mut self, index: usize, value: u32) {
+        match index {
+            8..=12 if self.mode() == CpuMode::Fiq => self.banked.r8_shared[index - 8] = value,
+            13 | 14 if !matches!(self.mode(), CpuMode::User | CpuMode::System) => {
+                if index == 13 { self.banked.r13_banked[0] = value } else { self.banked.r14_banked[0] = value }
+            }
+            _ => self.regs[index] = value,
+        }
+    }
+
+    // Register write from an executing instruction; writing R15 requests a pipeline flush
+    fn set_reg(&mut self, index: usize, value: u32) {
+        self.regs[index] = value;
+        if index == 15 { self.pc_written = true; }
+    }
+
     pub fn arm_pipeline_decode(&self) -> u32 { self.arm_pipe.decode }
 
     pub fn set_swi_hle(&mut self, enabled: bool) { self.swi_hle = enabled; }
+    pub fn cycles(&self) -> u64 { self.cycles }
+
+    /// Strict mode reports impossible CPU states (invalid mode bits, SPSR access
+    /// without an SPSR) instead of silently tolerating them.
+    pub fn set_strict_mode(&mut self, strict: bool) { self.strict = strict; }
+    pub fn strict_mode(&self) -> bool { self.strict }
+    pub fn strict_violations(&self) -> &[String] { &self.strict_violations }
+
+    /// Undefined instructions take the Undefined trap like hardware does. With traps
+    /// off they are recorded as unimplemented and skipped, so a debugger can stop on them.
+    pub fn set_trap_undefined(&mut self, enabled: bool) { self.trap_undefined = enabled; }
+
+    /// Returns the last unimplemented instruction hit since the previous call.
+    pub fn take_unimplemented(&mut self) -> Option<UnimplementedInstruction> {
+        self.unimplemented.take()
+    }
+
+    // Unimplemented opcodes execute as no-ops; the record lets a debugger stop on them
+    fn note_unimplemented(&mut self, opcode: u32) {
+        let thumb = self.state() == CpuState::Thumb;
+        let pc = self.regs[15].wrapping_sub(if thumb { 4 } else { 8 });
+        log::warn!("Unimplemented {} opcode {:#010x} at {:#010x}", if thumb { "Thumb" } else { "ARM" }, opcode, pc);
+        self.unimplemented = Some(UnimplementedInstruction { opcode, pc, thumb });
+    }
+
+    fn undefined_instruction<B: BusAccess>(&mut self, bus: &mut B, opcode: u32) {
+        if self.trap_undefined {
+            let thumb = self.state() == CpuState::Thumb;
+            let pc = self.regs[15].wrapping_sub(if thumb { 4 } else { 8 });
+            log::debug!("Undefined {} opcode {:#010x} at {:#010x}", if thumb { "Thumb" } else { "ARM" }, opcode, pc);
+            self.enter_exception(bus, Exception::Undefined);
+        } else {
+            self.note_unimplemented(opcode);
+        }
+    }
+
+    fn report_violation(&mut self, message: String) {
+        if self.strict {
+            log::error!("CPU strict mode: {} (PC={:#010x})", message, self.regs[15]);
+            self.strict_violations.push(message);
+        } else {
+            log::debug!("CPU: {}", message);
+        }
+    }
+
+    /// Writes the whole CPSR, switching register banks when the mode changes.
+    /// Invalid mode bits leave the current mode in place.
+    pub fn write_cpsr(&mut self, value: u32) {
+        let mode = match CpuMode::try_from_bits(value) {
+            Some(mode) => mode,
+            None => {
+                self.report_violation(format!("invalid CPSR mode bits {:#07b}", value & 0x1F));
+                self.mode()
+            }
+        };
+        self.set_mode(mode);
+        self.set_state(if (value & (1 << 5)) != 0 { CpuState::Thumb } else { CpuState::Arm });
+        self.cpsr.set_raw((value & !0x1F) | mode.to_bits());
+    }
+
+    pub fn capture_state(&self) -> CpuSnapshot {
+        CpuSnapshot {
+            regs: self.regs,
+            cpsr: self.cpsr.raw(),
+            r8_fiq: self.banked.r8_fiq,
+            r8_shared: self.banked.r8_shared,
+            r13_banked: self.banked.r13_banked,
+            r14_banked: self.banked.r14_banked,
+            spsr_banked: self.banked.spsr_banked,
+            arm_fetch: self.arm_pipe.fetch,
+            arm_decode: self.arm_pipe.decode,
+            arm_pipe_valid: self.arm_pipe.valid,
+            thumb_fetch: self.thumb_pipe.fetch,
+            thumb_decode: self.thumb_pipe.decode,
+            thumb_pipe_valid: self.thumb_pipe.valid,
+            swi_hle: self.swi_hle,
+            cycles: self.cycles,
+            pending_exceptions: self.pending_exceptions,
+        }
+    }
+
+    pub fn restore_state(&mut self, state: &CpuSnapshot) {
+        self.regs = state.regs;
+        self.cpsr.set_raw(state.cpsr);
+        self.banked.r8_fiq = state.r8_fiq;
+        self.banked.r8_shared = state.r8_shared;
+        self.banked.r13_banked = state.r13_banked;
+        self.banked.r14_banked = state.r14_banked;
+        self.banked.spsr_banked = state.spsr_banked;
+        self.arm_pipe = ArmPipeline { fetch: state.arm_fetch, decode: state.arm_decode, valid: state.arm_pipe_valid };
+        self.thumb_pipe = ThumbPipeline { fetch: state.thumb_fetch, decode: state.thumb_decode, valid: state.thumb_pipe_valid };
+        self.swi_hle = state.swi_hle;
+        self.cycles = state.cycles;
+        self.pending_exceptions = state.pending_exceptions;
+    }
 
     pub fn mode(&self) -> CpuMode { self.cpsr.mode() }
     pub fn state(&self) -> CpuState { self.cpsr.state() }
@@ -224,13 +499,18 @@ impl Cpu {
         let old_pc = self.pc();
         let new_mode = exception.target_mode();
 
-        let lr_offset: u32 = match exception {
-            Exception::Reset => 0,
-            Exception::Swi | Exception::Undefined => 0,
-            Exception::PrefetchAbort | Exception::Irq | Exception::Fiq => 0,
-            Exception::DataAbort => 4,
+        // SWI and undefined are raised while executing, when R15 is two instructions ahead.
+        // The rest are taken between instructions with R15 on the next one, and LR gets
+        // that plus 4 in either state so handlers return with SUBS PC, LR, #4 (#8 for
+        // data aborts, whose next instruction follows the aborted one).
+        let instr_width = if self.cpsr.t() { 2 } else { 4 };
+        let return_addr = match exception {
+            Exception::Reset => self.pc(),
+            Exception::Swi | Exception::Undefined => self.pc().wrapping_sub(instr_width),
+            Exception::PrefetchAbort | Exception::DataAbort | Exception::Irq | Exception::Fiq => {
+                self.pc().wrapping_add(4)
+            }
         };
-        let return_addr = self.pc().wrapping_add(lr_offset);
 
         self.set_mode(new_mode);
         self.set_spsr_for_mode(new_mode, old_cpsr);
@@ -242,7 +522,7 @@ impl Cpu {
             self.cpsr.set_f(true);
         }
 
-        self.regs[15] = exception.vector();
+        self.set_reg(15, exception.vector());
         self.flush_pipeline(bus);
 
         log::trace!(
@@ -377,6 +657,29 @@ impl Cpu {
         self.enter_exception(bus, Exception::Reset);
     }
 
+    /// Latches an exception to be taken at the next instruction boundary.
+    pub fn raise_exception(&mut self, exception: Exception) {
+        self.pending_exceptions |= exception.pending_bit();
+    }
+
+    pub fn clear_exception(&mut self, exception: Exception) {
+        self.pending_exceptions &= !exception.pending_bit();
+    }
+
+    /// Highest-priority pending exception not masked by the CPSR I/F bits.
+    pub fn resolve_exception(&self) -> Option<Exception> {
+        Exception::ALL
+            .iter()
+            .copied()
+            .filter(|e| (self.pending_exceptions & e.pending_bit()) != 0)
+            .filter(|e| match e {
+                Exception::Irq => !self.cpsr.i(),
+                Exception::Fiq => !self.cpsr.f(),
+                _ => true,
+            })
+            .min_by_key(|e| e.priority())
+    }
+
     pub fn set_mode(&mut self, new_mode: CpuMode) {
         let old_mode = self.mode();
         if old_mode == new_mode { return; }
@@ -574,6 +877,66 @@ impl Cpu {
         }
     }
 
+    // ----- Cycle accounting -----
+    // Internal cycles spent by the multiplier, based on the significant bytes of the operand
+    fn multiply_cycles(rs: u32) -> u32 {
+        if (rs & 0xFFFF_FF00) == 0 || (rs & 0xFFFF_FF00) == 0xFFFF_FF00 {
+            1
+        } else if (rs & 0xFFFF_0000) == 0 || (rs & 0xFFFF_0000) == 0xFFFF_0000 {
+            2
+        } else if (rs & 0xFF00_0000) == 0 || (rs & 0xFF00_0000) == 0xFF00_0000 {
+            3
+        } else {
+            4
+        }
+    }
+
+    // Cost of a Thumb instruction with every S/N/I cycle counted as one (no wait states).
+    // Pipeline refills after a taken branch or PC write are added by step().
+    fn thumb_instruction_cycles(&self, instr: u32) -> u32 {
+        let load = (instr >> 11) & 1 != 0;
+        let transfer = |load: bool| if load { 3 } else { 2 }; // 1S+1N+1I / 2N
+        match instr >> 13 {
+            0b000 | 0b001 => 1,
+            0b010 => {
+                if (instr >> 10) == 0b010000 {
+                    match (instr >> 6) & 0xF {
+                        0x2 | 0x3 | 0x4 | 0x7 => 2, // shift by register
+                        0xD => 1 + Self::multiply_cycles(self.regs[(instr & 7) as usize]),
+                        _ => 1,
+                    }
+                } else if (instr >> 10) == 0b010001 {
+                    1
+                } else if (instr >> 11) == 0b01001 {
+                    3
+                } else if (instr >> 9) & 1 == 0 {
+                    transfer(load)
+                } else {
+                    transfer((instr >> 10) & 0x3 != 0) // only STRH stores
+                }
+            }
+            0b011 => transfer(load),
+            0b100 => transfer(load),
+            0b101 => {
+                if (instr >> 12) & 1 == 0 || (instr >> 8) & 0xF == 0 {
+                    1
+                } else {
+                    let n = (instr & 0x1FF).count_ones();
+                    if load { n + 2 } else { n + 1 }
+                }
+            }
+            0b110 => {
+                if (instr >> 12) & 1 == 0 {
+                    let n = (instr & 0xFF).count_ones();
+                    if load { n + 2 } else { n + 1 }
+                } else {
+                    1
+                }
+            }
+            _ => 1,
+        }
+    }
+
     // ----- Condition evaluation -----
     fn condition_passed(&self, cond: u32) -> bool {
         let n = self.cpsr.n();
@@ -619,17 +982,18 @@ impl Cpu {
             // Register shifter operand
             let rm = (opcode & 0xF) as usize;
             let typ = (opcode >> 5) & 0x3; // 0 LSL,1 LSR,2 ASR,3 ROR
-            let by_reg = ((opcode >> 4) & 1) == 1;
-            if by_reg {
+            if Self::shift_by_register(opcode) {
                 let rs = ((opcode >> 8) & 0xF) as usize;
                 let amount = self.regs[rs] & 0xFF;
+                let value = self.shift_operand_reg(opcode, rm);
                 match typ {
-                    0 => Self::lsl_with_carry(self.regs[rm], amount, self.cpsr.c(), false),
-                    1 => Self::lsr_with_carry(self.regs[rm], amount, self.cpsr.c(), false),
-                    2 => Self::asr_with_carry(self.regs[rm], amount, self.cpsr.c(), false),
-                    _ => Self::ror_with_carry(self.regs[rm], amount, self.cpsr.c(), false),
+                    0 => Self::lsl_with_carry(value, amount, self.cpsr.c(), false),
+                    1 => Self::lsr_with_carry(value, amount, self.cpsr.c(), false),
+                    2 => Self::asr_with_carry(value, amount, self.cpsr.c(), false),
+                    _ => Self::ror_with_carry(value, amount, self.cpsr.c(), false),
                 }
             } else {
+                // An immediate amount of 0 encodes LSR/ASR #32 and RRX; the helpers remap it
                 let imm5 = (opcode >> 7) & 0x1F;
                 match typ {
                     0 => Self::lsl_with_carry(self.regs[rm], imm5, self.cpsr.c(), true),
@@ -641,6 +1005,21 @@ impl Cpu {
         }
     }
 
+    // Bit 4 of a register operand selects a shift amount from Rs rather than imm5
+    fn shift_by_register(opcode: u32) -> bool {
+        (opcode >> 25) & 1 == 0 && (opcode >> 4) & 1 == 1
+    }
+
+    // Reading Rs takes an extra cycle, by which point the PC has moved on to
+    // instruction + 12
+    fn shift_operand_reg(&self, opcode: u32, index: usize) -> u32 {
+        if index == 15 && Self::shift_by_register(opcode) {
+            self.regs[15].wrapping_add(4)
+        } else {
+            self.regs[index]
+        }
+    }
+
     // ----- Flag helpers -----
     fn add_with_carry(a: u32, b: u32, carry: bool) -> (u32, bool, bool) {
         let carry_in = if carry { 1u64 } else { 0u64 };
@@ -683,10 +1062,13 @@ impl Cpu {
         let rn = ((opcode >> 16) & 0xF) as usize;
         let rd = ((opcode >> 12) & 0xF) as usize;
         let (op2, sh_carry) = self.decode_operand2(opcode);
+        if Self::shift_by_register(opcode) {
+            self.cycles += 1;
+        }
 
         let mut write_result = true;
         let result: u32;
-        let rn_val = self.regs[rn];
+        let rn_val = self.shift_operand_reg(opcode, rn);
         match op {
             0x0 => { result = rn_val & op2; if s { self.cpsr.set_c(sh_carry); } },              // AND
             0x1 => { result = rn_val ^ op2; if s { self.cpsr.set_c(sh_carry); } },              // EOR
@@ -714,7 +1096,16 @@ impl Cpu {
         }
 
         if write_result {
-            self.regs[rd] = result;
+            self.set_reg(rd, result);
+        }
+
+        // S with Rd=15 returns from an exception: CPSR is restored from SPSR rather
+        // than taking the flags. This also covers the test ops (legacy TEQP/CMPP).
+        if s && rd == 15 {
+            match self.spsr() {
+                Some(spsr) => self.write_cpsr(spsr),
+                None => self.report_violation(format!("no SPSR to restore in {:?} mode", self.mode())),
+            }
         }
     }
 
@@ -728,14 +1119,25 @@ impl Cpu {
         let rs = ((instr >> 8) & 0xF) as usize;
         let rm = (instr & 0xF) as usize;
 
+        // Both are unpredictable per spec; the hardware result is kept for Rd == Rm
+        // but the PC is never a multiply destination
+        if rd == rm {
+            self.report_violation(format!("multiply with Rd == Rm (r{})", rd));
+        }
+        if rd == 15 {
+            self.report_violation("multiply into r15".to_string());
+            return;
+        }
+
         let mut result = self.regs[rm].wrapping_mul(self.regs[rs]);
         if a { result = result.wrapping_add(self.regs[rn]); }
-        self.regs[rd] = result;
+        self.set_reg(rd, result);
 
         if s {
             self.cpsr.set_n((result >> 31) != 0);
             self.cpsr.set_z(result == 0);
-            // C and V are unchanged for MUL/MLA on ARM7TDMI
+            // V is unchanged; C is architecturally meaningless after MUL/MLA on
+            // ARM7TDMI and is left as it was
         }
     }
 
@@ -751,6 +1153,14 @@ impl Cpu {
         let rs = ((instr >> 8) & 0xF) as usize;
         let rm = (instr & 0xF) as usize;
 
+        if rd_hi == rd_lo || rd_hi == rm || rd_lo == rm {
+            self.report_violation(format!("long multiply with overlapping registers (r{}:r{}, r{})", rd_hi, rd_lo, rm));
+        }
+        if rd_hi == 15 || rd_lo == 15 {
+            self.report_violation("long multiply into r15".to_string());
+            return;
+        }
+
         let multiplicand_a = self.regs[rm];
         let multiplicand_b = self.regs[rs];
 
@@ -779,7 +1189,7 @@ impl Cpu {
 
         if s {
             self.cpsr.set_n((result_hi >> 31) != 0);
-            self.cpsr.set_z(result == 0);
+            self.cpsr.set_z((result as u64) == 0);
             // C and V are undefined for long multiply on ARM7TDMI; leave unchanged
         }
     }
@@ -814,6 +1224,72 @@ impl Cpu {
         }
     }
 
+    fn execute_arm_instruction<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
+        let top2 = (instr >> 26) & 0x3;
+        let top3 = (instr >> 25) & 0x7;
+        if ((instr >> 22) & 0x3F) == 0 && ((instr >> 4) & 0xF) == 0b1001 {
+            self.execute_arm_multiply(instr);
+        } else if ((instr >> 23) & 0x1F) == 0b00001 && ((instr >> 4) & 0xF) == 0b1001 {
+            // UMULL/UMLAL/SMULL/SMLAL
+            self.execute_arm_multiply_long(instr);
+        } else if (((instr >> 23) & 0x1F) == 0b00010) && (((instr >> 21) & 0x3) == 0) && (((instr >> 4) & 0xF) == 0b1001) {
+            self.execute_arm_swp(bus, instr);
+        } else if (instr & 0x0FFF_FFF0) == 0x012F_FF10 {
+            self.execute_arm_branch_exchange(instr);
+        } else if (instr & 0x0FBF0FFF) == 0x010F0000
+            || (instr & 0x0FB0F000) == 0x0320F000
+            || (instr & 0x0FB0FFF0) == 0x0120F000
+        {
+            self.execute_arm_psr_transfer(instr);
+        } else if (instr & 0x0E00_0090) == 0x0000_0090 && ((instr >> 5) & 0x3) != 0 {
+            // Halfword and signed transfers, immediate (bit 22) or register offset
+            self.execute_arm_halfword_transfer(bus, instr);
+        } else if (instr & 0x0E00_0010) == 0x0600_0010 || top3 == 0b110 || (instr >> 24) & 0xF == 0xE {
+            // Architecturally undefined space, and coprocessor instructions that no
+            // coprocessor answers on the GBA
+            if self.condition_passed((instr >> 28) & 0xF) {
+                self.undefined_instruction(bus, instr);
+            }
+        } else if top3 == 0b100 {
+            self.execute_arm_block_transfer(bus, instr);
+        } else if top2 == 0 {
+            self.execute_arm_data_processing(instr);
+        } else if top3 == 0b101 {
+            let cond = (instr >> 28) & 0xF;
+            if self.condition_passed(cond) {
+                let l = ((instr >> 24) & 1) != 0;
+                let imm24 = instr & 0x00FF_FFFF;
+                // imm24 counts words: sign-extend to 32 bits and scale by 4 exactly once,
+                // giving a reach of -32MB..+32MB-4 from R15 (instruction + 8)
+                let offset = (((imm24 as i32) << 8) >> 6) as u32;
+                if l { self.regs[14] = self.regs[15].wrapping_sub(4); }
+                self.set_reg(15, self.regs[15].wrapping_add(offset));
+            }
+        } else if top2 == 0b01 {
+            self.execute_arm_single_data_transfer(bus, instr);
+        } else if (instr >> 24) & 0xF == 0xF {
+            let cond = (instr >> 28) & 0xF;
+            if self.condition_passed(cond) {
+                let swi_num = (instr & 0xFF) as u8;
+                self.handle_swi(bus, swi_num);
+            }
+        }
+    }
+
+    fn execute_arm_branch_exchange(&mut self, instr: u32) {
+        let cond = (instr >> 28) & 0xF;
+        if !self.condition_passed(cond) { return; }
+        let target = self.regs[(instr & 0xF) as usize];
+        // Bit 0 selects the state; the PC is aligned for it
+        if (target & 1) != 0 {
+            self.set_state(CpuState::Thumb);
+            self.set_reg(15, target & !1);
+        } else {
+            self.set_state(CpuState::Arm);
+            self.set_reg(15, target & !3);
+        }
+    }
+
     fn flush_pipeline<B: BusAccess>(&mut self, bus: &mut B) {
         let target = self.pc();
         self.regs[15] = target;
@@ -855,16 +1331,13 @@ impl Cpu {
         if l {
             if b {
                 let value = (bus.read16(address & !1) >> ((address & 1) * 8)) as u8 as u32;
-                self.regs[rd] = value;
+                self.set_reg(rd, value);
             } else {
                 let aligned = address & !3;
                 let raw = bus.read32(aligned);
                 let rotate = (address & 3) * 8;
                 let value = if rotate != 0 { raw.rotate_right(rotate) } else { raw };
-                self.regs[rd] = value;
-                if rd == 15 {
-                    self.flush_pipeline(bus);
-                }
+                self.set_reg(rd, value);
             }
         } else if b {
             bus.write8(address, (self.regs[rd] & 0xFF) as u8);
@@ -875,6 +1348,11 @@ impl Cpu {
             bus.write32(aligned, value);
         }
 
+        // Writeback to R15 as base is unpredictable; ignore it. A load into the
+        // base register wins over the writeback.
+        if rn == 15 || (l && rn == rd) {
+            return;
+        }
         if p && w {
             self.regs[rn] = base.wrapping_add(off);
         } else if !p {
@@ -906,32 +1384,27 @@ impl Cpu {
         let off = if u { offset } else { 0u32.wrapping_sub(offset) };
         let address = if p { base.wrapping_add(off) } else { base };
 
-     if l {
-         let value = match (s, h) {
-             (false, true) => { // LDRH
-                 bus.read16(address & !1) as u32
-             }
-             (true, false) => { // LDRSB
-
-                 bus.read8(address) as i8 as i32 as u32
-             }
-             (true, true) => { // LDRSH
-
-                 bus.read16(address & !1) as i16 as i32 as u32
-             }
-             _ => 0,
-         };
-         self.regs[rd] = value;
-     } else {
-         // STRH only
-         if h {
-             bus.write16(address & !1, (self.regs[rd] & 0xFFFF) as u16);
-         }
-     }
-
-     if p && w { self.regs[rn] = base.wrapping_add(off); }
-     if !p { self.regs[rn] = base.wrapping_add(off); }
- }
+        if l {
+            let value = match (s, h) {
+                // LDRH: a misaligned address returns the halfword rotated by a byte
+                (false, true) => (bus.read16(address & !1) as u32).rotate_right((address & 1) * 8),
+                // LDRSB
+                (true, false) => bus.read8(address) as i8 as i32 as u32,
+                // LDRSH: a misaligned address loads a sign-extended byte instead
+                (true, true) if (address & 1) != 0 => bus.read8(address) as i8 as i32 as u32,
+                (true, true) => bus.read16(address) as i16 as i32 as u32,
+                _ => 0,
+            };
+            self.set_reg(rd, value);
+        } else if h {
+            // STRH only
+            bus.write16(address & !1, (self.regs[rd] & 0xFFFF) as u16);
+        }
+
+        if rn == 15 || (l && rn == rd) { return; }
+        if p && w { self.regs[rn] = base.wrapping_add(off); }
+        if !p { self.regs[rn] = base.wrapping_add(off); }
+    }
 
     fn execute_arm_swp<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
         let cond = (instr >> 28) & 0xF;
@@ -941,32 +1414,38 @@ impl Cpu {
         let rd = ((instr >> 12) & 0xF) as usize;
         let rm = (instr & 0xF) as usize;
         let address = self.regs[rn];
+        // SWP locks the bus between its read and write. DMA only starts between
+        // instructions or from a completed write, so nothing can slip in between
         if byte {
             let old = bus.read8(address) as u32;
             bus.write8(address, (self.regs[rm] & 0xFF) as u8);
-            self.regs[rd] = old;
+            self.set_reg(rd, old);
         } else {
+            // The load half rotates a misaligned word like LDR does
             let aligned = address & !3;
-            let old = bus.read32(aligned);
+            let old = bus.read32(aligned).rotate_right((address & 3) * 8);
             bus.write32(aligned, self.regs[rm]);
-            self.regs[rd] = old;
+            self.set_reg(rd, old);
         }
     }
 
     fn execute_arm_psr_transfer(&mut self, instr: u32) {
         let cond = (instr >> 28) & 0xF;
         if !self.condition_passed(cond) { return; }
-        let r = ((instr >> 22) & 1) != 0; // 0=CPSR, 1=SPSR (unsupported)
+        let r = ((instr >> 22) & 1) != 0; // 0=CPSR, 1=SPSR of the current mode
         let mrs = ((instr >> 21) & 1) == 0 && (((instr >> 4) & 0xFF) == 0);
+        // User and System mode have no SPSR; the access is ignored
+        if r && self.spsr().is_none() {
+            self.report_violation(format!("SPSR access in {:?} mode", self.mode()));
+            return;
+        }
         if mrs {
-            if r { return; }
             let rd = ((instr >> 12) & 0xF) as usize;
-            self.regs[rd] = self.cpsr.raw();
+            self.regs[rd] = if r { self.spsr().unwrap_or(0) } else { self.cpsr.raw() };
             return;
         }
         // MSR
         let immediate = ((instr >> 25) & 1) == 1;
-        if r { return; }
         let field_mask = (instr >> 16) & 0xF; // f,s,x,c
         let operand = if immediate {
             let imm8 = instr & 0xFF;
@@ -976,26 +1455,26 @@ impl Cpu {
             let rm = (instr & 0xF) as usize;
             self.regs[rm]
         };
-        let mut cpsr = self.cpsr.raw();
-        // Only handle f (flags) and c (control) minimally; here apply flags when bit3 (f) set
-        if (field_mask & 0b1000) != 0 {
-            // Derive NZCV from operand. Prefer bits31..28; if zero (immediate low form), use bits7..4 mapping.
-            let nzcv = if (operand & 0xF000_0000) != 0 {
-                (operand >> 28) & 0xF
-            } else {
-                (operand >> 4) & 0xF
-            };
-            // Clear flags then set from nzcv
-            cpsr &= 0x0FFF_FFFF;
-            cpsr |= nzcv << 28;
+        // Each field bit selects one byte of the PSR
+        let mut mask = (0..4)
+            .filter(|i| (field_mask >> i) & 1 != 0)
+            .fold(0u32, |m, i| m | (0xFF << (i * 8)));
+        if r {
+            let spsr = self.spsr().unwrap_or(0);
+            self.set_spsr((spsr & !mask) | (operand & mask));
+            return;
         }
-        // Optionally update I,F,T and mode if c bit set (lowest nibble). For safety, ignore mode changes here.
-        if (field_mask & 0b0001) != 0 {
-            // Update only I,F,T bits (7,6,5)
-            let mask = (1<<7) | (1<<6) | (1<<5);
-            cpsr = (cpsr & !mask) | (operand & mask);
+        // The control byte (I, F, T and mode) is only writable from a privileged
+        // mode, and T never changes through MSR
+        if self.mode() == CpuMode::User {
+            mask &= !0xFF;
         }
-        self.cpsr.set_raw(cpsr);
+        if (mask & (operand ^ self.cpsr.raw()) & (1 << 5)) != 0 {
+            self.report_violation("MSR cannot change the T bit; use BX".to_string());
+        }
+        mask &= !(1 << 5);
+        let cpsr = (self.cpsr.raw() & !mask) | (operand & mask);
+        self.write_cpsr(cpsr);
     }
 
     fn execute_arm_block_transfer<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
@@ -1019,7 +1498,7 @@ impl Cpu {
                     self.regs[rn]
                 };
                 let pc_val = bus.read32(addr & !3);
-                self.regs[15] = pc_val;
+                self.set_reg(15, pc_val);
                 if w {
                     self.regs[rn] = if u {
                         self.regs[rn].wrapping_add(4)
@@ -1028,13 +1507,13 @@ impl Cpu {
                     };
                 }
             } else {
-                // STM with empty list: store PC+12 to address
+                // STM with empty list: store PC+12 (R15 + 4) to address
                 let addr = if p {
                     if u { self.regs[rn].wrapping_add(4) } else { self.regs[rn].wrapping_sub(4) }
                 } else {
                     self.regs[rn]
                 };
-                bus.write32(addr & !3, self.regs[15].wrapping_add(12));
+                bus.write32(addr & !3, self.regs[15].wrapping_add(4));
                 if w {
                     self.regs[rn] = if u {
                         self.regs[rn].wrapping_add(4)
@@ -1059,9 +1538,20 @@ impl Cpu {
         let start_addr = match (u, p) {
             (true, false) => base,                          // IA (Increment After)
             (true, true)  => base.wrapping_add(4),          // IB (Increment Before)
-            (false, false)=> base.wrapping_sub(4 * count),  // DA (Decrement After)
-            (false, true) => base.wrapping_sub(4).wrapping_sub(4 * count), // DB (Decrement Before)
+            (false, false)=> base.wrapping_sub(4 * count).wrapping_add(4), // DA (Decrement After)
+            (false, true) => base.wrapping_sub(4 * count),  // DB (Decrement Before)
         };
+        let new_base = if u { base.wrapping_add(4 * count) } else { base.wrapping_sub(4 * count) };
+
+        // With the S bit, an LDM that loads the PC returns from an exception; any
+        // other form transfers the user bank registers instead of the current ones
+        let restore_cpsr = s && l && (reg_list & 0x8000) != 0;
+        let user_bank = s && !restore_cpsr;
+        // Writeback is unpredictable on a user bank transfer; it still updates the
+        // current mode's base register here
+        if user_bank && w {
+            self.report_violation(format!("user bank block transfer with writeback to r{}", rn));
+        }
 
         // Perform transfers in ascending register order
         for (i, &reg) in regs.iter().enumerate() {
@@ -1070,18 +1560,22 @@ impl Cpu {
             if l {
                 // Load operation
                 let val = bus.read32(addr & !3);
-                self.regs[reg] = val;
-
-                // Special handling for PC load
-                if reg == 15 {
-                    // PC load causes pipeline flush
-                    self.flush_pipeline(bus);
-            }
-        } else {
+                if user_bank {
+                    self.set_user_reg(reg, val);
+                } else {
+                    self.set_reg(reg, val);
+                }
+            } else {
                 // Store operation
                 let val = if reg == 15 {
-                    // Store PC+12 for return address
-                    self.regs[15].wrapping_add(12)
+                    // Stored PC is one word past the R15 value seen by operands
+                    self.regs[15].wrapping_add(4)
+                } else if reg == rn && w && i != 0 {
+                    // The base is written back after the first store, so only a
+                    // base that is the lowest listed register stores its old value
+                    new_base
+                } else if user_bank {
+                    self.user_reg(reg)
                 } else {
                     self.regs[reg]
                 };
@@ -1091,99 +1585,58 @@ impl Cpu {
 
         // Update base register if writeback is enabled
         if w {
-            let new_base = match (u, p) {
-                (true, false) => base.wrapping_add(4 * count),      // IA: base + count*4
-                (true, true)  => base.wrapping_add(4).wrapping_add(4 * count), // IB: base + 4 + count*4
-                (false, false)=> base.wrapping_sub(4 * count),      // DA: base - count*4
-                (false, true) => base.wrapping_sub(4).wrapping_sub(4 * count), // DB: base - 4 - count*4
-            };
             self.regs[rn] = new_base;
         }
 
-        // Note: S bit (user mode registers) not implemented yet
-        let _ = s;
+        if restore_cpsr {
+            match self.spsr() {
+                Some(spsr) => self.write_cpsr(spsr),
+                None => self.report_violation(format!("no SPSR to restore in {:?} mode", self.mode())),
+            }
+        }
     }
 
     // THUMB instruction implementations
 
+    // Format 1: LSL/LSR/ASR by an immediate, which uses the ARM immediate-shift
+    // encoding where LSR #0 and ASR #0 mean a shift by 32
     fn execute_thumb_move_shifted_register(&mut self, instr: u32) {
-        let op = (instr >> 11) & 0x3; // 00=LSL, 01=LSR, 10=ASR, 11=ADD/SUB
+        let op = (instr >> 11) & 0x3; // 00=LSL, 01=LSR, 10=ASR
         let offset5 = (instr >> 6) & 0x1F;
-        let rs = (instr >> 3) & 0x7;
-        let rd = instr & 0x7;
+        let rs = ((instr >> 3) & 0x7) as usize;
+        let rd = (instr & 0x7) as usize;
 
-        match op {
-            0 => { // LSL
-                let (result, carry) = Self::lsl_with_carry(self.regs[rs as usize], offset5, self.cpsr.c(), true);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-            }
-            1 => { // LSR
-                let (result, carry) = Self::lsr_with_carry(self.regs[rs as usize], offset5, self.cpsr.c(), true);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-            }
-            2 => { // ASR
-                let (result, carry) = Self::asr_with_carry(self.regs[rs as usize], offset5, self.cpsr.c(), true);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-            }
-            3 => { // ADD/SUB
-                let op2 = (instr >> 9) & 0x1; // 0=ADD, 1=SUB
-                let rm = (instr >> 6) & 0x7;
-                let rs_val = self.regs[rs as usize];
-                let rm_val = self.regs[rm as usize];
-
-                if op2 == 0 { // ADD
-                    let (result, carry, overflow) = Self::add_with_carry(rs_val, rm_val, false);
-                    self.regs[rd as usize] = result;
-                    self.cpsr.set_n((result >> 31) != 0);
-                    self.cpsr.set_z(result == 0);
-                    self.cpsr.set_c(carry);
-                    self.cpsr.set_v(overflow);
-                } else { // SUB
-                    let (result, carry, overflow) = Self::sub_with_borrow(rs_val, rm_val, true);
-                    self.regs[rd as usize] = result;
-                    self.cpsr.set_n((result >> 31) != 0);
-                    self.cpsr.set_z(result == 0);
-                    self.cpsr.set_c(carry);
-                    self.cpsr.set_v(overflow);
-                }
-            }
-            _ => {}
-        }
+        let (result, carry) = match op {
+            0 => Self::lsl_with_carry(self.regs[rs], offset5, self.cpsr.c(), true),
+            1 => Self::lsr_with_carry(self.regs[rs], offset5, self.cpsr.c(), true),
+            _ => Self::asr_with_carry(self.regs[rs], offset5, self.cpsr.c(), true),
+        };
+        self.regs[rd] = result;
+        self.cpsr.set_n((result >> 31) != 0);
+        self.cpsr.set_z(result == 0);
+        self.cpsr.set_c(carry);
     }
 
+    // Format 2: ADD/SUB rd, rs, rn or #imm3
     fn execute_thumb_add_subtract(&mut self, instr: u32) {
-        let op = (instr >> 9) & 0x1; // 0=ADD, 1=SUB
+        let immediate = (instr >> 10) & 0x1 == 1;
+        let sub = (instr >> 9) & 0x1 == 1;
         let rn = (instr >> 6) & 0x7;
-        let rs = (instr >> 3) & 0x7;
-        let rd = instr & 0x7;
+        let rs = ((instr >> 3) & 0x7) as usize;
+        let rd = (instr & 0x7) as usize;
 
-        let rs_val = self.regs[rs as usize];
-        let rn_val = self.regs[rn as usize];
-
-        if op == 0 { // ADD
-            let (result, carry, overflow) = Self::add_with_carry(rs_val, rn_val, false);
-            self.regs[rd as usize] = result;
-            self.cpsr.set_n((result >> 31) != 0);
-            self.cpsr.set_z(result == 0);
-            self.cpsr.set_c(carry);
-            self.cpsr.set_v(overflow);
-        } else { // SUB
-            let (result, carry, overflow) = Self::sub_with_borrow(rs_val, rn_val, true);
-            self.regs[rd as usize] = result;
-            self.cpsr.set_n((result >> 31) != 0);
-            self.cpsr.set_z(result == 0);
-            self.cpsr.set_c(carry);
-            self.cpsr.set_v(overflow);
-        }
+        let rs_val = self.regs[rs];
+        let operand = if immediate { rn } else { self.regs[rn as usize] };
+        let (result, carry, overflow) = if sub {
+            Self::sub_with_borrow(rs_val, operand, true)
+        } else {
+            Self::add_with_carry(rs_val, operand, false)
+        };
+        self.regs[rd] = result;
+        self.cpsr.set_n((result >> 31) != 0);
+        self.cpsr.set_z(result == 0);
+        self.cpsr.set_c(carry);
+        self.cpsr.set_v(overflow);
     }
 
     fn execute_thumb_move_compare_add_subtract_immediate(&mut self, instr: u32) {
@@ -1227,272 +1680,190 @@ impl Cpu {
         }
     }
 
+    // Format 4: every op sets N and Z; C and V only change where given
     fn execute_thumb_alu_operations(&mut self, instr: u32) {
         let op = (instr >> 6) & 0xF;
-        let rs = (instr >> 3) & 0x7;
-        let rd = instr & 0x7;
+        let rs = ((instr >> 3) & 0x7) as usize;
+        let rd = (instr & 0x7) as usize;
+
+        let rs_val = self.regs[rs];
+        let rd_val = self.regs[rd];
+        let c = self.cpsr.c();
+        let shift = rs_val & 0xFF;
+        let logical = |result: u32| (result, None, None);
+        let shifted = |(result, carry): (u32, bool)| (result, Some(carry), None);
+        let arithmetic = |(result, carry, overflow): (u32, bool, bool)| (result, Some(carry), Some(overflow));
+
+        let (result, carry, overflow) = match op {
+            0x0 | 0x8 => logical(rd_val & rs_val),                             // AND, TST
+            0x1 => logical(rd_val ^ rs_val),                                   // EOR
+            0x2 => shifted(Self::lsl_with_carry(rd_val, shift, c, false)),     // LSL
+            0x3 => shifted(Self::lsr_with_carry(rd_val, shift, c, false)),     // LSR
+            0x4 => shifted(Self::asr_with_carry(rd_val, shift, c, false)),     // ASR
+            0x5 => arithmetic(Self::add_with_carry(rd_val, rs_val, c)),        // ADC
+            0x6 => arithmetic(Self::sub_with_borrow(rd_val, rs_val, c)),       // SBC
+            0x7 => shifted(Self::ror_with_carry(rd_val, shift, c, false)),     // ROR
+            0x9 => arithmetic(Self::sub_with_borrow(0, rs_val, true)),         // NEG
+            0xA => arithmetic(Self::sub_with_borrow(rd_val, rs_val, true)),    // CMP
+            0xB => arithmetic(Self::add_with_carry(rd_val, rs_val, false)),    // CMN
+            0xC => logical(rd_val | rs_val),                                   // ORR
+            // ARM7TDMI leaves C unpredictable (kept as-is here) and never touches V
+            0xD => logical(rd_val.wrapping_mul(rs_val)),                       // MUL
+            0xE => logical(rd_val & !rs_val),                                  // BIC
+            _ => logical(!rs_val),                                             // MVN
+        };
+
+        if !matches!(op, 0x8 | 0xA | 0xB) {
+            self.regs[rd] = result;
+        }
+        self.cpsr.set_n((result >> 31) != 0);
+        self.cpsr.set_z(result == 0);
+        if let Some(carry) = carry {
+            self.cpsr.set_c(carry);
+        }
+        if let Some(overflow) = overflow {
+            self.cpsr.set_v(overflow);
+        }
+    }
 
-        let rs_val = self.regs[rs as usize];
-        let rd_val = self.regs[rd as usize];
+    // Format 5: only CMP sets flags. A PC written by ADD or MOV stays in Thumb
+    // state, halfword aligned.
+    fn execute_thumb_hi_register_operations_branch_exchange(&mut self, instr: u32) {
+        let op = (instr >> 8) & 0x3;
+        let h1 = (instr >> 7) & 0x1;
+        let h2 = (instr >> 6) & 0x1;
+        let rs = ((instr >> 3) & 0x7 | h2 << 3) as usize;
+        let rd = (instr & 0x7 | h1 << 3) as usize;
 
+        let rs_val = self.regs[rs];
+        let rd_val = self.regs[rd];
         match op {
-            0 => { // AND
-                let result = rd_val & rs_val;
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-            }
-            1 => { // EOR
-                let result = rd_val ^ rs_val;
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
+            0 | 2 => { // ADD, MOV
+                let result = if op == 0 { rd_val.wrapping_add(rs_val) } else { rs_val };
+                if rd == 15 {
+                    self.set_reg(15, result & !1);
+                } else {
+                    self.regs[rd] = result;
+                }
             }
-            2 => { // LSL
-                let shift = rs_val & 0xFF;
-                let (result, carry) = Self::lsl_with_carry(rd_val, shift, self.cpsr.c(), false);
-                self.regs[rd as usize] = result;
+            1 => { // CMP
+                let (result, carry, overflow) = Self::sub_with_borrow(rd_val, rs_val, true);
                 self.cpsr.set_n((result >> 31) != 0);
                 self.cpsr.set_z(result == 0);
                 self.cpsr.set_c(carry);
+                self.cpsr.set_v(overflow);
             }
-            3 => { // LSR
-                let shift = rs_val & 0xFF;
-                let (result, carry) = Self::lsr_with_carry(rd_val, shift, self.cpsr.c(), false);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
+            _ => { // BX; bit 0 selects the state and the PC is aligned for it
+                if (rs_val & 1) != 0 {
+                    self.set_reg(15, rs_val & !1);
+                } else {
+                    self.set_state(CpuState::Arm);
+                    self.set_reg(15, rs_val & !3);
+                }
             }
-            4 => { // ASR
-                let shift = rs_val & 0xFF;
-                let (result, carry) = Self::asr_with_carry(rd_val, shift, self.cpsr.c(), false);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
+        }
+    }
+
+    fn execute_thumb_pc_relative_load<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
+        let rd = (instr >> 8) & 0x7;
+        let imm8 = instr & 0xFF;
+
+        let pc = self.regs[15] & !3; // PC + 4, word aligned
+        let address = pc.wrapping_add(imm8 << 2);
+
+        self.regs[rd as usize] = bus.read32(address);
+    }
+
+    fn execute_thumb_load_store_register_offset<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
+        let op = (instr >> 10) & 0x3; // 00=STR, 01=STRB, 10=LDR, 11=LDRB
+        let ro = (instr >> 6) & 0x7;
+        let rb = (instr >> 3) & 0x7;
+        let rd = instr & 0x7;
+
+        let address = self.regs[rb as usize].wrapping_add(self.regs[ro as usize]);
+
+        match op {
+            0 => { // STR
+                let value = self.regs[rd as usize];
+                bus.write32(address & !3, value);
             }
-            5 => { // ADC
-                let (result, carry, overflow) = Self::add_with_carry(rd_val, rs_val, self.cpsr.c());
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-                self.cpsr.set_v(overflow);
+            1 => { // STRB
+                let value = self.regs[rd as usize] as u8;
+                bus.write8(address, value);
             }
-            6 => { // SBC
-                let (result, carry, overflow) = Self::sub_with_borrow(rd_val, rs_val, self.cpsr.c());
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-                self.cpsr.set_v(overflow);
+            2 => { // LDR
+                let value = bus.read32(address & !3).rotate_right((address & 3) * 8);
+                self.regs[rd as usize] = value;
             }
-            7 => { // ROR
-                let shift = rs_val & 0xFF;
-                let (result, carry) = Self::ror_with_carry(rd_val, shift, self.cpsr.c(), false);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-            }
-            8 => { // TST
-                let result = rd_val & rs_val;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-            }
-            9 => { // NEG
-                let (result, carry, overflow) = Self::sub_with_borrow(0, rs_val, true);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-                self.cpsr.set_v(overflow);
-            }
-            10 => { // CMP
-                let (result, carry, overflow) = Self::sub_with_borrow(rd_val, rs_val, true);
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-                self.cpsr.set_v(overflow);
-            }
-            11 => { // CMN
-                let (result, carry, overflow) = Self::add_with_carry(rd_val, rs_val, false);
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-                self.cpsr.set_v(overflow);
-            }
-            12 => { // ORR
-                let result = rd_val | rs_val;
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-            }
-            13 => { // MUL
-                let result = rd_val.wrapping_mul(rs_val);
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                // C and V are undefined for MUL in THUMB
-            }
-            14 => { // BIC
-                let result = rd_val & !rs_val;
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-            }
-            15 => { // MVN
-                let result = !rs_val;
-                self.regs[rd as usize] = result;
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-            }
-            _ => {}
-        }
-    }
-
-    fn execute_thumb_hi_register_operations_branch_exchange(&mut self, instr: u32) {
-        let op = (instr >> 8) & 0x3;
-        let h1 = (instr >> 7) & 0x1;
-        let h2 = (instr >> 6) & 0x1;
-        let rs = (instr >> 3) & 0x7;
-        let rd = instr & 0x7;
-
-        let rd_idx = if h1 == 1 { rd + 8 } else { rd } as usize;
-        let rs_idx = if h2 == 1 { rs + 8 } else { rs } as usize;
-
-        match op {
-            0 => { // ADD
-                let rd_val = self.regs[rd_idx];
-                let rs_val = self.regs[rs_idx];
-                let (result, carry, overflow) = Self::add_with_carry(rd_val, rs_val, false);
-                self.regs[rd_idx] = result;
-                if rd_idx < 8 { // Only set flags for low registers
-                    self.cpsr.set_n((result >> 31) != 0);
-                    self.cpsr.set_z(result == 0);
-                    self.cpsr.set_c(carry);
-                    self.cpsr.set_v(overflow);
-                }
-            }
-            1 => { // CMP
-                let rd_val = self.regs[rd_idx];
-                let rs_val = self.regs[rs_idx];
-                let (result, carry, overflow) = Self::sub_with_borrow(rd_val, rs_val, true);
-                self.cpsr.set_n((result >> 31) != 0);
-                self.cpsr.set_z(result == 0);
-                self.cpsr.set_c(carry);
-                self.cpsr.set_v(overflow);
-            }
-            2 => { // MOV
-                let rs_val = self.regs[rs_idx];
-                self.regs[rd_idx] = rs_val;
-                if rd_idx < 8 { // Only set flags for low registers
-                    self.cpsr.set_n((rs_val >> 31) != 0);
-                    self.cpsr.set_z(rs_val == 0);
-                }
-            }
-            3 => { // BX
-                let rs_val = self.regs[rs_idx];
-                let new_pc = rs_val & !1; // Clear bit 0
-                let new_state = if (rs_val & 1) != 0 { CpuState::Thumb } else { CpuState::Arm };
-
-                self.regs[15] = new_pc;
-                self.set_state(new_state);
-                // Pipeline flush will be handled by the step function
-            }
-            _ => {}
-        }
-    }
-
-    fn execute_thumb_pc_relative_load<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
-        let rd = (instr >> 8) & 0x7;
-        let imm8 = instr & 0xFF;
-
-        let pc = (self.regs[15] & !3) + 4; // PC + 4, word aligned
-        let address = pc + (imm8 << 2);
-
-        let value = bus.read32(address & !3);
-        self.regs[rd as usize] = value;
-    }
-
-    fn execute_thumb_load_store_register_offset<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
-        let op = (instr >> 10) & 0x3; // 00=STR, 01=STRH, 10=STRB, 11=LDRSB
-        let ro = (instr >> 6) & 0x7;
-        let rb = (instr >> 3) & 0x7;
-        let rd = instr & 0x7;
-
-        let rb_val = self.regs[rb as usize];
-        let ro_val = self.regs[ro as usize];
-        let address = rb_val + ro_val;
-
-        match op {
-            0 => { // STR
-                let value = self.regs[rd as usize];
-                bus.write32(address & !3, value);
-            }
-            1 => { // STRH
-                let value = self.regs[rd as usize] as u16;
-                bus.write16(address & !1, value);
-            }
-            2 => { // STRB
-                let value = self.regs[rd as usize] as u8;
-                bus.write8(address, value);
-            }
-            3 => { // LDRSB
-                let value = bus.read8(address) as i8 as i32 as u32;
+            3 => { // LDRB
+                let value = bus.read8(address) as u32;
                 self.regs[rd as usize] = value;
             }
             _ => {}
         }
     }
 
+    // Format 8: bit 11 is H, bit 10 is S
     fn execute_thumb_load_store_sign_extended<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
-        let op = (instr >> 10) & 0x3; // 00=LDRH, 01=LDSB, 10=LDRB, 11=LDSH
+        let op = (instr >> 10) & 0x3; // 00=STRH, 01=LDSB, 10=LDRH, 11=LDSH
         let ro = (instr >> 6) & 0x7;
         let rb = (instr >> 3) & 0x7;
         let rd = instr & 0x7;
 
-        let rb_val = self.regs[rb as usize];
-        let ro_val = self.regs[ro as usize];
-        let address = rb_val + ro_val;
+        let address = self.regs[rb as usize].wrapping_add(self.regs[ro as usize]);
 
         match op {
-            0 => { // LDRH
-                let value = bus.read16(address & !1) as u32;
-                self.regs[rd as usize] = value;
+            0 => { // STRH
+                let value = self.regs[rd as usize] as u16;
+                bus.write16(address & !1, value);
             }
             1 => { // LDSB (LDRSB)
                 let value = bus.read8(address) as i8 as i32 as u32;
                 self.regs[rd as usize] = value;
             }
-            2 => { // LDRB
-                let value = bus.read8(address) as u32;
+            2 => { // LDRH
+                let value = (bus.read16(address & !1) as u32).rotate_right((address & 1) * 8);
                 self.regs[rd as usize] = value;
             }
             3 => { // LDSH (LDRSH)
-                let value = bus.read16(address & !1) as i16 as i32 as u32;
+                // A misaligned LDSH only loads the addressed byte
+                let value = if address & 1 != 0 {
+                    bus.read8(address) as i8 as i32 as u32
+                } else {
+                    bus.read16(address) as i16 as i32 as u32
+                };
                 self.regs[rd as usize] = value;
             }
             _ => {}
         }
     }
 
+    // Format 9: bit 12 is B, bit 11 is L. Word offsets are scaled by 4, byte offsets are not.
     fn execute_thumb_load_store_immediate_offset<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
-        let op = (instr >> 11) & 0x1; // 0=STR, 1=LDR
+        let op = (instr >> 11) & 0x3; // 00=STR, 01=LDR, 10=STRB, 11=LDRB
         let imm5 = (instr >> 6) & 0x1F;
         let rb = (instr >> 3) & 0x7;
         let rd = instr & 0x7;
 
         let rb_val = self.regs[rb as usize];
-        let address = rb_val + (imm5 << 2);
 
-        if op == 0 { // STR
-            let value = self.regs[rd as usize];
-            bus.write32(address & !3, value);
-        } else { // LDR
-            let value = bus.read32(address & !3);
-            self.regs[rd as usize] = value;
+        match op {
+            0 => { // STR
+                let address = rb_val.wrapping_add(imm5 << 2);
+                bus.write32(address & !3, self.regs[rd as usize]);
+            }
+            1 => { // LDR
+                let address = rb_val.wrapping_add(imm5 << 2);
+                let value = bus.read32(address & !3).rotate_right((address & 3) * 8);
+                self.regs[rd as usize] = value;
+            }
+            2 => { // STRB
+                bus.write8(rb_val.wrapping_add(imm5), self.regs[rd as usize] as u8);
+            }
+            3 => { // LDRB
+                self.regs[rd as usize] = bus.read8(rb_val.wrapping_add(imm5)) as u32;
+            }
+            _ => {}
         }
     }
 
@@ -1503,13 +1874,13 @@ impl Cpu {
         let rd = instr & 0x7;
 
         let rb_val = self.regs[rb as usize];
-        let address = rb_val + (imm5 << 1);
+        let address = rb_val.wrapping_add(imm5 << 1);
 
         if op == 0 { // STRH
             let value = self.regs[rd as usize] as u16;
             bus.write16(address & !1, value);
         } else { // LDRH
-            let value = bus.read16(address & !1) as u32;
+            let value = (bus.read16(address & !1) as u32).rotate_right((address & 1) * 8);
             self.regs[rd as usize] = value;
         }
     }
@@ -1520,13 +1891,13 @@ impl Cpu {
         let imm8 = instr & 0xFF;
 
         let sp = self.regs[13];
-        let address = sp + (imm8 << 2);
+        let address = sp.wrapping_add(imm8 << 2);
 
         if op == 0 { // STR
             let value = self.regs[rd as usize];
             bus.write32(address & !3, value);
         } else { // LDR
-            let value = bus.read32(address & !3);
+            let value = bus.read32(address & !3).rotate_right((address & 3) * 8);
             self.regs[rd as usize] = value;
         }
     }
@@ -1537,7 +1908,7 @@ impl Cpu {
         let imm8 = instr & 0xFF;
 
         if sp == 0 { // ADD to PC
-            let pc = (self.regs[15] & !3) + 4; // PC + 4, word aligned
+            let pc = self.regs[15] & !3; // PC + 4, word aligned
             let address = pc + (imm8 << 2);
             self.regs[rd as usize] = address;
         } else { // ADD to SP
@@ -1565,25 +1936,32 @@ impl Cpu {
         let l = (instr >> 11) & 0x1; // 0=PUSH, 1=POP
         let r = (instr >> 8) & 0x1; // 0=no PC/LR, 1=include PC/LR
         let reg_list = instr & 0xFF;
-
         let sp = self.regs[13];
 
-        if l == 0 { // PUSH
-            let mut count = 0;
-            for i in 0..8 {
-                if (reg_list >> i) & 1 == 1 {
-                    count += 1;
-                }
+        // An empty list (not produced by assemblers) transfers PC and moves SP by 0x40
+        if reg_list == 0 && r == 0 {
+            if l == 0 {
+                let addr = sp.wrapping_sub(0x40);
+                bus.write32(addr & !3, self.regs[15].wrapping_add(2));
+                self.regs[13] = addr;
+            } else {
+                let value = bus.read32(sp & !3);
+                self.set_reg(15, value & !1);
+                self.regs[13] = sp.wrapping_add(0x40);
             }
-            if r == 1 { count += 1; } // LR
+            return;
+        }
 
-            let start_addr = sp - (count << 2);
+        // Full descending stack: the lowest register always sits at the lowest address
+        let count = reg_list.count_ones() + r;
+        if l == 0 { // PUSH
+            let start_addr = sp.wrapping_sub(count << 2);
             let mut addr = start_addr;
 
             for i in 0..8 {
                 if (reg_list >> i) & 1 == 1 {
                     bus.write32(addr & !3, self.regs[i]);
-                    addr += 4;
+                    addr = addr.wrapping_add(4);
                 }
             }
             if r == 1 { // LR
@@ -1596,18 +1974,17 @@ impl Cpu {
 
             for i in 0..8 {
                 if (reg_list >> i) & 1 == 1 {
-                    let value = bus.read32(addr & !3);
-                    self.regs[i] = value;
-                    addr += 4;
+                    self.regs[i] = bus.read32(addr & !3);
+                    addr = addr.wrapping_add(4);
                 }
             }
             if r == 1 { // PC
+                // ARMv4T ignores bit 0 and stays in Thumb; only ARMv5 interworks here
                 let value = bus.read32(addr & !3);
-                self.regs[15] = value;
-                // Pipeline flush will be handled by the step function
+                self.set_reg(15, value & !1);
             }
 
-            self.regs[13] = addr;
+            self.regs[13] = sp.wrapping_add(count << 2);
         }
     }
 
@@ -1645,188 +2022,168 @@ impl Cpu {
 
         if self.condition_passed(cond) {
             let offset = ((imm8 as i8) as i32) << 1;
-            let pc = self.regs[15]; // PC is already advanced by 2, so this is PC+2
-            self.regs[15] = (pc as i32 + offset) as u32;
+            let pc = self.regs[15]; // PC + 4
+            self.set_reg(15, (pc as i32 + offset) as u32);
             // Pipeline flush will be handled by the step function
         }
     }
 
+    // Format 17: 11011111 comment. Handlers find the comment at LR - 2.
     fn execute_thumb_software_interrupt<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
         let swi_num = (instr & 0xFF) as u8;
         self.handle_swi(bus, swi_num);
     }
 
-    #[allow(dead_code)]
     fn execute_thumb_unconditional_branch<B: BusAccess>(&mut self, _bus: &mut B, instr: u32) {
         let imm11 = instr & 0x7FF;
         let offset = ((imm11 as i16) << 5) >> 4; // Sign extend 11-bit to 16-bit, then to 32-bit
-        let pc = self.regs[15] - 2; // PC is already advanced by 2
-        self.regs[15] = (pc as i32 + offset as i32) as u32;
+        let pc = self.regs[15]; // PC + 4
+        self.set_reg(15, (pc as i32 + offset as i32) as u32);
         // Pipeline flush will be handled by the step function
     }
 
-    #[allow(dead_code)]
     fn execute_thumb_long_branch_with_link<B: BusAccess>(&mut self, _bus: &mut B, instr: u32) {
         let h = (instr >> 11) & 0x1;
         let imm11 = instr & 0x7FF;
 
-        if h == 0 { // First instruction
-            let offset = ((imm11 as i16) << 5) >> 4; // Sign extend
-            let pc = self.regs[15] - 2;
-            self.regs[14] = pc.wrapping_add(offset as u32);
-        } else { // Second instruction
-            let offset = ((imm11 as i16) << 5) >> 4; // Sign extend
+        if h == 0 { // First instruction: sign-extended upper offset bits, scaled by 4096
+            let offset = ((imm11 << 21) as i32 >> 9) as u32;
+            let pc = self.regs[15]; // PC + 4
+            self.regs[14] = pc.wrapping_add(offset);
+        } else { // Second instruction: unsigned lower offset bits, in halfwords
+            let offset = imm11 << 1;
             let lr = self.regs[14];
-            let pc = self.regs[15] - 2;
-            let new_pc = lr.wrapping_add(offset as u32);
+            let next_instr = self.regs[15].wrapping_sub(2);
+            let new_pc = lr.wrapping_add(offset);
 
-            self.regs[14] = pc | 1; // Set bit 0 to indicate THUMB return
-            self.regs[15] = new_pc;
+            self.regs[14] = next_instr | 1; // Set bit 0 to indicate THUMB return
+            self.set_reg(15, new_pc);
             // Pipeline flush will be handled by the step function
         }
     }
 
     fn execute_thumb_instruction<B: BusAccess>(&mut self, bus: &mut B, instr: u32) {
-        let opcode = (instr >> 11) & 0x1F;
-
-        match opcode {
-            0x00..=0x07 => {
-                self.execute_thumb_move_shifted_register(instr);
-            }
-            0x08..=0x0F => {
-                self.execute_thumb_add_subtract(instr);
-            }
-            0x10..=0x11 => {
-                self.execute_thumb_move_compare_add_subtract_immediate(instr);
-            }
-            0x12..=0x13 => {
-                self.execute_thumb_alu_operations(instr);
-            }
-            0x14..=0x15 => {
-                self.execute_thumb_hi_register_operations_branch_exchange(instr);
-            }
-            0x16..=0x17 => {
-                self.execute_thumb_pc_relative_load(bus, instr);
-            }
-            0x18..=0x19 => {
-                self.execute_thumb_load_store_register_offset(bus, instr);
-            }
-            0x1B => {
-                let cond = (instr >> 8) & 0xF;
-                if cond == 0xF {
-                    self.execute_thumb_software_interrupt(bus, instr);
-                } else {
-                    self.execute_thumb_load_store_sign_extended(bus, instr);
-                }
-            }
-            0x1C..=0x1D => {
-                self.execute_thumb_load_store_immediate_offset(bus, instr);
-            }
-            0x1E..=0x1F => {
-                self.execute_thumb_load_store_halfword(bus, instr);
-            }
-            0x20..=0x21 => {
-                self.execute_thumb_sp_relative_load_store(bus, instr);
-            }
-            0x22..=0x23 => {
-                self.execute_thumb_load_address(instr);
-            }
-            0x24..=0x25 => {
-                self.execute_thumb_add_offset_to_sp(instr);
-            }
-            0x26..=0x27 => {
-                self.execute_thumb_push_pop_registers(bus, instr);
-            }
-            0x28..=0x2F => {
-                self.execute_thumb_multiple_load_store(bus, instr);
-            }
-            0x1A => {
-                self.execute_thumb_conditional_branch(bus, instr);
-            }
-            _ => {}
+        match ThumbFormat::decode(instr as u16) {
+            ThumbFormat::MoveShiftedRegister => self.execute_thumb_move_shifted_register(instr),
+            ThumbFormat::AddSubtract => self.execute_thumb_add_subtract(instr),
+            ThumbFormat::MoveCompareAddSubtractImmediate => self.execute_thumb_move_compare_add_subtract_immediate(instr),
+            ThumbFormat::AluOperation => self.execute_thumb_alu_operations(instr),
+            ThumbFormat::HiRegisterOperationBranchExchange => self.execute_thumb_hi_register_operations_branch_exchange(instr),
+            ThumbFormat::PcRelativeLoad => self.execute_thumb_pc_relative_load(bus, instr),
+            ThumbFormat::LoadStoreRegisterOffset => self.execute_thumb_load_store_register_offset(bus, instr),
+            ThumbFormat::LoadStoreSignExtended => self.execute_thumb_load_store_sign_extended(bus, instr),
+            ThumbFormat::LoadStoreImmediateOffset => self.execute_thumb_load_store_immediate_offset(bus, instr),
+            ThumbFormat::LoadStoreHalfword => self.execute_thumb_load_store_halfword(bus, instr),
+            ThumbFormat::SpRelativeLoadStore => self.execute_thumb_sp_relative_load_store(bus, instr),
+            ThumbFormat::LoadAddress => self.execute_thumb_load_address(instr),
+            ThumbFormat::AddOffsetToSp => self.execute_thumb_add_offset_to_sp(instr),
+            ThumbFormat::PushPopRegisters => self.execute_thumb_push_pop_registers(bus, instr),
+            ThumbFormat::MultipleLoadStore => self.execute_thumb_multiple_load_store(bus, instr),
+            ThumbFormat::ConditionalBranch => self.execute_thumb_conditional_branch(bus, instr),
+            ThumbFormat::SoftwareInterrupt => self.execute_thumb_software_interrupt(bus, instr),
+            ThumbFormat::UnconditionalBranch => self.execute_thumb_unconditional_branch(bus, instr),
+            ThumbFormat::LongBranchWithLink => self.execute_thumb_long_branch_with_link(bus, instr),
+            ThumbFormat::Undefined => self.undefined_instruction(bus, instr),
         }
     }
 
     pub fn step<B: BusAccess>(&mut self, bus: &mut B) {
+        // Pending exceptions are taken before the next instruction executes; an
+        // undefined or SWI instruction there simply runs again after the handler returns
+        if let Some(exception) = self.resolve_exception() {
+            self.clear_exception(exception);
+            if exception.priority() < Exception::PrefetchAbort.priority() {
+                self.clear_exception(Exception::PrefetchAbort);
+                self.clear_exception(Exception::Undefined);
+                self.clear_exception(Exception::Swi);
+            }
+            self.enter_exception(bus, exception);
+            return;
+        }
+
         match self.state() {
             CpuState::Arm => {
                 if !self.arm_pipe.valid { self.reset_pipeline(bus); }
+                self.cycles += 1;
                 let instr = self.arm_pipe.decode;
-                let next_pc = (self.pc() & !3).wrapping_add(4);
-                let new_decode = self.arm_pipe.fetch;
-                let new_fetch = bus.read32(next_pc.wrapping_add(4));
-                self.arm_pipe.decode = new_decode;
-                self.arm_pipe.fetch = new_fetch;
-                self.regs[15] = next_pc;
-
-                let top2 = (instr >> 26) & 0x3;
-                let top3 = (instr >> 25) & 0x7;
-                if ((instr >> 22) & 0x3F) == 0 && ((instr >> 4) & 0xF) == 0b1001 {
-                    let before_pc = self.pc();
-                    self.execute_arm_multiply(instr);
-                    if self.pc() != before_pc { self.flush_pipeline(bus); }
-                } else if ((instr >> 23) & 0x1F) == 0b00001 && ((instr >> 4) & 0xF) == 0b1001 {
-                    // UMULL/UMLAL/SMULL/SMLAL
-                    self.execute_arm_multiply_long(instr);
-                } else if (((instr >> 23) & 0x1F) == 0b00010) && (((instr >> 21) & 0x3) == 0) && (((instr >> 4) & 0xF) == 0b1001) {
-                    self.execute_arm_swp(bus, instr);
-                } else if (instr & 0x0FBF0FFF) == 0x010F0000
-                    || (instr & 0x0FBFF000) == 0x0320F000
-                    || (instr & 0x0FBFF000) == 0x0120F000
-                {
-                    self.execute_arm_psr_transfer(instr);
-                } else if (instr & 0x0E400090) == 0x00400090 && (((instr >> 4) & 0xF) != 0b1001) {
-                    self.execute_arm_halfword_transfer(bus, instr);
-                } else if top3 == 0b100 {
-                    self.execute_arm_block_transfer(bus, instr);
-                } else if top2 == 0 {
-                    let before_pc = self.pc();
-                    self.execute_arm_data_processing(instr);
-                    if self.pc() != before_pc { self.flush_pipeline(bus); }
-                } else if top3 == 0b101 {
-                    let cond = (instr >> 28) & 0xF;
-                    if self.condition_passed(cond) {
-                        let l = ((instr >> 24) & 1) != 0;
-                        let imm24 = instr & 0x00FF_FFFF;
-                        let offset = (((imm24 as i32) << 8) >> 6) as u32;
-                        let base = next_pc.wrapping_add(4);
-                        if l { self.regs[14] = base.wrapping_sub(4); }
-                        self.regs[15] = base.wrapping_add(offset);
-                        self.flush_pipeline(bus);
-                    }
-                } else if top2 == 0b01 {
-                    self.execute_arm_single_data_transfer(bus, instr);
-                } else if (instr >> 24) & 0xF == 0xF {
-                    let cond = (instr >> 28) & 0xF;
-                    if self.condition_passed(cond) {
-                        let swi_num = (instr & 0xFF) as u8;
-                        self.handle_swi(bus, swi_num);
-                    }
+                let instr_addr = self.pc() & !3;
+                // While executing, R15 holds the fetch address: instruction + 8
+                let exec_pc = instr_addr.wrapping_add(8);
+                self.arm_pipe.decode = self.arm_pipe.fetch;
+                self.arm_pipe.fetch = bus.read32(exec_pc);
+                self.regs[15] = exec_pc;
+                self.pc_written = false;
+
+                trace_cpu!("{:#010x}: {:08x}", instr_addr, instr);
+                self.execute_arm_instruction(bus, instr);
+
+                if self.pc_written {
+                    self.flush_pipeline(bus);
+                } else {
+                    self.regs[15] = instr_addr.wrapping_add(4);
                 }
             }
             CpuState::Thumb => {
                 if !self.thumb_pipe.valid { self.reset_pipeline(bus); }
                 let instr = self.thumb_pipe.decode as u32;
-                let current_pc = self.pc();
-                let next_pc = (current_pc & !1).wrapping_add(2);
-                let new_decode = self.thumb_pipe.fetch as u32;
-                let new_fetch = bus.read16(next_pc.wrapping_add(2)) as u32;
-                self.thumb_pipe.decode = new_decode as u16;
-                self.thumb_pipe.fetch = new_fetch as u16;
-                self.regs[15] = next_pc;
-
+                let instr_addr = self.pc() & !1;
+                // While executing, R15 holds the fetch address: instruction + 4
+                let exec_pc = instr_addr.wrapping_add(4);
+                self.thumb_pipe.decode = self.thumb_pipe.fetch;
+                self.thumb_pipe.fetch = bus.read16(exec_pc);
+                self.regs[15] = exec_pc;
+                self.pc_written = false;
+
+                let mut cycles = self.thumb_instruction_cycles(instr);
+                trace_cpu!("{:#010x}: {:04x}", instr_addr, instr);
                 self.execute_thumb_instruction(bus, instr);
-                if self.pc() != next_pc {
+                if self.pc_written {
                     self.flush_pipeline(bus);
+                    cycles += 2; // 1S + 1N refill
+                } else {
+                    self.regs[15] = instr_addr.wrapping_add(2);
                 }
+                self.cycles += cycles as u64;
             }
         }
     }
+
+    /// Executes a single ARM `opcode` as if it were fetched from the current PC,
+    /// without touching the pipeline or reading the instruction from memory.
+    pub fn execute_raw<B: BusAccess>(&mut self, bus: &mut B, opcode: u32) {
+        let instr_addr = self.pc() & !3;
+        self.regs[15] = instr_addr.wrapping_add(8);
+        self.pc_written = false;
+        self.execute_arm_instruction(bus, opcode);
+        self.finish_raw(bus, instr_addr.wrapping_add(4));
+    }
+
+    /// Thumb counterpart of [`Cpu::execute_raw`].
+    pub fn execute_raw_thumb<B: BusAccess>(&mut self, bus: &mut B, opcode: u16) {
+        let instr_addr = self.pc() & !1;
+        self.regs[15] = instr_addr.wrapping_add(4);
+        self.pc_written = false;
+        self.execute_thumb_instruction(bus, opcode as u32);
+        self.finish_raw(bus, instr_addr.wrapping_add(2));
+    }
+
+    // The pipeline no longer matches the PC after a raw instruction, so the next
+    // step refetches unless a branch already refilled it
+    fn finish_raw<B: BusAccess>(&mut self, bus: &mut B, next_pc: u32) {
+        if self.pc_written {
+            self.flush_pipeline(bus);
+        } else {
+            self.regs[15] = next_pc;
+            self.arm_pipe.valid = false;
+            self.thumb_pipe.valid = false;
+        }
+    }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::asm;
 
     struct MockBus { mem: Vec<u8> }
     impl MockBus {
@@ -1907,7 +2264,8 @@ mod tests {
         cpu.set_state(CpuState::Thumb);
         let mut bus = MockBus::new(64);
         bus.mem[0] = 0x00;
-        bus.mem[1] = 0xB5; // push {lr} example encoding upper byte pattern, unused
+        bus.mem[1] = 0xB5; // push {lr}
+        cpu.write_reg(13, 0x40);
         cpu.set_pc(0);
         cpu.step(&mut bus);
         assert_eq!(cpu.pc(), 2);
@@ -1921,7 +2279,7 @@ mod tests {
 
         // MOV r1, #0x42 (Format 3: Move/Compare/Add/Subtract Immediate)
         // op=00 (MOV), rd=1, imm8=0x42
-        let mov_instr = (0x10 << 11) | (1 << 8) | 0x42;
+        let mov_instr = (0b00100 << 11) | (1 << 8) | 0x42;
         bus.write16(0, mov_instr as u16);
 
         cpu.set_pc(0);
@@ -1942,7 +2300,7 @@ mod tests {
 
         // ADD r1, r1, #0x20 (Format 3: Move/Compare/Add/Subtract Immediate)
         // op=10 (ADD), rd=1, imm8=0x20
-        let add_instr = (0x10 << 11) | (2 << 10) | (1 << 8) | 0x20;
+        let add_instr = (0b00100 << 11) | (2 << 10) | (1 << 8) | 0x20;
         bus.write16(0, add_instr as u16);
 
         cpu.set_pc(0);
@@ -1986,7 +2344,7 @@ mod tests {
 
         // LDR r1, [r0, #8] (Format 9: Load/Store with Immediate Offset)
         // op=1 (LDR), imm5=2, rb=0, rd=1
-        let ldr_instr = (0x1D << 11) | (2 << 6) | (0 << 3) | 1;
+        let ldr_instr = (0b01101 << 11) | (2 << 6) | (0 << 3) | 1;
         bus.write16(0, ldr_instr as u16);
 
         cpu.set_pc(0);
@@ -2005,7 +2363,7 @@ mod tests {
 
         // BX r0 (Format 5: Hi Register Operations/Branch Exchange)
         // op=3 (BX), h1=0, h2=0, rs=0, rd=0
-        let bx_instr = (0x15 << 11) | (3 << 8) | (0 << 7) | (0 << 6) | (0 << 3) | 0;
+        let bx_instr = (0b010001 << 10) | (3 << 8) | (0 << 7) | (0 << 6) | (0 << 3) | 0;
         bus.write16(0, bx_instr as u16);
 
         cpu.set_pc(0);
@@ -2030,8 +2388,8 @@ mod tests {
 
         cpu.set_pc(0);
         cpu.step(&mut bus);
-        // PC should be 0 + 2 (advance) + 4*2 (offset) = 10
-        assert_eq!(cpu.pc(), 10);
+        // PC should be 0 + 4 (pipeline) + 4*2 (offset) = 12
+        assert_eq!(cpu.pc(), 12);
     }
 
     #[test]
@@ -2367,6 +2725,94 @@ mod tests {
         assert!(!cpu.cpsr().z());
     }
 
+    #[test]
+    fn arm_mul_flags_and_invalid_registers() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        cpu.set_strict_mode(true);
+
+        cpu.write_reg(0, 0x8000_0000);
+        cpu.write_reg(1, 2);
+        cpu.cpsr_mut().set_c(true);
+        cpu.cpsr_mut().set_v(true);
+        cpu.execute_raw(&mut bus, asm::arm("muls r2, r0, r1"));
+        assert_eq!(cpu.read_reg(2), 0);
+        assert!(cpu.cpsr().z() && !cpu.cpsr().n());
+        assert!(cpu.cpsr().c() && cpu.cpsr().v(), "C and V are left alone");
+
+        cpu.write_reg(0, 0xFFFF_FFFF);
+        cpu.write_reg(3, 0);
+        cpu.execute_raw(&mut bus, asm::arm("mlas r2, r0, r1, r3"));
+        assert_eq!(cpu.read_reg(2), 0xFFFF_FFFE);
+        assert!(cpu.cpsr().n() && !cpu.cpsr().z());
+
+        // Without S the flags stay put
+        cpu.write_reg(0, 0);
+        cpu.execute_raw(&mut bus, asm::arm("mul r2, r0, r1"));
+        assert!(!cpu.cpsr().z());
+        assert!(cpu.strict_violations().is_empty());
+
+        cpu.set_pc(0x40);
+        cpu.execute_raw(&mut bus, asm::arm("mul pc, r0, r1"));
+        assert_eq!(cpu.pc(), 0x44, "r15 is not written");
+        cpu.execute_raw(&mut bus, asm::arm("mul r1, r1, r0"));
+        assert_eq!(cpu.strict_violations().len(), 2);
+    }
+
+    #[test]
+    fn arm_long_multiply_flags_use_all_64_bits() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+
+        // 0x80000000 * 2: the low word is zero but the result is not
+        cpu.write_reg(2, 0x8000_0000);
+        cpu.write_reg(3, 2);
+        cpu.execute_raw(&mut bus, asm::arm("umulls r0, r1, r2, r3"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0, 1));
+        assert!(!cpu.cpsr().z() && !cpu.cpsr().n());
+
+        // Signed: -0x80000000 * 2 is negative
+        cpu.execute_raw(&mut bus, asm::arm("smulls r0, r1, r2, r3"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0, 0xFFFF_FFFF));
+        assert!(cpu.cpsr().n() && !cpu.cpsr().z());
+
+        // Accumulating -1 * 1 onto 1 lands exactly on zero
+        cpu.write_reg(0, 1);
+        cpu.write_reg(1, 0);
+        cpu.write_reg(2, 0xFFFF_FFFF);
+        cpu.write_reg(3, 1);
+        cpu.execute_raw(&mut bus, asm::arm("smlals r0, r1, r2, r3"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0, 0));
+        assert!(cpu.cpsr().z() && !cpu.cpsr().n());
+
+        // Unsigned accumulate carries into the high word
+        cpu.write_reg(0, 0xFFFF_FFFF);
+        cpu.write_reg(1, 0x7FFF_FFFF);
+        cpu.execute_raw(&mut bus, asm::arm("umlals r0, r1, r2, r3"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0xFFFF_FFFE, 0x8000_0000));
+        assert!(cpu.cpsr().n() && !cpu.cpsr().z());
+
+        // Without S the flags are left alone
+        cpu.execute_raw(&mut bus, asm::arm("umull r0, r1, r3, r3"));
+        assert!(cpu.cpsr().n());
+
+        // The accumulator wraps to zero: Z reflects the 64 bits written, not the carry out
+        cpu.write_reg(0, 0xFFFF_FFFF);
+        cpu.write_reg(1, 0xFFFF_FFFF);
+        cpu.write_reg(2, 1);
+        cpu.write_reg(3, 1);
+        cpu.execute_raw(&mut bus, asm::arm("smlals r0, r1, r2, r3"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0, 0));
+        assert!(cpu.cpsr().z() && !cpu.cpsr().n());
+
+        // An unsigned sum of exactly 2^64
+        cpu.write_reg(0, 0xFFFF_FFFF);
+        cpu.write_reg(1, 0xFFFF_FFFF);
+        cpu.execute_raw(&mut bus, asm::arm("umlals r0, r1, r2, r3"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0, 0));
+        assert!(cpu.cpsr().z() && !cpu.cpsr().n());
+    }
+
     #[test]
     fn arm_umull_smull_and_umlal_smlal() {
         let mut cpu = Cpu::new();
@@ -2467,6 +2913,145 @@ mod tests {
         assert_eq!(stored, 0xDDAA_BBCC);
     }
 
+    #[test]
+    fn arm_ldr_str_shifted_register_offsets() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        for i in 0..8 {
+            write32_le(&mut bus.mem, 0x80 + i * 4, 0x100 + i as u32);
+        }
+
+        cpu.write_reg(1, 0x80);
+        cpu.write_reg(2, 3);
+        cpu.execute_raw(&mut bus, asm::arm("ldr r0, [r1, r2, lsl #2]"));
+        assert_eq!(cpu.read_reg(0), 0x103);
+        assert_eq!(cpu.read_reg(1), 0x80, "no writeback");
+
+        // Subtracted and shifted right: 0x98 - (0x20 >> 2)
+        cpu.write_reg(1, 0x98);
+        cpu.write_reg(2, 0x20);
+        cpu.execute_raw(&mut bus, asm::arm("ldr r0, [r1, -r2, lsr #2]"));
+        assert_eq!(cpu.read_reg(0), 0x104);
+
+        // Post-indexed: the access uses the base, then the base moves by r2 * 4
+        cpu.write_reg(1, 0x84);
+        cpu.write_reg(2, 2);
+        cpu.execute_raw(&mut bus, asm::arm("ldr r0, [r1], r2, lsl #2"));
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (0x101, 0x8C));
+        cpu.write_reg(3, 0xDEAD_BEEF);
+        cpu.execute_raw(&mut bus, asm::arm("str r3, [r1], -r2, lsl #2"));
+        assert_eq!(bus.read32(0x8C), 0xDEAD_BEEF);
+        assert_eq!(cpu.read_reg(1), 0x84);
+
+        // ASR #32 is encoded as ASR #0: a negative index becomes -1
+        cpu.write_reg(1, 0x90);
+        cpu.write_reg(2, 0x8000_0000);
+        cpu.execute_raw(&mut bus, asm::arm("ldrb r0, [r1, r2, asr #32]"));
+        assert_eq!(cpu.read_reg(0), bus.read8(0x8F) as u32);
+    }
+
+    #[test]
+    fn arm_ldr_rotates_for_each_alignment() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        write32_le(&mut bus.mem, 0x80, 0x1122_3344);
+        write32_le(&mut bus.mem, 0x84, 0xFFFF_FFFF);
+
+        let expected = [0x1122_3344, 0x4411_2233, 0x3344_1122, 0x2233_4411];
+        for (offset, want) in expected.into_iter().enumerate() {
+            cpu.write_reg(0, 0x80 + offset as u32);
+            cpu.execute_raw(&mut bus, asm::arm("ldr r1, [r0]"));
+            assert_eq!(cpu.read_reg(1), want, "offset {}", offset);
+            // Byte loads are never rotated
+            cpu.execute_raw(&mut bus, asm::arm("ldrb r2, [r0]"));
+            assert_eq!(cpu.read_reg(2), [0x44, 0x33, 0x22, 0x11][offset]);
+        }
+    }
+
+    #[test]
+    fn arm_halfword_loads_extend_and_index() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        write32_le(&mut bus.mem, 0x80, 0x80F1_7FFE);
+
+        cpu.write_reg(0, 0x80);
+        cpu.execute_raw(&mut bus, asm::arm("ldrsb r1, [r0, #1]"));
+        assert_eq!(cpu.read_reg(1), 0x0000_007F);
+        cpu.execute_raw(&mut bus, asm::arm("ldrsb r1, [r0, #3]"));
+        assert_eq!(cpu.read_reg(1), 0xFFFF_FF80);
+        cpu.execute_raw(&mut bus, asm::arm("ldrsh r1, [r0, #2]"));
+        assert_eq!(cpu.read_reg(1), 0xFFFF_80F1);
+        cpu.execute_raw(&mut bus, asm::arm("ldrh r1, [r0, #2]"));
+        assert_eq!(cpu.read_reg(1), 0x0000_80F1);
+
+        // Misaligned: LDRH rotates, LDRSH degrades to a signed byte load
+        cpu.execute_raw(&mut bus, asm::arm("ldrh r1, [r0, #1]"));
+        assert_eq!(cpu.read_reg(1), 0xFE00_007F);
+        cpu.execute_raw(&mut bus, asm::arm("ldrsh r1, [r0, #3]"));
+        assert_eq!(cpu.read_reg(1), 0xFFFF_FF80);
+
+        // Register offset, pre-index with writeback, then post-index
+        cpu.write_reg(2, 2);
+        cpu.write_reg(3, 0xBEEF);
+        cpu.execute_raw(&mut bus, asm::arm("strh r3, [r0, r2]!"));
+        assert_eq!(cpu.read_reg(0), 0x82);
+        assert_eq!(bus.read16(0x82), 0xBEEF);
+        cpu.execute_raw(&mut bus, asm::arm("ldrh r4, [r0], #-2"));
+        assert_eq!(cpu.read_reg(4), 0xBEEF);
+        assert_eq!(cpu.read_reg(0), 0x80);
+    }
+
+    #[test]
+    fn misaligned_word_loads_rotate_in_swp_and_thumb() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let expected = [0x1122_3344, 0x4411_2233, 0x3344_1122, 0x2233_4411];
+
+        for (offset, want) in expected.into_iter().enumerate() {
+            write32_le(&mut bus.mem, 0x80, 0x1122_3344);
+            cpu.write_reg(0, 0x80 + offset as u32);
+            cpu.write_reg(2, 0xAABB_CCDD);
+            cpu.execute_raw(&mut bus, asm::arm("swp r1, r2, [r0]"));
+            assert_eq!(cpu.read_reg(1), want, "swp offset {}", offset);
+            assert_eq!(bus.read32(0x80), 0xAABB_CCDD, "the store is word aligned");
+
+            write32_le(&mut bus.mem, 0x80, 0x1122_3344);
+            cpu.write_reg(0, 0x80);
+            cpu.write_reg(1, offset as u32);
+            cpu.execute_thumb_load_store_register_offset(&mut bus, asm::thumb("ldr r2, [r0, r1]") as u32);
+            assert_eq!(cpu.read_reg(2), want, "thumb ldr offset {}", offset);
+        }
+    }
+
+    #[test]
+    fn misaligned_thumb_immediate_and_halfword_loads_rotate() {
+        let mut bus = MockBus::new(0x200);
+        write32_le(&mut bus.mem, 0x80, 0x1122_3344);
+        let words = [0x1122_3344, 0x4411_2233, 0x3344_1122, 0x2233_4411];
+        let halves = [0x3344, 0x4400_0033];
+
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+        cpu.set_pc(0x100);
+        for (offset, want) in words.into_iter().enumerate() {
+            // Format 9: immediate offset
+            cpu.write_reg(0, 0x7C + offset as u32);
+            cpu.execute_raw_thumb(&mut bus, asm::thumb("ldr r2, [r0, #4]"));
+            assert_eq!(cpu.read_reg(2), want, "format 9 ldr offset {}", offset);
+
+            // Format 11: SP-relative
+            cpu.write_reg(13, 0x78 + offset as u32);
+            cpu.execute_raw_thumb(&mut bus, asm::thumb("ldr r3, [sp, #8]"));
+            assert_eq!(cpu.read_reg(3), want, "format 11 ldr offset {}", offset);
+        }
+        for (offset, want) in halves.into_iter().enumerate() {
+            // Format 10: halfword immediate offset
+            cpu.write_reg(0, 0x7A + offset as u32);
+            cpu.execute_raw_thumb(&mut bus, asm::thumb("ldrh r4, [r0, #6]"));
+            assert_eq!(cpu.read_reg(4), want, "format 10 ldrh offset {}", offset);
+        }
+    }
+
     #[test]
     fn arm_halfword_and_signed_transfers() {
         let mut cpu = Cpu::new();
@@ -2567,12 +3152,34 @@ mod tests {
         assert_eq!(word, 0x1122_3344);
     }
 
+    #[test]
+    fn swp_completes_before_a_dma_it_starts() {
+        use crate::bus::Bus;
+
+        let mut cpu = Cpu::new();
+        let mut bus = Bus::new();
+        bus.write32(0x0300_0000, 0x1234_5678);
+        bus.write32(0x0400_00D4, 0x0300_0000); // DMA3SAD
+        bus.write32(0x0400_00D8, 0x0300_0010); // DMA3DAD
+        bus.write16(0x0400_00DE, 1 << 10); // 32-bit units, not yet enabled
+
+        // Swapping into DMA3CNT reads the old control value, then the write
+        // itself starts the transfer
+        cpu.write_reg(0, 0x0400_00DC);
+        cpu.write_reg(2, 0x8400_0001);
+        cpu.set_pc(0x0300_0100);
+        cpu.execute_raw(&mut bus, asm::arm("swp r1, r2, [r0]"));
+        assert_eq!(cpu.read_reg(1), 0x0400_0000, "CNT_L is write-only; CNT_H before the write");
+        assert_eq!(bus.read32(0x0300_0010), 0x1234_5678);
+        assert!(!bus.io.dma.channels[3].enabled(), "the transfer already ran");
+    }
+
     #[test]
     fn arm_psr_mrs_msr_flags() {
         let mut cpu = Cpu::new();
-        // MSR CPSR_f, #imm set N and C
-        let imm8 = 0b1010_0000; // N=1,C=1 after rotation 0
-        let msr_imm = (0xE << 28) | (0b00110 << 23) | (1 << 21) | (0xF << 16) | (0 << 8) | imm8;
+        // MSR CPSR_f, #0xA0000000 sets N and C
+        let imm8 = 0b1010; // rotated right by 4 into bits 31..28
+        let msr_imm = (0xE << 28) | (0b00110 << 23) | (1 << 21) | (0x8 << 16) | (2 << 8) | imm8;
         cpu.execute_arm_psr_transfer(msr_imm);
         assert!(cpu.cpsr().n());
         assert!(cpu.cpsr().c());
@@ -2582,6 +3189,67 @@ mod tests {
         assert_eq!(cpu.read_reg(1) & 0xF000_0000, 0xA000_0000);
     }
 
+    #[test]
+    fn strict_mode_reports_invalid_mode_write() {
+        let mut bus = MockBus::new(256);
+        let msr_invalid_mode = 0xE321_F005; // MSR CPSR_c, #0x05
+
+        let mut cpu = Cpu::new();
+        cpu.execute_raw(&mut bus, msr_invalid_mode);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert!(cpu.strict_violations().is_empty());
+
+        let mut cpu = Cpu::new();
+        cpu.set_strict_mode(true);
+        cpu.execute_raw(&mut bus, msr_invalid_mode);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert_eq!(cpu.strict_violations().len(), 1);
+
+        // MRS r0, SPSR has no SPSR to read in System mode
+        cpu.execute_raw(&mut bus, 0xE14F_0000);
+        assert_eq!(cpu.strict_violations().len(), 2);
+
+        // Valid mode changes through MSR swap banks
+        cpu.execute_raw(&mut bus, 0xE321_F0D2); // MSR CPSR_c, #0xD2 (IRQ, I+F masked)
+        assert_eq!(cpu.mode(), CpuMode::Irq);
+        assert_eq!(cpu.strict_violations().len(), 2);
+    }
+
+    #[test]
+    fn arm_mrs_msr_spsr_in_exception_modes() {
+        let mut bus = MockBus::new(256);
+        let mut cpu = Cpu::new();
+        let modes = [CpuMode::Fiq, CpuMode::Irq, CpuMode::Supervisor, CpuMode::Abort, CpuMode::Undefined];
+
+        for (i, &mode) in modes.iter().enumerate() {
+            cpu.set_mode(mode);
+            cpu.set_spsr(0x6000_0010 | i as u32);
+            cpu.execute_raw(&mut bus, 0xE14F_0000); // MRS r0, SPSR
+            assert_eq!(cpu.read_reg(0), 0x6000_0010 | i as u32, "{:?}", mode);
+
+            cpu.write_reg(1, 0x9000_00D3);
+            cpu.execute_raw(&mut bus, 0xE169_F001); // MSR SPSR_fc, r1
+            assert_eq!(cpu.spsr(), Some(0x9000_00D3), "{:?}", mode);
+        }
+
+        // Each mode kept its own SPSR
+        cpu.set_mode(CpuMode::Irq);
+        cpu.write_reg(1, 0x1F);
+        cpu.execute_raw(&mut bus, 0xE168_F001); // MSR SPSR_f, r1 leaves the control byte
+        assert_eq!(cpu.spsr(), Some(0x0000_00D3));
+        cpu.set_mode(CpuMode::Fiq);
+        assert_eq!(cpu.spsr(), Some(0x9000_00D3));
+
+        for mode in [CpuMode::User, CpuMode::System] {
+            cpu.set_mode(mode);
+            cpu.write_reg(0, 0xAAAA_AAAA);
+            cpu.execute_raw(&mut bus, 0xE14F_0000);
+            assert_eq!(cpu.read_reg(0), 0xAAAA_AAAA);
+            cpu.execute_raw(&mut bus, 0xE169_F001);
+            assert_eq!(cpu.spsr(), None);
+        }
+    }
+
     #[test]
     fn arm_block_transfer_stmia_ldmia() {
         let mut cpu = Cpu::new();
@@ -2625,7 +3293,7 @@ mod tests {
         cpu.execute_arm_block_transfer(&mut bus, stmib);
         assert_eq!(bus.read32(0x204), 0x3333_3333);
         assert_eq!(bus.read32(0x208), 0x4444_4444);
-        assert_eq!(cpu.read_reg(0), 0x20C); // writeback enabled
+        assert_eq!(cpu.read_reg(0), 0x208); // writeback enabled
 
         // Test STMDA (Decrement After)
         cpu.write_reg(0, 0x300); // base
@@ -2634,8 +3302,8 @@ mod tests {
         let stmda = (0xE << 28) | (0b100 << 25) | (0 << 24) | (0 << 23) | (0 << 22) | (0 << 21) | (0 << 20)
             | (0 << 16) | ((1<<5)|(1<<6));
         cpu.execute_arm_block_transfer(&mut bus, stmda);
-        assert_eq!(bus.read32(0x2F8), 0x5555_5555);
-        assert_eq!(bus.read32(0x2FC), 0x6666_6666);
+        assert_eq!(bus.read32(0x2FC), 0x5555_5555);
+        assert_eq!(bus.read32(0x300), 0x6666_6666);
         assert_eq!(cpu.read_reg(0), 0x300); // no writeback
 
         // Test STMDB (Decrement Before) with writeback
@@ -2645,9 +3313,9 @@ mod tests {
         let stmdb = (0xE << 28) | (0b100 << 25) | (1 << 24) | (0 << 23) | (0 << 22) | (1 << 21) | (0 << 20)
             | (0 << 16) | ((1<<7)|(1<<8));
         cpu.execute_arm_block_transfer(&mut bus, stmdb);
-        assert_eq!(bus.read32(0x3F4), 0x7777_7777); // r7 at start address
-        assert_eq!(bus.read32(0x3F8), 0x8888_8888); // r8 at start address + 4
-        assert_eq!(cpu.read_reg(0), 0x3F4); // writeback enabled
+        assert_eq!(bus.read32(0x3F8), 0x7777_7777); // r7 at start address
+        assert_eq!(bus.read32(0x3FC), 0x8888_8888); // r8 at start address + 4
+        assert_eq!(cpu.read_reg(0), 0x3F8); // writeback enabled
     }
 
     #[test]
@@ -2657,7 +3325,7 @@ mod tests {
 
         // Test STM with PC (should store PC+12)
         cpu.write_reg(0, 0x100); // base
-        cpu.set_pc(0x1000);
+        cpu.set_pc(0x1008); // R15 as read by an instruction at 0x1000
         let stm_pc = (0xE << 28) | (0b100 << 25) | (0 << 24) | (1 << 23) | (0 << 22) | (0 << 21) | (0 << 20)
             | (0 << 16) | (1<<15); // store PC
         cpu.execute_arm_block_transfer(&mut bus, stm_pc);
@@ -2687,7 +3355,7 @@ mod tests {
 
         // Test STM with empty list (should store PC+12 to address)
         cpu.write_reg(0, 0x200); // base
-        cpu.set_pc(0x4000);
+        cpu.set_pc(0x4008); // R15 as read by an instruction at 0x4000
         let stm_empty = (0xE << 28) | (0b100 << 25) | (0 << 24) | (1 << 23) | (0 << 22) | (0 << 21) | (0 << 20)
             | (0 << 16) | 0; // empty register list
         cpu.execute_arm_block_transfer(&mut bus, stm_empty);
@@ -2714,7 +3382,7 @@ mod tests {
         let stmib_wb = (0xE << 28) | (0b100 << 25) | (1 << 24) | (1 << 23) | (0 << 22) | (1 << 21) | (0 << 20)
             | (0 << 16) | (1<<3);
         cpu.execute_arm_block_transfer(&mut bus, stmib_wb);
-        assert_eq!(cpu.read_reg(0), 0x208); // base + 4 + 1*4
+        assert_eq!(cpu.read_reg(0), 0x204); // base + 1*4
 
         // Test STMDA with writeback
         cpu.write_reg(0, 0x300); // base
@@ -2731,7 +3399,7 @@ mod tests {
         let stmdb_wb = (0xE << 28) | (0b100 << 25) | (1 << 24) | (0 << 23) | (0 << 22) | (1 << 21) | (0 << 20)
             | (0 << 16) | (1<<6);
         cpu.execute_arm_block_transfer(&mut bus, stmdb_wb);
-        assert_eq!(cpu.read_reg(0), 0x3F8); // base - 4 - 1*4
+        assert_eq!(cpu.read_reg(0), 0x3FC); // base - 1*4
     }
 
     #[test]
@@ -2744,7 +3412,7 @@ mod tests {
         cpu.write_reg(1, 0x1111_1111);
         cpu.write_reg(3, 0x3333_3333);
         cpu.write_reg(7, 0x7777_7777);
-        cpu.set_pc(0x1000); // Set PC to a known value
+        cpu.set_pc(0x1008); // R15 as read by an instruction at 0x1000
 
         // Register list: r1, r3, r7, r15 (not in bit order)
         let reg_list = (1<<1) | (1<<3) | (1<<7) | (1<<15);
@@ -2766,9 +3434,9 @@ mod tests {
         let mut bus = MockBus::new(128);
 
         // Write three instructions
-        let mov_r1 = (0x10 << 11) | (1 << 8) | 0x01; // MOV r1, #1
-        let mov_r2 = (0x10 << 11) | (2 << 8) | 0x02; // MOV r2, #2
-        let mov_r3 = (0x10 << 11) | (3 << 8) | 0x03; // MOV r3, #3
+        let mov_r1 = (0b00100 << 11) | (1 << 8) | 0x01; // MOV r1, #1
+        let mov_r2 = (0b00100 << 11) | (2 << 8) | 0x02; // MOV r2, #2
+        let mov_r3 = (0b00100 << 11) | (3 << 8) | 0x03; // MOV r3, #3
         bus.write16(0, mov_r1 as u16);
         bus.write16(2, mov_r2 as u16);
         bus.write16(4, mov_r3 as u16);
@@ -2802,7 +3470,7 @@ mod tests {
         cpu.set_pc(0);
         cpu.write_reg(0, 0x1000);
         // BX r0 to switch to ARM mode
-        let bx = (0x15 << 11) | (3 << 8) | (0 << 7) | (0 << 6) | (0 << 3) | 0;
+        let bx = (0b010001 << 10) | (3 << 8) | (0 << 7) | (0 << 6) | (0 << 3) | 0;
         bus.write16(0, bx as u16);
 
         cpu.set_pc(0);
@@ -3034,6 +3702,1571 @@ mod tests {
         assert!(cpu.cpsr().f());
     }
 
+    #[test]
+    fn thumb_pop_pc_ignores_bit_0() {
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+        let mut bus = MockBus::new(0x200);
+
+        cpu.write_reg(13, 0x100);
+        write32_le(&mut bus.mem, 0x100, 0x1002); // bit 0 clear would mean ARM on ARMv5
+
+        // POP {pc}
+        let pop_pc = (0xB << 12) | (1 << 11) | (1 << 10) | (1 << 8);
+        cpu.execute_thumb_push_pop_registers(&mut bus, pop_pc);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+        assert_eq!(cpu.pc(), 0x1002);
+        assert_eq!(cpu.read_reg(13), 0x104);
+    }
+
+    #[test]
+    fn thumb_push_lr_pop_pc_round_trip() {
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+        let mut bus = MockBus::new(0x200);
+
+        cpu.write_reg(13, 0x100);
+        for i in 0..3 { cpu.write_reg(i, 0x10 + i as u32); }
+        cpu.write_reg(14, 0x0123);
+
+        // PUSH {r0-r2, lr}
+        let push = (0xB << 12) | (1 << 10) | (1 << 8) | 0x07;
+        cpu.execute_thumb_push_pop_registers(&mut bus, push);
+        assert_eq!(cpu.read_reg(13), 0xF0);
+        assert_eq!(bus.read32(0xF0), 0x10);
+        assert_eq!(bus.read32(0xF4), 0x11);
+        assert_eq!(bus.read32(0xF8), 0x12);
+        assert_eq!(bus.read32(0xFC), 0x0123);
+
+        for i in 0..3 { cpu.write_reg(i, 0); }
+
+        // POP {r0-r2, pc}
+        let pop = (0xB << 12) | (1 << 11) | (1 << 10) | (1 << 8) | 0x07;
+        cpu.execute_thumb_push_pop_registers(&mut bus, pop);
+        assert_eq!(cpu.read_reg(13), 0x100);
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1), cpu.read_reg(2)), (0x10, 0x11, 0x12));
+        assert_eq!(cpu.pc(), 0x0122);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+    }
+
+    #[test]
+    fn thumb_empty_push_pop_moves_sp_by_0x40() {
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+        let mut bus = MockBus::new(0x200);
+        cpu.write_reg(13, 0x100);
+        cpu.set_pc(0x84); // executing at 0x80
+
+        cpu.execute_thumb_push_pop_registers(&mut bus, 0xB400);
+        assert_eq!(cpu.read_reg(13), 0xC0);
+        assert_eq!(bus.read32(0xC0), 0x86);
+
+        write32_le(&mut bus.mem, 0xC0, 0x0201);
+        cpu.execute_thumb_push_pop_registers(&mut bus, 0xBC00);
+        assert_eq!(cpu.read_reg(13), 0x100);
+        assert_eq!(cpu.pc(), 0x0200);
+    }
+
+    #[test]
+    fn thumb_pop_pc_stays_in_thumb() {
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+        let mut bus = MockBus::new(0x200);
+
+        cpu.write_reg(13, 0x100);
+        write32_le(&mut bus.mem, 0x100, 0x2001);
+
+        let pop_pc = (0xB << 12) | (1 << 11) | (1 << 10) | (1 << 8);
+        cpu.execute_thumb_push_pop_registers(&mut bus, pop_pc);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+        assert_eq!(cpu.pc(), 0x2000);
+    }
+
+    #[test]
+    fn thumb_load_costs_more_than_data_op() {
+        let cpu = Cpu::new();
+
+        let add = 0x1888; // ADD r0, r1, r2
+        let ldr = 0x6808; // LDR r0, [r1, #0]
+        let str = 0x6008; // STR r0, [r1, #0]
+        assert_eq!(cpu.thumb_instruction_cycles(add), 1);
+        assert_eq!(cpu.thumb_instruction_cycles(ldr), 3);
+        assert_eq!(cpu.thumb_instruction_cycles(str), 2);
+    }
+
+    #[test]
+    fn thumb_multi_register_and_bl_cycles() {
+        let mut cpu = Cpu::new();
+
+        assert_eq!(cpu.thumb_instruction_cycles(0xB40F), 5); // PUSH {r0-r3}
+        assert_eq!(cpu.thumb_instruction_cycles(0xBD01), 4); // POP {r0, pc}, refill added by step
+        assert_eq!(cpu.thumb_instruction_cycles(0xF000) + cpu.thumb_instruction_cycles(0xF800), 2);
+
+        cpu.write_reg(0, 0x0012_3456);
+        assert_eq!(cpu.thumb_instruction_cycles(0x4348), 4); // MUL r0, r1
+    }
+
+    #[test]
+    fn restored_state_replays_identically() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // ADD r0, r0, #1 ; ADDS r1, r1, r0 ; SUB r2, r1, #3 ; B .-12
+        write32_le(&mut bus.mem, 0, 0xE280_0001);
+        write32_le(&mut bus.mem, 4, 0xE091_1000);
+        write32_le(&mut bus.mem, 8, 0xE241_2003);
+        write32_le(&mut bus.mem, 12, 0xEAFF_FFFB);
+        cpu.set_pc(0);
+        cpu.set_mode(CpuMode::Irq);
+        cpu.set_spsr(0x1F);
+        cpu.step(&mut bus);
+
+        let saved = cpu.capture_state();
+        for _ in 0..10 { cpu.step(&mut bus); }
+        let first_run = cpu.capture_state();
+
+        cpu.restore_state(&saved);
+        assert_eq!(cpu.capture_state(), saved);
+        for _ in 0..10 { cpu.step(&mut bus); }
+        assert_eq!(cpu.capture_state(), first_run);
+        assert_eq!(cpu.spsr(), Some(0x1F));
+    }
+
+    #[test]
+    fn arm_pc_operand_reads_instruction_plus_8() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // MOV r0, pc at 0x10
+        write32_le(&mut bus.mem, 0x10, 0xE1A0_000F);
+        // ADD pc, pc, #0 at 0x14 skips the next instruction
+        write32_le(&mut bus.mem, 0x14, 0xE28F_F000);
+        write32_le(&mut bus.mem, 0x18, 0xE3A0_1001); // MOV r1, #1 (skipped)
+        write32_le(&mut bus.mem, 0x1C, 0xE3A0_2002); // MOV r2, #2
+
+        cpu.set_entry_point(&mut bus, 0x10);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(0), 0x18);
+        assert_eq!(cpu.pc(), 0x14);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 0x1C);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(1), 0);
+        assert_eq!(cpu.read_reg(2), 2);
+    }
+
+    #[test]
+    fn arm_branch_and_link_without_offset_math() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // BL +0x20 at 0x40: target = 0x40 + 8 + 0x20
+        write32_le(&mut bus.mem, 0x40, 0xEB00_0008);
+        cpu.set_entry_point(&mut bus, 0x40);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 0x68);
+        assert_eq!(cpu.read_reg(14), 0x44);
+    }
+
+    #[test]
+    fn arm_ldr_pc_relative_literal() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // LDR r0, [pc, #4] at 0x20 reads the literal at 0x20 + 8 + 4
+        write32_le(&mut bus.mem, 0x20, 0xE59F_0004);
+        write32_le(&mut bus.mem, 0x2C, 0xCAFE_BABE);
+        cpu.set_entry_point(&mut bus, 0x20);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(0), 0xCAFE_BABE);
+        assert_eq!(cpu.pc(), 0x24);
+    }
+
+    #[test]
+    fn exception_priority_order() {
+        let mut cpu = Cpu::new();
+        cpu.cpsr_mut().set_i(false);
+        cpu.cpsr_mut().set_f(false);
+
+        cpu.raise_exception(Exception::Undefined);
+        cpu.raise_exception(Exception::PrefetchAbort);
+        assert_eq!(cpu.resolve_exception(), Some(Exception::PrefetchAbort));
+        cpu.raise_exception(Exception::Irq);
+        assert_eq!(cpu.resolve_exception(), Some(Exception::Irq));
+        cpu.raise_exception(Exception::Fiq);
+        assert_eq!(cpu.resolve_exception(), Some(Exception::Fiq));
+        cpu.raise_exception(Exception::DataAbort);
+        assert_eq!(cpu.resolve_exception(), Some(Exception::DataAbort));
+        cpu.raise_exception(Exception::Reset);
+        assert_eq!(cpu.resolve_exception(), Some(Exception::Reset));
+
+        cpu.cpsr_mut().set_f(true);
+        cpu.clear_exception(Exception::Reset);
+        cpu.clear_exception(Exception::DataAbort);
+        assert_eq!(cpu.resolve_exception(), Some(Exception::Irq));
+    }
+
+    #[test]
+    fn irq_taken_before_undefined_instruction() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // Undefined instruction space (cond=AL, bits 27-25 = 011, bit 4 = 1)
+        write32_le(&mut bus.mem, 0x100, 0xE600_0010);
+        cpu.set_entry_point(&mut bus, 0x100);
+        cpu.cpsr_mut().set_i(false);
+        cpu.raise_exception(Exception::Irq);
+        cpu.raise_exception(Exception::Undefined);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Irq);
+        assert_eq!(cpu.pc(), Exception::Irq.vector());
+        assert_eq!(cpu.resolve_exception(), None);
+    }
+
+    #[test]
+    fn arm_ldr_pc_base_ignores_writeback() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // LDR r1, [pc, #-8]! at 0x40 reads itself and must not write back into PC
+        write32_le(&mut bus.mem, 0x40, 0xE53F_1008);
+        write32_le(&mut bus.mem, 0x44, 0xE3A0_2002); // MOV r2, #2
+        cpu.set_entry_point(&mut bus, 0x40);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(1), 0xE53F_1008);
+        assert_eq!(cpu.pc(), 0x44);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(2), 2);
+    }
+
+    #[test]
+    fn execute_raw_add_register_and_pc() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+        cpu.set_pc(0x80);
+        cpu.write_reg(1, 7);
+        cpu.write_reg(2, 35);
+
+        cpu.execute_raw(&mut bus, 0xE081_0002); // ADD r0, r1, r2
+        assert_eq!(cpu.read_reg(0), 42);
+        assert_eq!(cpu.pc(), 0x84);
+
+        cpu.execute_raw(&mut bus, 0xE28F_3000); // ADD r3, pc, #0
+        assert_eq!(cpu.read_reg(3), 0x8C);
+        assert_eq!(cpu.pc(), 0x88);
+    }
+
+    #[test]
+    fn execute_raw_ldr_reads_memory_only_for_data() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+        write32_le(&mut bus.mem, 0x24, 0xCAFE_BABE);
+        cpu.write_reg(1, 0x20);
+
+        cpu.execute_raw(&mut bus, 0xE5B1_0004); // LDR r0, [r1, #4]!
+        assert_eq!(cpu.read_reg(0), 0xCAFE_BABE);
+        assert_eq!(cpu.read_reg(1), 0x24);
+        assert_eq!(cpu.pc(), 4);
+    }
+
+    #[test]
+    fn execute_raw_thumb_swi_enters_supervisor() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+        cpu.cpsr_mut().set_t(true);
+        cpu.set_pc(0x100);
+
+        cpu.execute_raw_thumb(&mut bus, 0xDF05); // SWI 5
+        assert_eq!(cpu.mode(), CpuMode::Supervisor);
+        assert_eq!(cpu.pc(), Exception::Swi.vector());
+        assert_eq!(cpu.read_reg(14), 0x102);
+    }
+
+    #[test]
+    fn thumb_mul_sets_n_and_z_only() {
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+
+        // MUL r0, r1 with a negative product
+        cpu.write_reg(0, 3);
+        cpu.write_reg(1, (-5i32) as u32);
+        cpu.cpsr_mut().set_c(true);
+        cpu.cpsr_mut().set_v(true);
+        cpu.execute_thumb_alu_operations(0x4348);
+        assert_eq!(cpu.read_reg(0), (-15i32) as u32);
+        assert!(cpu.cpsr().n());
+        assert!(!cpu.cpsr().z());
+        assert!(cpu.cpsr().c());
+        assert!(cpu.cpsr().v());
+
+        // Zero product
+        cpu.write_reg(0, 0x1234);
+        cpu.write_reg(1, 0);
+        cpu.execute_thumb_alu_operations(0x4348);
+        assert_eq!(cpu.read_reg(0), 0);
+        assert!(!cpu.cpsr().n());
+        assert!(cpu.cpsr().z());
+        assert!(cpu.cpsr().v());
+    }
+
+    #[test]
+    fn arm_ldr_post_index_into_base_keeps_loaded_value() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+        write32_le(&mut bus.mem, 0x80, 0x1234_5678);
+        cpu.write_reg(0, 0x80);
+
+        cpu.execute_raw(&mut bus, 0xE490_0004); // LDR r0, [r0], #4
+        assert_eq!(cpu.read_reg(0), 0x1234_5678);
+
+        // LDRH r1, [r1, #2]! follows the same rule
+        write32_le(&mut bus.mem, 0x40, 0xBEEF_0000);
+        cpu.write_reg(1, 0x40);
+        cpu.execute_raw(&mut bus, 0xE1F1_10B2);
+        assert_eq!(cpu.read_reg(1), 0xBEEF);
+    }
+
+    #[test]
+    fn arm_branch_reaches_plus_and_minus_32mb() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(256);
+
+        // B with imm24 = 0x7FFFFF: the furthest forward target
+        cpu.set_pc(0);
+        cpu.execute_raw(&mut bus, 0xEA7F_FFFF);
+        assert_eq!(cpu.pc(), 8 + 0x01FF_FFFC);
+
+        // BL with imm24 = 0x800000: the furthest backward target
+        cpu.set_pc(0x0200_0000);
+        cpu.execute_raw(&mut bus, 0xEB80_0000);
+        assert_eq!(cpu.pc(), 0x0200_0008u32.wrapping_sub(0x0200_0000));
+        assert_eq!(cpu.read_reg(14), 0x0200_0004);
+
+        // imm24 = -1 is R15 - 4, i.e. the next instruction
+        cpu.set_pc(0x100);
+        cpu.execute_raw(&mut bus, 0xEAFF_FFFF);
+        assert_eq!(cpu.pc(), 0x104);
+    }
+
+    #[test]
+    fn thumb_format8_sign_and_zero_extension() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        cpu.set_state(CpuState::Thumb);
+        bus.mem[0x101] = 0x80;
+        bus.mem[0x102] = 0xFE;
+        bus.mem[0x103] = 0xFF;
+        cpu.write_reg(1, 0x100);
+
+        // LDSB r0, [r1, r2]
+        cpu.write_reg(2, 1);
+        cpu.execute_thumb_load_store_sign_extended(&mut bus, 0x5688);
+        assert_eq!(cpu.read_reg(0), 0xFFFF_FF80);
+
+        // LDSH r0, [r1, r2]
+        cpu.write_reg(2, 2);
+        cpu.execute_thumb_load_store_sign_extended(&mut bus, 0x5E88);
+        assert_eq!(cpu.read_reg(0), 0xFFFF_FFFE);
+
+        // LDRH r0, [r1, r2] zero-extends the same halfword
+        cpu.execute_thumb_load_store_sign_extended(&mut bus, 0x5A88);
+        assert_eq!(cpu.read_reg(0), 0x0000_FFFE);
+
+        // STRH r0, [r1, r2] stores only the low halfword
+        cpu.write_reg(0, 0x1234_8001);
+        cpu.write_reg(2, 4);
+        cpu.execute_thumb_load_store_sign_extended(&mut bus, 0x5288);
+        assert_eq!(&bus.mem[0x104..0x107], &[0x01, 0x80, 0x00]);
+    }
+
+    #[test]
+    fn arm_immediate_shift_by_zero_encodings() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+
+        // MOVS r0, r1, LSR #0 is LSR #32
+        cpu.write_reg(1, 0x8000_0001);
+        cpu.execute_raw(&mut bus, 0xE1B0_0021);
+        assert_eq!(cpu.read_reg(0), 0);
+        assert!(cpu.cpsr().z());
+        assert!(cpu.cpsr().c());
+
+        cpu.write_reg(1, 0x7FFF_FFFF);
+        cpu.execute_raw(&mut bus, 0xE1B0_0021);
+        assert_eq!(cpu.read_reg(0), 0);
+        assert!(!cpu.cpsr().c());
+
+        // MOVS r0, r1, ASR #0 is ASR #32
+        cpu.write_reg(1, 0x8000_0000);
+        cpu.execute_raw(&mut bus, 0xE1B0_0041);
+        assert_eq!(cpu.read_reg(0), 0xFFFF_FFFF);
+        assert!(cpu.cpsr().n());
+        assert!(cpu.cpsr().c());
+
+        // MOVS r0, r1, LSL #0 leaves the value and carry alone
+        cpu.cpsr_mut().set_c(true);
+        cpu.write_reg(1, 0x1234);
+        cpu.execute_raw(&mut bus, 0xE1B0_0001);
+        assert_eq!(cpu.read_reg(0), 0x1234);
+        assert!(cpu.cpsr().c());
+
+        // MOVS r0, r1, ROR #0 is RRX
+        cpu.cpsr_mut().set_c(true);
+        cpu.write_reg(1, 0x0000_0003);
+        cpu.execute_raw(&mut bus, 0xE1B0_0061);
+        assert_eq!(cpu.read_reg(0), 0x8000_0001);
+        assert!(cpu.cpsr().c());
+    }
+
+    #[test]
+    fn arm_data_processing_rd15_with_s_restores_cpsr() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+
+        // SUBS pc, lr, #4 returning from IRQ to User mode
+        cpu.set_mode(CpuMode::Irq);
+        cpu.set_spsr(0x6000_0010);
+        cpu.write_reg(14, 0x0000_0084);
+        cpu.execute_raw(&mut bus, 0xE25E_F004);
+        assert_eq!(cpu.mode(), CpuMode::User);
+        assert_eq!(cpu.pc(), 0x0000_0080);
+        assert!(cpu.cpsr().z());
+        assert!(cpu.cpsr().c());
+        assert!(!cpu.cpsr().n());
+
+        // CMP r0, #0 with Rd=15 (CMPP): flags come from SPSR, not the comparison
+        cpu.set_mode(CpuMode::Supervisor);
+        cpu.set_spsr(0x8000_001F);
+        cpu.write_reg(0, 5);
+        cpu.execute_raw(&mut bus, 0xE350_F000);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert!(cpu.cpsr().n());
+        assert!(!cpu.cpsr().c());
+
+        // TEQ r0, #0 with Rd=15 (TEQP) can switch back to Thumb
+        cpu.set_mode(CpuMode::Supervisor);
+        cpu.set_spsr(0x0000_003F);
+        cpu.execute_raw(&mut bus, 0xE330_F000);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+    }
+
+    #[test]
+    fn arm_bl_returns_with_bx_lr() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let code = asm::arm_program(0, "
+                bl func
+                mov r1, #2
+            halt:
+                b halt
+            func:
+                mov r0, #1
+                bx lr
+        ");
+        bus.mem[..code.len()].copy_from_slice(&code);
+        cpu.set_entry_point(&mut bus, 0);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(14), 4, "LR holds the instruction after BL");
+        assert_eq!(cpu.pc(), 12);
+
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 4);
+        assert_eq!(cpu.state(), CpuState::Arm);
+
+        cpu.step(&mut bus);
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (1, 2));
+    }
+
+    #[test]
+    fn arm_bx_with_bit0_set_enters_thumb() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let mut code = asm::arm_program(0, "
+                mov r0, #0x11
+                bx r0
+        ");
+        code.resize(0x10, 0);
+        code.extend(asm::thumb_program(0x10, "lsls r1, r0, #1"));
+        bus.mem[..code.len()].copy_from_slice(&code);
+        cpu.set_entry_point(&mut bus, 0);
+
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+        assert!(cpu.cpsr().t());
+        assert_eq!(cpu.pc(), 0x10, "bit 0 is dropped from the target");
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(1), 0x22, "execution continues as Thumb");
+        assert_eq!(cpu.pc(), 0x12);
+    }
+
+    #[test]
+    fn arm_bx_with_bit0_clear_stays_in_arm() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let code = asm::arm_program(0, "
+                mov r0, #0x22
+                bx r0
+                .word 0
+                .word 0
+                .word 0
+                .word 0
+                .word 0
+                .word 0
+                mov r1, #7
+        ");
+        bus.mem[..code.len()].copy_from_slice(&code);
+        cpu.set_entry_point(&mut bus, 0);
+
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.state(), CpuState::Arm);
+        assert_eq!(cpu.pc(), 0x20, "ARM targets are word aligned");
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(1), 7);
+
+        // A BX whose condition fails does nothing
+        cpu.cpsr_mut().set_z(false);
+        cpu.write_reg(0, 0x41);
+        cpu.execute_raw(&mut bus, asm::arm("bxeq r0"));
+        assert_eq!(cpu.state(), CpuState::Arm);
+        assert_eq!(cpu.pc(), 0x28, "falls through to the next instruction");
+    }
+
+    #[test]
+    fn thumb_bl_returns_with_bx_lr() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        cpu.set_state(CpuState::Thumb);
+
+        // Each half runs with R15 at its own address + 4
+        let mut bl = |cpu: &mut Cpu, at: u32, target: u32| {
+            let code = asm::thumb_program(at, &format!("bl {:#x}", target));
+            for (i, half) in code.chunks(2).enumerate() {
+                cpu.regs[15] = at + 2 * i as u32 + 4;
+                cpu.execute_thumb_long_branch_with_link(&mut bus, u16::from_le_bytes([half[0], half[1]]) as u32);
+            }
+        };
+
+        // Forward far enough to need the upper offset half
+        bl(&mut cpu, 0x0800_0100, 0x0800_2000);
+        assert_eq!(cpu.regs[15], 0x0800_2000);
+        assert_eq!(cpu.read_reg(14), 0x0800_0105, "LR is past the second half, with bit 0 set");
+
+        cpu.regs[15] = 0x0800_2004;
+        cpu.execute_thumb_hi_register_operations_branch_exchange(asm::thumb("bx lr") as u32);
+        assert_eq!(cpu.regs[15], 0x0800_0104);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+
+        // Backward
+        bl(&mut cpu, 0x0800_2000, 0x0800_0100);
+        assert_eq!(cpu.regs[15], 0x0800_0100);
+        assert_eq!(cpu.read_reg(14), 0x0800_2005);
+    }
+
+    #[test]
+    fn compare_ops_always_set_flags() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let flags = |cpu: &Cpu| (cpu.cpsr().n(), cpu.cpsr().z(), cpu.cpsr().c(), cpu.cpsr().v());
+
+        // (r0, r1, expected N Z C V) for CMP r0, r1
+        let cases = [
+            (5, 5, (false, true, true, false)),                        // equal
+            (7, 3, (false, false, true, false)),                       // greater, unsigned and signed
+            (3, 7, (true, false, false, false)),                       // less
+            (0x8000_0000, 1, (false, false, true, true)),              // signed underflow
+            (0x7FFF_FFFF, 0xFFFF_FFFF, (true, false, false, true)),    // signed overflow
+        ];
+        for (a, b, expected) in cases {
+            cpu.write_reg(0, a);
+            cpu.write_reg(1, b);
+            cpu.execute_raw(&mut bus, asm::arm("cmp r0, r1"));
+            assert_eq!(flags(&cpu), expected, "cmp {:#x}, {:#x}", a, b);
+            assert_eq!(cpu.read_reg(0), a, "cmp writes no register");
+        }
+
+        // CMN adds: -1 + 1 wraps to zero with a carry out
+        cpu.write_reg(0, 0xFFFF_FFFF);
+        cpu.execute_raw(&mut bus, asm::arm("cmn r0, #1"));
+        assert_eq!(flags(&cpu), (false, true, true, false));
+
+        // TST/TEQ take C from the shifter and leave V alone
+        cpu.cpsr_mut().set_v(true);
+        cpu.write_reg(1, 0x8000_0001);
+        cpu.execute_raw(&mut bus, asm::arm("tst r1, r1, lsr #1"));
+        assert_eq!(flags(&cpu), (false, true, true, true));
+        cpu.execute_raw(&mut bus, asm::arm("teq r1, #0x80000000"));
+        assert_eq!(flags(&cpu), (false, false, true, true));
+    }
+
+    #[test]
+    fn carry_chains_do_64_bit_arithmetic() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let pair = |cpu: &Cpu, lo: usize, hi: usize| ((cpu.read_reg(hi) as u64) << 32) | cpu.read_reg(lo) as u64;
+        let set = |cpu: &mut Cpu, lo: usize, value: u64| {
+            cpu.write_reg(lo, value as u32);
+            cpu.write_reg(lo + 1, (value >> 32) as u32);
+        };
+
+        let (a, b) = (0x0000_0001_FFFF_FFFFu64, 0x0000_0002_0000_0001u64);
+        set(&mut cpu, 0, a);
+        set(&mut cpu, 2, b);
+        cpu.execute_raw(&mut bus, asm::arm("adds r4, r0, r2"));
+        cpu.execute_raw(&mut bus, asm::arm("adcs r5, r1, r3"));
+        assert_eq!(pair(&cpu, 4, 5), a + b);
+        assert!(!cpu.cpsr().c() && !cpu.cpsr().v());
+
+        // Overflow out of the top half shows up in the final C
+        set(&mut cpu, 0, u64::MAX);
+        set(&mut cpu, 2, 1);
+        cpu.execute_raw(&mut bus, asm::arm("adds r4, r0, r2"));
+        cpu.execute_raw(&mut bus, asm::arm("adcs r5, r1, r3"));
+        assert_eq!(pair(&cpu, 4, 5), 0);
+        assert!(cpu.cpsr().c() && cpu.cpsr().z());
+
+        // The borrow from the low half feeds SBC
+        set(&mut cpu, 0, 0x0000_0002_0000_0000);
+        set(&mut cpu, 2, 1);
+        cpu.execute_raw(&mut bus, asm::arm("subs r4, r0, r2"));
+        cpu.execute_raw(&mut bus, asm::arm("sbcs r5, r1, r3"));
+        assert_eq!(pair(&cpu, 4, 5), 0x0000_0001_FFFF_FFFF);
+        assert!(cpu.cpsr().c(), "no borrow out of the top half");
+
+        // Negating a 64-bit value: 0 - x via RSBS/RSC
+        set(&mut cpu, 0, 5);
+        cpu.execute_raw(&mut bus, asm::arm("rsbs r4, r0, #0"));
+        cpu.execute_raw(&mut bus, asm::arm("rscs r5, r1, #0"));
+        assert_eq!(pair(&cpu, 4, 5), 5u64.wrapping_neg());
+        assert!(cpu.cpsr().n() && !cpu.cpsr().c());
+
+        // Signed overflow comes from the arithmetic, not the shifter
+        cpu.write_reg(0, 0x7FFF_FFFF);
+        cpu.write_reg(2, 0);
+        cpu.cpsr_mut().set_c(true);
+        cpu.execute_raw(&mut bus, asm::arm("adcs r4, r0, r2, lsl #1"));
+        assert_eq!(cpu.read_reg(4), 0x8000_0000);
+        assert!(cpu.cpsr().v() && !cpu.cpsr().c());
+    }
+
+    #[test]
+    fn arithmetic_flags_come_from_the_adder() {
+        let mut bus = MockBus::new(0x100);
+        // (instruction, r0, r1, result, N Z C V). An unshifted register passes the
+        // old C through the shifter, so C starts inverted to catch a leak.
+        let cases: &[(&str, u32, u32, u32, (bool, bool, bool, bool))] = &[
+            ("adds r2, r0, r1", 0x7FFF_FFFF, 1, 0x8000_0000, (true, false, false, true)),
+            ("adds r2, r0, r1", 0xFFFF_FFFF, 1, 0, (false, true, true, false)),
+            ("adds r2, r0, r1", 0x8000_0000, 0x8000_0000, 0, (false, true, true, true)),
+            ("subs r2, r0, r1", 0, 1, 0xFFFF_FFFF, (true, false, false, false)),
+            ("subs r2, r0, r1", 0x8000_0000, 1, 0x7FFF_FFFF, (false, false, true, true)),
+            ("subs r2, r0, r1", 5, 5, 0, (false, true, true, false)),
+            ("rsbs r2, r0, r1", 1, 0, 0xFFFF_FFFF, (true, false, false, false)),
+            ("rsbs r2, r0, r1", 1, 0x8000_0000, 0x7FFF_FFFF, (false, false, true, true)),
+        ];
+        for &(src, a, b, result, flags) in cases {
+            let mut cpu = Cpu::new();
+            cpu.write_reg(0, a);
+            cpu.write_reg(1, b);
+            cpu.cpsr_mut().set_c(!flags.2);
+            cpu.execute_raw(&mut bus, asm::arm(src));
+            let got = (cpu.cpsr().n(), cpu.cpsr().z(), cpu.cpsr().c(), cpu.cpsr().v());
+            assert_eq!((cpu.read_reg(2), got), (result, flags), "{} with {:#x}, {:#x}", src, a, b);
+        }
+
+        // Thumb ADD/SUB share the same flag logic
+        for &(src, a, b, result, flags) in &cases[..6] {
+            let mut cpu = Cpu::new();
+            cpu.write_reg(0, a);
+            cpu.write_reg(1, b);
+            cpu.cpsr_mut().set_c(!flags.2);
+            cpu.execute_thumb_add_subtract(asm::thumb(src) as u32);
+            let got = (cpu.cpsr().n(), cpu.cpsr().z(), cpu.cpsr().c(), cpu.cpsr().v());
+            assert_eq!((cpu.read_reg(2), got), (result, flags), "thumb {} with {:#x}, {:#x}", src, a, b);
+        }
+    }
+
+    #[test]
+    fn compare_driven_loop_terminates() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        let code = asm::arm_program(0, "
+                mov r0, #0
+            loop:
+                add r0, r0, #1
+                cmp r0, #10
+                blt loop
+            done:
+                b done
+        ");
+        bus.mem[..code.len()].copy_from_slice(&code);
+        cpu.reset(&mut bus);
+        for _ in 0..64 {
+            cpu.step(&mut bus);
+        }
+        assert_eq!(cpu.read_reg(0), 10);
+    }
+
+    #[test]
+    fn nested_exceptions_keep_each_spsr() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x400);
+        cpu.set_mode(CpuMode::User);
+        cpu.cpsr_mut().set_i(false);
+        cpu.cpsr_mut().set_z(true);
+        cpu.write_reg(14, 0x1111);
+        let user_cpsr = cpu.cpsr().raw();
+
+        cpu.set_pc(0x200);
+        cpu.execute_raw(&mut bus, asm::arm("swi #0"));
+        assert_eq!(cpu.mode(), CpuMode::Supervisor);
+        assert_eq!(cpu.spsr(), Some(user_cpsr));
+        let svc_lr = cpu.read_reg(14);
+        assert_eq!(svc_lr, 0x204);
+
+        // The SVC handler re-enables interrupts and gets interrupted
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_c, #0x13"));
+        cpu.cpsr_mut().set_z(false);
+        let svc_cpsr = cpu.cpsr().raw();
+        cpu.trigger_irq(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Irq);
+        assert_eq!(cpu.spsr(), Some(svc_cpsr), "SPSR_irq holds the SVC state");
+        assert!(cpu.cpsr().i());
+
+        // Back into SVC: its own SPSR and LR were untouched by the IRQ
+        cpu.execute_raw(&mut bus, asm::arm("subs pc, lr, #4"));
+        assert_eq!(cpu.cpsr().raw(), svc_cpsr);
+        assert_eq!(cpu.spsr(), Some(user_cpsr));
+        assert_eq!(cpu.read_reg(14), svc_lr);
+
+        // And back to the user code after the SWI
+        cpu.execute_raw(&mut bus, asm::arm("movs pc, lr"));
+        assert_eq!(cpu.cpsr().raw(), user_cpsr);
+        assert_eq!(cpu.mode(), CpuMode::User);
+        assert_eq!(cpu.pc(), 0x204);
+        assert_eq!(cpu.read_reg(14), 0x1111);
+    }
+
+    #[test]
+    fn msr_writes_only_the_selected_fields() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x100);
+        cpu.set_mode(CpuMode::System);
+
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_f, #0xF0000000"));
+        assert!(cpu.cpsr().n() && cpu.cpsr().z() && cpu.cpsr().c() && cpu.cpsr().v());
+        assert_eq!(cpu.mode(), CpuMode::System);
+
+        // A zero flags byte clears all four
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_f, #0"));
+        assert_eq!(cpu.cpsr().raw() >> 28, 0);
+
+        // The control field switches mode and banks; flags are untouched
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_f, #0x40000000"));
+        cpu.write_reg(13, 0x0300_7F00);
+        cpu.write_reg(0, 0x92);
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_c, r0"));
+        assert_eq!(cpu.mode(), CpuMode::Irq);
+        assert!(cpu.cpsr().i() && cpu.cpsr().z());
+        assert_ne!(cpu.read_reg(13), 0x0300_7F00, "IRQ mode has its own SP");
+
+        // T cannot be set through MSR
+        cpu.write_reg(0, 0x3F);
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_c, r0"));
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert!(!cpu.cpsr().t());
+
+        // User mode may only change the flags
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_c, #0x10"));
+        cpu.execute_raw(&mut bus, asm::arm("msr cpsr_fc, #0x1F"));
+        assert_eq!(cpu.mode(), CpuMode::User);
+    }
+
+    #[test]
+    fn ldm_with_s_bit_returns_from_an_exception() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x400);
+        cpu.set_mode(CpuMode::User);
+        cpu.cpsr_mut().set_i(false);
+        cpu.cpsr_mut().set_c(true);
+        cpu.write_reg(13, 0x3F0);
+        cpu.write_reg(14, 0x1111);
+        let user_cpsr = cpu.cpsr().raw();
+
+        cpu.set_pc(0x200);
+        cpu.execute_raw(&mut bus, asm::arm("swi #0"));
+        assert_eq!(cpu.mode(), CpuMode::Supervisor);
+        cpu.write_reg(13, 0x300);
+        cpu.write_reg(0, 0xAAAA);
+        cpu.execute_raw(&mut bus, asm::arm("stmfd sp!, {r0, lr}"));
+
+        // A user-bank store and load see the user SP and LR, not the SVC ones
+        cpu.write_reg(1, 0x380);
+        cpu.execute_raw(&mut bus, asm::arm("stmia r1, {r13, r14}^"));
+        assert_eq!(bus.read32(0x380), 0x3F0);
+        assert_eq!(bus.read32(0x384), 0x1111);
+        bus.write32(0x380, 0x2222);
+        cpu.execute_raw(&mut bus, asm::arm("ldmia r1, {r14}^"));
+        assert_eq!(cpu.mode(), CpuMode::Supervisor);
+        assert_eq!(cpu.read_reg(14), 0x204, "SVC LR untouched");
+
+        cpu.write_reg(0, 0);
+        cpu.execute_raw(&mut bus, asm::arm("ldmfd sp!, {r0, pc}^"));
+        assert_eq!(cpu.cpsr().raw(), user_cpsr);
+        assert_eq!(cpu.mode(), CpuMode::User);
+        assert_eq!(cpu.pc(), 0x204);
+        assert_eq!(cpu.read_reg(0), 0xAAAA);
+        assert_eq!(cpu.read_reg(13), 0x3F0);
+        assert_eq!(cpu.read_reg(14), 0x2222);
+
+        // Without the S bit, loading the PC leaves the mode alone
+        cpu.set_mode(CpuMode::Supervisor);
+        cpu.write_reg(13, 0x300);
+        bus.write32(0x300, 0x240);
+        cpu.execute_raw(&mut bus, asm::arm("ldmfd sp!, {pc}"));
+        assert_eq!(cpu.mode(), CpuMode::Supervisor);
+        assert_eq!(cpu.pc(), 0x240);
+    }
+
+    #[test]
+    fn ldm_addressing_modes_cover_the_words_next_to_the_base() {
+        let mut bus = MockBus::new(0x200);
+        for i in 0..8u32 {
+            bus.write32(0x100 + i * 4, 0xA0 + i);
+        }
+        // The lowest register always takes the lowest address; the base moves by 4 * count
+        for (source, loaded, new_base) in [
+            ("ldmia r0!, {r1, r2}", (0xA4, 0xA5), 0x118),
+            ("ldmib r0!, {r1, r2}", (0xA5, 0xA6), 0x118),
+            ("ldmda r0!, {r1, r2}", (0xA3, 0xA4), 0x108),
+            ("ldmdb r0!, {r1, r2}", (0xA2, 0xA3), 0x108),
+        ] {
+            let mut cpu = Cpu::new();
+            cpu.write_reg(0, 0x110);
+            cpu.execute_raw(&mut bus, asm::arm(source));
+            assert_eq!((cpu.read_reg(1), cpu.read_reg(2)), loaded, "{source}");
+            assert_eq!(cpu.read_reg(0), new_base, "{source}");
+        }
+    }
+
+    #[test]
+    fn stm_stores_old_base_only_when_it_is_the_lowest_register() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+
+        cpu.write_reg(0, 0x100);
+        cpu.write_reg(4, 0x4444);
+        cpu.execute_raw(&mut bus, asm::arm("stmia r0!, {r0, r4}"));
+        assert_eq!(bus.read32(0x100), 0x100, "lowest register: original base");
+        assert_eq!(bus.read32(0x104), 0x4444);
+        assert_eq!(cpu.read_reg(0), 0x108);
+
+        cpu.write_reg(0, 0x1111);
+        cpu.write_reg(1, 0x140);
+        cpu.execute_raw(&mut bus, asm::arm("stmia r1!, {r0, r1}"));
+        assert_eq!(bus.read32(0x140), 0x1111);
+        assert_eq!(bus.read32(0x144), 0x148, "not lowest: written-back base");
+        assert_eq!(cpu.read_reg(1), 0x148);
+
+        // Descending stores write back the same way: the base ends count words down
+        cpu.write_reg(5, 0x1C0);
+        cpu.execute_raw(&mut bus, asm::arm("stmdb r5!, {r0, r5}"));
+        assert_eq!(bus.read32(0x1B8), 0x1111);
+        assert_eq!(bus.read32(0x1BC), 0x1B8);
+        assert_eq!(cpu.read_reg(5), 0x1B8);
+
+        cpu.write_reg(6, 0x1C0);
+        cpu.execute_raw(&mut bus, asm::arm("stmda r6!, {r4, r6}"));
+        assert_eq!(bus.read32(0x1BC), 0x4444);
+        assert_eq!(bus.read32(0x1C0), 0x1B8);
+        assert_eq!(cpu.read_reg(6), 0x1B8);
+    }
+
+    #[test]
+    fn stm_with_s_bit_stores_the_user_bank_from_irq_mode() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x400);
+        cpu.set_mode(CpuMode::User);
+        for r in 0..15 {
+            cpu.write_reg(r, 0x1000 + r as u32);
+        }
+        cpu.set_mode(CpuMode::Irq);
+        cpu.write_reg(13, 0x200);
+        cpu.write_reg(14, 0xBAD);
+
+        cpu.execute_raw(&mut bus, asm::arm("stmia sp, {r0-lr}^"));
+        for r in 0..15u32 {
+            assert_eq!(bus.read32(0x200 + r * 4), 0x1000 + r, "r{}", r);
+        }
+        assert_eq!(cpu.read_reg(13), 0x200);
+
+        // Loads go to the user bank too, and FIQ mode sees the shared r8-r12
+        for r in 0..15u32 {
+            bus.write32(0x200 + r * 4, 0x2000 + r);
+        }
+        cpu.set_mode(CpuMode::Fiq);
+        cpu.write_reg(8, 0xF1F1);
+        cpu.write_reg(13, 0x200);
+        cpu.execute_raw(&mut bus, asm::arm("ldmia sp, {r8-lr}^"));
+        assert_eq!(cpu.read_reg(8), 0xF1F1);
+        assert_eq!(cpu.read_reg(13), 0x200);
+        cpu.set_mode(CpuMode::User);
+        for r in 8..15 {
+            assert_eq!(cpu.read_reg(r), 0x2000 + (r - 8) as u32, "r{}", r);
+        }
+        assert_eq!(cpu.read_reg(0), 0x1000);
+    }
+
+    #[test]
+    fn irq_handler_returns_to_the_interrupted_instruction() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x400);
+        write32_le(&mut bus.mem, 0x18, asm::arm("subs pc, lr, #4"));
+        for i in 0..4u32 {
+            write32_le(&mut bus.mem, (0x100 + i * 4) as usize, asm::arm("add r0, r0, #1"));
+        }
+        cpu.set_entry_point(&mut bus, 0x100);
+        cpu.cpsr_mut().set_i(false);
+        cpu.cpsr_mut().set_c(true);
+        let arm_cpsr = cpu.cpsr().raw();
+
+        cpu.step(&mut bus);
+        cpu.trigger_irq(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Irq);
+        assert_eq!(cpu.pc(), 0x18);
+        assert_eq!(cpu.read_reg(14), 0x108, "next instruction + 4");
+        assert_eq!(cpu.spsr(), Some(arm_cpsr));
+        assert!(cpu.cpsr().i());
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.cpsr().raw(), arm_cpsr);
+        assert_eq!(cpu.pc(), 0x104);
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(0), 3, "nothing skipped or repeated");
+
+        // Thumb code gets the same +4 and comes back in Thumb state
+        for i in 0..4u32 {
+            bus.mem[0x200 + i as usize * 2..][..2].copy_from_slice(&asm::thumb("lsls r1, r1, #1").to_le_bytes());
+        }
+        cpu.write_reg(1, 1);
+        cpu.cpsr_mut().set_t(true);
+        cpu.set_entry_point(&mut bus, 0x200);
+
+        cpu.step(&mut bus);
+        let thumb_cpsr = cpu.cpsr().raw();
+        cpu.trigger_irq(&mut bus);
+        assert!(!cpu.cpsr().t());
+        assert_eq!(cpu.read_reg(14), 0x206);
+        assert_eq!(cpu.spsr(), Some(thumb_cpsr));
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.cpsr().raw(), thumb_cpsr);
+        assert_eq!(cpu.pc(), 0x202);
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(1), 8);
+    }
+
+    #[test]
+    fn undefined_instructions_take_the_undefined_trap() {
+        // CDP, the undefined space and STC
+        for opcode in [0xEE00_0000, 0xE600_0010, 0xEC00_0000] {
+            let mut cpu = Cpu::new();
+            let mut bus = MockBus::new(0x200);
+            write32_le(&mut bus.mem, 0x100, opcode);
+            cpu.set_entry_point(&mut bus, 0x100);
+            cpu.cpsr_mut().set_i(false);
+            cpu.cpsr_mut().set_z(true);
+            let old_cpsr = cpu.cpsr().raw();
+
+            cpu.step(&mut bus);
+            assert_eq!(cpu.mode(), CpuMode::Undefined, "{:#010x}", opcode);
+            assert_eq!(cpu.pc(), 0x04);
+            assert_eq!(cpu.read_reg(14), 0x104, "returns past the instruction with movs pc, lr");
+            assert_eq!(cpu.spsr(), Some(old_cpsr));
+            assert!(cpu.cpsr().i());
+            assert!(!cpu.cpsr().f());
+            assert_eq!(cpu.take_unimplemented(), None);
+        }
+
+        // Failed conditions skip the instruction; with traps off it is only recorded
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        cpu.set_pc(0x100);
+        cpu.execute_raw(&mut bus, 0x0E00_0000);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        cpu.set_trap_undefined(false);
+        cpu.execute_raw(&mut bus, 0xEE00_0000);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert_eq!(cpu.take_unimplemented().map(|i| i.opcode), Some(0xEE00_0000));
+    }
+
+    #[test]
+    fn every_alu_op_with_s_and_rd15_returns_from_an_exception() {
+        let ops = [
+            "movs pc, lr", "adds pc, lr, #0", "subs pc, r2, #4", "rsbs pc, r3, #0x80",
+            "ands pc, lr, lr", "orrs pc, lr, #0", "eors pc, lr, #0", "bics pc, lr, #0",
+            "adcs pc, lr, #0", "sbcs pc, r2, #3", "rscs pc, r3, #0x81", "mvns pc, r4",
+        ];
+        for op in ops {
+            let mut cpu = Cpu::new();
+            let mut bus = MockBus::new(0x100);
+            cpu.set_mode(CpuMode::User);
+            cpu.write_reg(13, 0x3F00);
+            cpu.write_reg(14, 0x1111);
+            cpu.set_mode(CpuMode::Irq);
+            cpu.set_spsr(0x6000_0010);
+            cpu.write_reg(13, 0x3FA0);
+            cpu.write_reg(14, 0x80);
+            cpu.write_reg(2, 0x84);
+            cpu.write_reg(3, 0);
+            cpu.write_reg(4, !0x80);
+            cpu.cpsr_mut().set_c(false);
+
+            cpu.execute_raw(&mut bus, asm::arm(op));
+            assert_eq!(cpu.cpsr().raw(), 0x6000_0010, "{}", op);
+            assert_eq!(cpu.pc(), 0x80, "{}", op);
+            assert_eq!((cpu.read_reg(13), cpu.read_reg(14)), (0x3F00, 0x1111), "{}", op);
+        }
+    }
+
+    #[test]
+    fn msr_setting_t_keeps_executing_arm() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        let code = asm::arm_program(0x100, "
+                msr cpsr_c, #0x20
+                mov r0, #1
+                mov r1, #2
+        ");
+        bus.mem[0x100..0x100 + code.len()].copy_from_slice(&code);
+        cpu.set_strict_mode(true);
+        cpu.set_entry_point(&mut bus, 0x100);
+
+        for _ in 0..3 {
+            cpu.step(&mut bus);
+        }
+        assert_eq!(cpu.state(), CpuState::Arm);
+        assert_eq!(cpu.mode(), CpuMode::System, "invalid mode bits are ignored too");
+        assert_eq!((cpu.read_reg(0), cpu.read_reg(1)), (1, 2));
+        assert_eq!(cpu.pc(), 0x10C);
+        assert_eq!(cpu.strict_violations().len(), 2);
+        assert!(cpu.strict_violations()[0].contains("T bit"));
+    }
+
+    #[test]
+    fn shift_by_r0_uses_the_register_amount() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x1000);
+        cpu.set_pc(0x100);
+        cpu.regs[2] = 0x11;
+
+        cpu.regs[0] = 0;
+        let before = cpu.cycles();
+        cpu.execute_raw(&mut bus, asm::arm("mov r1, r2, lsl r0"));
+        assert_eq!(cpu.regs[1], 0x11);
+        assert_eq!(cpu.cycles() - before, 1);
+
+        cpu.regs[0] = 3;
+        cpu.execute_raw(&mut bus, asm::arm("mov r1, r2, lsl r0"));
+        assert_eq!(cpu.regs[1], 0x88);
+
+        // The PC reads 12 ahead as an operand of a register-specified shift, 8 otherwise
+        cpu.set_pc(0x200);
+        cpu.regs[0] = 0;
+        cpu.execute_raw(&mut bus, asm::arm("add r1, pc, pc, lsl r0"));
+        assert_eq!(cpu.regs[1], 0x20C * 2);
+        cpu.set_pc(0x200);
+        cpu.execute_raw(&mut bus, asm::arm("add r1, pc, pc, lsl #0"));
+        assert_eq!(cpu.regs[1], 0x208 * 2);
+    }
+
+    #[test]
+    fn shift_matrix_over_types_and_amounts() {
+        const V: u32 = 0x8000_0001;
+        // (type, amount, result, carry out); None keeps the incoming carry
+        let by_register: [(u32, u32, u32, Option<bool>); 20] = [
+            (0, 0, V, None), (0, 1, 0x0000_0002, Some(true)), (0, 31, 0x8000_0000, Some(false)),
+            (0, 32, 0, Some(true)), (0, 33, 0, Some(false)),
+            (1, 0, V, None), (1, 1, 0x4000_0000, Some(true)), (1, 31, 0x0000_0001, Some(false)),
+            (1, 32, 0, Some(true)), (1, 33, 0, Some(false)),
+            (2, 0, V, None), (2, 1, 0xC000_0000, Some(true)), (2, 31, 0xFFFF_FFFF, Some(false)),
+            (2, 32, 0xFFFF_FFFF, Some(true)), (2, 33, 0xFFFF_FFFF, Some(true)),
+            (3, 0, V, None), (3, 1, 0xC000_0000, Some(true)), (3, 31, 0x0000_0003, Some(false)),
+            (3, 32, V, Some(true)), (3, 33, 0xC000_0000, Some(true)),
+        ];
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x1000);
+        for carry_in in [false, true] {
+            for &(typ, amount, result, carry) in &by_register {
+                cpu.set_pc(0x100);
+                cpu.regs[2] = V;
+                cpu.regs[0] = amount;
+                cpu.cpsr.set_c(carry_in);
+                // MOVS r1, r2, <typ> r0
+                cpu.execute_raw(&mut bus, 0xE1B0_1012 | typ << 5);
+                assert_eq!(cpu.regs[1], result, "type {} by r0={}", typ, amount);
+                assert_eq!(cpu.cpsr.c(), carry.unwrap_or(carry_in), "type {} by r0={} carry", typ, amount);
+            }
+        }
+
+        // Immediate amounts of 0 encode LSL #0, LSR #32, ASR #32 and RRX
+        let rrx = |c: bool| (V >> 1) | (c as u32) << 31;
+        for carry_in in [false, true] {
+            let by_immediate: [(u32, u32, u32, Option<bool>); 12] = [
+                (0, 0, V, None), (0, 1, 0x0000_0002, Some(true)), (0, 31, 0x8000_0000, Some(false)),
+                (1, 0, 0, Some(true)), (1, 1, 0x4000_0000, Some(true)), (1, 31, 0x0000_0001, Some(false)),
+                (2, 0, 0xFFFF_FFFF, Some(true)), (2, 1, 0xC000_0000, Some(true)), (2, 31, 0xFFFF_FFFF, Some(false)),
+                (3, 0, rrx(carry_in), Some(true)), (3, 1, 0xC000_0000, Some(true)), (3, 31, 0x0000_0003, Some(false)),
+            ];
+            for &(typ, imm, result, carry) in &by_immediate {
+                cpu.set_pc(0x100);
+                cpu.regs[2] = V;
+                cpu.cpsr.set_c(carry_in);
+                // MOVS r1, r2, <typ> #imm
+                cpu.execute_raw(&mut bus, 0xE1B0_1002 | imm << 7 | typ << 5);
+                assert_eq!(cpu.regs[1], result, "type {} #{}", typ, imm);
+                assert_eq!(cpu.cpsr.c(), carry.unwrap_or(carry_in), "type {} #{} carry", typ, imm);
+            }
+        }
+    }
+
+    #[test]
+    fn thumb_swi_round_trips_through_an_arm_handler() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        // The handler reads the comment field back through LR, as the BIOS does
+        let handler = asm::arm_program(0x08, "ldrh r0, [lr, #-2]\nand r0, r0, #0xFF\nmovs pc, lr");
+        bus.mem[0x08..0x08 + handler.len()].copy_from_slice(&handler);
+        bus.write16(0x100, 0xDF2A); // SWI 0x2A
+        bus.write16(0x102, 0x0011); // LSLS r1, r2, #0
+        cpu.write_reg(2, 7);
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        cpu.set_entry_point(&mut bus, 0x100);
+        let old_cpsr = cpu.cpsr().raw();
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Supervisor);
+        assert_eq!(cpu.state(), CpuState::Arm);
+        assert_eq!(cpu.pc(), 0x08);
+        assert_eq!(cpu.read_reg(14), 0x102);
+        assert_eq!(cpu.spsr(), Some(old_cpsr));
+
+        for _ in 0..4 {
+            cpu.step(&mut bus);
+        }
+        assert_eq!(cpu.read_reg(0), 0x2A);
+        assert_eq!(cpu.read_reg(1), 7);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+        assert_eq!(cpu.mode(), CpuMode::System);
+    }
+
+    #[test]
+    fn thumb_bkpt_is_undefined() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        bus.write16(0x100, 0xBE01);
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        cpu.set_entry_point(&mut bus, 0x100);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Undefined);
+        assert_eq!(cpu.pc(), Exception::Undefined.vector());
+        assert_eq!(cpu.read_reg(14), 0x102);
+        assert_eq!(cpu.take_unimplemented(), None);
+    }
+
+    #[test]
+    fn thumb_formats_decode_from_their_fixed_bits() {
+        // First and last encodings of each format, plus the holes between them
+        let cases: [(u16, u8); 44] = [
+            (0x0000, 1), (0x17FF, 1),
+            (0x1800, 2), (0x1FFF, 2),
+            (0x2000, 3), (0x3FFF, 3),
+            (0x4000, 4), (0x43FF, 4),
+            (0x4400, 5), (0x47FF, 5),
+            (0x4800, 6), (0x4FFF, 6),
+            (0x5000, 7), (0x5DFF, 7),
+            (0x5200, 8), (0x5FFF, 8),
+            (0x6000, 9), (0x7FFF, 9),
+            (0x8000, 10), (0x8FFF, 10),
+            (0x9000, 11), (0x9FFF, 11),
+            (0xA000, 12), (0xAFFF, 12),
+            (0xB000, 13), (0xB0FF, 13),
+            (0xB400, 14), (0xBDFF, 14),
+            (0xC000, 15), (0xCFFF, 15),
+            (0xD000, 16), (0xDDFF, 16),
+            (0xDF00, 17), (0xDFFF, 17),
+            (0xE000, 18), (0xE7FF, 18),
+            (0xF000, 19), (0xFFFF, 19),
+            (0xB100, 0), (0xB600, 0), (0xBE00, 0),
+            (0xDE00, 0), (0xE800, 0), (0xEFFF, 0),
+        ];
+        for (instr, format) in cases {
+            assert_eq!(ThumbFormat::decode(instr).number(), format, "{:#06x}", instr);
+        }
+    }
+
+    #[test]
+    fn thumb_step_dispatches_on_the_decoded_format() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        let program = [
+            0x2107, // MOVS r1, #7      (format 3)
+            0x180A, // ADDS r2, r1, r0  (format 2)
+            0x4051, // EORS r1, r2      (format 4)
+            0xE7FE, // B .              (format 18)
+        ];
+        for (i, half) in program.iter().enumerate() {
+            bus.write16(0x100 + i as u32 * 2, *half);
+        }
+        cpu.write_reg(0, 1);
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        cpu.set_entry_point(&mut bus, 0x100);
+
+        for _ in 0..5 {
+            cpu.step(&mut bus);
+        }
+        assert_eq!(cpu.read_reg(1), 7 ^ 8);
+        assert_eq!(cpu.read_reg(2), 8);
+        assert_eq!(cpu.pc(), 0x106);
+        assert_eq!(cpu.take_unimplemented(), None);
+    }
+
+    // Runs one Thumb instruction on a fresh CPU with r0.. set from `regs`, C set
+    // to `carry` and V set, and returns the CPU with its NZCV flags
+    fn run_thumb_flags(src: &str, regs: &[u32], carry: bool) -> (Cpu, (bool, bool, bool, bool)) {
+        let mut bus = MockBus::new(0x200);
+        let mut cpu = Cpu::new();
+        cpu.set_state(CpuState::Thumb);
+        cpu.set_pc(0x100);
+        for (reg, &value) in regs.iter().enumerate() {
+            cpu.write_reg(reg, value);
+        }
+        cpu.cpsr_mut().set_c(carry);
+        cpu.cpsr_mut().set_v(true);
+        cpu.execute_raw_thumb(&mut bus, asm::thumb(src));
+        let flags = (cpu.cpsr().n(), cpu.cpsr().z(), cpu.cpsr().c(), cpu.cpsr().v());
+        (cpu, flags)
+    }
+
+    #[test]
+    fn thumb_shift_and_add_subtract_set_flags_like_arm() {
+        // (source, r1, r2, result, (n, z, c, v)); V is preset and only ADD/SUB change it
+        let cases: &[(&str, u32, u32, u32, (bool, bool, bool, bool))] = &[
+            ("lsls r0, r1, #5", 0x0C00_0001, 0, 0x8000_0020, (true, false, true, true)),
+            ("lsls r0, r1, #5", 0x0400_0000, 0, 0x8000_0000, (true, false, false, true)),
+            ("lsls r0, r1, #0", 0, 0, 0, (false, true, true, true)),
+            ("lsrs r0, r1, #32", 0x8000_0000, 0, 0, (false, true, true, true)),
+            ("asrs r0, r1, #32", 0x8000_0000, 0, 0xFFFF_FFFF, (true, false, true, true)),
+            ("adds r0, r1, r2", 0x7FFF_FFFF, 1, 0x8000_0000, (true, false, false, true)),
+            ("adds r0, r1, r2", 0xFFFF_FFFF, 1, 0, (false, true, true, false)),
+            ("adds r0, r1, #7", 1, 0, 8, (false, false, false, false)),
+            ("subs r0, r1, #3", 3, 0, 0, (false, true, true, false)),
+            ("subs r0, r1, #3", 2, 0, 0xFFFF_FFFF, (true, false, false, false)),
+            ("subs r0, r1, #3", 0x8000_0002, 0, 0x7FFF_FFFF, (false, false, true, true)),
+            ("subs r0, r1, r2", 5, 7, 0xFFFF_FFFE, (true, false, false, false)),
+        ];
+        for &(src, r1, r2, result, flags) in cases {
+            let (cpu, got) = run_thumb_flags(src, &[0, r1, r2], true);
+            assert_eq!((cpu.read_reg(0), got), (result, flags), "{} with {:#x}, {:#x}", src, r1, r2);
+        }
+    }
+
+    #[test]
+    fn thumb_alu_ops_set_flags_like_arm() {
+        // (op, rd, rs, carry in, rd after, (n, z, c, v)); V starts set
+        let cases: &[(&str, u32, u32, bool, u32, (bool, bool, bool, bool))] = &[
+            ("ands", 0xF0F0_0000, 0x8000_FFFF, false, 0x8000_0000, (true, false, false, true)),
+            ("eors", 0x1234_5678, 0x1234_5678, true, 0, (false, true, true, true)),
+            ("lsls", 0x0000_0003, 31, false, 0x8000_0000, (true, false, true, true)),
+            ("lsls", 0x0000_0003, 0, true, 0x0000_0003, (false, false, true, true)),
+            ("lsrs", 0x8000_0001, 32, false, 0, (false, true, true, true)),
+            ("asrs", 0x8000_0000, 40, false, 0xFFFF_FFFF, (true, false, true, true)),
+            ("adcs", 0xFFFF_FFFF, 0, true, 0, (false, true, true, false)),
+            ("adcs", 0x7FFF_FFFF, 0, true, 0x8000_0000, (true, false, false, true)),
+            ("sbcs", 5, 5, false, 0xFFFF_FFFF, (true, false, false, false)),
+            ("sbcs", 5, 5, true, 0, (false, true, true, false)),
+            ("rors", 0x0000_0001, 1, false, 0x8000_0000, (true, false, true, true)),
+            ("rors", 0x8000_0001, 32, false, 0x8000_0001, (true, false, true, true)),
+            ("tst", 0x0F, 0xF0, true, 0x0F, (false, true, true, true)),
+            ("negs", 0, 1, false, 0xFFFF_FFFF, (true, false, false, false)),
+            ("negs", 0, 0x8000_0000, false, 0x8000_0000, (true, false, false, true)),
+            ("negs", 0, 0, false, 0, (false, true, true, false)),
+            ("cmp", 3, 5, true, 3, (true, false, false, false)),
+            ("cmn", 0xFFFF_FFFF, 1, false, 0xFFFF_FFFF, (false, true, true, false)),
+            ("orrs", 0x8000_0000, 1, false, 0x8000_0001, (true, false, false, true)),
+            ("muls", 0xFFFF_FFFF, 5, true, 0xFFFF_FFFB, (true, false, true, true)),
+            ("muls", 0x10000, 0x10000, false, 0, (false, true, false, true)),
+            ("bics", 0xFF, 0x0F, true, 0xF0, (false, false, true, true)),
+            ("mvns", 0, 0xFFFF_FFFF, false, 0, (false, true, false, true)),
+        ];
+        for &(op, rd, rs, carry, result, flags) in cases {
+            let (cpu, got) = run_thumb_flags(&format!("{} r0, r1", op), &[rd, rs], carry);
+            assert_eq!((cpu.read_reg(0), got), (result, flags), "{} {:#x}, {:#x}", op, rd, rs);
+            assert_eq!(cpu.read_reg(1), rs);
+        }
+    }
+
+    #[test]
+    fn thumb_hi_register_ops() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x400);
+        let program = [
+            asm::thumb("mov r8, r0"),
+            asm::thumb("cmp r8, r0"),
+            asm::thumb("add pc, r1"), // to 0x104 + 4 + 0x0B, aligned to 0x112
+        ];
+        for (i, half) in program.iter().enumerate() {
+            bus.write16(0x100 + i as u32 * 2, *half);
+        }
+        bus.write16(0x112, asm::thumb("bx lr"));
+        write32_le(&mut bus.mem, 0x200, asm::arm("mov r2, #1"));
+        cpu.write_reg(0, 0x8000_0000);
+        cpu.write_reg(1, 0x0B);
+        cpu.write_reg(14, 0x200);
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        cpu.set_entry_point(&mut bus, 0x100);
+
+        // MOV leaves the flags alone even with a negative value
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(8), 0x8000_0000);
+        assert!(!cpu.cpsr().n());
+
+        cpu.step(&mut bus);
+        assert!(cpu.cpsr().z());
+        assert!(cpu.cpsr().c());
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 0x112);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+        assert!(cpu.cpsr().z(), "ADD to PC sets no flags");
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.state(), CpuState::Arm);
+        assert_eq!(cpu.pc(), 0x200);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(2), 1);
+    }
+
+    #[test]
+    fn thumb_bl_survives_an_irq_between_its_halves() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x2100);
+        let load = |bus: &mut MockBus, at: u32, code: Vec<u8>| {
+            bus.mem[at as usize..at as usize + code.len()].copy_from_slice(&code);
+        };
+        write32_le(&mut bus.mem, 0x18, asm::arm("subs pc, lr, #4"));
+        load(&mut bus, 0x100, asm::thumb_program(0x100, "bl 0x2000\nlsls r1, r2, #0\nb ."));
+        load(&mut bus, 0x2000, asm::thumb_program(0x2000, "bl 0x200\nbx r4"));
+        load(&mut bus, 0x200, asm::thumb_program(0x200, "bx lr"));
+        cpu.write_reg(2, 0x77);
+        cpu.write_reg(4, 0x105); // back to the LSLS after the first BL
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        cpu.cpsr_mut().set_i(false);
+        cpu.set_entry_point(&mut bus, 0x100);
+
+        // The first half leaves PC + offset in LR, which the IRQ must not disturb
+        cpu.step(&mut bus);
+        let partial = cpu.read_reg(14);
+        assert_eq!(partial, 0x1104, "PC + 4 plus the upper 0x1000 of the offset");
+        cpu.trigger_irq(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Irq);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert_eq!(cpu.read_reg(14), partial);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 0x2000);
+        assert_eq!(cpu.read_reg(14), 0x105);
+
+        // A backward BL, then returns through both link values
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 0x200);
+        assert_eq!(cpu.read_reg(14), 0x2005);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.pc(), 0x2004);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+        cpu.step(&mut bus);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(1), 0x77);
+    }
+
+    #[test]
+    fn thumb_push_and_pop_with_link_registers() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x400);
+        let code = asm::thumb_program(0x100, "push {r0-r3, lr}\npop {r4-r7, pc}");
+        bus.mem[0x100..0x100 + code.len()].copy_from_slice(&code);
+        for r in 0..4 {
+            cpu.write_reg(r, 0x10 * (r as u32 + 1));
+        }
+        cpu.write_reg(13, 0x300);
+        cpu.write_reg(14, 0x201); // Thumb-style return address
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        cpu.set_entry_point(&mut bus, 0x100);
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(13), 0x300 - 5 * 4);
+        for (i, expected) in [0x10, 0x20, 0x30, 0x40, 0x201].iter().enumerate() {
+            assert_eq!(bus.read32(0x2EC + i as u32 * 4), *expected, "slot {}", i);
+        }
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.read_reg(13), 0x300);
+        assert_eq!([4, 5, 6, 7].map(|r| cpu.read_reg(r)), [0x10, 0x20, 0x30, 0x40]);
+        assert_eq!(cpu.pc(), 0x200);
+        assert_eq!(cpu.state(), CpuState::Thumb);
+    }
+
+    #[test]
+    fn thumb_branches_sign_extend_their_offsets() {
+        // (base, opcode, Z flag, target) where the target is PC + 4 + offset * 2
+        let cases = [
+            (0x1000, 0xD002, true, 0x1008),  // BEQ +4
+            (0x1000, 0xD0FD, true, 0x0FFE),  // BEQ -6
+            (0x1000, 0xD07F, true, 0x1102),  // BEQ, largest forward offset
+            (0x1000, 0xD080, true, 0x0F04),  // BEQ, largest backward offset
+            (0x1000, 0xD07F, false, 0x1002), // BEQ not taken
+            (0x1000, 0xD17F, true, 0x1002),  // BNE not taken
+            (0x1000, 0xE002, false, 0x1008), // B +4
+            (0x1000, 0xE7FD, false, 0x0FFE), // B -6
+            (0x1000, 0xE3FF, false, 0x1802), // B, largest forward offset
+            (0x1000, 0xE400, false, 0x0804), // B, largest backward offset
+        ];
+        for (base, opcode, z, target) in cases {
+            let mut cpu = Cpu::new();
+            let mut bus = MockBus::new(0x2000);
+            cpu.cpsr_mut().set_state(CpuState::Thumb);
+            cpu.cpsr_mut().set_z(z);
+            bus.write16(base, opcode);
+            // Whatever executes next proves the pipeline was refilled from the target
+            bus.write16(target, 0x2007); // MOVS r0, #7
+
+            cpu.set_pc(base);
+            cpu.step(&mut bus);
+            assert_eq!(cpu.pc(), target, "{opcode:#06x} Z={z}");
+            cpu.step(&mut bus);
+            assert_eq!(cpu.read_reg(0), 7, "{opcode:#06x} Z={z}");
+        }
+    }
+
+    #[test]
+    fn thumb_load_store_addressing_forms() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x1100);
+        cpu.cpsr_mut().set_state(CpuState::Thumb);
+        let run = |cpu: &mut Cpu, bus: &mut MockBus, src: &str| cpu.execute_raw_thumb(bus, asm::thumb(src));
+
+        // Format 6: the base is PC + 4 with bit 1 cleared, whichever halfword the LDR is in
+        write32_le(&mut bus.mem, 0x1008, 0xCAFE_BABE);
+        for pc in [0x1000, 0x1002] {
+            cpu.set_pc(pc);
+            cpu.write_reg(0, 0);
+            run(&mut cpu, &mut bus, "ldr r0, [pc, #4]");
+            assert_eq!(cpu.read_reg(0), 0xCAFE_BABE, "pc {pc:#x}");
+        }
+
+        // Format 7: register offset, word and byte
+        cpu.set_pc(0x800);
+        cpu.write_reg(1, 0x80);
+        cpu.write_reg(2, 4);
+        cpu.write_reg(0, 0x8899_AABB);
+        run(&mut cpu, &mut bus, "str r0, [r1, r2]");
+        assert_eq!(bus.read32(0x84), 0x8899_AABB);
+        run(&mut cpu, &mut bus, "ldrb r3, [r1, r2]");
+        assert_eq!(cpu.read_reg(3), 0xBB);
+        run(&mut cpu, &mut bus, "strb r2, [r1, r2]");
+        run(&mut cpu, &mut bus, "ldr r3, [r1, r2]");
+        assert_eq!(cpu.read_reg(3), 0x8899_AA04);
+
+        // Format 8: sign extension
+        write32_le(&mut bus.mem, 0x88, 0x0000_8080);
+        cpu.write_reg(2, 8);
+        run(&mut cpu, &mut bus, "ldsb r3, [r1, r2]");
+        assert_eq!(cpu.read_reg(3), 0xFFFF_FF80);
+        run(&mut cpu, &mut bus, "ldsh r3, [r1, r2]");
+        assert_eq!(cpu.read_reg(3), 0xFFFF_8080);
+        run(&mut cpu, &mut bus, "ldrh r3, [r1, r2]");
+        assert_eq!(cpu.read_reg(3), 0x8080);
+        cpu.write_reg(0, 0x1234_5678);
+        run(&mut cpu, &mut bus, "strh r0, [r1, r2]");
+        assert_eq!(bus.read32(0x88), 0x0000_5678);
+
+        // Format 9: word offsets are scaled by 4, byte offsets are not
+        run(&mut cpu, &mut bus, "str r0, [r1, #8]");
+        assert_eq!(bus.read32(0x88), 0x1234_5678);
+        run(&mut cpu, &mut bus, "ldr r3, [r1, #4]");
+        assert_eq!(cpu.read_reg(3), 0x8899_AA04);
+        run(&mut cpu, &mut bus, "strb r0, [r1, #9]");
+        assert_eq!(bus.read32(0x88), 0x1234_7878);
+        run(&mut cpu, &mut bus, "ldrb r3, [r1, #11]");
+        assert_eq!(cpu.read_reg(3), 0x12);
+
+        // Format 10: halfword offsets are scaled by 2
+        run(&mut cpu, &mut bus, "ldrh r3, [r1, #10]");
+        assert_eq!(cpu.read_reg(3), 0x1234);
+        run(&mut cpu, &mut bus, "strh r2, [r1, #8]");
+        assert_eq!(bus.read32(0x88), 0x1234_0008);
+
+        // Format 11: SP-relative, scaled by 4
+        cpu.write_reg(13, 0x80);
+        run(&mut cpu, &mut bus, "ldr r4, [sp, #8]");
+        assert_eq!(cpu.read_reg(4), 0x1234_0008);
+        run(&mut cpu, &mut bus, "str r2, [sp, #16]");
+        assert_eq!(bus.read32(0x90), 8);
+    }
+
+    #[test]
+    fn fiq_swaps_in_its_banked_registers_and_back() {
+        let mut cpu = Cpu::new();
+        let mut bus = MockBus::new(0x200);
+        write32_le(&mut bus.mem, 0x1C, asm::arm("subs pc, lr, #4"));
+        write32_le(&mut bus.mem, 0x100, asm::arm("mov r0, r0"));
+
+        cpu.set_mode(CpuMode::Fiq);
+        for r in 8..=14 {
+            cpu.write_reg(r, 0xF1F0_0000 + r as u32);
+        }
+        cpu.set_mode(CpuMode::System);
+        for r in 8..=14 {
+            cpu.write_reg(r, 0x5550_0000 + r as u32);
+        }
+        cpu.cpsr_mut().set_f(false);
+        let old_cpsr = cpu.cpsr().raw();
+        cpu.set_pc(0x100);
+
+        cpu.raise_exception(Exception::Fiq);
+        cpu.step(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::Fiq);
+        assert_eq!(cpu.pc(), 0x1C);
+        assert!(cpu.cpsr().i() && cpu.cpsr().f());
+        assert_eq!(cpu.spsr(), Some(old_cpsr));
+        for r in 8..=13 {
+            assert_eq!(cpu.read_reg(r), 0xF1F0_0000 + r as u32, "r{r}_fiq");
+        }
+        assert_eq!(cpu.read_reg(14), 0x104, "LR_fiq is the interrupted instruction + 4");
+
+        cpu.step(&mut bus);
+        assert_eq!(cpu.mode(), CpuMode::System);
+        assert_eq!(cpu.pc(), 0x100);
+        assert_eq!(cpu.cpsr().raw(), old_cpsr);
+        for r in 8..=14 {
+            assert_eq!(cpu.read_reg(r), 0x5550_0000 + r as u32, "r{r} restored");
+        }
+    }
+
     #[test]
     fn conditional_swi_not_executed() {
         let mut cpu = Cpu::new();
@@ -0,0 +1,128 @@
+use std::collections::VecDeque;
+
+use log::Level;
+
+// Debug output interface understood by mGBA and used by homebrew print helpers:
+// the string goes into a 256-byte buffer and a flags write emits it
+pub const DEBUG_STRING: u32 = 0x04FF_F600;
+pub const DEBUG_FLAGS: u32 = 0x04FF_F700;
+pub const DEBUG_ENABLE: u32 = 0x04FF_F780;
+pub const DEBUG_BASE: u32 = DEBUG_STRING;
+pub const DEBUG_END: u32 = DEBUG_ENABLE + 1;
+
+const BUFFER_SIZE: usize = 0x100;
+const ENABLE_KEY: u16 = 0xC0DE;
+const ENABLE_ACK: u16 = 0x1DEA;
+const FLAG_SEND: u16 = 1 << 8;
+// Older messages are dropped once this many are waiting to be taken
+const MAX_PENDING: usize = 256;
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct DebugMessage {
+    pub level: Level,
+    pub text: String,
+}
+
+#[derive(Clone)]
+pub struct DebugPort {
+    enable: u16,
+    flags: u16,
+    buffer: [u8; BUFFER_SIZE],
+    messages: VecDeque<DebugMessage>,
+}
+
+impl Default for DebugPort {
+    fn default() -> Self {
+        Self { enable: 0, flags: 0, buffer: [0; BUFFER_SIZE], messages: VecDeque::new() }
+    }
+}
+
+impl DebugPort {
+    pub fn new() -> Self { Self::default() }
+
+    pub fn enabled(&self) -> bool { self.enable == ENABLE_KEY }
+
+    pub fn read8(&self, addr: u32) -> u8 {
+        match addr {
+            // Programs probe for the interface by reading back the acknowledgement
+            DEBUG_ENABLE if self.enabled() => ENABLE_ACK as u8,
+            0x04FF_F781 if self.enabled() => (ENABLE_ACK >> 8) as u8,
+            _ => 0,
+        }
+    }
+
+    pub fn write8(&mut self, addr: u32, value: u8) {
+        match addr {
+            DEBUG_ENABLE => self.enable = (self.enable & 0xFF00) | value as u16,
+            0x04FF_F781 => self.enable = (self.enable & 0x00FF) | ((value as u16) << 8),
+            _ if !self.enabled() => {}
+            DEBUG_STRING..DEBUG_FLAGS => self.buffer[(addr - DEBUG_STRING) as usize] = value,
+            DEBUG_FLAGS => self.flags = (self.flags & 0xFF00) | value as u16,
+            0x04FF_F701 => {
+                self.flags = (self.flags & 0x00FF) | ((value as u16) << 8);
+                if (self.flags & FLAG_SEND) != 0 {
+                    self.send();
+                }
+            }
+            _ => {}
+        }
+    }
+
+    fn send(&mut self) {
+        let len = self.buffer.iter().position(|&b| b == 0).unwrap_or(BUFFER_SIZE);
+        let text = String::from_utf8_lossy(&self.buffer[..len]).into_owned();
+        let level = match self.flags & 0x7 {
+            0 | 1 => Level::Error, // fatal, error
+            2 => Level::Warn,
+            3 => Level::Info,
+            _ => Level::Debug,
+        };
+        log::log!(target: "core::debug_port", level, "{}", text);
+
+        if self.messages.len() >= MAX_PENDING {
+            self.messages.pop_front();
+        }
+        self.messages.push_back(DebugMessage { level, text });
+        self.buffer.fill(0);
+        self.flags = 0;
+    }
+
+    /// Returns the messages the program printed since the last call.
+    pub fn take_messages(&mut self) -> Vec<DebugMessage> {
+        self.messages.drain(..).collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bus::{Bus, BusAccess};
+
+    fn print(bus: &mut Bus, text: &str, level: u16) {
+        for (i, b) in text.bytes().enumerate() {
+            bus.write8(DEBUG_STRING + i as u32, b);
+        }
+        bus.write16(DEBUG_FLAGS, FLAG_SEND | level);
+    }
+
+    #[test]
+    fn strings_are_captured_once_enabled() {
+        let mut bus = Bus::new();
+        print(&mut bus, "ignored", 3);
+        assert_eq!(bus.read16(DEBUG_ENABLE), 0);
+
+        bus.write16(DEBUG_ENABLE, ENABLE_KEY);
+        assert_eq!(bus.read16(DEBUG_ENABLE), ENABLE_ACK);
+
+        print(&mut bus, "hello from the rom", 3);
+        print(&mut bus, "low", 2);
+        assert_eq!(
+            bus.io.debug.take_messages(),
+            vec![
+                DebugMessage { level: Level::Info, text: "hello from the rom".to_string() },
+                DebugMessage { level: Level::Warn, text: "low".to_string() },
+            ]
+        );
+        assert!(bus.io.debug.take_messages().is_empty());
+    }
+}
@@ -0,0 +1,340 @@
+pub const DMA_BASE: u32 = 0x0400_00B0;
+pub const DMA_END: u32 = 0x0400_00DF;
+pub const FIFO_A: u32 = 0x0400_00A0;
+pub const FIFO_B: u32 = 0x0400_00A4;
+
+const DMA_ENABLE: u16 = 1 << 15;
+const DMA_IRQ: u16 = 1 << 14;
+const DMA_WORD: u16 = 1 << 10;
+const DMA_REPEAT: u16 = 1 << 9;
+
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum DmaTiming { Immediate, VBlank, HBlank, Special }
+
+#[derive(Default, Clone, Copy)]
+pub struct DmaChannel {
+    pub sad: u32,
+    pub dad: u32,
+    pub cnt_l: u16,
+    pub cnt_h: u16,
+    // Internal registers latched when the channel is enabled
+    src: u32,
+    dst: u32,
+    count: u32,
+    pending: bool,
+    // Last value moved by the channel, returned for sources it cannot read
+    latch: u32,
+}
+
+impl DmaChannel {
+    pub fn enabled(&self) -> bool { (self.cnt_h & DMA_ENABLE) != 0 }
+    pub fn repeat(&self) -> bool { (self.cnt_h & DMA_REPEAT) != 0 }
+    pub fn irq_enabled(&self) -> bool { (self.cnt_h & DMA_IRQ) != 0 }
+    pub fn word_transfer(&self) -> bool { (self.cnt_h & DMA_WORD) != 0 }
+    pub fn dst_control(&self) -> u16 { (self.cnt_h >> 5) & 0x3 }
+    pub fn src_control(&self) -> u16 { (self.cnt_h >> 7) & 0x3 }
+    pub fn internal_src(&self) -> u32 { self.src }
+    pub fn internal_dst(&self) -> u32 { self.dst }
+    pub fn internal_count(&self) -> u32 { self.count }
+
+    pub fn timing(&self) -> DmaTiming {
+        match (self.cnt_h >> 12) & 0x3 {
+            0 => DmaTiming::Immediate,
+            1 => DmaTiming::VBlank,
+            2 => DmaTiming::HBlank,
+            _ => DmaTiming::Special,
+        }
+    }
+
+    /// Performs one transfer burst through `bus` as channel `idx`, returning whether
+    /// the completion interrupt should be raised.
+    pub fn transfer<B: crate::bus::BusAccess>(&mut self, idx: usize, bus: &mut B) -> bool {
+        // Sound FIFO mode: always 4 words to a fixed destination, count untouched
+        let fifo = (idx == 1 || idx == 2) && self.timing() == DmaTiming::Special;
+        let word = fifo || self.word_transfer();
+        let unit: u32 = if word { 4 } else { 2 };
+        let units = if fifo { 4 } else { self.count };
+
+        let src_step = match self.src_control() {
+            1 => unit.wrapping_neg(),
+            2 => 0,
+            _ => unit,
+        };
+        let dst_step = match self.dst_control() {
+            _ if fifo => 0,
+            1 => unit.wrapping_neg(),
+            2 => 0,
+            _ => unit,
+        };
+
+        // Each unit goes through the bus on its own, so a burst that crosses
+        // regions picks up each region's width rules and side effects
+        for _ in 0..units {
+            // The BIOS and unmapped space below EWRAM are invisible to DMA
+            let readable = self.src >= 0x0200_0000;
+            if word {
+                if readable {
+                    self.latch = bus.read32(self.src & !3);
+                }
+                bus.write32(self.dst & !3, self.latch);
+            } else {
+                if readable {
+                    let value = bus.read16(self.src & !1) as u32;
+                    self.latch = value | (value << 16);
+                }
+                let shift = (self.dst & 2) * 8;
+                bus.write16(self.dst & !1, (self.latch >> shift) as u16);
+            }
+            self.src = self.src.wrapping_add(src_step);
+            self.dst = self.dst.wrapping_add(dst_step);
+        }
+
+        if self.repeat() && self.timing() != DmaTiming::Immediate {
+            if !fifo {
+                self.count = Dma::reload_count(idx, self.cnt_l);
+                if self.dst_control() == 3 {
+                    self.dst = self.dad & Dma::dst_mask(idx);
+                }
+            }
+        } else {
+            self.cnt_h &= !DMA_ENABLE;
+        }
+
+        self.irq_enabled()
+    }
+}
+
+#[derive(Default, Clone)]
+pub struct Dma {
+    pub channels: [DmaChannel; 4],
+}
+
+impl Dma {
+    pub fn new() -> Self { Self::default() }
+
+    fn src_mask(ch: usize) -> u32 { if ch == 0 { 0x07FF_FFFF } else { 0x0FFF_FFFF } }
+    fn dst_mask(ch: usize) -> u32 { if ch == 3 { 0x0FFF_FFFF } else { 0x07FF_FFFF } }
+
+    // A count of zero means the maximum transfer length
+    fn reload_count(ch: usize, cnt_l: u16) -> u32 {
+        let max = if ch == 3 { 0x10000 } else { 0x4000 };
+        match cnt_l as u32 & (max - 1) {
+            0 => max,
+            n => n,
+        }
+    }
+
+    pub fn read8(&self, addr: u32) -> u8 {
+        let offset = addr - DMA_BASE;
+        let ch = &self.channels[(offset / 12) as usize];
+        match offset % 12 {
+            10 => (ch.cnt_h & 0xFF) as u8,
+            11 => (ch.cnt_h >> 8) as u8,
+            _ => 0, // SAD, DAD and CNT_L are write-only
+        }
+    }
+
+    pub fn read16(&self, addr: u32) -> u16 {
+        self.read8(addr) as u16 | ((self.read8(addr + 1) as u16) << 8)
+    }
+
+    /// Reads any register byte, write-only ones included, for debuggers.
+    pub fn peek8(&self, addr: u32) -> u8 {
+        let offset = addr - DMA_BASE;
+        let ch = &self.channels[(offset / 12) as usize];
+        let value = match offset % 12 {
+            0..=3 => ch.sad,
+            4..=7 => ch.dad,
+            8..=9 => ch.cnt_l as u32,
+            _ => ch.cnt_h as u32,
+        };
+        (value >> ((offset % 4) * 8)) as u8
+    }
+
+    pub fn write8(&mut self, addr: u32, value: u8) {
+        let offset = addr - DMA_BASE;
+        let idx = (offset / 12) as usize;
+        let ch = &mut self.channels[idx];
+        let shift = (offset % 4) * 8;
+        match offset % 12 {
+            0..=3 => ch.sad = (ch.sad & !(0xFF << shift)) | ((value as u32) << shift),
+            4..=7 => ch.dad = (ch.dad & !(0xFF << shift)) | ((value as u32) << shift),
+            8 => ch.cnt_l = (ch.cnt_l & 0xFF00) | value as u16,
+            9 => ch.cnt_l = (ch.cnt_l & 0x00FF) | ((value as u16) << 8),
+            10 => ch.cnt_h = (ch.cnt_h & 0xFF00) | value as u16,
+            _ => {
+                let cnt_h = (ch.cnt_h & 0x00FF) | ((value as u16) << 8);
+                self.write_cnt_h(idx, cnt_h);
+            }
+        }
+    }
+
+    pub fn write16(&mut self, addr: u32, value: u16) {
+        let offset = addr - DMA_BASE;
+        let idx = (offset / 12) as usize;
+        if offset % 12 == 10 {
+            self.write_cnt_h(idx, value);
+        } else {
+            self.write8(addr, value as u8);
+            self.write8(addr + 1, (value >> 8) as u8);
+        }
+    }
+
+    // Enabling latches the addresses and count with the complete control value
+    fn write_cnt_h(&mut self, idx: usize, value: u16) {
+        let ch = &mut self.channels[idx];
+        let was_enabled = ch.enabled();
+        ch.cnt_h = value;
+        if ch.enabled() && !was_enabled {
+            ch.src = ch.sad & Self::src_mask(idx);
+            ch.dst = ch.dad & Self::dst_mask(idx);
+            ch.count = Self::reload_count(idx, ch.cnt_l);
+            ch.pending = ch.timing() == DmaTiming::Immediate;
+            log::debug!(
+                "DMA{} enabled: {:#010x} -> {:#010x} count={} cnt={:#06x}",
+                idx, ch.src, ch.dst, ch.count, ch.cnt_h
+            );
+        }
+    }
+
+    pub fn take_pending(&mut self) -> Option<usize> {
+        let idx = self.channels.iter().position(|ch| ch.pending)?;
+        self.channels[idx].pending = false;
+        Some(idx)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bus::{Bus, BusAccess};
+
+    #[test]
+    fn immediate_dma_copies_halfwords() {
+        let mut bus = Bus::new();
+        for i in 0..8u32 {
+            bus.write16(0x0200_0000 + i * 2, 0x1100 + i as u16);
+        }
+        bus.write32(DMA_BASE + 12 * 3, 0x0200_0000);
+        bus.write32(DMA_BASE + 12 * 3 + 4, 0x0300_0100);
+        bus.write16(DMA_BASE + 12 * 3 + 8, 8);
+        bus.write16(DMA_BASE + 12 * 3 + 10, DMA_ENABLE);
+
+        for i in 0..8u32 {
+            assert_eq!(bus.read16(0x0300_0100 + i * 2), 0x1100 + i as u16);
+        }
+        assert!(!bus.io.dma.channels[3].enabled());
+    }
+
+    #[test]
+    fn repeating_fifo_dma_transfers_four_words_per_trigger() {
+        let mut bus = Bus::new();
+        for i in 0..32u32 {
+            bus.write32(0x0200_0000 + i * 4, i);
+        }
+        bus.write32(DMA_BASE + 12, 0x0200_0000);
+        bus.write32(DMA_BASE + 12 + 4, FIFO_A);
+        bus.write16(DMA_BASE + 12 + 8, 0x20);
+        // Enable, repeat, special timing, 32-bit, dst increment (ignored in FIFO mode)
+        bus.write16(DMA_BASE + 12 + 10, DMA_ENABLE | DMA_REPEAT | (3 << 12) | DMA_WORD);
+
+        for trigger in 1..=3u32 {
+            bus.trigger_fifo_dma(0);
+            let ch = bus.io.dma.channels[1];
+            assert_eq!(ch.internal_src(), 0x0200_0000 + trigger * 16);
+            assert_eq!(ch.internal_dst(), FIFO_A);
+            assert_eq!(ch.internal_count(), 0x20);
+            assert!(ch.enabled());
+        }
+    }
+
+    #[test]
+    fn fifo_dma_follows_the_timer_selected_in_soundcnt_h() {
+        const SOUNDCNT_H: u32 = 0x0400_0082;
+        let mut bus = Bus::new();
+        let special = DMA_ENABLE | DMA_REPEAT | (3 << 12) | DMA_WORD;
+        // DMA1 feeds FIFO A; DMA0 and DMA3 in special timing must stay idle
+        for ch in [0u32, 1, 3] {
+            bus.write32(DMA_BASE + 12 * ch, 0x0200_0000);
+            bus.write32(DMA_BASE + 12 * ch + 4, FIFO_A);
+            bus.write16(DMA_BASE + 12 * ch + 8, 0x20);
+            bus.write16(DMA_BASE + 12 * ch + 10, special);
+        }
+        // FIFO A on timer 1, FIFO B on timer 0
+        bus.write16(SOUNDCNT_H, 1 << 10);
+
+        for at in 0..32 {
+            bus.timer_overflow(0, at);
+        }
+        assert_eq!(bus.io.dma.channels[1].internal_src(), 0x0200_0000, "timer 0 does not clock FIFO A");
+
+        // The empty FIFO is topped up at once, then whenever it is down to 16 samples
+        let src = |bus: &Bus| bus.io.dma.channels[1].internal_src() - 0x0200_0000;
+        bus.timer_overflow(1, 0);
+        assert_eq!(src(&bus), 16);
+        bus.timer_overflow(1, 1);
+        assert_eq!(src(&bus), 32);
+        for at in 2..16 {
+            bus.timer_overflow(1, at);
+        }
+        assert_eq!(src(&bus), 32);
+        bus.timer_overflow(1, 16);
+        assert_eq!(src(&bus), 48, "refilled after 16 more samples");
+        for ch in [0, 3] {
+            assert_eq!(bus.io.dma.channels[ch].internal_src(), 0x0200_0000);
+            assert!(bus.io.dma.channels[ch].enabled());
+        }
+    }
+
+    #[test]
+    fn repeating_hblank_dma_reloads_count_and_destination() {
+        let mut bus = Bus::new();
+        bus.write32(DMA_BASE, 0x0200_0000);
+        bus.write32(DMA_BASE + 4, 0x0300_0000);
+        bus.write16(DMA_BASE + 8, 2);
+        // dst control 3 = increment and reload
+        bus.write16(DMA_BASE + 10, DMA_ENABLE | DMA_REPEAT | (2 << 12) | (3 << 5));
+
+        bus.trigger_dma(DmaTiming::HBlank);
+        bus.trigger_dma(DmaTiming::HBlank);
+        let ch = bus.io.dma.channels[0];
+        assert_eq!(ch.internal_dst(), 0x0300_0000);
+        assert_eq!(ch.internal_src(), 0x0200_0008);
+        assert_eq!(ch.internal_count(), 2);
+    }
+
+    #[test]
+    fn dma_copies_rom_into_palette_ram() {
+        let mut bus = Bus::new();
+        let colors: [u16; 4] = [0x001F, 0x03E0, 0x7C00, 0x7FFF];
+        let rom: Vec<u8> = colors.iter().flat_map(|c| c.to_le_bytes()).collect();
+        bus.load_rom(&rom);
+
+        bus.write32(DMA_BASE + 12 * 3, 0x0800_0000);
+        bus.write32(DMA_BASE + 12 * 3 + 4, 0x0500_0000);
+        bus.write16(DMA_BASE + 12 * 3 + 8, 2);
+        bus.write16(DMA_BASE + 12 * 3 + 10, DMA_ENABLE | DMA_WORD);
+
+        for (i, color) in colors.iter().enumerate() {
+            assert_eq!(bus.read16(0x0500_0000 + i as u32 * 2), *color);
+        }
+    }
+
+    #[test]
+    fn dma_from_bios_repeats_last_transferred_value() {
+        let mut bus = Bus::new();
+        bus.write16(0x0200_0000, 0xBEEF);
+        bus.write32(DMA_BASE + 12 * 3, 0x0200_0000);
+        bus.write32(DMA_BASE + 12 * 3 + 4, 0x0300_0000);
+        bus.write16(DMA_BASE + 12 * 3 + 8, 1);
+        bus.write16(DMA_BASE + 12 * 3 + 10, DMA_ENABLE);
+
+        bus.write32(DMA_BASE + 12 * 3, 0x0000_0000);
+        bus.write32(DMA_BASE + 12 * 3 + 4, 0x0300_0010);
+        bus.write16(DMA_BASE + 12 * 3 + 8, 2);
+        bus.write16(DMA_BASE + 12 * 3 + 10, DMA_ENABLE);
+
+        assert_eq!(bus.read16(0x0300_0010), 0xBEEF);
+        assert_eq!(bus.read16(0x0300_0012), 0xBEEF);
+    }
+}
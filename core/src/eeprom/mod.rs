@@ -0,0 +1,191 @@
+/// Serial EEPROM save chip, mapped at 0x0D000000 and accessed one bit per
+/// halfword, normally through DMA3.
+///
+/// The 512-byte part takes 6-bit block addresses and the 8KB part 14-bit ones.
+/// Nothing in the cartridge says which is fitted, so the chip starts small and
+/// grows once a game sends a 14-bit address.
+#[derive(Clone)]
+pub struct Eeprom {
+    data: Vec<u8>,
+    // Bits of the command in progress, the first one sent in the highest position
+    command: u128,
+    command_len: u32,
+    // Block being streamed out by a read request, and how many bits have gone
+    reading: Option<(usize, u32)>,
+}
+
+pub const SMALL_SIZE: usize = 512;
+pub const LARGE_SIZE: usize = 8 * 1024;
+
+const READ_REQUEST: u128 = 0b11;
+const WRITE_REQUEST: u128 = 0b10;
+// A read answers with 4 junk bits before the 64 data bits
+const READ_PADDING: u32 = 4;
+const MIN_COMMAND_LEN: u32 = 2 + 6 + 1;
+
+impl Default for Eeprom {
+    fn default() -> Self {
+        Self { data: vec![0xFF; SMALL_SIZE], command: 0, command_len: 0, reading: None }
+    }
+}
+
+impl Eeprom {
+    pub fn new() -> Self { Self::default() }
+
+    /// Whether the ROM links Nintendo's EEPROM library, which embeds its version string.
+    pub fn detect(rom: &[u8]) -> bool { rom.windows(8).any(|w| w == b"EEPROM_V") }
+
+    pub fn size(&self) -> usize { self.data.len() }
+    pub fn data(&self) -> &[u8] { &self.data }
+
+    /// Replaces the chip's contents, e.g. from a save file. Images are padded or
+    /// cut to whichever of the two sizes fits, and an empty one leaves a blank chip.
+    pub fn set_data(&mut self, data: &[u8]) {
+        let size = if data.len() > SMALL_SIZE { LARGE_SIZE } else { SMALL_SIZE };
+        self.data = data.to_vec();
+        self.data.resize(size, 0xFF);
+        self.command = 0;
+        self.command_len = 0;
+        self.reading = None;
+    }
+
+    pub fn write_bit(&mut self, bit: bool) {
+        // Sending anything abandons a read that has not been fully clocked out
+        self.reading = None;
+        if self.command_len < 128 {
+            self.command = (self.command << 1) | bit as u128;
+            self.command_len += 1;
+        }
+    }
+
+    pub fn read_bit(&mut self) -> u16 {
+        // Commands have no terminator of their own; the game reads once it has sent
+        // all of it, and the bit count tells the address width
+        if self.command_len > 0 {
+            self.finish_command();
+        }
+        match self.reading {
+            Some((block, sent)) => {
+                let sent = sent + 1;
+                self.reading = (sent < READ_PADDING + 64).then_some((block, sent));
+                if sent <= READ_PADDING {
+                    0
+                } else {
+                    let bit = 64 - (sent - READ_PADDING);
+                    (u64::from_be_bytes(self.block(block).try_into().unwrap()) >> bit) as u16 & 1
+                }
+            }
+            // Writes complete at once, so the chip always reports ready
+            None => 1,
+        }
+    }
+
+    fn finish_command(&mut self) {
+        let (command, len) = (self.command, self.command_len);
+        self.command = 0;
+        self.command_len = 0;
+
+        // The shortest real command is a read with a 6-bit address
+        if len < MIN_COMMAND_LEN {
+            log::debug!("EEPROM: ignoring {}-bit command {:#x}", len, command);
+            return;
+        }
+
+        // Request bits, address, 64 data bits for writes, and a closing 0
+        let kind = command >> (len - 2) & 0b11;
+        let data_bits = if kind == WRITE_REQUEST { 64 } else { 0 };
+        let address_bits = len.saturating_sub(3 + data_bits);
+        if !(kind == READ_REQUEST || kind == WRITE_REQUEST) || !(address_bits == 6 || address_bits == 14) {
+            log::debug!("EEPROM: ignoring {}-bit command {:#x}", len, command);
+            return;
+        }
+        if address_bits == 14 && self.data.len() < LARGE_SIZE {
+            log::info!("EEPROM: 14-bit address seen, switching to {} bytes", LARGE_SIZE);
+            self.data.resize(LARGE_SIZE, 0xFF);
+        }
+
+        let address = (command >> (1 + data_bits)) as usize & ((1 << address_bits) - 1);
+        let block = address % (self.data.len() / 8);
+        if kind == READ_REQUEST {
+            self.reading = Some((block, 0));
+        } else {
+            let value = (command >> 1) as u64;
+            self.block_mut(block).copy_from_slice(&value.to_be_bytes());
+        }
+    }
+
+    fn block(&self, block: usize) -> &[u8] { &self.data[block * 8..block * 8 + 8] }
+    fn block_mut(&mut self, block: usize) -> &mut [u8] { &mut self.data[block * 8..block * 8 + 8] }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn send(eeprom: &mut Eeprom, value: u128, bits: u32) {
+        for i in (0..bits).rev() {
+            eeprom.write_bit((value >> i) & 1 != 0);
+        }
+    }
+
+    fn read_block(eeprom: &mut Eeprom, address: u128, address_bits: u32) -> u64 {
+        send(eeprom, READ_REQUEST << (address_bits + 1) | address << 1, address_bits + 3);
+        let bits: Vec<u16> = (0..68).map(|_| eeprom.read_bit()).collect();
+        assert_eq!(&bits[..4], &[0; 4]);
+        bits[4..].iter().fold(0, |v, &b| v << 1 | b as u64)
+    }
+
+    fn write_block(eeprom: &mut Eeprom, address: u128, address_bits: u32, value: u64) {
+        send(eeprom, WRITE_REQUEST << (address_bits + 65) | address << 65 | (value as u128) << 1, address_bits + 67);
+        assert_eq!(eeprom.read_bit(), 1);
+    }
+
+    #[test]
+    fn truncated_commands_are_ignored() {
+        let mut eeprom = Eeprom::new();
+        for bits in 1..MIN_COMMAND_LEN {
+            send(&mut eeprom, u128::MAX, bits);
+            assert_eq!(eeprom.read_bit(), 1, "{bits}-bit command");
+        }
+        assert_eq!(read_block(&mut eeprom, 0, 6), u64::MAX);
+    }
+
+    #[test]
+    fn six_bit_addresses_keep_the_small_size() {
+        let mut eeprom = Eeprom::new();
+        write_block(&mut eeprom, 0x3F, 6, 0x0123_4567_89AB_CDEF);
+        assert_eq!(eeprom.size(), SMALL_SIZE);
+        assert_eq!(read_block(&mut eeprom, 0x3F, 6), 0x0123_4567_89AB_CDEF);
+        assert_eq!(&eeprom.data()[0x1F8..0x1FA], &[0x01, 0x23]);
+    }
+
+    #[test]
+    fn fourteen_bit_address_expands_to_8kb() {
+        let mut eeprom = Eeprom::new();
+        write_block(&mut eeprom, 0x01, 6, 0x1111_2222_3333_4444);
+
+        // Only the low 10 bits of a 14-bit address select one of the 1024 blocks
+        write_block(&mut eeprom, 0x33FF, 14, 0xFEDC_BA98_7654_3210);
+        assert_eq!(eeprom.size(), LARGE_SIZE);
+        assert_eq!(read_block(&mut eeprom, 0x03FF, 14), 0xFEDC_BA98_7654_3210);
+        assert_eq!(read_block(&mut eeprom, 0x0001, 14), 0x1111_2222_3333_4444);
+        assert_eq!(read_block(&mut eeprom, 0x0002, 14), u64::MAX);
+    }
+
+    #[test]
+    fn set_data_picks_the_size_that_fits() {
+        let mut eeprom = Eeprom::new();
+        eeprom.set_data(&[0x12, 0x34]);
+        assert_eq!(eeprom.size(), SMALL_SIZE);
+        assert_eq!(read_block(&mut eeprom, 0, 6), 0x1234_FFFF_FFFF_FFFF);
+
+        let mut image = vec![0; SMALL_SIZE + 8];
+        image[SMALL_SIZE] = 0xAB;
+        eeprom.set_data(&image);
+        assert_eq!(eeprom.size(), LARGE_SIZE);
+        assert_eq!(read_block(&mut eeprom, (SMALL_SIZE / 8) as u128, 14), 0xAB00_0000_0000_0000);
+
+        eeprom.set_data(&[]);
+        assert_eq!(eeprom.data(), &[0xFF; SMALL_SIZE][..]);
+    }
+}
@@ -0,0 +1,83 @@
+use std::time::{Duration, Instant};
+
+/// One GBA frame of wall time: 280896 cycles at 16.78 MHz.
+pub const FRAME_TIME: Duration = Duration::from_nanos(16_742_706);
+
+/// Longest run of frames left undrawn before one is drawn regardless.
+pub const MAX_SKIPPED_FRAMES: u32 = 4;
+
+// Lag beyond this is written off rather than caught up, so a host stall (or a
+// debugger pause) does not leave the screen frozen for seconds afterwards
+const MAX_DEBT: Duration = Duration::from_nanos(FRAME_TIME.as_nanos() as u64 * 4);
+
+/// Decides which frames go undrawn when the host runs slower than the GBA.
+///
+/// Every frame is still emulated; skipping only saves the PPU render, which is
+/// usually enough to win the lost time back.
+#[derive(Default)]
+pub struct FrameSkipper {
+    last_frame: Option<Instant>,
+    // Wall time the host has fallen behind the GBA's frame rate
+    debt: Duration,
+    skipped: u32,
+    skipping: bool,
+}
+
+impl FrameSkipper {
+    pub fn new() -> Self { Self::default() }
+
+    /// Whether the frame in progress should go unrendered.
+    pub fn skipping(&self) -> bool { self.skipping }
+
+    /// Accounts for a frame that finished at `now` and decides about the next one.
+    pub fn end_frame(&mut self, now: Instant) {
+        if let Some(last) = self.last_frame {
+            let elapsed = now.saturating_duration_since(last);
+            self.debt = (self.debt + elapsed).saturating_sub(FRAME_TIME).min(MAX_DEBT);
+        }
+        self.last_frame = Some(now);
+        self.skipping = self.debt >= FRAME_TIME && self.skipped < MAX_SKIPPED_FRAMES;
+        self.skipped = if self.skipping { self.skipped + 1 } else { 0 };
+    }
+
+    /// Forgets the time between the last frame and the next, e.g. across a pause.
+    pub fn restart(&mut self) { self.last_frame = None; }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn slow_frames_are_skipped_until_caught_up() {
+        let mut skipper = FrameSkipper::new();
+        let mut now = Instant::now();
+        skipper.end_frame(now);
+        now += FRAME_TIME;
+        skipper.end_frame(now);
+        assert!(!skipper.skipping());
+
+        // A frame that took three frames' time leaves two to win back
+        now += FRAME_TIME * 3;
+        skipper.end_frame(now);
+        assert!(skipper.skipping());
+        now += FRAME_TIME / 2;
+        skipper.end_frame(now);
+        assert!(skipper.skipping());
+        now += FRAME_TIME / 2;
+        skipper.end_frame(now);
+        assert!(skipper.skipping());
+        now += FRAME_TIME / 2;
+        skipper.end_frame(now);
+        assert!(!skipper.skipping());
+
+        // Lagging far behind still draws every fifth frame
+        let mut drawn = 0;
+        for _ in 0..10 {
+            now += FRAME_TIME * 10;
+            skipper.end_frame(now);
+            drawn += !skipper.skipping() as u32;
+        }
+        assert_eq!(drawn, 2);
+    }
+}
@@ -0,0 +1,56 @@
+use std::collections::VecDeque;
+
+use crate::cpu::CpuSnapshot;
+
+/// What one instruction changed, enough to undo it.
+#[derive(Clone, Debug)]
+pub struct StepRecord {
+    pub cpu: CpuSnapshot,
+    /// Previous contents of every memory byte written, in write order
+    pub writes: Vec<(u32, u8)>,
+    pub instructions: u64,
+}
+
+/// Undo records for the most recent instructions, oldest first.
+///
+/// Only the CPU and memory contents are kept; IO registers, timers and the
+/// scheduler carry on from where they were.
+#[derive(Debug)]
+pub struct StepHistory {
+    records: VecDeque<StepRecord>,
+    depth: usize,
+}
+
+impl StepHistory {
+    pub fn new(depth: usize) -> Self { Self { records: VecDeque::with_capacity(depth), depth } }
+
+    pub fn depth(&self) -> usize { self.depth }
+    pub fn len(&self) -> usize { self.records.len() }
+    pub fn is_empty(&self) -> bool { self.records.is_empty() }
+
+    pub fn push(&mut self, record: StepRecord) {
+        if self.records.len() == self.depth {
+            self.records.pop_front();
+        }
+        self.records.push_back(record);
+    }
+
+    pub fn pop(&mut self) -> Option<StepRecord> { self.records.pop_back() }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn oldest_records_fall_off_the_end() {
+        let mut history = StepHistory::new(2);
+        for instructions in 0..3 {
+            history.push(StepRecord { cpu: CpuSnapshot::default(), writes: Vec::new(), instructions });
+        }
+        assert_eq!(history.len(), 2);
+        assert_eq!(history.pop().map(|r| r.instructions), Some(2));
+        assert_eq!(history.pop().map(|r| r.instructions), Some(1));
+        assert!(history.pop().is_none());
+    }
+}
@@ -1,3 +1,14 @@
+use crate::apu::{Apu, SOUND_BASE, SOUND_END};
+use crate::debug_port::DebugPort;
+use crate::dma::{Dma, DMA_BASE, DMA_END, FIFO_A};
+use crate::timer::Timers;
+
+pub mod registers;
+
+// Bit 3 selects CGB mode; only the BIOS can set it, so on a GBA it always reads back 0.
+const DISPCNT_WRITABLE: u16 = 0xFFF7;
+
+#[derive(Clone)]
 pub struct Io {
     pub dispcnt: u16,
     pub dispstat: u16,
@@ -27,6 +38,16 @@ pub struct Io {
     pub bg3x: i32,
     pub bg3y: i32,
     pub mosaic: u16,
+    pub greenswap: u16,
+    pub win0h: u16,
+    pub win1h: u16,
+    pub win0v: u16,
+    pub win1v: u16,
+    pub winin: u16,
+    pub winout: u16,
+    pub bldcnt: u16,
+    pub bldalpha: u16,
+    pub bldy: u16,
 
     pub keyinput: u16,
     pub keycnt: u16,
@@ -34,6 +55,12 @@ pub struct Io {
     pub ie: u16,
     pub if_: u16,
     pub ime: u16,
+    pub waitcnt: u16,
+
+    pub apu: Apu,
+    pub dma: Dma,
+    pub timers: Timers,
+    pub debug: DebugPort,
 
     pub postflg: u8,
     pub haltcnt: u8,
@@ -71,6 +98,16 @@ impl Default for Io {
             bg3x: 0,
             bg3y: 0,
             mosaic: 0,
+            greenswap: 0,
+            win0h: 0,
+            win1h: 0,
+            win0v: 0,
+            win1v: 0,
+            winin: 0,
+            winout: 0,
+            bldcnt: 0,
+            bldalpha: 0,
+            bldy: 0,
 
             keyinput: 0x03FF,
             keycnt: 0,
@@ -78,6 +115,12 @@ impl Default for Io {
             ie: 0,
             if_: 0,
             ime: 0,
+            waitcnt: 0,
+
+            apu: Apu::new(),
+            dma: Dma::new(),
+            timers: Timers::new(),
+            debug: DebugPort::new(),
 
             postflg: 0,
             haltcnt: 0,
@@ -93,6 +136,8 @@ impl Io {
         match addr {
             0x0400_0000 => (self.dispcnt & 0xFF) as u8,
             0x0400_0001 => (self.dispcnt >> 8) as u8,
+            0x0400_0002 => (self.greenswap & 0xFF) as u8,
+            0x0400_0003 => (self.greenswap >> 8) as u8,
             0x0400_0004 => (self.dispstat & 0xFF) as u8,
             0x0400_0005 => (self.dispstat >> 8) as u8,
             0x0400_0006 => (self.vcount & 0xFF) as u8,
@@ -153,8 +198,29 @@ impl Io {
             0x0400_003D => ((self.bg3y as u32 >> 8) & 0xFF) as u8,
             0x0400_003E => ((self.bg3y as u32 >> 16) & 0xFF) as u8,
             0x0400_003F => ((self.bg3y as u32 >> 24) & 0xFF) as u8,
+            0x0400_0040 => (self.win0h & 0xFF) as u8,
+            0x0400_0041 => (self.win0h >> 8) as u8,
+            0x0400_0042 => (self.win1h & 0xFF) as u8,
+            0x0400_0043 => (self.win1h >> 8) as u8,
+            0x0400_0044 => (self.win0v & 0xFF) as u8,
+            0x0400_0045 => (self.win0v >> 8) as u8,
+            0x0400_0046 => (self.win1v & 0xFF) as u8,
+            0x0400_0047 => (self.win1v >> 8) as u8,
+            0x0400_0048 => (self.winin & 0xFF) as u8,
+            0x0400_0049 => (self.winin >> 8) as u8,
+            0x0400_004A => (self.winout & 0xFF) as u8,
+            0x0400_004B => (self.winout >> 8) as u8,
             0x0400_004C => (self.mosaic & 0xFF) as u8,
             0x0400_004D => (self.mosaic >> 8) as u8,
+            0x0400_0050 => (self.bldcnt & 0xFF) as u8,
+            0x0400_0051 => (self.bldcnt >> 8) as u8,
+            0x0400_0052 => (self.bldalpha & 0xFF) as u8,
+            0x0400_0053 => (self.bldalpha >> 8) as u8,
+            0x0400_0054 => (self.bldy & 0xFF) as u8,
+            0x0400_0055 => (self.bldy >> 8) as u8,
+
+            SOUND_BASE..=SOUND_END => self.apu.read8(addr),
+            DMA_BASE..=DMA_END => self.dma.read8(addr),
 
             0x0400_0130 => (self.keyinput & 0xFF) as u8,
             0x0400_0131 => (self.keyinput >> 8) as u8,
@@ -165,6 +231,8 @@ impl Io {
             0x0400_0201 => (self.ie >> 8) as u8,
             0x0400_0202 => (self.if_ & 0xFF) as u8,
             0x0400_0203 => (self.if_ >> 8) as u8,
+            0x0400_0204 => (self.waitcnt & 0xFF) as u8,
+            0x0400_0205 => (self.waitcnt >> 8) as u8,
             0x0400_0208 => (self.ime & 0xFF) as u8,
             0x0400_0209 => (self.ime >> 8) as u8,
 
@@ -177,10 +245,12 @@ impl Io {
 
     pub fn write8(&mut self, addr: u32, value: u8) {
         match addr {
-            0x0400_0000 => self.dispcnt = (self.dispcnt & 0xFF00) | value as u16,
+            0x0400_0000 => self.dispcnt = (self.dispcnt & 0xFF00) | (value as u16 & DISPCNT_WRITABLE),
             0x0400_0001 => self.dispcnt = (self.dispcnt & 0x00FF) | ((value as u16) << 8),
-            0x0400_0004 => self.dispstat = (self.dispstat & 0xFF00) | value as u16,
-            0x0400_0005 => self.dispstat = (self.dispstat & 0x00FF) | ((value as u16) << 8),
+            0x0400_0002 => self.greenswap = value as u16 & 1,
+            0x0400_0003 => {}
+            0x0400_0004 => self.write_dispstat(value as u16, 0x00FF),
+            0x0400_0005 => self.write_dispstat((value as u16) << 8, 0xFF00),
             0x0400_0006 => {}
             0x0400_0007 => {}
             0x0400_0008 => self.bg0cnt = (self.bg0cnt & 0xFF00) | value as u16,
@@ -291,8 +361,30 @@ impl Io {
                 self.bg3y = ((old & !0xFF000000) | ((value as u32) << 24)) as i32;
                 self.bg3y = (self.bg3y << 4) >> 4;
             }
+            0x0400_0040 => self.win0h = (self.win0h & 0xFF00) | value as u16,
+            0x0400_0041 => self.win0h = (self.win0h & 0x00FF) | ((value as u16) << 8),
+            0x0400_0042 => self.win1h = (self.win1h & 0xFF00) | value as u16,
+            0x0400_0043 => self.win1h = (self.win1h & 0x00FF) | ((value as u16) << 8),
+            0x0400_0044 => self.win0v = (self.win0v & 0xFF00) | value as u16,
+            0x0400_0045 => self.win0v = (self.win0v & 0x00FF) | ((value as u16) << 8),
+            0x0400_0046 => self.win1v = (self.win1v & 0xFF00) | value as u16,
+            0x0400_0047 => self.win1v = (self.win1v & 0x00FF) | ((value as u16) << 8),
+            0x0400_0048 => self.winin = (self.winin & 0xFF00) | (value as u16 & 0x3F),
+            0x0400_0049 => self.winin = (self.winin & 0x00FF) | (((value as u16) & 0x3F) << 8),
+            0x0400_004A => self.winout = (self.winout & 0xFF00) | (value as u16 & 0x3F),
+            0x0400_004B => self.winout = (self.winout & 0x00FF) | (((value as u16) & 0x3F) << 8),
             0x0400_004C => self.mosaic = (self.mosaic & 0xFF00) | value as u16,
             0x0400_004D => self.mosaic = (self.mosaic & 0x00FF) | ((value as u16) << 8),
+            0x0400_0050 => self.bldcnt = (self.bldcnt & 0xFF00) | value as u16,
+            0x0400_0051 => self.bldcnt = (self.bldcnt & 0x00FF) | (((value as u16) & 0x3F) << 8),
+            0x0400_0052 => self.bldalpha = (self.bldalpha & 0xFF00) | (value as u16 & 0x1F),
+            0x0400_0053 => self.bldalpha = (self.bldalpha & 0x00FF) | (((value as u16) & 0x1F) << 8),
+            0x0400_0054 => self.bldy = (self.bldy & 0xFF00) | (value as u16 & 0x1F),
+            0x0400_0055 => {}
+
+            SOUND_BASE..=SOUND_END => self.apu.write8(addr, value),
+            FIFO_A..=0x0400_00A7 => self.apu.write_fifo(((addr - FIFO_A) / 4) as usize, value),
+            DMA_BASE..=DMA_END => self.dma.write8(addr, value),
 
             0x0400_0130 => {}
             0x0400_0131 => {}
@@ -303,6 +395,8 @@ impl Io {
             0x0400_0201 => self.ie = (self.ie & 0x00FF) | ((value as u16) << 8),
             0x0400_0202 => self.if_ &= !(value as u16),
             0x0400_0203 => self.if_ &= !((value as u16) << 8),
+            0x0400_0204 => self.waitcnt = (self.waitcnt & 0xFF00) | value as u16,
+            0x0400_0205 => self.waitcnt = (self.waitcnt & 0x00FF) | (((value as u16) & 0x5F) << 8),
             0x0400_0208 => self.ime = value as u16 & 1,
             0x0400_0209 => {}
 
@@ -318,6 +412,51 @@ impl Io {
         }
     }
 
+    /// Reads a whole halfword register in one access, so both bytes come from
+    /// the same state. `addr` must be halfword aligned.
+    pub fn read16(&self, addr: u32) -> u16 {
+        match addr {
+            0x0400_0000 => self.dispcnt,
+            0x0400_0004 => self.dispstat,
+            0x0400_0006 => self.vcount,
+            DMA_BASE..=DMA_END => self.dma.read16(addr),
+            0x0400_0200 => self.ie,
+            0x0400_0202 => self.if_,
+            0x0400_0208 => self.ime,
+            _ => self.read8(addr) as u16 | ((self.read8(addr + 1) as u16) << 8),
+        }
+    }
+
+    /// Writes a whole halfword register, applying side effects once with the full value.
+    pub fn write16(&mut self, addr: u32, value: u16) {
+        match addr {
+            0x0400_0000 => self.dispcnt = value & DISPCNT_WRITABLE,
+            0x0400_0004 => self.write_dispstat(value, 0xFFFF),
+            0x0400_0006 => {}
+            DMA_BASE..=DMA_END => self.dma.write16(addr, value),
+            0x0400_0200 => self.ie = value,
+            0x0400_0202 => self.if_ &= !value,
+            0x0400_0208 => self.ime = value & 1,
+            _ => {
+                self.write8(addr, value as u8);
+                self.write8(addr + 1, (value >> 8) as u8);
+            }
+        }
+    }
+
+    // Bits 0-2 are status flags owned by the PPU. A new LYC may already match
+    // the current line, so the match flag is re-evaluated on every write.
+    fn write_dispstat(&mut self, value: u16, mask: u16) {
+        let mask = mask & 0xFF38;
+        self.dispstat = (self.dispstat & !mask) | (value & mask);
+        let was_matching = (self.dispstat & 0x04) != 0;
+        let matching = (self.dispstat >> 8) == self.vcount;
+        self.dispstat = (self.dispstat & !0x04) | if matching { 0x04 } else { 0 };
+        if matching && !was_matching && (self.dispstat & 0x20) != 0 {
+            self.request_interrupt(0x0004);
+        }
+    }
+
     pub fn request_interrupt(&mut self, irq: u16) {
         self.if_ |= irq;
         if (self.ie & irq) != 0 {
@@ -0,0 +1,337 @@
+//! Table of the memory-mapped I/O registers, for tracing and the register inspector.
+
+/// A bit field inside a register.
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub struct Field {
+    pub name: &'static str,
+    pub shift: u8,
+    pub bits: u8,
+}
+
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub struct IoRegister {
+    pub name: &'static str,
+    pub addr: u32,
+    /// Width in bytes
+    pub width: u8,
+    /// Bits the CPU can read back; a write-only register has none
+    pub read_mask: u32,
+    pub write_mask: u32,
+    pub fields: &'static [Field],
+}
+
+impl IoRegister {
+    pub fn contains(&self, addr: u32) -> bool { (self.addr..self.addr + self.width as u32).contains(&addr) }
+    pub fn readable(&self) -> bool { self.read_mask != 0 }
+    pub fn writable(&self) -> bool { self.write_mask != 0 }
+
+    /// Splits `value` into the register's named fields.
+    pub fn decode(&self, value: u32) -> Vec<(&'static str, u32)> {
+        self.fields
+            .iter()
+            .map(|f| (f.name, (value >> f.shift) & ((1u64 << f.bits) - 1) as u32))
+            .collect()
+    }
+}
+
+/// A register's current value split into its fields.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct RegisterView {
+    pub register: &'static IoRegister,
+    pub value: u32,
+    pub fields: Vec<(&'static str, u32)>,
+}
+
+impl RegisterView {
+    pub fn new(register: &'static IoRegister, value: u32) -> Self {
+        Self { register, value, fields: register.decode(value) }
+    }
+
+    pub fn field(&self, name: &str) -> Option<u32> {
+        self.fields.iter().find(|(n, _)| *n == name).map(|&(_, v)| v)
+    }
+}
+
+/// Finds the register covering `addr`, which may point into the middle of it.
+pub fn lookup(addr: u32) -> Option<&'static IoRegister> {
+    IO_REGISTERS.iter().find(|r| r.contains(addr))
+}
+
+const fn field(name: &'static str, shift: u8, bits: u8) -> Field {
+    Field { name, shift, bits }
+}
+
+const fn reg(name: &'static str, addr: u32, width: u8, read_mask: u32, write_mask: u32, fields: &'static [Field]) -> IoRegister {
+    IoRegister { name, addr: 0x0400_0000 + addr, width, read_mask, write_mask, fields }
+}
+
+const DISPCNT: &[Field] = &[
+    field("mode", 0, 3),
+    field("frame", 4, 1),
+    field("hblank_free", 5, 1),
+    field("obj_1d", 6, 1),
+    field("forced_blank", 7, 1),
+    field("bg0", 8, 1),
+    field("bg1", 9, 1),
+    field("bg2", 10, 1),
+    field("bg3", 11, 1),
+    field("obj", 12, 1),
+    field("win0", 13, 1),
+    field("win1", 14, 1),
+    field("obj_win", 15, 1),
+];
+
+const DISPSTAT: &[Field] = &[
+    field("vblank", 0, 1),
+    field("hblank", 1, 1),
+    field("vcount_match", 2, 1),
+    field("vblank_irq", 3, 1),
+    field("hblank_irq", 4, 1),
+    field("vcount_irq", 5, 1),
+    field("lyc", 8, 8),
+];
+
+const VCOUNT: &[Field] = &[field("line", 0, 8)];
+
+const BGCNT: &[Field] = &[
+    field("priority", 0, 2),
+    field("char_base", 2, 2),
+    field("mosaic", 6, 1),
+    field("colors_256", 7, 1),
+    field("screen_base", 8, 5),
+    field("wraparound", 13, 1),
+    field("size", 14, 2),
+];
+
+const WINDOW_BOUNDS: &[Field] = &[field("end", 0, 8), field("start", 8, 8)];
+
+const WINDOW_CONTROL: &[Field] = &[
+    field("lo_layers", 0, 5),
+    field("lo_effects", 5, 1),
+    field("hi_layers", 8, 5),
+    field("hi_effects", 13, 1),
+];
+
+const MOSAIC: &[Field] = &[
+    field("bg_h", 0, 4),
+    field("bg_v", 4, 4),
+    field("obj_h", 8, 4),
+    field("obj_v", 12, 4),
+];
+
+const BLDCNT: &[Field] = &[
+    field("first_target", 0, 6),
+    field("effect", 6, 2),
+    field("second_target", 8, 6),
+];
+
+const BLDALPHA: &[Field] = &[field("eva", 0, 5), field("evb", 8, 5)];
+
+const BLDY: &[Field] = &[field("evy", 0, 5)];
+
+const SOUNDCNT_X: &[Field] = &[
+    field("sound1_on", 0, 1),
+    field("sound2_on", 1, 1),
+    field("sound3_on", 2, 1),
+    field("sound4_on", 3, 1),
+    field("master_enable", 7, 1),
+];
+
+const DMACNT_H: &[Field] = &[
+    field("dst_control", 5, 2),
+    field("src_control", 7, 2),
+    field("repeat", 9, 1),
+    field("word", 10, 1),
+    field("gamepak_drq", 11, 1),
+    field("timing", 12, 2),
+    field("irq", 14, 1),
+    field("enable", 15, 1),
+];
+
+const TMCNT_H: &[Field] = &[
+    field("prescaler", 0, 2),
+    field("count_up", 2, 1),
+    field("irq", 6, 1),
+    field("enable", 7, 1),
+];
+
+const KEYS: &[Field] = &[
+    field("a", 0, 1),
+    field("b", 1, 1),
+    field("select", 2, 1),
+    field("start", 3, 1),
+    field("right", 4, 1),
+    field("left", 5, 1),
+    field("up", 6, 1),
+    field("down", 7, 1),
+    field("r", 8, 1),
+    field("l", 9, 1),
+];
+
+const KEYCNT: &[Field] = &[
+    field("a", 0, 1),
+    field("b", 1, 1),
+    field("select", 2, 1),
+    field("start", 3, 1),
+    field("right", 4, 1),
+    field("left", 5, 1),
+    field("up", 6, 1),
+    field("down", 7, 1),
+    field("r", 8, 1),
+    field("l", 9, 1),
+    field("irq", 14, 1),
+    field("and_mode", 15, 1),
+];
+
+const INTERRUPTS: &[Field] = &[
+    field("vblank", 0, 1),
+    field("hblank", 1, 1),
+    field("vcount", 2, 1),
+    field("timer0", 3, 1),
+    field("timer1", 4, 1),
+    field("timer2", 5, 1),
+    field("timer3", 6, 1),
+    field("serial", 7, 1),
+    field("dma0", 8, 1),
+    field("dma1", 9, 1),
+    field("dma2", 10, 1),
+    field("dma3", 11, 1),
+    field("keypad", 12, 1),
+    field("gamepak", 13, 1),
+];
+
+const WAITCNT: &[Field] = &[
+    field("sram", 0, 2),
+    field("ws0_first", 2, 2),
+    field("ws0_second", 4, 1),
+    field("ws1_first", 5, 2),
+    field("ws1_second", 7, 1),
+    field("ws2_first", 8, 2),
+    field("ws2_second", 10, 1),
+    field("phi", 11, 2),
+    field("prefetch", 14, 1),
+];
+
+const IME: &[Field] = &[field("enable", 0, 1)];
+
+/// Every register in 0x04000000-0x040003FF, in address order.
+pub const IO_REGISTERS: &[IoRegister] = &[
+    reg("DISPCNT", 0x000, 2, 0xFFF7, 0xFFF7, DISPCNT),
+    reg("GREENSWAP", 0x002, 2, 0x0001, 0x0001, &[]),
+    reg("DISPSTAT", 0x004, 2, 0xFF3F, 0xFF38, DISPSTAT),
+    reg("VCOUNT", 0x006, 2, 0x00FF, 0, VCOUNT),
+    reg("BG0CNT", 0x008, 2, 0xDFFF, 0xDFFF, BGCNT),
+    reg("BG1CNT", 0x00A, 2, 0xDFFF, 0xDFFF, BGCNT),
+    reg("BG2CNT", 0x00C, 2, 0xFFFF, 0xFFFF, BGCNT),
+    reg("BG3CNT", 0x00E, 2, 0xFFFF, 0xFFFF, BGCNT),
+    reg("BG0HOFS", 0x010, 2, 0, 0x01FF, &[]),
+    reg("BG0VOFS", 0x012, 2, 0, 0x01FF, &[]),
+    reg("BG1HOFS", 0x014, 2, 0, 0x01FF, &[]),
+    reg("BG1VOFS", 0x016, 2, 0, 0x01FF, &[]),
+    reg("BG2HOFS", 0x018, 2, 0, 0x01FF, &[]),
+    reg("BG2VOFS", 0x01A, 2, 0, 0x01FF, &[]),
+    reg("BG3HOFS", 0x01C, 2, 0, 0x01FF, &[]),
+    reg("BG3VOFS", 0x01E, 2, 0, 0x01FF, &[]),
+    reg("BG2PA", 0x020, 2, 0, 0xFFFF, &[]),
+    reg("BG2PB", 0x022, 2, 0, 0xFFFF, &[]),
+    reg("BG2PC", 0x024, 2, 0, 0xFFFF, &[]),
+    reg("BG2PD", 0x026, 2, 0, 0xFFFF, &[]),
+    reg("BG2X", 0x028, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("BG2Y", 0x02C, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("BG3PA", 0x030, 2, 0, 0xFFFF, &[]),
+    reg("BG3PB", 0x032, 2, 0, 0xFFFF, &[]),
+    reg("BG3PC", 0x034, 2, 0, 0xFFFF, &[]),
+    reg("BG3PD", 0x036, 2, 0, 0xFFFF, &[]),
+    reg("BG3X", 0x038, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("BG3Y", 0x03C, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("WIN0H", 0x040, 2, 0, 0xFFFF, WINDOW_BOUNDS),
+    reg("WIN1H", 0x042, 2, 0, 0xFFFF, WINDOW_BOUNDS),
+    reg("WIN0V", 0x044, 2, 0, 0xFFFF, WINDOW_BOUNDS),
+    reg("WIN1V", 0x046, 2, 0, 0xFFFF, WINDOW_BOUNDS),
+    reg("WININ", 0x048, 2, 0x3F3F, 0x3F3F, WINDOW_CONTROL),
+    reg("WINOUT", 0x04A, 2, 0x3F3F, 0x3F3F, WINDOW_CONTROL),
+    reg("MOSAIC", 0x04C, 2, 0, 0xFFFF, MOSAIC),
+    reg("BLDCNT", 0x050, 2, 0x3FFF, 0x3FFF, BLDCNT),
+    reg("BLDALPHA", 0x052, 2, 0x1F1F, 0x1F1F, BLDALPHA),
+    reg("BLDY", 0x054, 2, 0, 0x001F, BLDY),
+    reg("SOUND1CNT_L", 0x060, 2, 0x007F, 0x007F, &[]),
+    reg("SOUND1CNT_H", 0x062, 2, 0xFFC0, 0xFFFF, &[]),
+    reg("SOUND1CNT_X", 0x064, 2, 0x4000, 0xC7FF, &[]),
+    reg("SOUND2CNT_L", 0x068, 2, 0xFFC0, 0xFFFF, &[]),
+    reg("SOUND2CNT_H", 0x06C, 2, 0x4000, 0xC7FF, &[]),
+    reg("SOUND3CNT_L", 0x070, 2, 0x00E0, 0x00E0, &[]),
+    reg("SOUND3CNT_H", 0x072, 2, 0xE000, 0xE0FF, &[]),
+    reg("SOUND3CNT_X", 0x074, 2, 0x4000, 0xC7FF, &[]),
+    reg("SOUND4CNT_L", 0x078, 2, 0xFF00, 0xFF3F, &[]),
+    reg("SOUND4CNT_H", 0x07C, 2, 0x40FF, 0xC0FF, &[]),
+    reg("SOUNDCNT_L", 0x080, 2, 0xFF77, 0xFF77, &[]),
+    reg("SOUNDCNT_H", 0x082, 2, 0x770F, 0xFF0F, &[]),
+    reg("SOUNDCNT_X", 0x084, 2, 0x008F, 0x0080, SOUNDCNT_X),
+    reg("SOUNDBIAS", 0x088, 2, 0xC3FE, 0xC3FE, &[]),
+    reg("WAVE_RAM0", 0x090, 4, 0xFFFF_FFFF, 0xFFFF_FFFF, &[]),
+    reg("WAVE_RAM1", 0x094, 4, 0xFFFF_FFFF, 0xFFFF_FFFF, &[]),
+    reg("WAVE_RAM2", 0x098, 4, 0xFFFF_FFFF, 0xFFFF_FFFF, &[]),
+    reg("WAVE_RAM3", 0x09C, 4, 0xFFFF_FFFF, 0xFFFF_FFFF, &[]),
+    reg("FIFO_A", 0x0A0, 4, 0, 0xFFFF_FFFF, &[]),
+    reg("FIFO_B", 0x0A4, 4, 0, 0xFFFF_FFFF, &[]),
+    reg("DMA0SAD", 0x0B0, 4, 0, 0x07FF_FFFF, &[]),
+    reg("DMA0DAD", 0x0B4, 4, 0, 0x07FF_FFFF, &[]),
+    reg("DMA0CNT_L", 0x0B8, 2, 0, 0x3FFF, &[]),
+    reg("DMA0CNT_H", 0x0BA, 2, 0xF7E0, 0xF7E0, DMACNT_H),
+    reg("DMA1SAD", 0x0BC, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("DMA1DAD", 0x0C0, 4, 0, 0x07FF_FFFF, &[]),
+    reg("DMA1CNT_L", 0x0C4, 2, 0, 0x3FFF, &[]),
+    reg("DMA1CNT_H", 0x0C6, 2, 0xF7E0, 0xF7E0, DMACNT_H),
+    reg("DMA2SAD", 0x0C8, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("DMA2DAD", 0x0CC, 4, 0, 0x07FF_FFFF, &[]),
+    reg("DMA2CNT_L", 0x0D0, 2, 0, 0x3FFF, &[]),
+    reg("DMA2CNT_H", 0x0D2, 2, 0xF7E0, 0xF7E0, DMACNT_H),
+    reg("DMA3SAD", 0x0D4, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("DMA3DAD", 0x0D8, 4, 0, 0x0FFF_FFFF, &[]),
+    reg("DMA3CNT_L", 0x0DC, 2, 0, 0xFFFF, &[]),
+    reg("DMA3CNT_H", 0x0DE, 2, 0xFFE0, 0xFFE0, DMACNT_H),
+    reg("TM0CNT_L", 0x100, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("TM0CNT_H", 0x102, 2, 0x00C7, 0x00C7, TMCNT_H),
+    reg("TM1CNT_L", 0x104, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("TM1CNT_H", 0x106, 2, 0x00C7, 0x00C7, TMCNT_H),
+    reg("TM2CNT_L", 0x108, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("TM2CNT_H", 0x10A, 2, 0x00C7, 0x00C7, TMCNT_H),
+    reg("TM3CNT_L", 0x10C, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("TM3CNT_H", 0x10E, 2, 0x00C7, 0x00C7, TMCNT_H),
+    reg("SIOMULTI0", 0x120, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("SIOMULTI1", 0x122, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("SIOMULTI2", 0x124, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("SIOMULTI3", 0x126, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("SIOCNT", 0x128, 2, 0x7FFF, 0x7FFF, &[]),
+    reg("SIOMLT_SEND", 0x12A, 2, 0xFFFF, 0xFFFF, &[]),
+    reg("KEYINPUT", 0x130, 2, 0x03FF, 0, KEYS),
+    reg("KEYCNT", 0x132, 2, 0xC3FF, 0xC3FF, KEYCNT),
+    reg("RCNT", 0x134, 2, 0xC1FF, 0xC1FF, &[]),
+    reg("JOYCNT", 0x140, 2, 0x0047, 0x0047, &[]),
+    reg("JOY_RECV", 0x150, 4, 0xFFFF_FFFF, 0xFFFF_FFFF, &[]),
+    reg("JOY_TRANS", 0x154, 4, 0xFFFF_FFFF, 0xFFFF_FFFF, &[]),
+    reg("JOYSTAT", 0x158, 2, 0x003A, 0x0030, &[]),
+    reg("IE", 0x200, 2, 0x3FFF, 0x3FFF, INTERRUPTS),
+    reg("IF", 0x202, 2, 0x3FFF, 0x3FFF, INTERRUPTS),
+    reg("WAITCNT", 0x204, 2, 0xDFFF, 0x5FFF, WAITCNT),
+    reg("IME", 0x208, 2, 0x0001, 0x0001, IME),
+    reg("POSTFLG", 0x300, 1, 0x01, 0x01, &[]),
+    reg("HALTCNT", 0x301, 1, 0, 0x80, &[]),
+];
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn registers_are_sorted_and_do_not_overlap() {
+        for pair in IO_REGISTERS.windows(2) {
+            assert!(pair[0].addr + pair[0].width as u32 <= pair[1].addr, "{} / {}", pair[0].name, pair[1].name);
+        }
+        assert_eq!(lookup(0x0400_002B).map(|r| r.name), Some("BG2X"));
+        assert_eq!(lookup(0x0400_0056), None);
+        assert_eq!(lookup(0x0400_0129).map(|r| r.name), Some("SIOCNT"));
+        assert_eq!(lookup(0x0400_0134).map(|r| r.name), Some("RCNT"));
+        assert_eq!(lookup(0x0400_0157).map(|r| r.name), Some("JOY_TRANS"));
+    }
+}
@@ -0,0 +1,263 @@
+use std::fmt::Write;
+
+enum Value {
+    Number(u64),
+    Bool(bool),
+    String(String),
+    Object(JsonObject),
+}
+
+/// A JSON object built field by field, written out in insertion order.
+#[derive(Default)]
+pub struct JsonObject {
+    fields: Vec<(String, Value)>,
+}
+
+impl JsonObject {
+    pub fn new() -> Self { Self::default() }
+
+    pub fn number(&mut self, key: &str, value: impl Into<u64>) -> &mut Self {
+        self.push(key, Value::Number(value.into()))
+    }
+
+    pub fn boolean(&mut self, key: &str, value: bool) -> &mut Self {
+        self.push(key, Value::Bool(value))
+    }
+
+    pub fn string(&mut self, key: &str, value: &str) -> &mut Self {
+        self.push(key, Value::String(value.to_string()))
+    }
+
+    pub fn object(&mut self, key: &str, value: JsonObject) -> &mut Self {
+        self.push(key, Value::Object(value))
+    }
+
+    fn push(&mut self, key: &str, value: Value) -> &mut Self {
+        self.fields.push((key.to_string(), value));
+        self
+    }
+
+    /// Writes the object with two-space indentation.
+    pub fn to_pretty_string(&self) -> String {
+        let mut out = String::new();
+        self.write(&mut out, 0);
+        out.push('\n');
+        out
+    }
+
+    fn write(&self, out: &mut String, depth: usize) {
+        if self.fields.is_empty() {
+            out.push_str("{}");
+            return;
+        }
+        out.push_str("{\n");
+        for (i, (key, value)) in self.fields.iter().enumerate() {
+            let _ = write!(out, "{:indent$}", "", indent = (depth + 1) * 2);
+            write_string(out, key);
+            out.push_str(": ");
+            match value {
+                Value::Number(n) => { let _ = write!(out, "{}", n); }
+                Value::Bool(b) => { let _ = write!(out, "{}", b); }
+                Value::String(s) => write_string(out, s),
+                Value::Object(object) => object.write(out, depth + 1),
+            }
+            out.push_str(if i + 1 < self.fields.len() { ",\n" } else { "\n" });
+        }
+        let _ = write!(out, "{:indent$}}}", "", indent = depth * 2);
+    }
+}
+
+fn write_string(out: &mut String, s: &str) {
+    out.push('"');
+    for c in s.chars() {
+        match c {
+            '"' => out.push_str("\\\""),
+            '\\' => out.push_str("\\\\"),
+            c if (c as u32) < 0x20 => { let _ = write!(out, "\\u{:04x}", c as u32); }
+            c => out.push(c),
+        }
+    }
+    out.push('"');
+}
+
+#[cfg(test)]
+pub(crate) mod tests {
+    use super::*;
+
+    /// Parses the subset of JSON this module writes, rejecting anything else, so
+    /// tests can check output is well formed and read fields back from it.
+    pub(crate) fn parse(text: &str) -> Result<JsonObject, String> {
+        let mut parser = Parser { bytes: text.as_bytes(), pos: 0 };
+        let object = parser.object()?;
+        parser.skip_whitespace();
+        if parser.pos != text.len() {
+            return Err(format!("trailing data at {}", parser.pos));
+        }
+        Ok(object)
+    }
+
+    /// The number at `path`, following nested objects by key.
+    pub(crate) fn number_at(object: &JsonObject, path: &[&str]) -> Option<u64> {
+        let (last, parents) = path.split_last()?;
+        let mut object = object;
+        for key in parents {
+            match object.get(key)? {
+                Value::Object(inner) => object = inner,
+                _ => return None,
+            }
+        }
+        match object.get(last)? {
+            Value::Number(n) => Some(*n),
+            _ => None,
+        }
+    }
+
+    impl JsonObject {
+        fn get(&self, key: &str) -> Option<&Value> {
+            self.fields.iter().find(|(k, _)| k == key).map(|(_, value)| value)
+        }
+    }
+
+    struct Parser<'a> {
+        bytes: &'a [u8],
+        pos: usize,
+    }
+
+    impl Parser<'_> {
+        fn skip_whitespace(&mut self) {
+            while self.bytes.get(self.pos).is_some_and(u8::is_ascii_whitespace) {
+                self.pos += 1;
+            }
+        }
+
+        fn expect(&mut self, byte: u8) -> Result<(), String> {
+            self.skip_whitespace();
+            if self.bytes.get(self.pos) != Some(&byte) {
+                return Err(format!("expected '{}' at {}", byte as char, self.pos));
+            }
+            self.pos += 1;
+            Ok(())
+        }
+
+        fn peek(&mut self) -> Option<u8> {
+            self.skip_whitespace();
+            self.bytes.get(self.pos).copied()
+        }
+
+        fn object(&mut self) -> Result<JsonObject, String> {
+            self.expect(b'{')?;
+            let mut object = JsonObject::new();
+            if self.peek() == Some(b'}') {
+                self.pos += 1;
+                return Ok(object);
+            }
+            loop {
+                let key = self.string()?;
+                if object.get(&key).is_some() {
+                    return Err(format!("duplicate key {key}"));
+                }
+                self.expect(b':')?;
+                let value = self.value()?;
+                object.push(&key, value);
+                match self.peek() {
+                    Some(b',') => self.pos += 1,
+                    Some(b'}') => {
+                        self.pos += 1;
+                        return Ok(object);
+                    }
+                    _ => return Err(format!("expected ',' or '}}' at {}", self.pos)),
+                }
+            }
+        }
+
+        fn value(&mut self) -> Result<Value, String> {
+            match self.peek() {
+                Some(b'{') => self.object().map(Value::Object),
+                Some(b'"') => self.string().map(Value::String),
+                Some(b'0'..=b'9') => {
+                    let start = self.pos;
+                    while self.bytes.get(self.pos).is_some_and(u8::is_ascii_digit) {
+                        self.pos += 1;
+                    }
+                    let digits = std::str::from_utf8(&self.bytes[start..self.pos]).unwrap();
+                    if digits.len() > 1 && digits.starts_with('0') {
+                        return Err(format!("leading zero at {start}"));
+                    }
+                    digits.parse().map(Value::Number).map_err(|e| format!("{e} at {start}"))
+                }
+                _ if self.bytes[self.pos..].starts_with(b"true") => {
+                    self.pos += 4;
+                    Ok(Value::Bool(true))
+                }
+                _ if self.bytes[self.pos..].starts_with(b"false") => {
+                    self.pos += 5;
+                    Ok(Value::Bool(false))
+                }
+                _ => Err(format!("unexpected value at {}", self.pos)),
+            }
+        }
+
+        fn string(&mut self) -> Result<String, String> {
+            self.expect(b'"')?;
+            let mut bytes = Vec::new();
+            loop {
+                let Some(&byte) = self.bytes.get(self.pos) else {
+                    return Err("unterminated string".to_string());
+                };
+                self.pos += 1;
+                match byte {
+                    b'"' => return String::from_utf8(bytes).map_err(|e| e.to_string()),
+                    b'\\' => {
+                        let escaped = match self.bytes.get(self.pos) {
+                            Some(b'"') => '"',
+                            Some(b'\\') => '\\',
+                            Some(b'u') => {
+                                let hex = self.bytes.get(self.pos + 1..self.pos + 5).ok_or("short \\u escape")?;
+                                let code = u32::from_str_radix(std::str::from_utf8(hex).map_err(|e| e.to_string())?, 16)
+                                    .map_err(|e| e.to_string())?;
+                                self.pos += 4;
+                                char::from_u32(code).ok_or("bad \\u escape")?
+                            }
+                            _ => return Err(format!("bad escape at {}", self.pos)),
+                        };
+                        self.pos += 1;
+                        bytes.extend_from_slice(escaped.encode_utf8(&mut [0; 4]).as_bytes());
+                    }
+                    byte if byte < 0x20 => return Err(format!("raw control character at {}", self.pos - 1)),
+                    byte => bytes.push(byte),
+                }
+            }
+        }
+    }
+
+    #[test]
+    fn nested_objects_are_indented_in_insertion_order() {
+        let mut inner = JsonObject::new();
+        inner.number("b", 2u32).boolean("c", true);
+        let mut outer = JsonObject::new();
+        outer.string("a", "say \"hi\"\n").object("inner", inner).object("empty", JsonObject::new());
+
+        assert_eq!(
+            outer.to_pretty_string(),
+            "{\n  \"a\": \"say \\\"hi\\\"\\u000a\",\n  \"inner\": {\n    \"b\": 2,\n    \"c\": true\n  },\n  \"empty\": {}\n}\n"
+        );
+    }
+
+    #[test]
+    fn written_objects_parse_back_to_the_same_text() {
+        let mut inner = JsonObject::new();
+        inner.number("max", u64::MAX).boolean("off", false).string("esc", "a\\b\"\t");
+        let mut outer = JsonObject::new();
+        outer.object("inner", inner).object("empty", JsonObject::new()).number("zero", 0u8);
+        let text = outer.to_pretty_string();
+
+        let parsed = parse(&text).unwrap();
+        assert_eq!(parsed.to_pretty_string(), text);
+        assert_eq!(number_at(&parsed, &["inner", "max"]), Some(u64::MAX));
+        assert_eq!(number_at(&parsed, &["inner", "off"]), None);
+
+        for bad in ["{", "{\"a\": 1,}", "{\"a\": 01}", "{\"a\" 1}", "{} {}", "{\"a\": \"\n\"}", "{\"a\": 1, \"a\": 2}"] {
+            assert!(parse(bad).is_err(), "{bad:?} should be rejected");
+        }
+    }
+}
@@ -1,21 +1,52 @@
 #![forbid(unsafe_code)]
 
 use std::path::{Path, PathBuf};
-
-use crate::cpu::Cpu;
-use crate::ppu::Ppu;
-use crate::video::{framebuffer_rgb555_to_rgba, GBA_SCREEN_H, GBA_SCREEN_W};
-use crate::bus::Bus;
+use std::time::Instant;
+
+use sha2::{Digest, Sha256};
+
+use crate::cart::{Region, RomHeader};
+use crate::coverage::{Access, Coverage};
+use crate::cpu::{Cpu, UnimplementedInstruction};
+use crate::debug_port::DebugMessage;
+use crate::frameskip::FrameSkipper;
+use crate::history::{StepHistory, StepRecord};
+use crate::io::registers::{self, RegisterView};
+use crate::json::JsonObject;
+use crate::movie::Movie;
+use crate::ppu::{Ppu, PpuPhase};
+use crate::profile::{FrameTiming, Profiler, Section};
+use crate::render_cache::RenderCache;
+use crate::symbols::SymbolTable;
+use crate::video::{framebuffer_rgb555_to_rgba, RgbaImage, GBA_SCREEN_H, GBA_SCREEN_W};
+use crate::bus::{Bus, WriteViolation};
+use crate::dma::DmaTiming;
+use crate::timing::Event;
 
 pub mod apu;
+#[cfg(test)]
+mod asm;
 pub mod audio;
 pub mod bus;
 pub mod cart;
+pub mod coverage;
 pub mod cpu;
+pub mod debug_port;
+pub mod dma;
+pub mod eeprom;
+pub mod history;
+pub mod frameskip;
 pub mod io;
+pub mod json;
 pub mod log_buffer;
 pub mod mem;
+pub mod movie;
 pub mod ppu;
+pub mod profile;
+pub mod render_cache;
+pub mod runner;
+pub mod symbols;
+pub mod timer;
 pub mod timing;
 pub mod video;
 
@@ -23,6 +54,98 @@ const CYCLES_PER_SCANLINE: usize = 1232;
 const SCANLINES_PER_FRAME: usize = 228;
 const VISIBLE_SCANLINES: usize = 160;
 const HBLANK_START_CYCLE: usize = 960;
+const CYCLES_PER_DOT: u64 = 4;
+// DISPCNT through BLDY: every IO register the renderer reads
+const DISPLAY_IO_LEN: u32 = 0x56;
+
+const BIOS_ENTRY_POINT: u32 = 0x0000_0000;
+const ROM_ENTRY_POINT: u32 = 0x0800_0000;
+
+/// Boot settings resolved from BIOS availability and the loaded ROM header.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct BootConfig {
+    pub skip_bios: bool,
+    pub entry_point: u32,
+    pub swi_hle: bool,
+    pub region: Region,
+    pub game_code: String,
+    /// The cartridge has a real-time clock, which is not emulated
+    pub rtc: bool,
+}
+
+impl Default for BootConfig {
+    fn default() -> Self {
+        Self {
+            skip_bios: false,
+            entry_point: BIOS_ENTRY_POINT,
+            swi_hle: false,
+            region: Region::Unknown,
+            game_code: String::new(),
+            rtc: false,
+        }
+    }
+}
+
+impl BootConfig {
+    pub fn resolve(header: Option<&RomHeader>, bios_loaded: bool) -> Self {
+        // Without a BIOS there is nothing to boot through, so jump straight into
+        // the cartridge and service SWIs in high-level emulation
+        let skip_bios = !bios_loaded;
+        Self {
+            skip_bios,
+            entry_point: if skip_bios { ROM_ENTRY_POINT } else { BIOS_ENTRY_POINT },
+            swi_hle: skip_bios,
+            region: header.map_or(Region::Unknown, |h| h.region()),
+            game_code: header.map(|h| h.game_code.clone()).unwrap_or_default(),
+            rtc: header.is_some_and(RomHeader::has_rtc),
+        }
+    }
+}
+
+/// What to do after the emulator paused on an unimplemented instruction.
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum UnimplementedAction {
+    /// Treat the instruction as a no-op and keep running
+    Skip,
+    /// Stay paused until [`Emulator::resume`] is called
+    Abort,
+}
+
+/// The emulated machine at one moment, for [`Emulator::load_state`].
+///
+/// Held in memory only. The cartridge ROM is not part of it, so a state loads
+/// back only into an emulator running the same ROM.
+#[derive(Clone)]
+pub struct SaveState {
+    cpu: Cpu,
+    ppu: Ppu,
+    bus: Bus,
+    rgba_frame: Vec<u8>,
+    cycles: usize,
+    frame_count: u64,
+    frame_end: Option<u64>,
+    line_start: u64,
+    instructions: u64,
+    rom_hash: [u8; 32],
+}
+
+impl SaveState {
+    /// Frames the emulator had completed when the state was saved.
+    pub fn frame_count(&self) -> u64 { self.frame_count }
+}
+
+impl std::fmt::Debug for SaveState {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("SaveState").field("frame_count", &self.frame_count).finish_non_exhaustive()
+    }
+}
+
+enum MovieMode {
+    Recording(Movie),
+    Playing { movie: Movie, frame: usize },
+}
+
+type UnimplementedHandler = Box<dyn FnMut(&UnimplementedInstruction) -> UnimplementedAction + Send>;
 
 pub struct Emulator {
     cpu: Cpu,
@@ -34,6 +157,29 @@ pub struct Emulator {
     frame_ready: bool,
     bios_loaded: bool,
     rom_loaded: bool,
+    rom_header: Option<RomHeader>,
+    rom_hash: [u8; 32],
+    boot_config: BootConfig,
+    symbols: SymbolTable,
+    unimplemented_handler: Option<UnimplementedHandler>,
+    paused: bool,
+    // End cycle of a frame interrupted by a pause, so run_frame can finish it
+    frame_end: Option<u64>,
+    // When the current scanline's HDraw ran
+    line_start: u64,
+    profiler: Option<Profiler>,
+    frameskip: Option<FrameSkipper>,
+    render_cache: Option<RenderCache>,
+    instructions: u64,
+    // One-shot breakpoints on the instruction count and the system cycle counter
+    break_at_instruction: Option<u64>,
+    break_at_cycle: Option<u64>,
+    // Debug override of where execution starts after a reset or ROM load
+    entry_override: Option<u32>,
+    movie: Option<MovieMode>,
+    history: Option<StepHistory>,
+    // Set by run_to_vblank: run_frame returns early once VBlank starts
+    stop_at_vblank: bool,
 }
 
 impl Emulator {
@@ -49,46 +195,130 @@ impl Emulator {
             frame_ready: false,
             bios_loaded: false,
             rom_loaded: false,
+            rom_header: None,
+            rom_hash: [0; 32],
+            boot_config: BootConfig::default(),
+            symbols: SymbolTable::new(),
+            unimplemented_handler: None,
+            paused: false,
+            frame_end: None,
+            line_start: 0,
+            profiler: None,
+            frameskip: None,
+            render_cache: None,
+            instructions: 0,
+            break_at_instruction: None,
+            break_at_cycle: None,
+            entry_override: None,
+            movie: None,
+            history: None,
+            stop_at_vblank: false,
         }
     }
 
     pub fn reset(&mut self) {
         log::info!("Emulator reset");
+        self.power_on(true);
+        self.boot();
+    }
+
+    // Returns every component to its power-on state. The BIOS always survives;
+    // `keep_cart` also keeps the ROM and its save memory, as a reset button would.
+    fn power_on(&mut self, keep_cart: bool) {
+        let mut mem = std::mem::take(&mut self.bus.mem);
+        let coverage = self.bus.coverage.is_some();
+        let sandboxed = self.bus.write_violations.is_some();
+        let dma_time = self.bus.dma_time.map(|_| Default::default());
+
+        self.bus = Bus::new();
+        self.bus.mem.bios = std::mem::take(&mut mem.bios);
+        if keep_cart {
+            self.bus.mem.rom = std::mem::take(&mut mem.rom);
+            self.bus.mem.sram = std::mem::take(&mut mem.sram);
+            self.bus.mem.eeprom = mem.eeprom.take();
+        }
+        if coverage {
+            self.bus.coverage = Some(Coverage::new());
+        }
+        if sandboxed {
+            self.bus.write_violations = Some(Vec::new());
+        }
+        self.bus.dma_time = dma_time;
+
+        // Debug settings are the user's choice and outlive the machine state
+        let strict = self.cpu.strict_mode();
+        let isolation = self.ppu.layer_isolation();
         self.cpu = Cpu::new();
+        self.cpu.set_strict_mode(strict);
+        self.cpu.set_trap_undefined(self.unimplemented_handler.is_none());
         self.ppu = Ppu::new();
+        self.ppu.set_layer_isolation(isolation);
+        self.rgba_frame.fill(0);
         self.cycles = 0;
         self.frame_count = 0;
         self.frame_ready = false;
+        self.paused = false;
+        self.frame_end = None;
+        self.line_start = 0;
+        self.instructions = 0;
+        if let Some(history) = &mut self.history {
+            *history = StepHistory::new(history.depth());
+        }
+        if let Some(cache) = &mut self.render_cache {
+            cache.invalidate();
+        }
+    }
 
-        if self.bios_loaded {
-            self.cpu.set_entry_point(&mut self.bus, 0x0000_0000);
-            log::info!("Entry point: BIOS (0x00000000)");
-        } else if self.rom_loaded {
-            self.cpu.set_entry_point(&mut self.bus, 0x0800_0000);
-            log::info!("Entry point: ROM (0x08000000)");
+    fn boot(&mut self) {
+        if self.rom_loaded && self.boot_config.skip_bios {
+            self.init_without_bios();
+            log::info!("Entry point: ROM ({:#010x}) - no BIOS", self.boot_config.entry_point);
+        } else if self.bios_loaded {
+            self.cpu.set_entry_point(&mut self.bus, self.boot_config.entry_point);
+            log::info!("Entry point: BIOS ({:#010x})", self.boot_config.entry_point);
+        }
+        if let Some(addr) = self.entry_override {
+            self.cpu.set_entry_point(&mut self.bus, addr);
+            log::info!("Entry point: override ({:#010x})", addr);
         }
     }
 
+    /// Starts ARM execution at `addr` now and after every reset or ROM load,
+    /// instead of the BIOS or cartridge entry point.
+    pub fn set_entry_point(&mut self, addr: u32) -> Result<(), std::io::Error> {
+        let executable = match addr >> 24 {
+            0x00 => (addr as usize) < mem::BIOS_SIZE,
+            0x02 | 0x03 | 0x06 | 0x08..=0x0D => true,
+            _ => false,
+        };
+        if !executable || (addr & 3) != 0 {
+            return Err(std::io::Error::new(
+                std::io::ErrorKind::InvalidInput,
+                format!("{:#010x} is not a word-aligned address in executable memory", addr),
+            ));
+        }
+        self.entry_override = Some(addr);
+        self.cpu.set_entry_point(&mut self.bus, addr);
+        Ok(())
+    }
+
+    pub fn clear_entry_point(&mut self) { self.entry_override = None; }
+
     pub fn load_bios(&mut self, path: &Path) -> Result<(), std::io::Error> {
         let data = std::fs::read(path)?;
         log::info!("BIOS loaded: {} bytes from {:?}", data.len(), path);
         self.bus.load_bios(&data);
         self.bios_loaded = true;
-        self.cpu.set_entry_point(&mut self.bus, 0x0000_0000);
+        self.boot_config = BootConfig::resolve(self.rom_header.as_ref(), true);
+        self.cpu.set_entry_point(&mut self.bus, self.boot_config.entry_point);
         Ok(())
     }
 
     pub fn load_rom(&mut self, rom_path: &PathBuf) {
-        match std::fs::read(rom_path) {
+        match std::fs::read(rom_path).and_then(cart::unpack_rom) {
             Ok(data) => {
                 log::info!("ROM loaded: {} bytes from {:?}", data.len(), rom_path);
-                self.bus.load_rom(&data);
-                self.rom_loaded = true;
-
-                if !self.bios_loaded {
-                    self.init_without_bios();
-                    log::info!("Entry point: ROM (0x08000000) - no BIOS");
-                }
+                self.load_rom_data(&data);
             }
             Err(e) => {
                 log::error!("Failed to load ROM {:?}: {}", rom_path, e);
@@ -96,10 +326,38 @@ impl Emulator {
         }
     }
 
+    /// Loads the symbol table of an ELF build of the ROM, for annotating addresses.
+    pub fn load_symbols(&mut self, elf_path: &Path) -> Result<(), std::io::Error> {
+        self.symbols = SymbolTable::load(elf_path)?;
+        log::info!("Symbols loaded: {} from {:?}", self.symbols.len(), elf_path);
+        Ok(())
+    }
+
+    pub fn symbols(&self) -> &SymbolTable { &self.symbols }
+
+    pub fn load_rom_data(&mut self, data: &[u8]) {
+        // Nothing from a previously running game may leak into the new one
+        self.power_on(false);
+        self.bus.load_rom(data);
+        self.rom_loaded = true;
+        self.rom_hash = Sha256::digest(data).into();
+        self.movie = None;
+        self.rom_header = RomHeader::parse(data);
+        if let Some(header) = &self.rom_header {
+            log::info!("ROM header: \"{}\" code={} maker={} v{}", header.title, header.game_code, header.maker_code, header.version);
+        }
+
+        self.boot_config = BootConfig::resolve(self.rom_header.as_ref(), self.bios_loaded);
+        if self.boot_config.rtc {
+            log::warn!("{} has a cartridge clock, which is not emulated", self.boot_config.game_code);
+        }
+        self.boot();
+    }
+
     fn init_without_bios(&mut self) {
         use crate::cpu::CpuMode;
 
-        self.cpu.set_swi_hle(true);
+        self.cpu.set_swi_hle(self.boot_config.swi_hle);
 
         self.cpu.set_mode(CpuMode::Supervisor);
         self.cpu.write_reg(13, 0x0300_7FE0);
@@ -110,93 +368,557 @@ impl Emulator {
         self.cpu.set_mode(CpuMode::System);
         self.cpu.write_reg(13, 0x0300_7F00);
 
-        self.cpu.set_entry_point(&mut self.bus, 0x0800_0000);
+        self.cpu.set_entry_point(&mut self.bus, self.boot_config.entry_point);
     }
 
     pub fn step_cpu(&mut self) {
+        if let Some(coverage) = &mut self.bus.coverage {
+            coverage.record(Access::Execute, self.cpu.pc());
+        }
+        let before = self.history.is_some().then(|| {
+            self.bus.write_log = Some(Vec::new());
+            self.cpu.capture_state()
+        });
         self.cpu.step(&mut self.bus);
+        if let (Some(history), Some(cpu)) = (&mut self.history, before) {
+            let writes = self.bus.write_log.take().unwrap_or_default();
+            history.push(StepRecord { cpu, writes, instructions: self.instructions });
+        }
+        self.instructions += 1;
+
+        if let Some(instr) = self.cpu.take_unimplemented()
+            && let Some(handler) = &mut self.unimplemented_handler
+        {
+            self.paused = true;
+            if handler(&instr) == UnimplementedAction::Skip {
+                self.paused = false;
+            }
+        }
     }
 
-    pub fn run_frame(&mut self) {
-        self.frame_ready = false;
-        self.bus.set_access_permissions(true, true, true);
+    /// Pauses on unimplemented instructions and hands them to `handler`, which
+    /// decides whether to skip them or stay paused. The PC has already moved past
+    /// the instruction, so resuming continues with the next one. Undefined
+    /// instructions are reported here too instead of taking the Undefined trap.
+    pub fn set_unimplemented_handler(
+        &mut self,
+        handler: impl FnMut(&UnimplementedInstruction) -> UnimplementedAction + Send + 'static,
+    ) {
+        self.unimplemented_handler = Some(Box::new(handler));
+        self.cpu.set_trap_undefined(false);
+    }
 
-        let mut prev_vblank = false;
-        let mut prev_hblank = false;
+    pub fn clear_unimplemented_handler(&mut self) {
+        self.unimplemented_handler = None;
+        self.cpu.set_trap_undefined(true);
+    }
 
-        for scanline in 0..SCANLINES_PER_FRAME {
-            self.bus.io.vcount = scanline as u16;
+    pub fn is_paused(&self) -> bool { self.paused }
 
-            let in_vblank = scanline >= VISIBLE_SCANLINES;
-            let lyc = (self.bus.io.dispstat >> 8) as usize;
-            let vcounter_match = scanline == lyc;
+    /// Keeps undo records for the last `depth` instructions so [`Emulator::step_back`]
+    /// can rewind them; 0 turns recording off. Costs a CPU snapshot per instruction.
+    pub fn set_step_history(&mut self, depth: usize) {
+        self.history = (depth > 0).then(|| StepHistory::new(depth));
+    }
 
-            if in_vblank && !prev_vblank {
-                if (self.bus.io.dispstat & 0x08) != 0 {
-                    self.bus.io.request_interrupt(0x0001);
-                }
-            }
+    /// Un-executes the last recorded instruction, restoring the CPU and any memory
+    /// it wrote. IO registers and peripherals are not rewound. Returns false once
+    /// the history is exhausted.
+    pub fn step_back(&mut self) -> bool {
+        let Some(record) = self.history.as_mut().and_then(StepHistory::pop) else {
+            return false;
+        };
+        self.cpu.restore_state(&record.cpu);
+        self.bus.undo_writes(&record.writes);
+        self.instructions = record.instructions;
+        true
+    }
 
-            if vcounter_match {
-                if (self.bus.io.dispstat & 0x20) != 0 {
-                    self.bus.io.request_interrupt(0x0004);
-                }
-            }
+    /// Instructions executed since power-on.
+    pub fn instructions_executed(&self) -> u64 { self.instructions }
 
-            self.bus.io.dispstat = (self.bus.io.dispstat & 0xFFF8)
-                | (if in_vblank { 1 } else { 0 })
-                | (if vcounter_match { 4 } else { 0 });
+    /// Pauses once `count` instructions have executed since power-on.
+    pub fn break_at_instruction(&mut self, count: u64) { self.break_at_instruction = Some(count); }
 
-            prev_vblank = in_vblank;
+    /// Pauses once the system cycle counter reaches `cycle`.
+    pub fn break_at_cycle(&mut self, cycle: u64) { self.break_at_cycle = Some(cycle); }
 
-            for cycle_in_line in 0..CYCLES_PER_SCANLINE {
-                let in_hblank = cycle_in_line >= HBLANK_START_CYCLE;
+    pub fn clear_breakpoints(&mut self) {
+        self.break_at_instruction = None;
+        self.break_at_cycle = None;
+    }
 
-                if in_hblank && !prev_hblank {
-                    if (self.bus.io.dispstat & 0x10) != 0 {
-                        self.bus.io.request_interrupt(0x0002);
-                    }
-                }
+    fn check_breakpoints(&mut self) {
+        if self.break_at_instruction.is_some_and(|n| self.instructions >= n) {
+            log::info!(
+                "Instruction breakpoint hit after {} instructions | PC={}",
+                self.instructions,
+                self.symbols.format_addr(self.cpu.pc())
+            );
+            self.break_at_instruction = None;
+            self.paused = true;
+        }
+        let now = self.bus.scheduler.now();
+        if self.break_at_cycle.is_some_and(|c| now >= c) {
+            log::info!("Cycle breakpoint hit at cycle {} | PC={}", now, self.symbols.format_addr(self.cpu.pc()));
+            self.break_at_cycle = None;
+            self.paused = true;
+        }
+    }
+
+    pub fn resume(&mut self) {
+        self.paused = false;
+        if let Some(skipper) = &mut self.frameskip {
+            skipper.restart();
+        }
+    }
 
-                if in_hblank {
-                    self.bus.io.dispstat |= 2;
-                } else {
-                    self.bus.io.dispstat &= !2;
+    /// Starts or stops recording which memory ranges are read, written and executed.
+    pub fn set_coverage_enabled(&mut self, enabled: bool) {
+        self.bus.coverage = if enabled { Some(Coverage::new()) } else { None };
+    }
+
+    pub fn coverage(&self) -> Option<&Coverage> { self.bus.coverage.as_ref() }
+
+    /// Reports stores to the BIOS, cartridge ROM or unmapped space instead of dropping
+    /// them silently, so fuzz runs can fail on writes that went to the wrong region.
+    pub fn set_write_sandbox(&mut self, enabled: bool) {
+        self.bus.write_violations = enabled.then(Vec::new);
+    }
+
+    /// Writes that hit a read-only region since the sandbox was enabled.
+    pub fn write_violations(&self) -> &[WriteViolation] { self.bus.write_violations.as_deref().unwrap_or_default() }
+
+    /// Starts or stops measuring where each frame's wall-clock time goes.
+    pub fn set_profiling_enabled(&mut self, enabled: bool) {
+        self.profiler = enabled.then(Profiler::new);
+        self.bus.dma_time = enabled.then(Default::default);
+    }
+
+    /// Skips rendering, but not emulating, frames while the host runs behind the
+    /// GBA's 59.73 Hz. Skipped frames leave the previous image in place.
+    pub fn set_auto_frameskip(&mut self, enabled: bool) {
+        self.frameskip = enabled.then(FrameSkipper::new);
+    }
+
+    /// Keeps the previous pixels of every scanline whose inputs have not changed
+    /// since the last render, at the cost of holding a copy of VRAM, palette and OAM.
+    pub fn set_render_cache(&mut self, enabled: bool) {
+        self.render_cache = enabled.then(RenderCache::new);
+    }
+
+    /// Scanlines that kept their previous pixels, while the render cache is enabled.
+    pub fn reused_lines(&self) -> Option<u64> { self.render_cache.as_ref().map(RenderCache::reused) }
+
+    /// Per-subsystem timings of the last completed frame, while profiling is enabled.
+    pub fn frame_timing(&self) -> Option<FrameTiming> { self.profiler.as_ref().and_then(Profiler::last) }
+
+    // Times `f` into `section` when profiling
+    fn profiled<T>(&mut self, section: Section, f: impl FnOnce(&mut Self) -> T) -> T {
+        let started = self.profiler.is_some().then(Instant::now);
+        let dma_before = self.bus.dma_time.unwrap_or_default();
+        let result = f(self);
+        if let (Some(profiler), Some(started)) = (&mut self.profiler, started) {
+            // DMA kicked off from inside the section is reported on its own
+            let dma = self.bus.dma_time.unwrap_or_default().saturating_sub(dma_before);
+            profiler.record(section, started.elapsed().saturating_sub(dma));
+        }
+        result
+    }
+
+    /// Drains the strings the running program printed through the debug port.
+    pub fn take_debug_messages(&mut self) -> Vec<DebugMessage> { self.bus.io.debug.take_messages() }
+
+    /// Drains the interleaved left/right samples mixed so far, at [`apu::SAMPLE_RATE`].
+    pub fn take_audio(&mut self) -> Vec<i16> { self.bus.io.apu.take_samples() }
+
+    /// Captures the machine so that [`Emulator::load_state`] can return to it.
+    pub fn save_state(&mut self) -> SaveState {
+        // The ROM cannot change, so it stays out of the copy
+        let rom = std::mem::take(&mut self.bus.mem.rom);
+        let mut bus = self.bus.clone();
+        self.bus.mem.rom = rom;
+        bus.coverage = None;
+        bus.write_log = None;
+        bus.write_violations = None;
+        SaveState {
+            cpu: self.cpu.clone(),
+            ppu: self.ppu.clone(),
+            bus,
+            rgba_frame: self.rgba_frame.clone(),
+            cycles: self.cycles,
+            frame_count: self.frame_count,
+            frame_end: self.frame_end,
+            line_start: self.line_start,
+            instructions: self.instructions,
+            rom_hash: self.rom_hash,
+        }
+    }
+
+    /// Puts the machine back into `state`. Debug settings stay as they are, and a
+    /// movie being recorded or played stops, since its input no longer lines up.
+    pub fn load_state(&mut self, state: &SaveState) -> Result<(), std::io::Error> {
+        if state.rom_hash != self.rom_hash {
+            return Err(std::io::Error::new(
+                std::io::ErrorKind::InvalidInput,
+                "state was saved on a different ROM",
+            ));
+        }
+        let mut bus = state.bus.clone();
+        bus.mem.rom = std::mem::take(&mut self.bus.mem.rom);
+        bus.mem.bios = std::mem::take(&mut self.bus.mem.bios);
+        bus.coverage = self.bus.coverage.take();
+        bus.write_log = self.bus.write_log.take();
+        bus.write_violations = self.bus.write_violations.take();
+        bus.dma_time = self.bus.dma_time.map(|_| Default::default());
+        self.bus = bus;
+
+        let strict = self.cpu.strict_mode();
+        let isolation = self.ppu.layer_isolation();
+        self.cpu = state.cpu.clone();
+        self.cpu.set_strict_mode(strict);
+        self.cpu.set_trap_undefined(self.unimplemented_handler.is_none());
+        self.ppu = state.ppu.clone();
+        self.ppu.set_layer_isolation(isolation);
+        self.rgba_frame.copy_from_slice(&state.rgba_frame);
+        self.cycles = state.cycles;
+        self.frame_count = state.frame_count;
+        self.frame_end = state.frame_end;
+        self.line_start = state.line_start;
+        self.instructions = state.instructions;
+        self.frame_ready = true;
+        self.paused = false;
+        if self.movie.take().is_some() {
+            log::info!("Movie stopped by loading a state");
+        }
+        if let Some(history) = &mut self.history {
+            *history = StepHistory::new(history.depth());
+        }
+        if let Some(cache) = &mut self.render_cache {
+            cache.invalidate();
+        }
+        Ok(())
+    }
+
+    /// Resets the machine and records the keys held on every frame from here on.
+    pub fn start_recording(&mut self) {
+        let eeprom = self.bus.mem.eeprom.as_ref().map_or_else(Vec::new, |eeprom| eeprom.data().to_vec());
+        let movie = Movie::new(self.rom_hash, self.bus.mem.sram.clone(), eeprom);
+        self.reset();
+        self.movie = Some(MovieMode::Recording(movie));
+    }
+
+    /// Resets the machine into the movie's initial state and replays its input.
+    pub fn play_movie(&mut self, movie: Movie) -> Result<(), std::io::Error> {
+        if !self.rom_loaded || movie.rom_hash != self.rom_hash {
+            return Err(std::io::Error::new(
+                std::io::ErrorKind::InvalidInput,
+                "movie was recorded on a different ROM",
+            ));
+        }
+        self.bus.mem.sram = movie.initial_save.clone();
+        if let Some(eeprom) = &mut self.bus.mem.eeprom {
+            eeprom.set_data(&movie.initial_eeprom);
+        }
+        self.reset();
+        self.movie = Some(MovieMode::Playing { movie, frame: 0 });
+        Ok(())
+    }
+
+    /// Ends recording or playback, returning the movie.
+    pub fn stop_movie(&mut self) -> Option<Movie> {
+        match self.movie.take()? {
+            MovieMode::Recording(movie) | MovieMode::Playing { movie, .. } => Some(movie),
+        }
+    }
+
+    pub fn is_playing_movie(&self) -> bool { matches!(self.movie, Some(MovieMode::Playing { .. })) }
+
+    // Movie input is applied once per frame, before any of it runs
+    fn movie_frame(&mut self) {
+        match &mut self.movie {
+            Some(MovieMode::Recording(movie)) => movie.frames.push(self.bus.io.keyinput),
+            Some(MovieMode::Playing { movie, frame }) => match movie.frames.get(*frame) {
+                Some(&keys) => {
+                    self.bus.io.keyinput = keys;
+                    *frame += 1;
+                }
+                None => {
+                    log::info!("Movie playback finished after {} frames", movie.len());
+                    self.movie = None;
                 }
-                prev_hblank = in_hblank;
+            },
+            None => {}
+        }
+    }
+
+    pub fn run_frame(&mut self) {
+        if self.paused {
+            return;
+        }
+        self.frame_ready = false;
+        self.bus.set_access_permissions(true, true, true);
 
-                if !self.bus.io.is_halted() {
-                    self.step_cpu();
+        let frame_end = match self.frame_end {
+            Some(end) => {
+                if let Some(profiler) = &mut self.profiler {
+                    profiler.resume();
+                }
+                end
+            }
+            None => {
+                // A frame resumed after a pause or breakpoint keeps timing from its original start
+                if let Some(profiler) = &mut self.profiler {
+                    profiler.begin_frame();
                 }
+                self.movie_frame();
+                let frame_start = self.bus.scheduler.now();
+                self.bus.scheduler.schedule_at(frame_start, Event::HDraw(0));
+                frame_start + (CYCLES_PER_SCANLINE * SCANLINES_PER_FRAME) as u64
+            }
+        };
+        self.frame_end = Some(frame_end);
+
+        while self.bus.scheduler.now() < frame_end {
+            if self.paused {
+                self.suspend_profiler();
+                return;
+            }
 
-                if self.bus.io.pending_interrupts() {
+            let mut vblank_started = false;
+            while let Some((at, event)) = self.bus.scheduler.pop_due() {
+                vblank_started |= event == Event::HDraw(VISIBLE_SCANLINES);
+                self.handle_event(at, event);
+            }
+            if vblank_started && self.stop_at_vblank {
+                self.stop_at_vblank = false;
+                self.present_frame();
+                self.suspend_profiler();
+                return;
+            }
+
+            if self.bus.io.is_halted() {
+                let irq_line = self.bus.io.pending_interrupts();
+                // Nothing runs until the next event can raise an interrupt
+                let next = self.bus.scheduler.next_event_at().unwrap_or(frame_end);
+                let next = self.break_at_cycle.map_or(next, |c| next.min(c));
+                self.bus.scheduler.advance_to(next.min(frame_end));
+                self.check_breakpoints();
+                if irq_line && self.bus.io.pending_interrupts() {
                     self.cpu.trigger_irq(&mut self.bus);
                 }
+            } else {
+                self.profiled(Section::Cpu, |emu| emu.run_cpu(frame_end));
             }
         }
 
-        self.ppu.render_frame_with_bus(&mut self.bus);
-        self.frame_ready = true;
+        self.frame_end = None;
+        self.present_frame();
         self.frame_count += 1;
 
         if self.frame_count.is_multiple_of(60) {
             log::debug!(
-                "Frame {} complete | PC={:#010x} | DISPCNT={:#06x}",
+                "Frame {} complete | PC={} | DISPCNT={:#06x}",
                 self.frame_count,
-                self.cpu.read_reg(15),
+                self.symbols.format_addr(self.cpu.read_reg(15)),
                 self.bus.io.dispcnt
             );
         }
 
+        if let Some(profiler) = &mut self.profiler {
+            profiler.end_frame(self.bus.dma_time.take().unwrap_or_default());
+            self.bus.dma_time = Some(Default::default());
+        }
+        if let Some(skipper) = &mut self.frameskip {
+            skipper.end_frame(Instant::now());
+        }
+    }
+
+    // Runs instructions until the next event is due, or the CPU halts or pauses
+    fn run_cpu(&mut self, frame_end: u64) {
+        loop {
+            // The IRQ line is sampled before the instruction, so enabling IME (or
+            // IE) only takes effect once the following instruction has run
+            let irq_line = self.bus.io.pending_interrupts();
+            let before = self.cpu.cycles();
+            self.step_cpu();
+            self.bus.scheduler.advance((self.cpu.cycles() - before).max(1));
+            self.check_breakpoints();
+            if irq_line && self.bus.io.pending_interrupts() {
+                self.cpu.trigger_irq(&mut self.bus);
+            }
+
+            let now = self.bus.scheduler.now();
+            let event_due = self.bus.scheduler.next_event_at().is_some_and(|at| at <= now);
+            if self.paused || self.bus.io.is_halted() || event_due || now >= frame_end {
+                return;
+            }
+        }
+    }
+
+    // A frame left unfinished does not count the time until it is resumed
+    fn suspend_profiler(&mut self) {
+        if let Some(profiler) = &mut self.profiler {
+            profiler.suspend();
+        }
+    }
+
+    /// Runs until the PPU enters VBlank (VCOUNT 160), before the CPU sees any of it,
+    /// and returns the frame drawn so far. The rest of the frame runs on the next
+    /// [`Emulator::run_frame`] or `run_to_vblank` call.
+    pub fn run_to_vblank(&mut self) -> &[u8] {
+        self.stop_at_vblank = true;
+        while self.stop_at_vblank && !self.paused {
+            self.run_frame();
+        }
+        self.stop_at_vblank = false;
+        &self.rgba_frame
+    }
+
+    fn present_frame(&mut self) {
+        self.draw_frame();
+        // The latches belong to this frame; the next one latches its own lines
+        self.ppu.clear_latches();
+    }
+
+    fn draw_frame(&mut self) {
+        if self.frameskip.as_ref().is_some_and(FrameSkipper::skipping) {
+            return;
+        }
+        let mut lines = vec![true; VISIBLE_SCANLINES];
+        if let Some(cache) = &mut self.render_cache {
+            let io: Vec<u8> = (0..DISPLAY_IO_LEN).map(|i| self.bus.peek_io8(0x0400_0000 + i)).collect();
+            lines = cache.dirty_lines(&io, &self.ppu, &self.bus.mem);
+            if !lines.contains(&true) {
+                self.frame_ready = true;
+                return;
+            }
+        }
+        self.profiled(Section::Ppu, |emu| emu.ppu.render_lines_with_bus(&mut emu.bus, &lines));
+        self.frame_ready = true;
         framebuffer_rgb555_to_rgba(&mut self.rgba_frame, self.ppu.framebuffer());
     }
 
+    fn handle_event(&mut self, at: u64, event: Event) {
+        match event {
+            Event::HDraw(scanline) => {
+                self.line_start = at;
+                self.bus.io.vcount = scanline as u16;
+                self.ppu.latch_line(&mut self.bus, scanline);
+
+                let in_vblank = scanline >= VISIBLE_SCANLINES;
+                let vcounter_match = scanline == (self.bus.io.dispstat >> 8) as usize;
+
+                if scanline == VISIBLE_SCANLINES {
+                    if (self.bus.io.dispstat & 0x08) != 0 {
+                        self.bus.io.request_interrupt(0x0001);
+                    }
+                    self.bus.trigger_dma(DmaTiming::VBlank);
+                }
+
+                if vcounter_match && (self.bus.io.dispstat & 0x20) != 0 {
+                    self.bus.io.request_interrupt(0x0004);
+                }
+
+                // VBlank flag is set on lines 160-226 but not on the last line
+                let vblank_flag = in_vblank && scanline != SCANLINES_PER_FRAME - 1;
+                self.bus.io.dispstat = (self.bus.io.dispstat & 0xFFF8)
+                    | (if vblank_flag { 1 } else { 0 })
+                    | (if vcounter_match { 4 } else { 0 });
+                self.profiled(Section::Apu, |emu| emu.bus.io.apu.step(CYCLES_PER_SCANLINE as u32));
+
+                self.bus.scheduler.schedule_at(at + HBLANK_START_CYCLE as u64, Event::HBlank(scanline));
+                if scanline + 1 < SCANLINES_PER_FRAME {
+                    self.bus.scheduler.schedule_at(at + CYCLES_PER_SCANLINE as u64, Event::HDraw(scanline + 1));
+                }
+            }
+            Event::HBlank(scanline) => {
+                self.bus.io.dispstat |= 2;
+                if (self.bus.io.dispstat & 0x10) != 0 {
+                    self.bus.io.request_interrupt(0x0002);
+                }
+                if scanline < VISIBLE_SCANLINES {
+                    self.bus.trigger_dma(DmaTiming::HBlank);
+                }
+            }
+            Event::TimerOverflow(idx) => self.bus.timer_overflow(idx, at),
+        }
+    }
+
+    /// Runs `frames` frames and returns the SHA-256 of every framebuffer
+    /// concatenated, for pinning known-good output of a test ROM.
+    pub fn run_frames_and_hash(&mut self, frames: usize) -> [u8; 32] {
+        let mut hasher = Sha256::new();
+        for _ in 0..frames {
+            self.run_frame();
+            hasher.update(&self.rgba_frame);
+        }
+        hasher.finalize().into()
+    }
+
     pub fn ppu_mut(&mut self) -> &mut Ppu { &mut self.ppu }
     pub fn bus_mut(&mut self) -> &mut Bus { &mut self.bus }
     pub fn cpu_mut(&mut self) -> &mut Cpu { &mut self.cpu }
     pub fn framebuffer_rgba(&self) -> &[u8] { &self.rgba_frame }
     pub fn is_frame_ready(&self) -> bool { self.frame_ready }
     pub fn is_rom_loaded(&self) -> bool { self.rom_loaded }
+    pub fn frame_count(&self) -> u64 { self.frame_count }
+    pub fn scanline(&self) -> u16 { self.bus.io.vcount }
+    /// Horizontal position within the scanline in dots (0-307); each dot takes four cycles.
+    pub fn dot(&self) -> usize {
+        // CPU instructions may run a few cycles past the line's end before the next one starts
+        ((self.bus.scheduler.now() - self.line_start) / CYCLES_PER_DOT).min(307) as usize
+    }
+    pub fn ppu_phase(&self) -> PpuPhase { PpuPhase::at(self.bus.io.vcount, (self.bus.io.dispstat & 0x02) != 0) }
+    pub fn dump_tiles(&mut self, palette_bank: usize) -> RgbaImage { self.ppu.dump_tiles(&mut self.bus, palette_bank) }
+    pub fn dump_palette(&mut self) -> RgbaImage { self.ppu.dump_palette(&mut self.bus) }
+    pub fn dump_sprites(&mut self) -> RgbaImage { self.ppu.dump_sprites(&mut self.bus) }
+
+    /// Decodes the stored value of the IO register covering `addr`, write-only
+    /// registers included. Nothing is read through the bus, so no side effects.
+    pub fn inspect_io(&self, addr: u32) -> Option<RegisterView> {
+        let register = registers::lookup(addr)?;
+        let value = (0..register.width as u32)
+            .fold(0, |v, i| v | (self.bus.peek_io8(register.addr + i) as u32) << (i * 8));
+        Some(RegisterView::new(register, value))
+    }
+
+    /// CPU registers, IO registers and PPU position as pretty-printed JSON, for
+    /// external tools. Memory contents are left out; use a savestate for those.
+    pub fn state_json(&self) -> String {
+        let mut cpu = JsonObject::new();
+        for (i, value) in self.cpu.capture_state().regs.iter().enumerate() {
+            cpu.number(&format!("r{}", i), *value);
+        }
+        cpu.number("cpsr", self.cpu.cpsr().raw())
+            .string("mode", &format!("{:?}", self.cpu.mode()))
+            .string("state", &format!("{:?}", self.cpu.state()));
+        if let Some(spsr) = self.cpu.spsr() {
+            cpu.number("spsr", spsr);
+        }
+        cpu.number("cycles", self.cpu.cycles());
+
+        let mut io = JsonObject::new();
+        for register in registers::IO_REGISTERS {
+            if let Some(view) = self.inspect_io(register.addr) {
+                io.number(register.name, view.value);
+            }
+        }
+
+        let mut ppu = JsonObject::new();
+        ppu.number("vcount", self.bus.io.vcount)
+            .string("phase", &format!("{:?}", self.ppu_phase()))
+            .number("frame", self.frame_count);
+
+        let mut state = JsonObject::new();
+        state.object("cpu", cpu).object("io", io).object("ppu", ppu).boolean("halted", self.bus.io.is_halted());
+        state.to_pretty_string()
+    }
+
+    pub fn set_keyinput(&mut self, keyinput: u16) { self.bus.io.keyinput = keyinput & 0x03FF; }
+    pub fn boot_config(&self) -> &BootConfig { &self.boot_config }
+    pub fn rom_header(&self) -> Option<&RomHeader> { self.rom_header.as_ref() }
+    pub fn rom_hash(&self) -> [u8; 32] { self.rom_hash }
 }
 
 impl Default for Emulator {
@@ -209,6 +931,7 @@ impl Default for Emulator {
 mod tests {
     use super::*;
     use std::path::PathBuf;
+    use std::time::Duration;
     use crate::bus::BusAccess;
 
     #[test]
@@ -255,6 +978,96 @@ mod tests {
         assert_ne!(dispcnt, 0, "DISPCNT should have been written by ROM code");
     }
 
+    #[test]
+    fn rom_without_bios_resolves_skip_bios_boot() {
+        let mut rom = vec![0u8; 0x200];
+        rom[0..4].copy_from_slice(&0xEA00_002Eu32.to_le_bytes()); // B 0x080000C0
+        rom[0xAC..0xB0].copy_from_slice(b"AXVJ");
+
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+
+        let config = emu.boot_config();
+        assert!(config.skip_bios);
+        assert!(config.swi_hle);
+        assert_eq!(config.entry_point, 0x0800_0000);
+        assert_eq!(config.region, Region::Japan);
+        assert_eq!(config.game_code, "AXVJ");
+        assert!(config.rtc, "Pokémon Ruby has a cartridge clock");
+        assert_eq!(emu.cpu.pc(), 0x0800_0000);
+        assert_eq!(emu.cpu.read_reg(13), 0x0300_7F00);
+    }
+
+    #[test]
+    fn coverage_records_code_and_vram_writes() {
+        let program: [u32; 4] = [
+            0xE3A0_0406, // MOV r0, #0x06000000
+            0xE3A0_10FF, // MOV r1, #0xFF
+            0xE1C0_10B0, // STRH r1, [r0]
+            0xEAFF_FFFE, // B .
+        ];
+        let mut rom = vec![0u8; 0x200];
+        for (i, word) in program.iter().enumerate() {
+            rom[i * 4..i * 4 + 4].copy_from_slice(&word.to_le_bytes());
+        }
+
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.set_coverage_enabled(true);
+        emu.run_frame();
+
+        let coverage = emu.coverage().unwrap();
+        assert_eq!(coverage.ranges(Access::Execute), vec![(0x0800_0000, 0x0800_000F)]);
+        assert!(coverage.contains(Access::Write, 0x0600_0000));
+        assert!(coverage.report().contains("executed ROM 0x08000000-0x0800000f"));
+    }
+
+    fn rom_from_words(words: &[u32]) -> Vec<u8> {
+        let mut rom = vec![0u8; 0x200];
+        for (i, word) in words.iter().enumerate() {
+            rom[i * 4..i * 4 + 4].copy_from_slice(&word.to_le_bytes());
+        }
+        rom
+    }
+
+    #[test]
+    fn loading_a_rom_discards_previous_machine_state() {
+        let dirty = rom_from_words(&[
+            0xE3A0_0406, // MOV r0, #0x06000000
+            0xE3A0_10FF, // MOV r1, #0xFF
+            0xE1C0_10B0, // STRH r1, [r0]
+            0xE3A0_0301, // MOV r0, #0x04000000
+            0xE280_2C01, // ADD r2, r0, #0x100
+            0xE3A0_1080, // MOV r1, #0x80
+            0xE1C2_10B2, // STRH r1, [r2, #2]   ; TM0CNT_H = enable
+            0xE280_2C02, // ADD r2, r0, #0x200
+            0xE3A0_1001, // MOV r1, #1
+            0xE1C2_10B0, // STRH r1, [r2]       ; IE = VBlank
+            0xE3A0_1008, // MOV r1, #8
+            0xE1C0_10B4, // STRH r1, [r0, #4]   ; DISPSTAT VBlank IRQ
+            0xEAFF_FFFE, // B .
+        ]);
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&dirty);
+        emu.run_frame();
+        assert_eq!(emu.bus.mem.vram[0], 0xFF);
+        assert!(emu.bus.io.timers.timers[0].enabled());
+        assert_ne!(emu.bus.io.if_, 0);
+
+        emu.load_rom_data(&rom_from_words(&[0xEAFF_FFFE]));
+        assert!(emu.bus.mem.vram.iter().all(|&b| b == 0));
+        assert!(emu.bus.io.timers.timers.iter().all(|t| !t.enabled()));
+        assert_eq!((emu.bus.io.ie, emu.bus.io.if_, emu.bus.io.dispstat), (0, 0, 0));
+        assert_eq!(emu.bus.scheduler.now(), 0);
+        assert_eq!(emu.bus.scheduler.next_event_at(), None);
+        assert_eq!(emu.frame_count(), 0);
+        assert!(!emu.is_frame_ready());
+        assert!(emu.framebuffer_rgba().iter().all(|&b| b == 0));
+        assert_eq!(emu.cpu.cycles(), 0);
+        assert_eq!(emu.cpu.pc(), 0x0800_0000);
+        assert_eq!(emu.bus.read32(0x0800_0000), 0xEAFF_FFFE);
+    }
+
     #[test]
     fn bus_writes_to_dispcnt() {
         let mut bus = Bus::new();
@@ -272,6 +1085,21 @@ mod tests {
         assert_eq!(bus.io.dispcnt, 0x0405, "DISPCNT should be 0x0405 after u32 write");
     }
 
+    #[test]
+    fn dispcnt_cgb_mode_bit_reads_back_zero() {
+        let mut bus = Bus::new();
+        bus.write16(0x0400_0000, 0xFFFF);
+        assert_eq!(bus.read16(0x0400_0000), 0xFFF7);
+
+        bus.write16(0x0400_0000, 0);
+        bus.write8(0x0400_0000, 0xFF);
+        bus.write8(0x0400_0001, 0xFF);
+        assert_eq!(bus.read16(0x0400_0000), 0xFFF7);
+
+        bus.write32(0x0400_0000, 0xFFFF_FFFF);
+        assert_eq!(bus.read16(0x0400_0000), 0xFFF7);
+    }
+
     #[test]
     fn cpu_str_writes_to_io() {
         let mut emu = Emulator::new();
@@ -350,4 +1178,803 @@ mod tests {
         assert!(unique_colors.len() >= 10, "Expected at least 10 colors, got {}", unique_colors.len());
     }
 
+    #[test]
+    fn frame_hash_is_stable_across_runs() {
+        let rom_path = PathBuf::from("../test-roms/shades.gba");
+
+        if !rom_path.exists() {
+            return;
+        }
+
+        let mut first = Emulator::new();
+        first.load_rom(&rom_path);
+        let mut second = Emulator::new();
+        second.load_rom(&rom_path);
+
+        let hash = first.run_frames_and_hash(3);
+        assert_eq!(hash, second.run_frames_and_hash(3));
+        assert_ne!(hash, [0u8; 32]);
+    }
+
+    #[test]
+    fn unimplemented_instruction_pauses_and_calls_handler() {
+        use std::sync::{Arc, Mutex};
+
+        let rom = rom_from_words(&[
+            0xEE00_0000, // CDP p0, ... (no coprocessors on the GBA)
+            0xE3A0_0001, // MOV r0, #1
+            0xEAFF_FFFE, // B .
+        ]);
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+
+        let seen = Arc::new(Mutex::new(Vec::new()));
+        let log = Arc::clone(&seen);
+        emu.set_unimplemented_handler(move |instr| {
+            log.lock().unwrap().push(*instr);
+            UnimplementedAction::Abort
+        });
+
+        emu.run_frame();
+        assert!(emu.is_paused());
+        assert_eq!(emu.frame_count(), 0);
+        assert_eq!(emu.cpu.read_reg(0), 0);
+        assert_eq!(
+            *seen.lock().unwrap(),
+            vec![UnimplementedInstruction { opcode: 0xEE00_0000, pc: 0x0800_0000, thumb: false }]
+        );
+
+        // Paused emulators ignore frame requests until resumed
+        emu.run_frame();
+        assert_eq!(emu.cpu.read_reg(0), 0);
+
+        emu.resume();
+        emu.run_frame();
+        assert!(!emu.is_paused());
+        assert_eq!(emu.cpu.read_reg(0), 1);
+        assert_eq!(emu.frame_count(), 1);
+        assert_eq!(seen.lock().unwrap().len(), 1);
+    }
+
+    #[test]
+    fn frame_timing_breaks_down_the_frame() {
+        // Keep DMA3 copying IWRAM onto itself
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r0, #0x03000000
+                mov r1, #0x04000000
+                add r1, r1, #0xD4
+                mov r2, #0x80000000
+                orr r2, r2, #16
+            loop:
+                str r0, [r1]
+                str r0, [r1, #4]
+                str r2, [r1, #8]
+                b loop
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.run_frame();
+        assert_eq!(emu.frame_timing(), None);
+
+        emu.set_profiling_enabled(true);
+        emu.run_frame();
+        let timing = emu.frame_timing().expect("profiled frame");
+        assert!(timing.cpu > Duration::ZERO);
+        assert!(timing.ppu > Duration::ZERO);
+        assert!(timing.apu > Duration::ZERO);
+        assert!(timing.dma > Duration::ZERO);
+        assert_eq!(timing.accounted(), timing.total);
+        assert!(timing.cpu + timing.ppu + timing.apu + timing.dma <= timing.total);
+
+        emu.set_profiling_enabled(false);
+        assert_eq!(emu.frame_timing(), None);
+    }
+
+    #[test]
+    fn large_roms_map_into_every_wait_state_window() {
+        let mut rom = rom_from_words(&[0xEAFF_FFFE]); // B .
+        rom.resize(0x0100_0000 + 0x100, 0);
+        rom[0x0100_0010..0x0100_0014].copy_from_slice(&0xCAFE_F00Du32.to_le_bytes());
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+
+        // The upper 16MB appear at +0x01000000 in each of WS0, WS1 and WS2
+        for window in [0x0800_0000u32, 0x0A00_0000, 0x0C00_0000] {
+            assert_eq!(emu.bus.read32(window + 0x0100_0010), 0xCAFE_F00D, "window {:#x}", window);
+            assert_eq!(emu.bus.read32(window), 0xEAFF_FFFE);
+        }
+        // Past the end of the ROM reads return the address-derived open bus pattern
+        assert_eq!(emu.bus.read16(0x0900_0200), (0x0900_0200u32 >> 1) as u16);
+        emu.run_frame();
+
+        // Anything beyond 32MB is dropped instead of overflowing the window
+        let mut huge = rom;
+        huge.resize(mem::ROM_MAX_SIZE + 0x1000, 0xFF);
+        emu.load_rom_data(&huge);
+        assert_eq!(emu.bus.mem.rom.len(), mem::ROM_MAX_SIZE);
+        assert_eq!(emu.bus.read32(0x0DFF_FFFC), 0xFFFF_FFFF);
+    }
+
+    #[test]
+    fn instruction_and_cycle_breakpoints_pause_execution() {
+        let rom = crate::asm::arm_program(0x0800_0000, "
+            loop:
+                add r0, r0, #1
+                b loop
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+
+        emu.break_at_instruction(7);
+        emu.run_frame();
+        assert!(emu.is_paused());
+        assert_eq!(emu.instructions_executed(), 7);
+        assert_eq!(emu.cpu.read_reg(0), 4, "ADD, B, ADD, B, ADD, B, ADD");
+
+        // The breakpoint is one-shot
+        let target = emu.bus.scheduler.now() + 1000;
+        emu.break_at_cycle(target);
+        emu.resume();
+        emu.run_frame();
+        assert!(emu.is_paused());
+        let now = emu.bus.scheduler.now();
+        assert!((target..target + 16).contains(&now), "stopped at cycle {}", now);
+        assert_eq!(emu.frame_count(), 0);
+
+        emu.resume();
+        emu.run_frame();
+        assert!(!emu.is_paused());
+        assert_eq!(emu.frame_count(), 1);
+    }
+
+    #[test]
+    fn entry_point_override_starts_execution_in_ewram() {
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom_from_words(&[0xEAFF_FFFE])); // B .
+        let code = crate::asm::arm_program(0x0200_0100, "
+                mov r0, #42
+            halt:
+                b halt
+        ");
+        for (i, byte) in code.iter().enumerate() {
+            emu.bus.write8(0x0200_0100 + i as u32, *byte);
+        }
+
+        assert!(emu.set_entry_point(0x0500_0000).is_err(), "palette RAM");
+        assert!(emu.set_entry_point(0x0200_0102).is_err(), "misaligned");
+        emu.set_entry_point(0x0200_0100).unwrap();
+        assert_eq!(emu.cpu.pc(), 0x0200_0100);
+
+        emu.step_cpu();
+        assert_eq!(emu.cpu.read_reg(0), 42);
+
+        // Resets keep the override
+        emu.reset();
+        assert_eq!(emu.cpu.pc(), 0x0200_0100);
+        emu.clear_entry_point();
+        emu.reset();
+        assert_eq!(emu.cpu.pc(), 0x0800_0000);
+    }
+
+    #[test]
+    fn ime_honors_bit0_and_enables_after_one_instruction() {
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r1, #0x04000000
+                add r1, r1, #0x200
+                mov r2, #1
+                strh r2, [r1]           ; IE = VBlank
+                mov r0, #0
+                mov r3, #0xFE
+                strh r3, [r1, #8]       ; IME = 0xFE: bit 0 clear, still disabled
+                add r0, r0, #1
+                strh r2, [r1, #8]       ; IME = 1
+                add r0, r0, #1          ; runs before the IRQ is taken
+                add r0, r0, #1
+            halt:
+                b halt
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.bus.io.if_ = 1; // VBlank already requested
+
+        for _ in 0..8 {
+            emu.step_cpu();
+        }
+        assert_eq!(emu.bus.read16(0x0400_0208), 0, "only bit 0 of IME is stored");
+
+        emu.break_at_instruction(12);
+        emu.run_frame();
+        assert_eq!(emu.bus.read32(0x0400_0208), 1);
+        assert_eq!(emu.cpu.read_reg(0), 2, "one instruction ran after the IME write");
+        assert_eq!(emu.cpu.mode(), crate::cpu::CpuMode::Irq);
+    }
+
+    #[test]
+    fn obj_palette_writes_leave_the_bg_palette_alone() {
+        let mut bus = Bus::new();
+        bus.write16(0x0500_0000, 0x001F);
+        bus.write16(0x0500_0200, 0x7C00);
+        assert_eq!(bus.read16(0x0500_0000), 0x001F, "BG color 0");
+        assert_eq!(bus.read16(0x0500_0200), 0x7C00, "OBJ color 0");
+        // Both halves mirror together every 1KB
+        assert_eq!(bus.read16(0x0500_0600), 0x7C00);
+    }
+
+    #[test]
+    fn recorded_movie_replays_identical_frames() {
+        // Shows the held keys as the backdrop color
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r1, #0x04000000
+                add r1, r1, #0x130
+                mov r2, #0x05000000
+            loop:
+                ldrh r0, [r1]
+                strh r0, [r2]
+                b loop
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+
+        let inputs = [0x03FF, 0x03FE, 0x03FE, 0x037F, 0x03FF, 0x01F0];
+        emu.start_recording();
+        let mut recorded = Vec::new();
+        for keys in inputs {
+            emu.set_keyinput(keys);
+            emu.run_frame();
+            recorded.push(emu.framebuffer_rgba().to_vec());
+        }
+        let movie = emu.stop_movie().unwrap();
+        assert_eq!(movie.frames, inputs);
+        assert_eq!(movie.rom_hash, emu.rom_hash());
+        assert_ne!(recorded[0], recorded[1], "input must reach the screen");
+
+        // Wander off with other input, then replay from the saved file format
+        emu.set_keyinput(0);
+        emu.run_frame();
+        let movie = Movie::from_bytes(&movie.to_bytes()).unwrap();
+        emu.play_movie(movie).unwrap();
+        for frame in &recorded {
+            assert!(emu.is_playing_movie());
+            emu.run_frame();
+            assert_eq!(emu.framebuffer_rgba(), frame.as_slice());
+        }
+
+        let mut other = Emulator::new();
+        other.load_rom_data(&rom_from_words(&[0xEAFF_FFFE]));
+        assert!(other.play_movie(emu.stop_movie().unwrap()).is_err());
+    }
+
+    #[test]
+    fn write_only_ppu_registers_read_as_open_bus() {
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r1, #0x04000000
+                mov r2, #0x55
+                strh r2, [r1, #0x10]    ; BG0HOFS
+                ldr r0, [r1, #0x10]
+                ldrh r3, [r1, #0x08]    ; BG0CNT reads back normally
+                b .                     ; prefetched while the ldr executes
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.bus.write16(0x0400_0008, 0x1234);
+        for _ in 0..5 {
+            emu.step_cpu();
+        }
+
+        assert_eq!(emu.cpu.read_reg(0), crate::asm::arm("b ."), "opcode two ahead of the ldr");
+        assert_eq!(emu.cpu.read_reg(3), 0x1234);
+        assert_eq!(emu.bus.io.bg0hofs, 0x55, "the PPU still sees the written scroll");
+
+        emu.bus.set_ppu_rendering(true);
+        assert_eq!(emu.bus.read16(0x0400_0010), 0x55);
+        emu.bus.set_ppu_rendering(false);
+        emu.bus.read16(0x0400_0008);
+        assert_eq!(emu.bus.read8(0x0400_0011), 0x12);
+        assert_eq!(emu.bus.read16(0x0400_0054), 0x1234, "BLDY");
+    }
+
+    #[test]
+    fn run_to_vblank_stops_at_the_vblank_boundary() {
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r0, #0x05000000
+                mov r1, #0x1F
+                strh r1, [r0]           ; red backdrop
+                b .
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        let frame_cycles = (CYCLES_PER_SCANLINE * SCANLINES_PER_FRAME) as u64;
+        let vblank_cycle = (CYCLES_PER_SCANLINE * VISIBLE_SCANLINES) as u64;
+
+        let frame = emu.run_to_vblank().to_vec();
+        assert_eq!(&frame[..4], &[0xFF, 0, 0, 0xFF]);
+        assert!(emu.is_frame_ready());
+        assert_eq!(emu.scanline(), 160);
+        assert_eq!(emu.ppu_phase(), PpuPhase::VBlank);
+        assert_eq!(emu.bus.scheduler.now(), vblank_cycle);
+        assert_eq!(emu.frame_count(), 0);
+
+        // run_frame finishes the same frame rather than starting another
+        emu.run_frame();
+        assert_eq!(emu.frame_count(), 1);
+        assert_eq!(emu.bus.scheduler.now(), frame_cycles);
+
+        emu.run_to_vblank();
+        assert_eq!(emu.bus.scheduler.now(), frame_cycles + vblank_cycle);
+        // Called from inside VBlank it runs on to the next frame's
+        emu.run_to_vblank();
+        assert_eq!(emu.bus.scheduler.now(), 2 * frame_cycles + vblank_cycle);
+        assert_eq!(emu.frame_count(), 2);
+    }
+
+    #[test]
+    fn branch_conditions_come_from_the_opcode_not_the_address() {
+        // Bits 31-28 of every ROM address read as EQ; none of this may depend on that
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                movs r0, #1             ; Z clear
+                beq fail
+                bne ne_taken
+                b fail
+            ne_taken:
+                cmp r0, #1              ; Z and C set
+                bne fail
+                bhi fail
+                bls ls_taken
+                b fail
+            ls_taken:
+                mov r5, #1
+                b .
+            fail:
+                mov r5, #2
+                b .
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        for _ in 0..16 {
+            emu.step_cpu();
+        }
+        assert_eq!(emu.cpu.read_reg(5), 1);
+    }
+
+    #[test]
+    fn inspector_decodes_register_fields() {
+        let mut emu = Emulator::new();
+        // Mode 3, BG2 and OBJ on, 1D OBJ mapping, window 0 enabled
+        emu.bus.write16(0x0400_0000, 0x3 | (1 << 6) | (1 << 10) | (1 << 12) | (1 << 13));
+
+        let view = emu.inspect_io(0x0400_0001).unwrap();
+        assert_eq!(view.register.name, "DISPCNT");
+        assert_eq!(view.value, 0x3443);
+        assert_eq!(view.field("mode"), Some(3));
+        assert_eq!(view.field("obj_1d"), Some(1));
+        assert_eq!(view.field("bg0"), Some(0));
+        assert_eq!(view.field("bg2"), Some(1));
+        assert_eq!(view.field("obj"), Some(1));
+        assert_eq!(view.field("win0"), Some(1));
+        assert_eq!(view.field("forced_blank"), Some(0));
+
+        // Write-only registers show what was written, masked as the hardware stores it
+        emu.bus.write16(0x0400_0054, 0xFFFF);
+        emu.bus.write32(0x0400_00D4, 0x0800_1234);
+        assert_eq!(emu.inspect_io(0x0400_0054).unwrap().field("evy"), Some(0x1F));
+        assert_eq!(emu.inspect_io(0x0400_00D4).unwrap().value, 0x0800_1234);
+        assert!(!emu.inspect_io(0x0400_0054).unwrap().register.readable());
+        assert!(emu.inspect_io(0x0400_0056).is_none());
+    }
+
+    #[test]
+    fn auto_frameskip_skips_rendering_after_a_slow_frame() {
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom_from_words(&[0xEAFF_FFFE])); // b .
+        emu.set_auto_frameskip(true);
+        emu.bus.io.dispcnt = 0;
+        emu.run_frame();
+        assert!(emu.is_frame_ready());
+
+        // The frame that just ended took three frames' worth of wall time
+        let late = Instant::now() + frameskip::FRAME_TIME * 3;
+        emu.frameskip.as_mut().unwrap().end_frame(late);
+
+        let old_frame = emu.framebuffer_rgba().to_vec();
+        let start = emu.bus.scheduler.now();
+        emu.bus.write16(0x0500_0000, 0x001F); // red backdrop
+        emu.run_frame();
+        assert!(!emu.is_frame_ready());
+        assert_eq!(emu.framebuffer_rgba(), &old_frame[..]);
+        assert_eq!(emu.bus.scheduler.now() - start, (CYCLES_PER_SCANLINE * SCANLINES_PER_FRAME) as u64);
+        assert_eq!(emu.frame_count(), 2);
+
+        // Drawing resumes once caught up, and at the latest after the skip limit
+        let mut frames = 0;
+        while !emu.is_frame_ready() {
+            emu.run_frame();
+            frames += 1;
+        }
+        assert!(frames <= frameskip::MAX_SKIPPED_FRAMES);
+        assert_eq!(&emu.framebuffer_rgba()[..4], &[0xFF, 0, 0, 0xFF]);
+    }
+
+    #[test]
+    fn step_back_restores_registers_and_memory() {
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&crate::asm::arm_program(0x0800_0000, "
+            mov r1, #0x03000000
+            mov r0, #1
+            adds r0, r0, #2
+            str r0, [r1]
+            strb r0, [r1, #5]
+            subs r0, r0, #3
+        "));
+        emu.set_step_history(8);
+        for _ in 0..3 {
+            emu.step_cpu();
+        }
+        let checkpoint = emu.cpu.capture_state();
+        let ram = emu.bus.read32(0x0300_0000);
+
+        for _ in 0..3 {
+            emu.step_cpu();
+        }
+        assert!(emu.cpu.cpsr().z());
+        assert_eq!(emu.bus.read32(0x0300_0000), 3);
+        assert_eq!(emu.bus.read8(0x0300_0005), 3);
+
+        for _ in 0..3 {
+            assert!(emu.step_back());
+        }
+        assert_eq!(emu.cpu.capture_state(), checkpoint);
+        assert_eq!(emu.bus.read32(0x0300_0000), ram);
+        assert_eq!(emu.bus.read8(0x0300_0005), 0);
+        assert_eq!(emu.instructions_executed(), 3);
+
+        // Replaying from there gives the same result, and history runs out eventually
+        for _ in 0..3 {
+            emu.step_cpu();
+        }
+        assert_eq!(emu.cpu.read_reg(0), 0);
+        while emu.step_back() {}
+        assert_eq!(emu.instructions_executed(), 0);
+        assert_eq!(emu.cpu.pc(), 0x0800_0000);
+    }
+
+    #[test]
+    fn entry_branch_jumps_over_the_header() {
+        // Everything in the header decodes as MOV r0, #0xFF if it were ever executed
+        let mut rom = [0xE3A0_00FFu32; 0x30].iter().flat_map(|w| w.to_le_bytes()).collect::<Vec<u8>>();
+        rom[0..4].copy_from_slice(&0xEA00_002Eu32.to_le_bytes()); // B 0x080000C0
+        rom.extend(crate::asm::arm_program(0x0800_00C0, "mov r0, #0x42\nb ."));
+
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.step_cpu();
+        assert_eq!(emu.cpu.pc(), 0x0800_00C0);
+        emu.step_cpu();
+        assert_eq!(emu.cpu.read_reg(0), 0x42);
+
+        // A real cartridge lands wherever its own entry branch points
+        let Ok(rom) = std::fs::read("../test-roms/stripes.gba") else { return };
+        let first = u32::from_le_bytes(rom[0..4].try_into().unwrap());
+        assert_eq!(first >> 24, 0xEA, "cartridges start with an unconditional B");
+        let target = 0x0800_0008u32.wrapping_add((((first as i32) << 8) >> 6) as u32);
+        emu.load_rom_data(&rom);
+        emu.step_cpu();
+        assert_eq!(emu.cpu.pc(), target);
+    }
+
+    #[test]
+    fn sandbox_reports_a_stray_write_to_rom() {
+        let rom = rom_from_words(&[
+            0xE3A0_0402, // MOV r0, #0x02000000
+            0xE3A0_1008, // MOV r1, #0x08
+            0xE5C0_1000, // STRB r1, [r0]
+            0xE3A0_0302, // MOV r0, #0x08000000
+            0xE5C0_1100, // STRB r1, [r0, #0x100]
+            0xEAFF_FFFE, // B .
+        ]);
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.set_write_sandbox(true);
+        emu.run_frame();
+
+        assert_eq!(emu.write_violations(), &[WriteViolation { addr: 0x0800_0100, value: 0x08 }]);
+        assert_eq!(emu.bus.read8(0x0800_0100), 0);
+
+        emu.set_write_sandbox(false);
+        assert!(emu.write_violations().is_empty());
+    }
+
+    #[test]
+    fn scroll_written_mid_line_shifts_only_later_lines() {
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r0, #0x04000000
+                mov r1, #4
+            wait:
+                ldrh r2, [r0, #6]
+                cmp r2, #80
+                bne wait
+                strh r1, [r0, #0x10]
+            halt:
+                b halt
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.bus.write16(0x0400_0000, 0x0100); // mode 0, BG0 on
+        emu.bus.write16(0x0400_0008, 0x0800); // map at 0x06004000, tiles at 0x06000000
+        emu.bus.write16(0x0500_0002, 0x001F);
+        emu.bus.write16(0x0500_0004, 0x03E0);
+        // Tile 0: four pixels of colour 1, then four of colour 2, on every row
+        for row in 0..8 {
+            emu.bus.write32(0x0600_0000 + row * 4, 0x2222_1111);
+        }
+        emu.run_frame();
+
+        let fb = emu.ppu.framebuffer();
+        for y in [0, 79, 80] {
+            assert_eq!(fb[y * 240], 0x001F, "line {y} was drawn before the write");
+        }
+        for y in [81, 159] {
+            assert_eq!(fb[y * 240], 0x03E0, "line {y} starts after the write");
+        }
+    }
+
+    #[test]
+    fn state_json_matches_live_registers() {
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r0, #42
+                mov r1, #0x04000000
+                mov r2, #0x0400
+                orr r2, r2, #3
+                strh r2, [r1]
+            halt:
+                b halt
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.run_frame();
+
+        let json = emu.state_json();
+        let state = crate::json::tests::parse(&json).unwrap_or_else(|e| panic!("{e} in {json}"));
+        assert_eq!(state.to_pretty_string(), json);
+        let number = |path: &[&str]| crate::json::tests::number_at(&state, path).unwrap_or_else(|| panic!("no {path:?} in {json}"));
+        assert_eq!(number(&["cpu", "r0"]), 42);
+        assert_eq!(number(&["cpu", "r1"]), 0x0400_0000);
+        assert_eq!(number(&["cpu", "r15"]), emu.cpu.read_reg(15) as u64);
+        assert_eq!(number(&["cpu", "cpsr"]), emu.cpu.cpsr().raw() as u64);
+        assert_eq!(number(&["io", "DISPCNT"]), 0x0403);
+        assert_eq!(number(&["ppu", "vcount"]), emu.bus.io.vcount as u64);
+        assert_eq!(number(&["ppu", "frame"]), 1);
+        assert!(json.contains("\"state\": \"Arm\""));
+    }
+
+    const CYCLES_PER_FRAME: u64 = (CYCLES_PER_SCANLINE * SCANLINES_PER_FRAME) as u64;
+
+    // Handles the line events due up to cycle `until` without running the CPU,
+    // calling `each` after every one
+    fn run_scanline_events(emu: &mut Emulator, until: u64, mut each: impl FnMut(&mut Emulator, Event)) {
+        while let Some(at) = emu.bus.scheduler.next_event_at().filter(|&at| at <= until) {
+            emu.bus.scheduler.advance_to(at);
+            let (at, event) = emu.bus.scheduler.pop_due().unwrap();
+            emu.handle_event(at, event);
+            each(emu, event);
+        }
+        emu.bus.scheduler.advance_to(until);
+    }
+
+    #[test]
+    fn dispstat_flags_follow_the_scanline_events() {
+        let mut emu = Emulator::new();
+        emu.bus.scheduler.schedule_at(0, Event::HDraw(0));
+        let mut events = 0;
+        run_scanline_events(&mut emu, CYCLES_PER_FRAME, |emu, event| {
+            events += 1;
+            let dispstat = emu.bus.read16(0x0400_0004);
+            let vcount = emu.bus.read16(0x0400_0006) as usize;
+            let (line, in_hblank) = match event {
+                Event::HDraw(line) => (line, false),
+                Event::HBlank(line) => (line, true),
+                Event::TimerOverflow(_) => unreachable!(),
+            };
+            assert_eq!(vcount, line);
+            assert_eq!(dispstat & 1 != 0, (160..=226).contains(&line), "VBlank flag on line {line}");
+            assert_eq!(dispstat & 2 != 0, in_hblank, "HBlank flag on line {line}");
+        });
+        assert_eq!(events, SCANLINES_PER_FRAME * 2);
+        assert!(emu.bus.scheduler.next_event_at().is_none(), "the frame ends after line 227");
+    }
+
+    #[test]
+    fn display_interrupts_follow_the_dispstat_enables() {
+        let run_frame_events = |dispstat: u16| {
+            let mut emu = Emulator::new();
+            emu.bus.write16(0x0400_0004, dispstat);
+            emu.bus.scheduler.schedule_at(0, Event::HDraw(0));
+            let mut raised = Vec::new();
+            run_scanline_events(&mut emu, CYCLES_PER_FRAME, |emu, event| {
+                let flags = emu.bus.read16(0x0400_0202);
+                if flags != 0 {
+                    raised.push((event, flags));
+                    emu.bus.write16(0x0400_0202, flags);
+                }
+            });
+            raised
+        };
+
+        assert_eq!(run_frame_events(0x0008), vec![(Event::HDraw(160), 0x0001)]);
+        assert_eq!(run_frame_events(0x6420), vec![(Event::HDraw(100), 0x0004)], "VCount match at line 100");
+
+        let hblanks = run_frame_events(0x0010);
+        assert_eq!(hblanks.len(), SCANLINES_PER_FRAME, "every line has an HBlank, VBlank lines included");
+        assert!(hblanks.iter().all(|&(event, flags)| matches!(event, Event::HBlank(_)) && flags == 0x0002));
+
+        assert!(run_frame_events(0x6400).is_empty(), "nothing fires without an enable bit");
+    }
+
+    #[test]
+    fn render_cache_redraws_only_the_lines_that_changed() {
+        let rom = rom_from_words(&[0xEAFF_FFFE]); // B .
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.set_render_cache(true);
+        emu.bus.write16(0x0400_0000, 0x1403); // mode 3, BG2 and OBJ on
+        emu.bus.write16(0x0600_0000, 0x001F);
+
+        emu.run_frame();
+        emu.run_frame();
+        assert_eq!(emu.reused_lines(), Some(160), "an unchanged frame reuses every line");
+        assert_eq!(emu.ppu.framebuffer()[0], 0x001F);
+
+        // A VRAM byte on line 100 only redraws that line
+        let line_100 = 0x0600_0000 + 100 * 480;
+        emu.bus.write16(line_100, 0x03E0);
+        emu.run_frame();
+        assert_eq!(emu.reused_lines(), Some(160 + 159));
+        assert_eq!(emu.ppu.framebuffer()[100 * 240], 0x03E0);
+        assert_eq!(emu.ppu.framebuffer()[0], 0x001F);
+
+        emu.bus.write16(0x0500_0202, 0x7C00);
+        emu.bus.write32(0x0601_4000, 0x1111_1111);
+        emu.run_frame();
+        assert_eq!(emu.reused_lines(), Some(160 + 159), "a palette change redraws everything");
+        // Moving the 8x8 OBJ 0 from line 0 to line 40 redraws both places
+        emu.bus.write16(0x0700_0000, 40);
+        emu.bus.write16(0x0700_0002, 8);
+        emu.bus.write16(0x0700_0004, 512);
+        emu.run_frame();
+        assert_eq!(emu.reused_lines(), Some(160 + 159 + 144));
+        assert_eq!(emu.ppu.framebuffer()[40 * 240 + 8], 0x7C00);
+
+        emu.set_render_cache(false);
+        assert_eq!(emu.reused_lines(), None);
+    }
+
+    #[test]
+    fn presented_frames_drop_their_line_latches() {
+        let rom = rom_from_words(&[0xEAFF_FFFE]); // B .
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.bus.write16(0x0400_0000, 0x0100); // mode 0, BG0 on
+        emu.bus.write16(0x0400_0010, 4);
+
+        emu.run_frame();
+        assert!((0..VISIBLE_SCANLINES).all(|y| emu.ppu.line_registers(y).is_none()));
+        // The next frame latches its lines again as they start
+        emu.handle_event(0, Event::HDraw(0));
+        assert!(emu.ppu.line_registers(0).is_some());
+    }
+
+    #[test]
+    fn resumed_frames_are_not_profiled_as_new_ones() {
+        let rom = rom_from_words(&[0xEAFF_FFFE]); // B .
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.run_to_vblank();
+
+        // Profiling switched on mid-frame only covers frames that start afterwards
+        emu.set_profiling_enabled(true);
+        emu.run_frame();
+        assert_eq!(emu.frame_timing(), None);
+        emu.run_frame();
+        assert!(emu.frame_timing().is_some());
+    }
+
+    #[test]
+    fn loading_a_state_returns_to_the_saved_machine() {
+        // Counts frames into r5 and shows the count as the backdrop color
+        let rom = crate::asm::arm_program(0x0800_0000, "
+                mov r1, #0x04000000
+                mov r2, #0x05000000
+                mov r5, #0
+            wait:
+                ldrh r0, [r1, #6]
+                cmp r0, #160
+                bne wait
+                add r5, r5, #1
+                strh r5, [r2]
+            leave:
+                ldrh r0, [r1, #6]
+                cmp r0, #160
+                beq leave
+                b wait
+        ");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.run_frame();
+        emu.run_frame();
+        let state = emu.save_state();
+        let saved = (emu.cpu.read_reg(5), emu.framebuffer_rgba().to_vec(), emu.bus.scheduler.now());
+        assert_eq!(state.frame_count(), 2);
+
+        emu.run_frame();
+        emu.run_frame();
+        assert_ne!(emu.cpu.read_reg(5), saved.0);
+        emu.load_state(&state).unwrap();
+        assert_eq!(emu.frame_count(), 2);
+        assert_eq!((emu.cpu.read_reg(5), emu.framebuffer_rgba().to_vec(), emu.bus.scheduler.now()), saved);
+        assert_eq!(emu.bus.read32(0x0800_0000), u32::from_le_bytes(rom[..4].try_into().unwrap()));
+
+        // Running on from the state repeats the original run exactly
+        emu.run_frame();
+        let replayed = emu.framebuffer_rgba().to_vec();
+        emu.load_state(&state).unwrap();
+        emu.run_frame();
+        assert_eq!(emu.framebuffer_rgba(), &replayed[..]);
+
+        let mut other = Emulator::new();
+        other.load_rom_data(&rom_from_words(&[0xEAFF_FFFE]));
+        assert!(other.load_state(&state).is_err());
+    }
+
+    #[test]
+    fn movies_start_from_the_recorded_eeprom() {
+        let mut rom = rom_from_words(&[0xEAFF_FFFE]); // b .
+        rom.extend_from_slice(b"EEPROM_V124");
+        let mut emu = Emulator::new();
+        emu.load_rom_data(&rom);
+        emu.bus.mem.eeprom.as_mut().unwrap().set_data(&[0x5A; 8]);
+
+        emu.start_recording();
+        emu.run_frame();
+        let movie = emu.stop_movie().unwrap();
+        assert_eq!(&movie.initial_eeprom[..8], &[0x5A; 8]);
+
+        emu.bus.mem.eeprom.as_mut().unwrap().set_data(&[]);
+        emu.play_movie(Movie::from_bytes(&movie.to_bytes()).unwrap()).unwrap();
+        let data = emu.bus.mem.eeprom.as_ref().unwrap().data();
+        assert_eq!(&data[..8], &[0x5A; 8]);
+        assert_eq!(data[8], 0xFF);
+    }
+
+    #[test]
+    fn scanline_and_dot_advance_with_every_cycle() {
+        let mut emu = Emulator::new();
+        emu.bus.scheduler.schedule_at(0, Event::HDraw(0));
+        for cycle in 0..(CYCLES_PER_SCANLINE * (SCANLINES_PER_FRAME - 1)) as u64 {
+            run_scanline_events(&mut emu, cycle, |_, _| {});
+            let line = cycle as usize / CYCLES_PER_SCANLINE;
+            let in_line = cycle as usize % CYCLES_PER_SCANLINE;
+            assert_eq!(emu.scanline() as usize, line, "cycle {cycle}");
+            assert_eq!(emu.dot(), in_line / 4, "cycle {cycle}");
+        }
+    }
+
+    #[test]
+    fn scanline_and_phase_follow_the_line_events() {
+        let mut emu = Emulator::new();
+        emu.bus.scheduler.schedule_at(0, Event::HDraw(0));
+        let at = |emu: &mut Emulator, cycle: usize| {
+            run_scanline_events(emu, cycle as u64, |_, _| {});
+            (emu.scanline(), emu.ppu_phase())
+        };
+        let line = |n: usize| n * CYCLES_PER_SCANLINE;
+
+        assert_eq!(at(&mut emu, 0), (0, PpuPhase::Visible));
+        assert_eq!(at(&mut emu, HBLANK_START_CYCLE - 1), (0, PpuPhase::Visible));
+        assert_eq!(at(&mut emu, HBLANK_START_CYCLE), (0, PpuPhase::HBlank));
+        assert_eq!(at(&mut emu, line(1)), (1, PpuPhase::Visible));
+        assert_eq!(at(&mut emu, line(160) - 1), (159, PpuPhase::HBlank));
+        assert_eq!(at(&mut emu, line(160)), (160, PpuPhase::VBlank));
+        // The last line is still VBlank even though the DISPSTAT flag has dropped
+        assert_eq!(at(&mut emu, line(227)), (227, PpuPhase::VBlank));
+        assert_eq!(emu.bus.io.dispstat & 1, 0);
+    }
 }
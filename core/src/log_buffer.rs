@@ -1,5 +1,104 @@
 use std::collections::VecDeque;
-use std::sync::{Mutex, OnceLock};
+use std::sync::{Mutex, OnceLock, RwLock};
+
+use log::{Level, LevelFilter};
+
+// Per-instruction and per-access tracing is too hot to filter at runtime, so
+// these compile to nothing unless the matching `trace_*` feature is enabled
+macro_rules! trace_cpu {
+    ($($arg:tt)*) => {
+        #[cfg(feature = "trace_cpu")]
+        log::trace!(target: "core::cpu", $($arg)*);
+    };
+}
+
+macro_rules! trace_bus {
+    ($($arg:tt)*) => {
+        #[cfg(feature = "trace_bus")]
+        log::trace!(target: "core::bus", $($arg)*);
+    };
+}
+
+macro_rules! trace_ppu {
+    ($($arg:tt)*) => {
+        #[cfg(feature = "trace_ppu")]
+        log::trace!(target: "core::ppu", $($arg)*);
+    };
+}
+
+pub(crate) use {trace_bus, trace_cpu, trace_ppu};
+
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum Subsystem { Cpu, Ppu, Dma, Bus, Other }
+
+impl Subsystem {
+    const COUNT: usize = 5;
+
+    /// Maps a log target (the emitting module path) to its subsystem.
+    pub fn from_target(target: &str) -> Self {
+        match target.split("::").nth(1).unwrap_or("") {
+            "cpu" => Subsystem::Cpu,
+            "ppu" | "video" => Subsystem::Ppu,
+            "dma" => Subsystem::Dma,
+            "bus" | "mem" | "io" => Subsystem::Bus,
+            _ => Subsystem::Other,
+        }
+    }
+}
+
+/// Runtime log filter: a default level plus optional per-subsystem overrides.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct LogFilter {
+    level: LevelFilter,
+    overrides: [Option<LevelFilter>; Subsystem::COUNT],
+}
+
+impl LogFilter {
+    pub const fn new(level: LevelFilter) -> Self {
+        Self { level, overrides: [None; Subsystem::COUNT] }
+    }
+
+    pub fn level(&self) -> LevelFilter { self.level }
+    pub fn set_level(&mut self, level: LevelFilter) { self.level = level; }
+
+    /// Overrides the level of one subsystem; `None` falls back to the default level.
+    pub fn set_subsystem_level(&mut self, subsystem: Subsystem, level: Option<LevelFilter>) {
+        self.overrides[subsystem as usize] = level;
+    }
+
+    pub fn subsystem_level(&self, subsystem: Subsystem) -> LevelFilter {
+        self.overrides[subsystem as usize].unwrap_or(self.level)
+    }
+
+    pub fn enabled(&self, target: &str, level: Level) -> bool {
+        level <= self.subsystem_level(Subsystem::from_target(target))
+    }
+
+    /// Most verbose level any subsystem lets through, for `log::set_max_level`.
+    pub fn max_level(&self) -> LevelFilter {
+        self.overrides.iter().flatten().copied().fold(self.level, Ord::max)
+    }
+}
+
+static FILTER: RwLock<LogFilter> = RwLock::new(LogFilter::new(LevelFilter::Info));
+
+pub fn filter() -> LogFilter {
+    FILTER.read().map(|f| f.clone()).unwrap_or_else(|_| LogFilter::new(LevelFilter::Info))
+}
+
+/// Replaces the runtime filter, e.g. to enable only PPU debug logs.
+pub fn set_filter(filter: LogFilter) {
+    log::set_max_level(filter.max_level());
+    if let Ok(mut current) = FILTER.write() {
+        *current = filter;
+    }
+}
+
+pub fn set_subsystem_level(subsystem: Subsystem, level: Option<LevelFilter>) {
+    let mut updated = filter();
+    updated.set_subsystem_level(subsystem, level);
+    set_filter(updated);
+}
 
 #[derive(Clone, Debug)]
 pub struct LogEntry {
@@ -51,7 +150,7 @@ pub struct BufferLogger;
 
 impl log::Log for BufferLogger {
     fn enabled(&self, metadata: &log::Metadata) -> bool {
-        metadata.level() <= log::Level::Trace
+        FILTER.read().is_ok_and(|f| f.enabled(metadata.target(), metadata.level()))
     }
 
     fn log(&self, record: &log::Record) {
@@ -73,7 +172,7 @@ impl log::Log for BufferLogger {
 static LOGGER: BufferLogger = BufferLogger;
 
 pub fn init_logger(level: log::LevelFilter) -> Result<(), log::SetLoggerError> {
-    log::set_logger(&LOGGER).map(|()| log::set_max_level(level))
+    log::set_logger(&LOGGER).map(|()| set_filter(LogFilter::new(level)))
 }
 
 pub fn drain_logs() -> Vec<LogEntry> {
@@ -89,3 +188,36 @@ pub fn clear_logs() {
     }
 }
 
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn filter_levels_and_subsystem_overrides() {
+        let mut filter = LogFilter::new(LevelFilter::Debug);
+        assert!(filter.enabled("core::cpu", Level::Warn));
+        assert!(filter.enabled("core::ppu", Level::Debug));
+        assert!(!filter.enabled("core::cpu", Level::Trace));
+
+        // Only the PPU gets the firehose
+        filter.set_level(LevelFilter::Warn);
+        filter.set_subsystem_level(Subsystem::Ppu, Some(LevelFilter::Trace));
+        assert!(filter.enabled("core::ppu::render", Level::Trace));
+        assert!(!filter.enabled("core::cpu", Level::Info));
+        assert!(filter.enabled("core::dma", Level::Error));
+        assert_eq!(filter.max_level(), LevelFilter::Trace);
+
+        filter.set_subsystem_level(Subsystem::Ppu, None);
+        assert!(!filter.enabled("core::ppu", Level::Debug));
+        assert_eq!(filter.max_level(), LevelFilter::Warn);
+    }
+
+    #[test]
+    fn targets_map_to_subsystems() {
+        assert_eq!(Subsystem::from_target("core::cpu"), Subsystem::Cpu);
+        assert_eq!(Subsystem::from_target("core::video"), Subsystem::Ppu);
+        assert_eq!(Subsystem::from_target("core::io"), Subsystem::Bus);
+        assert_eq!(Subsystem::from_target("core"), Subsystem::Other);
+        assert_eq!(Subsystem::from_target("desktop"), Subsystem::Other);
+    }
+}
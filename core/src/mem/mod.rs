@@ -1,11 +1,14 @@
+use crate::eeprom::Eeprom;
+
 pub const BIOS_SIZE: usize = 16 * 1024;
 pub const EWRAM_SIZE: usize = 256 * 1024;
 pub const IWRAM_SIZE: usize = 32 * 1024;
 pub const VRAM_SIZE: usize = 96 * 1024;
-pub const PALETTE_SIZE: usize = 512;
+pub const PALETTE_SIZE: usize = 1024;
 pub const OAM_SIZE: usize = 1024;
 pub const ROM_MAX_SIZE: usize = 32 * 1024 * 1024;
 
+#[derive(Clone)]
 pub struct Mem {
     pub bios: Vec<u8>,
     pub ewram: Vec<u8>,
@@ -15,6 +18,8 @@ pub struct Mem {
     pub oam: Vec<u8>,
     pub rom: Vec<u8>,
     pub sram: Vec<u8>,
+    /// Present when the cartridge saves to EEPROM instead of SRAM
+    pub eeprom: Option<Eeprom>,
 }
 
 impl Default for Mem {
@@ -28,6 +33,7 @@ impl Default for Mem {
             oam: vec![0u8; OAM_SIZE],
             rom: Vec::new(),
             sram: vec![0u8; 64 * 1024],
+            eeprom: None,
         }
     }
 }
@@ -41,6 +47,11 @@ impl Mem {
     }
 
     pub fn load_rom(&mut self, data: &[u8]) {
-        self.rom = data.to_vec();
+        // Each wait-state window only decodes 25 address bits, so nothing past
+        // 32MB is reachable
+        if data.len() > ROM_MAX_SIZE {
+            log::warn!("ROM is {} bytes; only the first {} are addressable", data.len(), ROM_MAX_SIZE);
+        }
+        self.rom = data[..data.len().min(ROM_MAX_SIZE)].to_vec();
     }
 }
@@ -0,0 +1,140 @@
+use std::io::{Error, ErrorKind};
+use std::path::Path;
+
+const MAGIC: &[u8; 4] = b"RBAM";
+const VERSION: u16 = 2;
+// Version 1 files predate the EEPROM image and load with an empty one
+const OLDEST_VERSION: u16 = 1;
+
+/// A frame-by-frame input recording.
+///
+/// Movies start from a reset with the recorded save memory in place, which is the
+/// whole initial state: everything else returns to power-on on a reset.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Movie {
+    /// SHA-256 of the ROM the movie was recorded on
+    pub rom_hash: [u8; 32],
+    pub initial_save: Vec<u8>,
+    /// Contents of the EEPROM chip, empty for cartridges without one
+    pub initial_eeprom: Vec<u8>,
+    /// KEYINPUT for each frame, in order
+    pub frames: Vec<u16>,
+}
+
+impl Movie {
+    pub fn new(rom_hash: [u8; 32], initial_save: Vec<u8>, initial_eeprom: Vec<u8>) -> Self {
+        Self { rom_hash, initial_save, initial_eeprom, frames: Vec::new() }
+    }
+
+    pub fn len(&self) -> usize { self.frames.len() }
+    pub fn is_empty(&self) -> bool { self.frames.is_empty() }
+
+    /// Layout: magic, version, ROM hash, save length and data, EEPROM length and
+    /// data, frame count, frames. All integers are little-endian.
+    pub fn to_bytes(&self) -> Vec<u8> {
+        let len = 50 + self.initial_save.len() + self.initial_eeprom.len() + self.frames.len() * 2;
+        let mut out = Vec::with_capacity(len);
+        out.extend_from_slice(MAGIC);
+        out.extend_from_slice(&VERSION.to_le_bytes());
+        out.extend_from_slice(&self.rom_hash);
+        for image in [&self.initial_save, &self.initial_eeprom] {
+            out.extend_from_slice(&(image.len() as u32).to_le_bytes());
+            out.extend_from_slice(image);
+        }
+        out.extend_from_slice(&(self.frames.len() as u32).to_le_bytes());
+        for keys in &self.frames {
+            out.extend_from_slice(&keys.to_le_bytes());
+        }
+        out
+    }
+
+    pub fn from_bytes(data: &[u8]) -> Result<Self, Error> {
+        let mut reader = Reader { data, pos: 0 };
+        if reader.take(4)? != MAGIC {
+            return Err(Error::new(ErrorKind::InvalidData, "not a movie file"));
+        }
+        let version = u16::from_le_bytes(reader.take(2)?.try_into().unwrap());
+        if !(OLDEST_VERSION..=VERSION).contains(&version) {
+            return Err(Error::new(ErrorKind::InvalidData, format!("unsupported movie version {}", version)));
+        }
+        let rom_hash = reader.take(32)?.try_into().unwrap();
+        let save_len = reader.u32()? as usize;
+        let initial_save = reader.take(save_len)?.to_vec();
+        let initial_eeprom = if version >= 2 {
+            let eeprom_len = reader.u32()? as usize;
+            reader.take(eeprom_len)?.to_vec()
+        } else {
+            Vec::new()
+        };
+        let frame_count = reader.u32()? as usize;
+        let frames = reader
+            .take(frame_count * 2)?
+            .chunks_exact(2)
+            .map(|b| u16::from_le_bytes([b[0], b[1]]))
+            .collect();
+        Ok(Self { rom_hash, initial_save, initial_eeprom, frames })
+    }
+
+    pub fn save(&self, path: &Path) -> Result<(), Error> {
+        std::fs::write(path, self.to_bytes())
+    }
+
+    pub fn load(path: &Path) -> Result<Self, Error> {
+        Self::from_bytes(&std::fs::read(path)?)
+    }
+}
+
+struct Reader<'a> {
+    data: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, len: usize) -> Result<&'a [u8], Error> {
+        let bytes = self
+            .data
+            .get(self.pos..self.pos + len)
+            .ok_or_else(|| Error::new(ErrorKind::UnexpectedEof, "truncated movie file"))?;
+        self.pos += len;
+        Ok(bytes)
+    }
+
+    fn u32(&mut self) -> Result<u32, Error> {
+        Ok(u32::from_le_bytes(self.take(4)?.try_into().unwrap()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn movie_round_trips_through_bytes() {
+        let mut movie = Movie::new([7; 32], vec![1, 2, 3], vec![4; 8]);
+        movie.frames.extend([0x03FF, 0x03FE, 0x03F7]);
+
+        let bytes = movie.to_bytes();
+        assert_eq!(Movie::from_bytes(&bytes).unwrap(), movie);
+
+        let err = Movie::from_bytes(&bytes[..bytes.len() - 1]).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::UnexpectedEof);
+        let err = Movie::from_bytes(b"NOPE").unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::InvalidData);
+    }
+
+    #[test]
+    fn version_1_movies_load_without_an_eeprom_image() {
+        let mut bytes = MAGIC.to_vec();
+        bytes.extend_from_slice(&1u16.to_le_bytes());
+        bytes.extend_from_slice(&[7; 32]);
+        bytes.extend_from_slice(&2u32.to_le_bytes());
+        bytes.extend_from_slice(&[1, 2]);
+        bytes.extend_from_slice(&1u32.to_le_bytes());
+        bytes.extend_from_slice(&0x03FEu16.to_le_bytes());
+
+        let movie = Movie::from_bytes(&bytes).unwrap();
+        assert_eq!(movie.initial_save, [1, 2]);
+        assert!(movie.initial_eeprom.is_empty());
+        assert_eq!(movie.frames, [0x03FE]);
+    }
+}
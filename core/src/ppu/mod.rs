@@ -5,6 +5,10 @@
 //! It defines the PPU's state, memory-mapped registers, and rendering pipeline.
 //! The acceptance tests serve as a scaffold for implementing the PPU's behavior step-by-step.
 
+use crate::log_buffer::trace_ppu;
+use crate::mem::VRAM_SIZE;
+use crate::video::RgbaImage;
+
 // Constants for PPU memory-mapped I/O registers.
 // These are defined in hexadecimal format and represent the memory addresses
 // that the CPU uses to interact with the PPU.
@@ -53,6 +57,7 @@ const OAM_START: u32 = 0x0700_0000;
 const PALETTE_RAM_START: u32 = 0x0500_0000;
 
 /// Represents a minimal state of the GBA's PPU sufficient to start producing frames.
+#[derive(Clone)]
 pub struct Ppu {
     dispcnt: u16,
     dispstat: u16,
@@ -60,12 +65,61 @@ pub struct Ppu {
     framebuffer: Vec<u16>,
     cycles: usize,
     vcount: u8,
+    layer_isolation: Option<PpuLayer>,
+    // Per-scanline register values, filled in by `latch_line` as each line starts
+    lines: Vec<Option<LineRegisters>>,
+    // Lines the render in progress draws; the rest of the framebuffer is kept
+    lines_to_draw: Vec<bool>,
+}
+
+#[derive(Copy, Clone, Default, PartialEq, Eq)]
+pub(crate) struct LineRegisters {
+    bgcnt: [u16; 4],
+    // Horizontal then vertical offset for each background
+    offsets: [[u16; 2]; 4],
+}
+
+/// Which part of the frame the PPU is drawing.
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum PpuPhase {
+    Visible,
+    HBlank,
+    /// Lines 160-227, including their HBlank periods
+    VBlank,
+}
+
+impl PpuPhase {
+    pub fn at(scanline: u16, in_hblank: bool) -> Self {
+        if scanline as usize >= SCANLINES_VISIBLE {
+            PpuPhase::VBlank
+        } else if in_hblank {
+            PpuPhase::HBlank
+        } else {
+            PpuPhase::Visible
+        }
+    }
+}
+
+/// A layer that can be rendered on its own for debugging.
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum PpuLayer {
+    Bg0,
+    Bg1,
+    Bg2,
+    Bg3,
+    Obj,
+    Backdrop,
 }
 
 const SCREEN_W: usize = 240;
 const SCREEN_H: usize = 160;
 const FRAME_PIXELS: usize = SCREEN_W * SCREEN_H;
 
+// OBJ rendering cycles per scanline; fewer are left when OAM must stay
+// accessible during HBlank (DISPCNT bit 5)
+const OBJ_CYCLES_PER_LINE: usize = 1210;
+const OBJ_CYCLES_PER_LINE_HBLANK_FREE: usize = 954;
+
 #[derive(Clone)]
 struct PixelLayer {
     color: u16,
@@ -110,6 +164,9 @@ impl Default for Ppu {
             framebuffer: vec![0u16; FRAME_PIXELS],
             cycles: 0,
             vcount: 0,
+            layer_isolation: None,
+            lines: vec![None; SCREEN_H],
+            lines_to_draw: vec![true; SCREEN_H],
         }
     }
 }
@@ -122,6 +179,65 @@ impl Ppu {
     pub fn write_dispcnt(&mut self, value: u16) {
         self.dispcnt = value;
     }
+
+    /// Renders only `layer` (all others transparent), or every layer when `None`.
+    pub fn set_layer_isolation(&mut self, layer: Option<PpuLayer>) {
+        self.layer_isolation = layer;
+    }
+    pub fn layer_isolation(&self) -> Option<PpuLayer> {
+        self.layer_isolation
+    }
+
+    fn isolate_layers(&self, dispcnt: u16) -> u16 {
+        let keep = match self.layer_isolation {
+            None => return dispcnt,
+            Some(PpuLayer::Bg0) => DISPCNT_BG0_ENABLE,
+            Some(PpuLayer::Bg1) => DISPCNT_BG1_ENABLE,
+            Some(PpuLayer::Bg2) => DISPCNT_BG2_ENABLE,
+            Some(PpuLayer::Bg3) => DISPCNT_BG3_ENABLE,
+            Some(PpuLayer::Obj) => DISPCNT_OBJ_ENABLE,
+            Some(PpuLayer::Backdrop) => 0,
+        };
+        let layers = DISPCNT_BG0_ENABLE
+            | DISPCNT_BG1_ENABLE
+            | DISPCNT_BG2_ENABLE
+            | DISPCNT_BG3_ENABLE
+            | DISPCNT_OBJ_ENABLE;
+        (dispcnt & !layers) | (dispcnt & keep)
+    }
+
+    /// Records the background registers scanline `line` is drawn with. The frame is
+    /// rendered later, at VBlank, so this keeps raster effects that rewrite the
+    /// registers between lines.
+    pub fn latch_line<B: crate::bus::BusAccess>(&mut self, bus: &mut B, line: usize) {
+        if line >= SCREEN_H {
+            return;
+        }
+        // Clear the latch first so the reads below go to the bus
+        self.lines[line] = None;
+        bus.set_ppu_rendering(true);
+        let mut regs = LineRegisters::default();
+        for bg_num in 0..4 {
+            regs.bgcnt[bg_num] = self.read_bgcnt(bus, bg_num, line);
+            regs.offsets[bg_num] = [
+                self.read_bg_offset(bus, bg_num, true, line),
+                self.read_bg_offset(bus, bg_num, false, line),
+            ];
+        }
+        bus.set_ppu_rendering(false);
+        self.lines[line] = Some(regs);
+    }
+
+    pub(crate) fn line_registers(&self, y: usize) -> Option<LineRegisters> {
+        self.lines.get(y).copied().flatten()
+    }
+
+    /// Drops the latched line registers once their frame is drawn, so a later
+    /// render reads the live registers instead of a finished frame's.
+    pub fn clear_latches(&mut self) {
+        self.lines.fill(None);
+    }
+
     pub fn read_dispcnt(&self) -> u16 {
         self.dispcnt
     }
@@ -144,10 +260,23 @@ impl Ppu {
         CYCLES_PER_SCANLINE * SCANLINES_PER_FRAME
     }
 
+    /// Advances by `cycles`, one scanline at a time so that a long step still
+    /// passes through every line's VBlank and VCount transitions.
     pub fn step(&mut self, cycles: usize) {
-        let cycles_per_frame = self.cycles_per_frame();
-        self.cycles = (self.cycles + cycles) % cycles_per_frame;
+        let mut remaining = cycles;
+        loop {
+            let run = remaining.min(CYCLES_PER_SCANLINE - self.get_cycle_in_scanline());
+            self.cycles = (self.cycles + run) % self.cycles_per_frame();
+            remaining -= run;
+            self.update_status();
+            if remaining == 0 {
+                break;
+            }
+        }
+    }
 
+    // Only the status flags; the matching IRQs are raised by the scheduler's line events
+    fn update_status(&mut self) {
         let current_scanline = (self.cycles / CYCLES_PER_SCANLINE) as u8;
         let cycle_in_scanline = self.cycles % CYCLES_PER_SCANLINE;
 
@@ -156,16 +285,15 @@ impl Ppu {
 
             if self.vcount == SCANLINES_VISIBLE as u8 {
                 self.dispstat |= DISPSTAT_VBLANK_FLAG;
-                // (self.dispstat & DISPSTAT_VBLANK_IRQ) != 0;
                 self.render_frame();
-            } else if self.vcount == 0 {
+            } else if self.vcount == (SCANLINES_PER_FRAME - 1) as u8 || self.vcount == 0 {
+                // The flag already drops on the last line (227), not at the wrap to 0
                 self.dispstat &= !DISPSTAT_VBLANK_FLAG;
             }
 
             let lyc = (self.dispstat >> 8) as u8;
             if self.vcount == lyc {
                 self.dispstat |= DISPSTAT_VCOUNT_FLAG;
-                if (self.dispstat & DISPSTAT_VCOUNT_IRQ) != 0 {}
             } else {
                 self.dispstat &= !DISPSTAT_VCOUNT_FLAG;
             }
@@ -175,7 +303,6 @@ impl Ppu {
             self.dispstat &= !DISPSTAT_HBLANK_FLAG;
         } else if (self.dispstat & DISPSTAT_HBLANK_FLAG) == 0 {
             self.dispstat |= DISPSTAT_HBLANK_FLAG;
-            if (self.dispstat & DISPSTAT_HBLANK_IRQ) != 0 {}
         }
     }
 
@@ -185,6 +312,12 @@ impl Ppu {
 
     pub fn write_dispstat(&mut self, value: u16) {
         self.dispstat = (self.dispstat & 0x7) | (value & 0xFFF8);
+        // The new LYC is compared against the current line right away
+        if (self.dispstat >> 8) as u8 == self.vcount {
+            self.dispstat |= DISPSTAT_VCOUNT_FLAG;
+        } else {
+            self.dispstat &= !DISPSTAT_VCOUNT_FLAG;
+        }
     }
 
     pub fn is_in_vblank(&self) -> bool {
@@ -242,6 +375,98 @@ impl Ppu {
         self.cycles % CYCLES_PER_SCANLINE
     }
 
+    /// Draws all of VRAM as 4bpp tiles, 32 tiles per row, for a tile viewer.
+    /// Tiles in the BG area use BG palette `palette_bank`, tiles in the OBJ area
+    /// the matching OBJ palette; color 0 is left transparent.
+    pub fn dump_tiles<B: crate::bus::BusAccess>(&self, bus: &mut B, palette_bank: usize) -> RgbaImage {
+        const TILES_PER_ROW: usize = 32;
+        let tile_count = VRAM_SIZE / 32;
+        let mut image = RgbaImage::new(TILES_PER_ROW * 8, tile_count / TILES_PER_ROW * 8);
+        for tile in 0..tile_count {
+            let offset = (tile * 32) as u32;
+            let palette = if offset < OBJ_VRAM_START_MODE012 - VRAM_START {
+                PALETTE_RAM_START
+            } else {
+                OBJ_PALETTE_START
+            } + (palette_bank as u32 & 0xF) * 32;
+            let (tx, ty) = (tile % TILES_PER_ROW * 8, tile / TILES_PER_ROW * 8);
+            for py in 0..8 {
+                for px in 0..8 {
+                    let byte = bus.read8(VRAM_START + offset + (py * 4 + px / 2) as u32);
+                    let index = if px % 2 == 0 { byte & 0xF } else { byte >> 4 };
+                    if index != 0 {
+                        let color = bus.read16(palette + index as u32 * 2);
+                        image.set_bgr555(tx + px, ty + py, color);
+                    }
+                }
+            }
+        }
+        image
+    }
+
+    /// Draws the 512 palette entries as 8x8 swatches, BG palette on top.
+    pub fn dump_palette<B: crate::bus::BusAccess>(&self, bus: &mut B) -> RgbaImage {
+        let mut image = RgbaImage::new(16 * 8, 32 * 8);
+        for entry in 0..512 {
+            let color = bus.read16(PALETTE_RAM_START + entry as u32 * 2);
+            let (sx, sy) = (entry % 16 * 8, entry / 16 * 8);
+            for y in 0..8 {
+                for x in 0..8 {
+                    image.set_bgr555(sx + x, sy + y, color);
+                }
+            }
+        }
+        image
+    }
+
+    /// Draws all 128 OAM entries as a 16x8 grid of 64x64 cells, for a sprite
+    /// viewer. Each OBJ sits unflipped and untransformed in the top-left of its
+    /// cell, whether or not it is currently shown.
+    pub fn dump_sprites<B: crate::bus::BusAccess>(&self, bus: &mut B) -> RgbaImage {
+        const CELL: usize = 64;
+        const CELLS_PER_ROW: usize = 16;
+        let dispcnt = bus.read16(REG_DISPCNT);
+        let obj_vram_base = if dispcnt & DISPCNT_MODE_MASK >= 3 {
+            OBJ_VRAM_START_MODE345
+        } else {
+            OBJ_VRAM_START_MODE012
+        };
+        let one_dimensional = (dispcnt & DISPCNT_OBJ_VRAM_MAPPING) != 0;
+
+        let mut image = RgbaImage::new(CELLS_PER_ROW * CELL, 128 / CELLS_PER_ROW * CELL);
+        for obj_num in 0..128 {
+            let oam_addr = OAM_START + (obj_num * 8) as u32;
+            let attr0 = bus.read16(oam_addr);
+            let attr1 = bus.read16(oam_addr + 2);
+            let attr2 = bus.read16(oam_addr + 4);
+            let (obj_w, obj_h) = self.get_obj_size((attr0 >> 14) & 0x3, (attr1 >> 14) & 0x3);
+            let is_256_color = (attr0 >> 13) & 1 != 0;
+            let (cx, cy) = (obj_num % CELLS_PER_ROW * CELL, obj_num / CELLS_PER_ROW * CELL);
+            for y in 0..obj_h {
+                for x in 0..obj_w {
+                    let pixel = self.render_regular_obj_pixel(
+                        bus,
+                        obj_vram_base,
+                        one_dimensional,
+                        is_256_color,
+                        attr2 & 0x3FF,
+                        (attr2 >> 12) & 0xF,
+                        obj_w,
+                        obj_h,
+                        x,
+                        y,
+                        false,
+                        false,
+                    );
+                    if let Some(color) = pixel {
+                        image.set_bgr555(cx + x, cy + y, color);
+                    }
+                }
+            }
+        }
+        image
+    }
+
     /// Renders a single frame.
     ///
     /// This function will be the core of the PPU emulation. It should
@@ -268,25 +493,30 @@ impl Ppu {
     }
 
     pub fn render_frame_with_bus<B: crate::bus::BusAccess>(&mut self, bus: &mut B) {
+        self.render_lines_with_bus(bus, &[true; SCREEN_H]);
+    }
+
+    /// Like [`Ppu::render_frame_with_bus`], but only redraws the lines set in
+    /// `lines`; the others keep what the framebuffer already holds.
+    pub fn render_lines_with_bus<B: crate::bus::BusAccess>(&mut self, bus: &mut B, lines: &[bool]) {
+        self.lines_to_draw.copy_from_slice(&lines[..SCREEN_H]);
         bus.set_ppu_rendering(true);
 
         if (self.dispcnt & DISPCNT_FORCED_BLANK) != 0 {
-            for p in self.framebuffer.iter_mut() {
-                *p = 0;
-            }
+            self.fill_lines(0);
             bus.set_ppu_rendering(false);
+            self.lines_to_draw.fill(true);
             return;
         }
 
         let lo = bus.read8(REG_DISPCNT) as u16;
         let hi = bus.read8(REG_DISPCNT + 1) as u16;
-        self.dispcnt = lo | (hi << 8);
+        self.dispcnt = self.isolate_layers(lo | (hi << 8));
 
-        for p in self.framebuffer.iter_mut() {
-            *p = 0;
-        }
+        self.fill_lines(0);
 
         let mode = self.dispcnt & DISPCNT_MODE_MASK;
+        trace_ppu!("Render frame: DISPCNT={:#06x} mode {}", self.dispcnt, mode);
         match mode {
             0 => self.render_mode0(bus),
             1 => self.render_mode1(bus),
@@ -294,10 +524,25 @@ impl Ppu {
             3 => self.render_mode3(bus),
             4 => self.render_mode4(bus),
             5 => self.render_mode5(bus),
-            _ => {}
+            _ => self.render_invalid_mode(bus),
         }
 
         bus.set_ppu_rendering(false);
+        self.lines_to_draw.fill(true);
+    }
+
+    fn fill_lines(&mut self, color: u16) {
+        for (line, draw) in self.framebuffer.chunks_mut(SCREEN_W).zip(&self.lines_to_draw) {
+            if *draw {
+                line.fill(color);
+            }
+        }
+    }
+
+    /// Modes 6 and 7 are invalid; fill with the backdrop instead of leaving black.
+    fn render_invalid_mode<B: crate::bus::BusAccess>(&mut self, bus: &mut B) {
+        let backdrop = self.read_backdrop_color(bus);
+        self.fill_lines(backdrop);
     }
 
     fn render_mode0<B: crate::bus::BusAccess>(&mut self, bus: &mut B) {
@@ -307,6 +552,9 @@ impl Ppu {
         let mut layer_buffer: Vec<Vec<PixelLayer>> = vec![vec![]; FRAME_PIXELS];
 
         for y in 0..SCREEN_H {
+            if !self.lines_to_draw[y] {
+                continue;
+            }
             for x in 0..SCREEN_W {
                 let window_region = self.get_window_region(bus, x, y, &obj_window_mask);
                 let idx = y * SCREEN_W + x;
@@ -319,7 +567,7 @@ impl Ppu {
                         continue;
                     }
 
-                    let bgcnt = self.read_bgcnt(bus, bg_num);
+                    let bgcnt = self.read_bgcnt(bus, bg_num, y);
                     let bg_priority = (bgcnt & 0x3) as u8;
 
                     let src_x = if (bgcnt >> 6) & 1 != 0 {
@@ -352,8 +600,24 @@ impl Ppu {
             self.render_objs_with_windows_layers(bus, fb, &obj_window_mask);
         }
 
-        for layer in layer_buffer.iter_mut().take(FRAME_PIXELS) {
-            layer.sort_by(|a, b| {
+        for (y, line) in layer_buffer.chunks_mut(SCREEN_W).enumerate() {
+            if self.lines_to_draw[y] {
+                self.composite_line(bus, y, line, backdrop);
+            }
+        }
+    }
+
+    /// Sorts each pixel's layers by priority (OBJ wins ties) and writes the
+    /// blended result of scanline `y` into the framebuffer.
+    fn composite_line<B: crate::bus::BusAccess>(
+        &mut self,
+        bus: &mut B,
+        y: usize,
+        line: &mut [Vec<PixelLayer>],
+        backdrop: u16,
+    ) {
+        for (x, layers) in line.iter_mut().enumerate().take(SCREEN_W) {
+            layers.sort_by(|a, b| {
                 a.priority.cmp(&b.priority).then_with(|| {
                     if a.is_obj && !b.is_obj {
                         std::cmp::Ordering::Less
@@ -364,16 +628,10 @@ impl Ppu {
                     }
                 })
             });
-        }
-
 
-        for y in 0..SCREEN_H {
-            for x in 0..SCREEN_W {
-                let idx = y * SCREEN_W + x;
-                let top = layer_buffer[idx].first().cloned();
-                let second = layer_buffer[idx].get(1).cloned();
-                self.framebuffer[idx] = self.combine_pixel_layers(bus, top, second, backdrop);
-            }
+            let top = layers.first().cloned();
+            let second = layers.get(1).cloned();
+            self.framebuffer[y * SCREEN_W + x] = self.combine_pixel_layers(bus, top, second, backdrop);
         }
     }
 
@@ -384,6 +642,9 @@ impl Ppu {
         let mut temp_buffer = vec![0u16; FRAME_PIXELS];
 
         for y in 0..SCREEN_H {
+            if !self.lines_to_draw[y] {
+                continue;
+            }
             for x in 0..SCREEN_W {
                 let window_region = self.get_window_region(bus, x, y, &obj_window_mask);
                 let mut pixel = backdrop;
@@ -397,7 +658,7 @@ impl Ppu {
                         continue;
                     }
 
-                    let bgcnt = self.read_bgcnt(bus, bg_num);
+                    let bgcnt = self.read_bgcnt(bus, bg_num, y);
                     let bg_priority = (bgcnt & 0x3) as u8;
                     if bg_priority >= priority {
                         continue;
@@ -434,7 +695,15 @@ impl Ppu {
             let mut fb = temp_buffer.as_mut_slice();
             self.render_objs_with_windows(bus, fb, &obj_window_mask);
         }
-        self.framebuffer.copy_from_slice(&temp_buffer);
+        self.copy_drawn_lines(&temp_buffer);
+    }
+
+    fn copy_drawn_lines(&mut self, buffer: &[u16]) {
+        for (y, line) in buffer.chunks(SCREEN_W).enumerate() {
+            if self.lines_to_draw[y] {
+                self.framebuffer[y * SCREEN_W..(y + 1) * SCREEN_W].copy_from_slice(line);
+            }
+        }
     }
 
     fn render_mode2<B: crate::bus::BusAccess>(&mut self, bus: &mut B) {
@@ -444,6 +713,9 @@ impl Ppu {
         let mut temp_buffer = vec![0u16; FRAME_PIXELS];
 
         for y in 0..SCREEN_H {
+            if !self.lines_to_draw[y] {
+                continue;
+            }
             for x in 0..SCREEN_W {
                 let window_region = self.get_window_region(bus, x, y, &obj_window_mask);
                 let mut pixel = backdrop;
@@ -457,7 +729,7 @@ impl Ppu {
                         continue;
                     }
 
-                    let bgcnt = self.read_bgcnt(bus, bg_num);
+                    let bgcnt = self.read_bgcnt(bus, bg_num, y);
                     let bg_priority = (bgcnt & 0x3) as u8;
                     if bg_priority >= priority {
                         continue;
@@ -488,7 +760,7 @@ impl Ppu {
             let mut fb = temp_buffer.as_mut_slice();
             self.render_objs_with_windows(bus, fb, &obj_window_mask);
         }
-        self.framebuffer.copy_from_slice(&temp_buffer);
+        self.copy_drawn_lines(&temp_buffer);
     }
 
     fn render_mode3<B: crate::bus::BusAccess>(&mut self, bus: &mut B) {
@@ -496,13 +768,29 @@ impl Ppu {
             return;
         }
 
+        let backdrop = self.read_backdrop_color(bus);
+        let mut line: Vec<Vec<PixelLayer>> = vec![vec![]; SCREEN_W];
+
         for y in 0..SCREEN_H {
-            for x in 0..SCREEN_W {
+            if !self.lines_to_draw[y] {
+                continue;
+            }
+            let bg_priority = (self.read_bgcnt(bus, 2, y) & 0x3) as u8;
+            for (x, layers) in line.iter_mut().enumerate() {
                 let addr = VRAM_START + ((y * SCREEN_W + x) * 2) as u32;
                 let lo = bus.read8(addr) as u16;
                 let hi = bus.read8(addr + 1) as u16;
-                self.framebuffer[y * SCREEN_W + x] = lo | (hi << 8);
+                layers.clear();
+                layers.push(PixelLayer {
+                    color: lo | (hi << 8),
+                    priority: bg_priority,
+                    layer: 2,
+                    is_obj: false,
+                    is_backdrop: false,
+                    is_semi_transparent: false,
+                });
             }
+            self.composite_line(bus, y, &mut line, backdrop);
         }
         self.render_objs_direct(bus);
     }
@@ -516,6 +804,9 @@ impl Ppu {
         let frame_base = if frame_select == 0 { 0 } else { 0x0A000 };
 
         for y in 0..SCREEN_H {
+            if !self.lines_to_draw[y] {
+                continue;
+            }
             for x in 0..SCREEN_W {
                 let addr = VRAM_START + frame_base + ((y * SCREEN_W + x) as u32);
                 let palette_idx = bus.read8(addr) as usize;
@@ -543,6 +834,9 @@ impl Ppu {
         const MODE5_H: usize = 128;
 
         for y in 0..MODE5_H {
+            if !self.lines_to_draw[y] {
+                continue;
+            }
             for x in 0..MODE5_W {
                 let addr = VRAM_START + frame_base + ((y * MODE5_W + x) * 2) as u32;
                 let lo = bus.read8(addr) as u16;
@@ -621,6 +915,7 @@ impl Ppu {
         one_dimensional: bool,
         obj_window_mask: &[bool],
     ) {
+        let budget = self.obj_line_budget(bus);
         for obj_num in (0..128).rev() {
             let oam_addr = OAM_START + (obj_num * 8) as u32;
             let attr0_lo = bus.read8(oam_addr) as u16;
@@ -674,6 +969,9 @@ impl Ppu {
                 if fy >= SCREEN_H {
                     continue;
                 }
+                if budget[fy] & (1 << obj_num) == 0 {
+                    continue;
+                }
 
                 let src_y = if obj_mosaic {
                     self.apply_mosaic_y(fy, mosaic)
@@ -773,6 +1071,7 @@ impl Ppu {
         };
         let one_dimensional = (dispcnt & DISPCNT_OBJ_VRAM_MAPPING) != 0;
 
+        let budget = self.obj_line_budget(bus);
         for obj_num in (0..128).rev() {
             let oam_addr = OAM_START + (obj_num * 8) as u32;
             let attr0_lo = bus.read8(oam_addr) as u16;
@@ -827,6 +1126,9 @@ impl Ppu {
                 if fy >= SCREEN_H {
                     continue;
                 }
+                if budget[fy] & (1 << obj_num) == 0 {
+                    continue;
+                }
 
                 let src_y = if obj_mosaic {
                     self.apply_mosaic_y(fy, mosaic)
@@ -947,6 +1249,7 @@ impl Ppu {
         obj_vram_base: u32,
         one_dimensional: bool,
     ) {
+        let budget = self.obj_line_budget(bus);
         for obj_num in (0..128).rev() {
             let oam_addr = OAM_START + (obj_num * 8) as u32;
             let attr0_lo = bus.read8(oam_addr) as u16;
@@ -1000,6 +1303,9 @@ impl Ppu {
                 if fy >= SCREEN_H {
                     continue;
                 }
+                if budget[fy] & (1 << obj_num) == 0 {
+                    continue;
+                }
 
                 let src_y = if obj_mosaic {
                     self.apply_mosaic_y(fy, mosaic)
@@ -1086,6 +1392,7 @@ impl Ppu {
         obj_vram_base: u32,
         one_dimensional: bool,
     ) {
+        let budget = self.obj_line_budget(bus);
         for obj_num in (0..128).rev() {
             let oam_addr = OAM_START + (obj_num * 8) as u32;
             let attr0_lo = bus.read8(oam_addr) as u16;
@@ -1139,6 +1446,9 @@ impl Ppu {
                 if fy >= SCREEN_H {
                     continue;
                 }
+                if budget[fy] & (1 << obj_num) == 0 {
+                    continue;
+                }
 
                 let src_y = if obj_mosaic {
                     self.apply_mosaic_y(fy, mosaic)
@@ -1214,6 +1524,44 @@ impl Ppu {
         }
     }
 
+    /// For each scanline, the set of OBJs (bit n = OBJ n) that fit in the line's
+    /// rendering cycles. OBJs are fetched in OAM order, so the highest-numbered
+    /// ones drop out first; an OBJ that does not fit is skipped whole.
+    fn obj_line_budget<B: crate::bus::BusAccess>(&self, bus: &mut B) -> Vec<u128> {
+        let budget = if self.is_hblank_interval_free() {
+            OBJ_CYCLES_PER_LINE_HBLANK_FREE
+        } else {
+            OBJ_CYCLES_PER_LINE
+        };
+        let mut used = vec![0usize; SCREEN_H];
+        let mut fits = vec![0u128; SCREEN_H];
+
+        for obj_num in 0..128 {
+            let oam_addr = OAM_START + (obj_num * 8) as u32;
+            let attr0 = bus.read8(oam_addr) as u16 | ((bus.read8(oam_addr + 1) as u16) << 8);
+            let attr1 = bus.read8(oam_addr + 2) as u16 | ((bus.read8(oam_addr + 3) as u16) << 8);
+
+            let Some((y, height)) = self.obj_rows(attr0, attr1) else {
+                continue;
+            };
+            let rotation_scaling = (attr0 >> 8) & 1 != 0;
+            let (obj_w, obj_h) = self.get_obj_size((attr0 >> 14) & 0x3, (attr1 >> 14) & 0x3);
+            // Regular OBJs take a cycle per pixel, affine ones two plus setup
+            let cost = if rotation_scaling { 10 + 2 * obj_w * (height / obj_h) } else { obj_w };
+
+            let screen_y = if y >= 160 { y.wrapping_sub(256) } else { y };
+            for py in 0..height {
+                let fy = screen_y.wrapping_add(py);
+                if fy >= SCREEN_H || !self.lines_to_draw[fy] || used[fy] + cost > budget {
+                    continue;
+                }
+                used[fy] += cost;
+                fits[fy] |= 1 << obj_num;
+            }
+        }
+        fits
+    }
+
     fn get_obj_size(&self, shape: u16, size: u16) -> (usize, usize) {
         match (shape, size) {
             (0, 0) => (8, 8),
@@ -1232,6 +1580,18 @@ impl Ppu {
         }
     }
 
+    /// First line (0-255, wrapping past the bottom of the screen) and height of
+    /// an OBJ, or `None` when it is not displayed.
+    pub(crate) fn obj_rows(&self, attr0: u16, attr1: u16) -> Option<(usize, usize)> {
+        let rotation_scaling = (attr0 >> 8) & 1 != 0;
+        if (!rotation_scaling && (attr0 >> 9) & 1 != 0) || (attr0 >> 10) & 0x3 == 3 {
+            return None;
+        }
+        let (_, obj_h) = self.get_obj_size((attr0 >> 14) & 0x3, (attr1 >> 14) & 0x3);
+        let double_size = rotation_scaling && (attr0 >> 9) & 1 != 0;
+        Some(((attr0 & 0xFF) as usize, if double_size { obj_h * 2 } else { obj_h }))
+    }
+
     #[allow(clippy::too_many_arguments)]
     fn render_regular_obj_pixel<B: crate::bus::BusAccess>(
         &self,
@@ -1279,7 +1639,12 @@ impl Ppu {
             base_tile + tile_offset
         };
 
-        let tile_addr = obj_vram_base + actual_tile * (if is_256_color { 64 } else { 32 });
+        // Tile numbers always count from the start of OBJ VRAM; in bitmap modes the
+        // first 16KB belongs to the frame buffer, so only tiles 512-1023 are usable
+        if obj_vram_base == OBJ_VRAM_START_MODE345 && base_tile < 512 {
+            return None;
+        }
+        let tile_addr = OBJ_VRAM_START_MODE012 + actual_tile * (if is_256_color { 64 } else { 32 });
         let row_addr = tile_addr + final_pixel_y as u32 * (if is_256_color { 8 } else { 4 });
 
         if is_256_color {
@@ -1372,7 +1737,12 @@ impl Ppu {
             base_tile + tile_offset
         };
 
-        let tile_addr = obj_vram_base + actual_tile * (if is_256_color { 64 } else { 32 });
+        // Tile numbers always count from the start of OBJ VRAM; in bitmap modes the
+        // first 16KB belongs to the frame buffer, so only tiles 512-1023 are usable
+        if obj_vram_base == OBJ_VRAM_START_MODE345 && base_tile < 512 {
+            return None;
+        }
+        let tile_addr = OBJ_VRAM_START_MODE012 + actual_tile * (if is_256_color { 64 } else { 32 });
         let row_addr = tile_addr + pixel_y as u32 * (if is_256_color { 8 } else { 4 });
 
         if is_256_color {
@@ -1421,7 +1791,7 @@ impl Ppu {
                         continue;
                     }
                     if self.render_text_bg_pixel(bus, bg_num, x, y).is_some() {
-                        let bgcnt = self.read_bgcnt(bus, bg_num);
+                        let bgcnt = self.read_bgcnt(bus, bg_num, y);
                         let bg_priority = (bgcnt & 0x3) as u8;
                         if bg_priority < min_priority {
                             min_priority = bg_priority;
@@ -1441,7 +1811,7 @@ impl Ppu {
                         self.render_affine_bg_pixel(bus, bg_num, x, y).is_some()
                     };
                     if has_pixel {
-                        let bgcnt = self.read_bgcnt(bus, bg_num);
+                        let bgcnt = self.read_bgcnt(bus, bg_num, y);
                         let bg_priority = (bgcnt & 0x3) as u8;
                         if bg_priority < min_priority {
                             min_priority = bg_priority;
@@ -1456,7 +1826,7 @@ impl Ppu {
                         continue;
                     }
                     if self.render_affine_bg_pixel(bus, bg_num, x, y).is_some() {
-                        let bgcnt = self.read_bgcnt(bus, bg_num);
+                        let bgcnt = self.read_bgcnt(bus, bg_num, y);
                         let bg_priority = (bgcnt & 0x3) as u8;
                         if bg_priority < min_priority {
                             min_priority = bg_priority;
@@ -1497,14 +1867,22 @@ impl Ppu {
         (y / v_size) * v_size
     }
 
-    fn read_bgcnt<B: crate::bus::BusAccess>(&self, bus: &mut B, bg_num: usize) -> u16 {
+    // BGxCNT and the scroll offsets come from the values latched when scanline `y`
+    // started, so a write partway through a line only shows from the next one
+    fn read_bgcnt<B: crate::bus::BusAccess>(&self, bus: &mut B, bg_num: usize, y: usize) -> u16 {
+        if let Some(regs) = self.line_registers(y) {
+            return regs.bgcnt[bg_num];
+        }
         let addr = REG_BG0CNT + (bg_num * 2) as u32;
         let lo = bus.read8(addr) as u16;
         let hi = bus.read8(addr + 1) as u16;
         lo | (hi << 8)
     }
 
-    fn read_bg_offset<B: crate::bus::BusAccess>(&self, bus: &mut B, bg_num: usize, h: bool) -> u16 {
+    fn read_bg_offset<B: crate::bus::BusAccess>(&self, bus: &mut B, bg_num: usize, h: bool, y: usize) -> u16 {
+        if let Some(regs) = self.line_registers(y) {
+            return regs.offsets[bg_num][!h as usize];
+        }
         let base = REG_BG0HOFS + (bg_num * 4) as u32;
         let addr = if h { base } else { base + 2 };
         let lo = bus.read8(addr) as u16;
@@ -1519,9 +1897,9 @@ impl Ppu {
         x: usize,
         y: usize,
     ) -> Option<u16> {
-        let bgcnt = self.read_bgcnt(bus, bg_num);
-        let hofs = self.read_bg_offset(bus, bg_num, true);
-        let vofs = self.read_bg_offset(bus, bg_num, false);
+        let bgcnt = self.read_bgcnt(bus, bg_num, y);
+        let hofs = self.read_bg_offset(bus, bg_num, true, y);
+        let vofs = self.read_bg_offset(bus, bg_num, false, y);
 
         let screen_size = (bgcnt >> 14) & 0x3;
         let screen_base = (((bgcnt >> 8) & 0x1F) * 0x800) as u32;
@@ -1603,7 +1981,7 @@ impl Ppu {
         x: usize,
         y: usize,
     ) -> Option<u16> {
-        let bgcnt = self.read_bgcnt(bus, bg_num);
+        let bgcnt = self.read_bgcnt(bus, bg_num, y);
         let screen_size = (bgcnt >> 14) & 0x3;
         let screen_base = (((bgcnt >> 8) & 0x1F) * 0x800) as u32;
         let char_base = (((bgcnt >> 2) & 0x3) * 0x4000) as u32;
@@ -1811,6 +2189,7 @@ impl Ppu {
         };
         let one_dimensional = (self.dispcnt & DISPCNT_OBJ_VRAM_MAPPING) != 0;
 
+        let budget = self.obj_line_budget(bus);
         for obj_num in 0..128 {
             let oam_addr = OAM_START + (obj_num * 8) as u32;
             let attr0_lo = bus.read8(oam_addr) as u16;
@@ -1862,6 +2241,9 @@ impl Ppu {
                 if fy >= SCREEN_H {
                     continue;
                 }
+                if budget[fy] & (1 << obj_num) == 0 {
+                    continue;
+                }
 
                 let src_y = py;
                 if src_y >= display_h {
@@ -2224,6 +2606,229 @@ mod tests {
         assert!(ppu.framebuffer().iter().all(|&px| px == 0x7C00));
     }
 
+    #[test]
+    fn invalid_mode7_renders_backdrop() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        bus.write16(PALETTE_RAM_START, 0x03E0);
+        bus.write16(REG_DISPCNT, 7 | (1 << 8));
+
+        ppu.render_frame_with_bus(&mut bus);
+        assert!(ppu.framebuffer().iter().all(|&px| px == 0x03E0));
+    }
+
+    #[test]
+    fn mode3_line_compositing_matches_vram() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        for i in 0..FRAME_PIXELS {
+            bus.write16(VRAM_START + (i * 2) as u32, (i as u16).wrapping_mul(37) & 0x7FFF);
+        }
+        bus.write16(REG_DISPCNT, 3 | (1 << 10));
+
+        ppu.render_frame_with_bus(&mut bus);
+        for (i, &px) in ppu.framebuffer().iter().enumerate() {
+            let addr = VRAM_START + (i * 2) as u32;
+            let expected = bus.read8(addr) as u16 | ((bus.read8(addr + 1) as u16) << 8);
+            assert_eq!(px, expected, "pixel {} differs", i);
+        }
+    }
+
+    #[test]
+    fn partial_renders_keep_the_other_lines() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        bus.write16(REG_DISPCNT, 0x1000); // mode 0, OBJ only
+        bus.write16(PALETTE_RAM_START, 0x001F);
+        ppu.render_frame_with_bus(&mut bus);
+
+        bus.write16(PALETTE_RAM_START, 0x03E0);
+        let mut lines = [false; SCREEN_H];
+        lines[3] = true;
+        ppu.render_lines_with_bus(&mut bus, &lines);
+        assert!(ppu.framebuffer()[3 * SCREEN_W..4 * SCREEN_W].iter().all(|&p| p == 0x03E0));
+        assert!(ppu.framebuffer()[..3 * SCREEN_W].iter().all(|&p| p == 0x001F));
+        assert!(ppu.framebuffer()[4 * SCREEN_W..].iter().all(|&p| p == 0x001F));
+
+        // The mask only applies to that render
+        ppu.render_frame_with_bus(&mut bus);
+        assert!(ppu.framebuffer().iter().all(|&p| p == 0x03E0));
+    }
+
+    #[test]
+    fn layer_isolation_shows_only_obj_over_backdrop() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        bus.write16(PALETTE_RAM_START, 0x7C00); // backdrop
+        bus.write16(PALETTE_RAM_START + 2, 0x03E0); // BG color 1
+        bus.write16(OBJ_PALETTE_START + 4, 0x001F); // OBJ color 2
+
+        // BG0: char block 0, screen block 31 (all tile 0), tile 0 filled with color 1
+        bus.write16(REG_BG0CNT, 31 << 8);
+        for i in 0..32 {
+            bus.write8(VRAM_START + i, 0x11);
+        }
+        // OBJ 0: 8x8 at (16, 16) using tile 1 filled with color 2
+        for i in 0..32 {
+            bus.write8(OBJ_VRAM_START_MODE012 + 32 + i, 0x22);
+        }
+        bus.write16(OAM_START, 16);
+        bus.write16(OAM_START + 2, 16);
+        bus.write16(OAM_START + 4, 1);
+        bus.write16(REG_DISPCNT, DISPCNT_BG0_ENABLE | DISPCNT_OBJ_ENABLE | DISPCNT_OBJ_VRAM_MAPPING);
+
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[0], 0x03E0);
+        assert_eq!(ppu.framebuffer()[20 * SCREEN_W + 20], 0x001F);
+
+        ppu.set_layer_isolation(Some(PpuLayer::Obj));
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[0], 0x7C00);
+        assert_eq!(ppu.framebuffer()[20 * SCREEN_W + 20], 0x001F);
+        assert_eq!(ppu.framebuffer()[30 * SCREEN_W + 30], 0x7C00);
+    }
+
+    #[test]
+    fn palette_halfword_and_byte_writes() {
+        let mut bus = Bus::new();
+
+        bus.write16(PALETTE_RAM_START + 6, 0x7C1F);
+        assert_eq!(bus.read8(PALETTE_RAM_START + 6), 0x1F);
+        assert_eq!(bus.read8(PALETTE_RAM_START + 7), 0x7C);
+        assert_eq!(bus.read16(PALETTE_RAM_START + 6), 0x7C1F);
+
+        // A byte write is mirrored into both halves of the color
+        bus.write8(PALETTE_RAM_START + 7, 0x12);
+        assert_eq!(bus.read16(PALETTE_RAM_START + 6), 0x1212);
+
+        // Palette RAM mirrors every 1 KiB
+        bus.write32(PALETTE_RAM_START + 0x400, 0x0123_4567);
+        assert_eq!(bus.read32(PALETTE_RAM_START), 0x0123_4567);
+    }
+
+    #[test]
+    fn bitmap_mode_objs_only_use_upper_tiles() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+
+        bus.write16(OBJ_PALETTE_START + 2, 0x001F);
+        // Tile 600 lives at 0x06010000 + 600 * 32, past the mode 3 frame buffer
+        for i in 0..32 {
+            bus.write8(OBJ_VRAM_START_MODE012 + 600 * 32 + i, 0x11);
+            bus.write8(OBJ_VRAM_START_MODE012 + 100 * 32 + i, 0x11);
+        }
+        // OBJ 0: tile 100 at (8, 8); OBJ 1: tile 600 at (40, 8)
+        bus.write16(OAM_START, 8);
+        bus.write16(OAM_START + 2, 8);
+        bus.write16(OAM_START + 4, 100);
+        bus.write16(OAM_START + 8, 8);
+        bus.write16(OAM_START + 10, 40);
+        bus.write16(OAM_START + 12, 600);
+        for obj in 2..128u32 {
+            bus.write16(OAM_START + obj * 8, 0x0200); // disabled
+        }
+        bus.write16(REG_DISPCNT, 3 | DISPCNT_BG2_ENABLE | DISPCNT_OBJ_ENABLE | DISPCNT_OBJ_VRAM_MAPPING);
+
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[10 * SCREEN_W + 10], 0x0000);
+        assert_eq!(ppu.framebuffer()[10 * SCREEN_W + 42], 0x001F);
+    }
+
+    #[test]
+    fn objs_past_the_line_cycle_budget_are_dropped() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        bus.write16(PALETTE_RAM_START, 0x7C00); // backdrop
+        bus.write16(OBJ_PALETTE_START + 4, 0x001F);
+        for i in 0..64 * 32 {
+            bus.write8(OBJ_VRAM_START_MODE012 + 32 + i, 0x22);
+        }
+
+        // OBJs 0-17: 64x64, parked left of the screen on lines 0-63. They are
+        // invisible but still use 18 * 64 = 1152 of the 1210 cycles on those lines
+        for obj in 0..18u32 {
+            bus.write16(OAM_START + obj * 8, 0);
+            bus.write16(OAM_START + obj * 8 + 2, 0xC000 | 0x1C0);
+        }
+        // OBJ 18: 64x64 on lines 32-95, which only fits below line 63
+        bus.write16(OAM_START + 18 * 8, 32);
+        bus.write16(OAM_START + 18 * 8 + 2, 0xC000 | 16);
+        bus.write16(OAM_START + 18 * 8 + 4, 1);
+        for obj in 19..128u32 {
+            bus.write16(OAM_START + obj * 8, 0x0200); // disabled
+        }
+        bus.write16(REG_DISPCNT, DISPCNT_OBJ_ENABLE | DISPCNT_OBJ_VRAM_MAPPING);
+
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[40 * SCREEN_W + 20], 0x7C00, "over budget on line 40");
+        assert_eq!(ppu.framebuffer()[70 * SCREEN_W + 20], 0x001F);
+
+        // Removing one of the parked OBJs frees enough cycles
+        bus.write16(OAM_START, 0x0200);
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[40 * SCREEN_W + 20], 0x001F);
+
+        // H-Blank Interval Free leaves only 954 cycles
+        bus.write16(REG_DISPCNT, DISPCNT_OBJ_ENABLE | DISPCNT_OBJ_VRAM_MAPPING | (1 << 5));
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[40 * SCREEN_W + 20], 0x7C00);
+        assert_eq!(ppu.framebuffer()[70 * SCREEN_W + 20], 0x001F);
+    }
+
+    #[test]
+    fn tile_viewer_draws_vram_tiles_with_the_selected_palette() {
+        let mut bus = Bus::new();
+        let ppu = Ppu::new();
+        bus.write16(PALETTE_RAM_START + 2 * 32 + 2, 0x001F); // BG bank 2, color 1
+        bus.write16(PALETTE_RAM_START + 2 * 32 + 4, 0x03E0); // BG bank 2, color 2
+        bus.write16(OBJ_PALETTE_START + 2 * 32 + 2, 0x7C00); // OBJ bank 2, color 1
+        // BG tile 1: top row alternates colors 1 and 2, the rest is transparent
+        bus.write32(VRAM_START + 32, 0x2121_2121);
+        // First OBJ tile: fully color 1
+        for row in 0..8 {
+            bus.write32(OBJ_VRAM_START_MODE012 + row * 4, 0x1111_1111);
+        }
+
+        let image = ppu.dump_tiles(&mut bus, 2);
+        assert_eq!((image.width, image.height), (256, 768));
+        assert_eq!(image.pixel(8, 0), [0xFF, 0, 0, 0xFF]);
+        assert_eq!(image.pixel(9, 0), [0, 0xFF, 0, 0xFF]);
+        assert_eq!(image.pixel(8, 1)[3], 0);
+        // VRAM offset 0x10000 is tile 2048, row 64 of the viewer
+        assert_eq!(image.pixel(3, 64 * 8 + 5), [0, 0, 0xFF, 0xFF]);
+
+        let palette = ppu.dump_palette(&mut bus);
+        assert_eq!(palette.pixel(1 * 8 + 4, 2 * 8 + 4), [0xFF, 0, 0, 0xFF]);
+        assert_eq!(palette.pixel(1 * 8, 18 * 8 + 7), [0, 0, 0xFF, 0xFF]);
+    }
+
+    #[test]
+    fn sprite_viewer_draws_each_oam_entry_in_its_cell() {
+        let mut bus = Bus::new();
+        let ppu = Ppu::new();
+        bus.write16(REG_DISPCNT, DISPCNT_OBJ_VRAM_MAPPING);
+        bus.write16(OBJ_PALETTE_START + 3 * 32 + 2, 0x001F); // OBJ bank 3, color 1
+        bus.write16(OBJ_PALETTE_START + 3 * 32 + 4, 0x03E0); // OBJ bank 3, color 2
+        // Tile 4 is color 1, tile 5 color 2
+        for row in 0..8 {
+            bus.write32(OBJ_VRAM_START_MODE012 + 4 * 32 + row * 4, 0x1111_1111);
+            bus.write32(OBJ_VRAM_START_MODE012 + 5 * 32 + row * 4, 0x2222_2222);
+        }
+        // OBJ 17: 16x8, tiles 4-5, bank 3, flipped and hidden, which the viewer ignores
+        let oam = OAM_START + 17 * 8;
+        bus.write16(oam, (1 << 14) | (1 << 9));
+        bus.write16(oam + 2, (1 << 12) | (1 << 13));
+        bus.write16(oam + 4, (3 << 12) | 4);
+
+        let image = ppu.dump_sprites(&mut bus);
+        assert_eq!((image.width, image.height), (1024, 512));
+        // Cell 17 is the second in the second row
+        assert_eq!(image.pixel(64, 64), [0xFF, 0, 0, 0xFF]);
+        assert_eq!(image.pixel(64 + 15, 64 + 7), [0, 0xFF, 0, 0xFF]);
+        assert_eq!(image.pixel(64 + 16, 64)[3], 0);
+        assert_eq!(image.pixel(64, 64 + 8)[3], 0);
+    }
+
     /// Test Suite for Display Status Register (REG_DISPSTAT).
     #[test]
     fn vblank_flag_is_set_and_cleared() {
@@ -2237,6 +2842,20 @@ mod tests {
         assert_eq!(ppu.read_dispstat() & DISPSTAT_VBLANK_FLAG, 0);
     }
 
+    #[test]
+    fn vblank_flag_clear_on_line_227() {
+        let mut ppu = Ppu::new();
+        for _ in 0..226 {
+            ppu.step(CYCLES_PER_SCANLINE);
+        }
+        assert_eq!(ppu.read_vcount(), 226);
+        assert_ne!(ppu.read_dispstat() & DISPSTAT_VBLANK_FLAG, 0);
+
+        ppu.step(CYCLES_PER_SCANLINE);
+        assert_eq!(ppu.read_vcount(), 227);
+        assert_eq!(ppu.read_dispstat() & DISPSTAT_VBLANK_FLAG, 0);
+    }
+
     #[test]
     fn hblank_flag_is_set_and_cleared() {
         let mut ppu = Ppu::new();
@@ -2268,6 +2887,44 @@ mod tests {
         assert_eq!(ppu.read_dispstat() & DISPSTAT_VCOUNT_FLAG, 0);
     }
 
+    #[test]
+    fn lyc_write_matching_current_line_sets_flag_immediately() {
+        let mut ppu = Ppu::new();
+        ppu.step(CYCLES_PER_SCANLINE * 42 + 10);
+        assert_eq!(ppu.read_dispstat() & DISPSTAT_VCOUNT_FLAG, 0);
+
+        ppu.write_dispstat(42 << 8);
+        assert_ne!(ppu.read_dispstat() & DISPSTAT_VCOUNT_FLAG, 0);
+        ppu.write_dispstat(43 << 8);
+        assert_eq!(ppu.read_dispstat() & DISPSTAT_VCOUNT_FLAG, 0);
+
+        // Same through the IO register the CPU writes, including the IRQ
+        let mut bus = Bus::new();
+        bus.io.vcount = 42;
+        bus.io.dispstat = DISPSTAT_HBLANK_FLAG;
+        bus.write16(REG_DISPSTAT, (42 << 8) | DISPSTAT_VCOUNT_IRQ | 0x7);
+        assert_eq!(bus.read16(REG_DISPSTAT) & 0x7, DISPSTAT_VCOUNT_FLAG | DISPSTAT_HBLANK_FLAG);
+        assert_eq!(bus.io.if_ & 0x0004, 0x0004);
+    }
+
+    #[test]
+    fn vcount_and_dispstat_read_as_one_word() {
+        let mut bus = Bus::new();
+        bus.io.vcount = 100;
+        bus.io.dispstat = DISPSTAT_VBLANK_FLAG;
+        bus.write16(REG_DISPSTAT, (100 << 8) | DISPSTAT_VBLANK_IRQ);
+
+        let word = bus.read32(REG_DISPSTAT);
+        let (dispstat, vcount) = (word as u16, (word >> 16) as u16);
+        assert_eq!(vcount, 100);
+        assert_eq!(dispstat >> 8, vcount);
+        assert_eq!(dispstat & 0xFF, DISPSTAT_VBLANK_IRQ | DISPSTAT_VCOUNT_FLAG | DISPSTAT_VBLANK_FLAG);
+
+        // VCOUNT is read-only, even through a word write
+        bus.write32(REG_DISPSTAT, 5 << 24);
+        assert_eq!(bus.read16(REG_VCOUNT), 100);
+    }
+
     /// Test Suite for Vertical Count Register (REG_VCOUNT).
     #[test]
     fn vcount_increments_correctly_per_scanline() {
@@ -2284,6 +2941,34 @@ mod tests {
         assert_eq!(ppu.read_vcount(), 0);
     }
 
+    #[test]
+    fn single_cycle_steps_advance_vcount_every_1232_cycles() {
+        let mut ppu = Ppu::new();
+        for cycle in 1..=CYCLES_PER_SCANLINE * (SCANLINES_PER_FRAME + 2) {
+            ppu.step(1);
+            let line = cycle / CYCLES_PER_SCANLINE % SCANLINES_PER_FRAME;
+            let in_line = cycle % CYCLES_PER_SCANLINE;
+            assert_eq!(ppu.read_vcount() as usize, line, "cycle {cycle}");
+            assert_eq!(ppu.is_in_hblank(), in_line >= CYCLES_VISIBLE, "cycle {cycle}");
+            assert_eq!(ppu.is_in_vblank(), (160..227).contains(&line), "cycle {cycle}");
+        }
+    }
+
+    #[test]
+    fn long_steps_do_not_skip_line_transitions() {
+        let mut ppu = Ppu::new();
+        ppu.write_dispstat(100 << 8);
+        ppu.step(CYCLES_PER_SCANLINE * 99 + 10);
+        ppu.step(CYCLES_PER_SCANLINE);
+        assert_eq!(ppu.read_vcount(), 100);
+        assert_ne!(ppu.read_dispstat() & DISPSTAT_VCOUNT_FLAG, 0);
+
+        // From line 100 straight past line 160 still enters VBlank
+        ppu.step(CYCLES_PER_SCANLINE * 62);
+        assert_eq!(ppu.read_vcount(), 162);
+        assert!(ppu.is_in_vblank());
+    }
+
     /// Test Suite for Background Control Registers (REG_BGxCNT).
     #[test]
     fn background_priority_is_set_correctly() {
@@ -2418,6 +3103,57 @@ mod tests {
         );
     }
 
+    #[test]
+    fn window_0_shows_bg0_only_inside_its_rectangle() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        bus.write16(PALETTE_RAM_START, 0x7C00); // backdrop
+        bus.write16(PALETTE_RAM_START + 2, 0x001F);
+        // Tile 0 is solid color 1 and the map at screenblock 31 is all tile 0
+        for row in 0..8 {
+            bus.write32(VRAM_START + row * 4, 0x1111_1111);
+        }
+        bus.write16(REG_BG0CNT, 31 << 8);
+        bus.write16(REG_DISPCNT, (1 << 8) | DISPCNT_WIN0_ENABLE);
+        bus.write16(REG_WIN0H, (10 << 8) | 50);
+        bus.write16(REG_WIN0V, (20 << 8) | 60);
+        bus.write16(REG_WININ, 1 << 0);
+        bus.write16(REG_WINOUT, 0);
+
+        ppu.render_frame_with_bus(&mut bus);
+        let fb = ppu.framebuffer();
+        assert_eq!(fb[30 * SCREEN_W + 20], 0x001F, "inside window 0");
+        assert_eq!(fb[30 * SCREEN_W + 49], 0x001F, "last column inside");
+        assert_eq!(fb[30 * SCREEN_W + 50], 0x7C00, "right edge is exclusive");
+        assert_eq!(fb[5 * SCREEN_W + 5], 0x7C00, "outside, BG0 is off in WINOUT");
+    }
+
+    #[test]
+    fn bldcnt_blends_bg2_with_the_backdrop_and_brightens_it() {
+        let mut ppu = Ppu::new();
+        let mut bus = Bus::new();
+        bus.write16(PALETTE_RAM_START, 0x7C00); // backdrop
+        bus.write16(VRAM_START, 0x001F);
+        bus.write16(REG_DISPCNT, 3 | (1 << 10));
+
+        // Alpha: BG2 first target, backdrop second, half of each
+        bus.write16(REG_BLDCNT, (1 << 2) | (1 << 6) | (1 << 13));
+        bus.write16(REG_BLDALPHA, 8 | (8 << 8));
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[0], 0x3C0F);
+
+        // Brightness increase by 16/16 turns the first target white
+        bus.write16(REG_BLDCNT, (1 << 2) | (2 << 6));
+        bus.write16(REG_BLDY, 16);
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[0], 0x7FFF);
+
+        // A layer that is not a first target is left alone
+        bus.write16(REG_BLDCNT, (1 << 0) | (2 << 6));
+        ppu.render_frame_with_bus(&mut bus);
+        assert_eq!(ppu.framebuffer()[0], 0x001F);
+    }
+
     /// Test Suite for Interrupts.
     #[test]
     fn vblank_interrupt_is_triggered() {
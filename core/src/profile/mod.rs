@@ -0,0 +1,120 @@
+use std::time::{Duration, Instant};
+
+/// Wall-clock time spent by each subsystem during one frame.
+#[derive(Copy, Clone, Debug, Default, PartialEq, Eq)]
+pub struct FrameTiming {
+    pub cpu: Duration,
+    pub ppu: Duration,
+    pub apu: Duration,
+    pub dma: Duration,
+    /// Scheduler events, interrupts and framebuffer conversion
+    pub other: Duration,
+    pub total: Duration,
+}
+
+impl FrameTiming {
+    pub fn accounted(&self) -> Duration { self.cpu + self.ppu + self.apu + self.dma + self.other }
+}
+
+#[derive(Copy, Clone, Debug, PartialEq, Eq)]
+pub enum Section { Cpu, Ppu, Apu }
+
+/// Accumulates per-subsystem timings for the frame in progress.
+///
+/// Only created when profiling is requested, since reading the clock on every
+/// instruction is not free (and `Instant` is unavailable on some web targets).
+#[derive(Default)]
+pub struct Profiler {
+    current: FrameTiming,
+    // Wall time of the frame in progress up to its last suspension, and when it
+    // last started running; the first is None outside a frame
+    elapsed: Option<Duration>,
+    running_since: Option<Instant>,
+    last: Option<FrameTiming>,
+}
+
+impl Profiler {
+    pub fn new() -> Self { Self::default() }
+
+    pub fn begin_frame(&mut self) {
+        self.current = FrameTiming::default();
+        self.elapsed = Some(Duration::ZERO);
+        self.running_since = Some(Instant::now());
+    }
+
+    /// Stops the clock on the frame in progress, e.g. while the emulator is paused.
+    pub fn suspend(&mut self) {
+        if let (Some(elapsed), Some(since)) = (&mut self.elapsed, self.running_since.take()) {
+            *elapsed += since.elapsed();
+        }
+    }
+
+    /// Restarts the clock on a suspended frame.
+    pub fn resume(&mut self) {
+        if self.elapsed.is_some() && self.running_since.is_none() {
+            self.running_since = Some(Instant::now());
+        }
+    }
+
+    pub fn record(&mut self, section: Section, elapsed: Duration) {
+        match section {
+            Section::Cpu => self.current.cpu += elapsed,
+            Section::Ppu => self.current.ppu += elapsed,
+            Section::Apu => self.current.apu += elapsed,
+        }
+    }
+
+    /// Closes the frame; `dma` is the transfer time the bus measured meanwhile.
+    pub fn end_frame(&mut self, dma: Duration) {
+        self.suspend();
+        let Some(total) = self.elapsed.take() else { return };
+        let mut timing = self.current;
+        timing.dma = dma;
+        timing.total = total;
+        timing.other = timing.total.saturating_sub(timing.cpu + timing.ppu + timing.apu + timing.dma);
+        self.last = Some(timing);
+    }
+
+    pub fn last(&self) -> Option<FrameTiming> { self.last }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn remainder_is_reported_as_other() {
+        let mut profiler = Profiler::new();
+        assert_eq!(profiler.last(), None);
+
+        profiler.begin_frame();
+        profiler.record(Section::Cpu, Duration::from_micros(3));
+        profiler.record(Section::Cpu, Duration::from_micros(2));
+        profiler.record(Section::Ppu, Duration::from_micros(1));
+        std::thread::sleep(Duration::from_millis(1));
+        profiler.end_frame(Duration::from_micros(4));
+
+        let timing = profiler.last().unwrap();
+        assert_eq!(timing.cpu, Duration::from_micros(5));
+        assert_eq!(timing.dma, Duration::from_micros(4));
+        assert!(timing.other > Duration::ZERO);
+        assert_eq!(timing.accounted(), timing.total);
+    }
+
+    #[test]
+    fn suspended_time_is_left_out_of_the_total() {
+        let mut profiler = Profiler::new();
+        profiler.begin_frame();
+        profiler.suspend();
+        std::thread::sleep(Duration::from_millis(50));
+        profiler.resume();
+        profiler.end_frame(Duration::ZERO);
+        let timing = profiler.last().unwrap();
+        assert!(timing.total < Duration::from_millis(50));
+
+        // Nothing to resume outside a frame
+        profiler.resume();
+        profiler.end_frame(Duration::ZERO);
+        assert_eq!(profiler.last(), Some(timing));
+    }
+}
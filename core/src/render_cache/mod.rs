@@ -0,0 +1,195 @@
+use crate::mem::Mem;
+use crate::ppu::{LineRegisters, Ppu};
+
+const SCREEN_H: usize = 160;
+// VRAM is compared in blocks of this many bytes
+const BLOCK: usize = 16;
+// BGxCNT and the BG offsets, which are latched per line rather than read at VBlank
+const LINE_IO: std::ops::Range<usize> = 0x08..0x20;
+
+/// Remembers what each scanline of the last rendered frame was drawn from, so
+/// lines with unchanged inputs keep their pixels instead of being drawn again.
+///
+/// The display registers read at VBlank, the palette, and BG tiles in the tiled
+/// modes feed every line; a change there redraws the whole frame. The latched
+/// per-line registers, bitmap VRAM and each OAM entry only redraw the lines they
+/// cover.
+///
+/// Costs a copy of VRAM, palette and OAM; static screens such as menus and text
+/// boxes then skip the PPU entirely, and a moving sprite only redraws its lines.
+#[derive(Default)]
+pub struct RenderCache {
+    frame: Vec<u8>,
+    lines: Vec<Option<LineRegisters>>,
+    palette: Vec<u8>,
+    vram: Vec<u8>,
+    oam: Vec<u8>,
+    valid: bool,
+    reused: u64,
+}
+
+impl RenderCache {
+    pub fn new() -> Self { Self::default() }
+
+    /// Scanlines that kept their previous pixels.
+    pub fn reused(&self) -> u64 { self.reused }
+
+    /// Compares the inputs of the frame about to be drawn with those of the last
+    /// one and returns which lines must be redrawn. `io` holds the display
+    /// registers from DISPCNT on. The new inputs are kept for the next comparison.
+    pub fn dirty_lines(&mut self, io: &[u8], ppu: &Ppu, mem: &Mem) -> Vec<bool> {
+        let mut frame = [&io[..LINE_IO.start], &io[LINE_IO.end..]].concat();
+        frame.push(ppu.layer_isolation().map_or(0, |layer| layer as u8 + 1));
+        let lines: Vec<_> = (0..SCREEN_H).map(|y| ppu.line_registers(y)).collect();
+
+        let dirty = if self.valid && self.frame == frame && self.palette == mem.palette {
+            self.compare_lines(io, ppu, &lines, mem)
+        } else {
+            vec![true; SCREEN_H]
+        };
+        self.reused += dirty.iter().filter(|&&d| !d).count() as u64;
+
+        self.frame = frame;
+        self.lines = lines;
+        self.palette.clone_from(&mem.palette);
+        self.vram.clone_from(&mem.vram);
+        self.oam.clone_from(&mem.oam);
+        self.valid = true;
+        dirty
+    }
+
+    fn compare_lines(&self, io: &[u8], ppu: &Ppu, lines: &[Option<LineRegisters>], mem: &Mem) -> Vec<bool> {
+        // A line without a latch reads the live registers, so it is always redrawn
+        let mut dirty: Vec<bool> = lines.iter().zip(&self.lines).map(|(new, old)| new.is_none() || new != old).collect();
+
+        let dispcnt = u16::from_le_bytes([io[0], io[1]]);
+        let mode = dispcnt & 0x7;
+        let frame_base = if dispcnt & (1 << 4) != 0 { 0xA000 } else { 0 };
+        // (start, size, bytes per line) of the displayed bitmap
+        let bitmap = match mode {
+            3 => Some((0, 240 * 160 * 2, 240 * 2)),
+            4 => Some((frame_base, 240 * 160, 240)),
+            5 => Some((frame_base, 160 * 128 * 2, 160 * 2)),
+            _ => None,
+        };
+        let obj_tiles = if mode >= 3 { 0x14000 } else { 0x10000 };
+
+        let mut obj_tiles_changed = false;
+        for (i, (old, new)) in self.vram.chunks(BLOCK).zip(mem.vram.chunks(BLOCK)).enumerate() {
+            if old == new {
+                continue;
+            }
+            let start = i * BLOCK;
+            if start >= obj_tiles {
+                obj_tiles_changed = true;
+                continue;
+            }
+            let Some((base, size, pitch)) = bitmap else {
+                // Any BG tile or map entry may show up on any line
+                return vec![true; SCREEN_H];
+            };
+            let (first, last) = (start.max(base), (start + BLOCK).min(base + size));
+            if first < last {
+                dirty[(first - base) / pitch..=(last - 1 - base) / pitch].fill(true);
+            }
+        }
+
+        // Each group of four entries keeps one set of affine parameters in their fourth halfwords
+        let params_changed: Vec<bool> = (0..32)
+            .map(|group| {
+                (0..4).any(|i| {
+                    let at = group * 32 + i * 8 + 6;
+                    self.oam[at..at + 2] != mem.oam[at..at + 2]
+                })
+            })
+            .collect();
+        for obj in 0..128 {
+            let attrs = obj * 8..obj * 8 + 6;
+            let attrs_changed = self.oam[attrs.clone()] != mem.oam[attrs];
+            for oam in [&self.oam, &mem.oam] {
+                let attr0 = u16::from_le_bytes([oam[obj * 8], oam[obj * 8 + 1]]);
+                let attr1 = u16::from_le_bytes([oam[obj * 8 + 2], oam[obj * 8 + 3]]);
+                let affine = (attr0 >> 8) & 1 != 0;
+                let group = ((attr1 >> 9) & 0x1F) as usize;
+                if !(attrs_changed || obj_tiles_changed || (affine && params_changed[group])) {
+                    continue;
+                }
+                if let Some((y, height)) = ppu.obj_rows(attr0, attr1) {
+                    for line in (0..height).map(|py| (y + py) % 256).filter(|&line| line < SCREEN_H) {
+                        dirty[line] = true;
+                    }
+                }
+            }
+        }
+        dirty
+    }
+
+    /// Forces the next frame to be drawn in full, e.g. after the framebuffer was cleared.
+    pub fn invalidate(&mut self) { self.valid = false; }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bus::{Bus, BusAccess};
+
+    // Latches every line the way the scheduler does, then asks the cache
+    fn dirty(cache: &mut RenderCache, ppu: &mut Ppu, bus: &mut Bus) -> Vec<usize> {
+        for line in 0..SCREEN_H {
+            ppu.latch_line(bus, line);
+        }
+        let io: Vec<u8> = (0..0x56).map(|i| bus.peek_io8(0x0400_0000 + i)).collect();
+        let dirty = cache.dirty_lines(&io, ppu, &bus.mem);
+        (0..SCREEN_H).filter(|&line| dirty[line]).collect()
+    }
+
+    #[test]
+    fn bitmap_writes_only_redraw_their_lines() {
+        let (mut cache, mut ppu, mut bus) = (RenderCache::new(), Ppu::new(), Bus::new());
+        bus.write16(0x0400_0000, 0x0414); // mode 4, second frame shown
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus).len(), SCREEN_H, "nothing cached yet");
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus), []);
+        assert_eq!(cache.reused(), SCREEN_H as u64);
+
+        bus.write16(0x0600_0000, 0xFFFF); // the hidden frame
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus), []);
+        bus.write16(0x0600_A000 + 7 * 240 + 100, 0xFFFF);
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus), [7]);
+
+        cache.invalidate();
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus).len(), SCREEN_H);
+    }
+
+    #[test]
+    fn tile_and_register_changes_redraw_what_they_reach() {
+        let (mut cache, mut ppu, mut bus) = (RenderCache::new(), Ppu::new(), Bus::new());
+        bus.write16(0x0400_0000, 0x0100); // mode 0, BG0 on
+        dirty(&mut cache, &mut ppu, &mut bus);
+
+        // BG tiles can appear anywhere, so they redraw the whole frame
+        bus.write16(0x0600_0020, 0x1111);
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus).len(), SCREEN_H);
+        bus.write16(0x0400_0052, 0x0808); // BLDALPHA is read once per frame
+        assert_eq!(dirty(&mut cache, &mut ppu, &mut bus).len(), SCREEN_H);
+
+        // A scroll register written mid-frame only reaches the lines latched after it
+        bus.write16(0x0400_0010, 4);
+        for line in 0..SCREEN_H {
+            ppu.latch_line(&mut bus, line);
+            if line == 99 {
+                bus.write16(0x0400_0010, 0);
+            }
+        }
+        let io: Vec<u8> = (0..0x56).map(|i| bus.peek_io8(0x0400_0000 + i)).collect();
+        let lines = cache.dirty_lines(&io, &ppu, &bus.mem);
+        assert_eq!(lines.iter().filter(|&&d| d).count(), 100);
+        assert!(!lines[100]);
+
+        // Affine parameters redraw the OBJs using them, in both the old and new frames
+        bus.write16(0x0700_0008, 0x0100 | 20); // OBJ 1: affine 8x8 at line 20, group 0
+        dirty(&mut cache, &mut ppu, &mut bus);
+        bus.write16(0x0700_0006, 0x0200); // group 0 PA
+        let lines = dirty(&mut cache, &mut ppu, &mut bus);
+        assert_eq!(lines, (20..28).collect::<Vec<_>>());
+    }
+}
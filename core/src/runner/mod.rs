@@ -0,0 +1,310 @@
+use std::collections::VecDeque;
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError, Sender, TryRecvError};
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread::{self, JoinHandle};
+use std::time::{Duration, Instant};
+
+use crate::frameskip::FRAME_TIME;
+use crate::{Emulator, SaveState};
+
+// Output the UI has not picked up yet; the oldest is dropped to make room beyond this
+const FRAME_QUEUE_DEPTH: usize = 2;
+const AUDIO_QUEUE_DEPTH: usize = 8;
+
+#[derive(Clone, Debug)]
+pub enum Command {
+    Pause,
+    Resume,
+    /// Runs a single frame, mainly useful while paused
+    StepFrame,
+    /// Raw KEYINPUT value (active low)
+    SetKeys(u16),
+    LoadState(Box<SaveState>),
+    /// Whether to hold running frames to the GBA's refresh rate (the default)
+    /// or run them as fast as possible
+    SetPaced(bool),
+    Shutdown,
+}
+
+pub struct Frame {
+    pub number: u64,
+    pub rgba: Vec<u8>,
+}
+
+/// Samples mixed while running frame `frame`, interleaved left/right at
+/// [`crate::apu::SAMPLE_RATE`].
+pub struct AudioChunk {
+    pub frame: u64,
+    pub samples: Vec<i16>,
+}
+
+/// Output waiting for the UI. A consumer that falls behind loses the oldest
+/// entries, so whatever it does pick up is as recent as possible.
+pub struct OutputQueue<T> {
+    items: Mutex<VecDeque<T>>,
+    ready: Condvar,
+    depth: usize,
+}
+
+pub type FrameQueue = OutputQueue<Frame>;
+pub type AudioQueue = OutputQueue<AudioChunk>;
+
+impl<T> OutputQueue<T> {
+    fn new(depth: usize) -> Self { Self { items: Mutex::new(VecDeque::new()), ready: Condvar::new(), depth } }
+
+    fn push(&self, item: T) {
+        let mut items = self.items.lock().unwrap();
+        if items.len() == self.depth {
+            items.pop_front();
+        }
+        items.push_back(item);
+        self.ready.notify_one();
+    }
+
+    pub fn try_recv(&self) -> Option<T> { self.items.lock().unwrap().pop_front() }
+
+    pub fn recv_timeout(&self, timeout: Duration) -> Result<T, RecvTimeoutError> {
+        let deadline = Instant::now() + timeout;
+        let mut items = self.items.lock().unwrap();
+        loop {
+            if let Some(item) = items.pop_front() {
+                return Ok(item);
+            }
+            let left = deadline.saturating_duration_since(Instant::now());
+            if left.is_zero() {
+                return Err(RecvTimeoutError::Timeout);
+            }
+            items = self.ready.wait_timeout(items, left).unwrap().0;
+        }
+    }
+}
+
+struct Outputs {
+    frames: FrameQueue,
+    audio: AudioQueue,
+}
+
+impl Default for Outputs {
+    fn default() -> Self {
+        Self { frames: OutputQueue::new(FRAME_QUEUE_DEPTH), audio: OutputQueue::new(AUDIO_QUEUE_DEPTH) }
+    }
+}
+
+/// Handle to an emulator running on its own thread. Dropping it shuts the core down.
+pub struct AsyncEmulator {
+    commands: Sender<Command>,
+    outputs: Arc<Outputs>,
+    handle: Option<JoinHandle<Emulator>>,
+}
+
+impl AsyncEmulator {
+    pub fn send(&self, command: Command) {
+        // The core thread only exits after Shutdown, at which point commands are moot
+        let _ = self.commands.send(command);
+    }
+
+    pub fn frames(&self) -> &FrameQueue { &self.outputs.frames }
+    pub fn audio(&self) -> &AudioQueue { &self.outputs.audio }
+
+    /// Stops the core thread and hands the emulator back.
+    pub fn shutdown(mut self) -> Emulator {
+        self.send(Command::Shutdown);
+        self.handle
+            .take()
+            .expect("emulator thread already joined")
+            .join()
+            .expect("emulator thread panicked")
+    }
+}
+
+impl Drop for AsyncEmulator {
+    fn drop(&mut self) {
+        if let Some(handle) = self.handle.take() {
+            let _ = self.commands.send(Command::Shutdown);
+            let _ = handle.join();
+        }
+    }
+}
+
+impl Emulator {
+    /// Moves the emulator onto a worker thread that runs frames at the GBA's
+    /// refresh rate until paused.
+    pub fn run_async(self) -> AsyncEmulator {
+        let (command_tx, command_rx) = mpsc::channel();
+        let outputs = Arc::new(Outputs::default());
+        let shared = Arc::clone(&outputs);
+        let handle = thread::Builder::new()
+            .name("emulator".to_string())
+            .spawn(move || run_loop(self, command_rx, &shared))
+            .expect("failed to spawn emulator thread");
+        AsyncEmulator { commands: command_tx, outputs, handle: Some(handle) }
+    }
+}
+
+fn run_loop(mut emu: Emulator, commands: Receiver<Command>, outputs: &Outputs) -> Emulator {
+    let mut paused = false;
+    let mut paced = true;
+    // When the next running frame is due; commands are still handled while waiting for it
+    let mut next_frame = Instant::now();
+    loop {
+        let wait = next_frame.saturating_duration_since(Instant::now());
+        let command = if paused {
+            // Block until something arrives instead of spinning
+            match commands.recv() {
+                Ok(command) => Some(command),
+                Err(_) => break,
+            }
+        } else if paced && !wait.is_zero() {
+            match commands.recv_timeout(wait) {
+                Ok(command) => Some(command),
+                Err(RecvTimeoutError::Timeout) => None,
+                Err(RecvTimeoutError::Disconnected) => break,
+            }
+        } else {
+            match commands.try_recv() {
+                Ok(command) => Some(command),
+                Err(TryRecvError::Empty) => None,
+                Err(TryRecvError::Disconnected) => break,
+            }
+        };
+
+        let mut step = false;
+        match command {
+            Some(Command::Pause) => paused = true,
+            Some(Command::Resume) => {
+                paused = false;
+                next_frame = Instant::now();
+                emu.resume();
+            }
+            Some(Command::StepFrame) => step = true,
+            Some(Command::SetKeys(keys)) => emu.set_keyinput(keys),
+            Some(Command::LoadState(state)) => {
+                if let Err(e) = emu.load_state(&state) {
+                    log::warn!("Emulator thread: {}", e);
+                }
+            }
+            Some(Command::SetPaced(enabled)) => {
+                paced = enabled;
+                next_frame = Instant::now();
+            }
+            Some(Command::Shutdown) => break,
+            None => {}
+        }
+        let now = Instant::now();
+        if !paused && (!paced || now >= next_frame) {
+            step = true;
+            // A frame that runs late pushes the schedule back rather than
+            // bunching the following ones together
+            next_frame = (next_frame + FRAME_TIME).max(now);
+        }
+
+        if step {
+            emu.run_frame();
+            let samples = emu.take_audio();
+            if !samples.is_empty() {
+                outputs.audio.push(AudioChunk { frame: emu.frame_count(), samples });
+            }
+            // The core stopped on its own (e.g. an unimplemented instruction)
+            if emu.is_paused() {
+                paused = true;
+                continue;
+            }
+            // Skipped frames leave the previous image in place, so there is nothing new to show
+            if emu.is_frame_ready() {
+                outputs.frames.push(Frame { number: emu.frame_count(), rgba: emu.framebuffer_rgba().to_vec() });
+            }
+        }
+    }
+    log::info!("Emulator thread stopped after {} frames", emu.frame_count());
+    emu
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::frameskip;
+
+    // Runs `commands` to completion on the current thread
+    fn run_commands(emu: Emulator, commands: Vec<Command>) -> (Emulator, Outputs) {
+        let (tx, rx) = mpsc::channel();
+        for command in commands.into_iter().chain([Command::Shutdown]) {
+            tx.send(command).unwrap();
+        }
+        let outputs = Outputs::default();
+        let emu = run_loop(emu, rx, &outputs);
+        (emu, outputs)
+    }
+
+    fn frame_numbers(queue: &FrameQueue) -> Vec<u64> { std::iter::from_fn(|| queue.try_recv()).map(|f| f.number).collect() }
+
+    #[test]
+    fn pause_stops_frames_until_stepped() {
+        let (emu, outputs) = run_commands(Emulator::new(), vec![Command::Pause, Command::StepFrame, Command::StepFrame]);
+        assert_eq!(emu.frame_count(), 2, "nothing ran besides the steps");
+        assert_eq!(frame_numbers(&outputs.frames), [1, 2]);
+    }
+
+    #[test]
+    fn lagging_consumer_gets_the_latest_frames() {
+        let steps = std::iter::repeat_n(Command::StepFrame, 5);
+        let (emu, outputs) = run_commands(Emulator::new(), [Command::Pause].into_iter().chain(steps).collect());
+        assert_eq!(emu.frame_count(), 5);
+        assert_eq!(frame_numbers(&outputs.frames), [4, 5]);
+    }
+
+    #[test]
+    fn frames_that_were_not_drawn_are_not_published() {
+        let mut emu = Emulator::new();
+        emu.set_auto_frameskip(true);
+        emu.run_frame();
+        // Pretend that frame took three frames' worth of wall time, so the next one is skipped
+        emu.frameskip.as_mut().unwrap().end_frame(Instant::now() + frameskip::FRAME_TIME * 3);
+
+        let (emu, outputs) = run_commands(emu, vec![Command::Pause, Command::StepFrame]);
+        assert_eq!(emu.frame_count(), 2);
+        assert!(!emu.is_frame_ready());
+        assert!(outputs.frames.try_recv().is_none());
+        // Audio keeps flowing through skipped frames
+        assert_eq!(outputs.audio.try_recv().map(|chunk| chunk.frame), Some(2));
+    }
+
+    #[test]
+    fn load_state_rewinds_the_running_core() {
+        let mut emu = Emulator::new();
+        emu.run_frame();
+        let state = Box::new(emu.save_state());
+
+        let (emu, outputs) = run_commands(
+            emu,
+            vec![Command::Pause, Command::StepFrame, Command::StepFrame, Command::LoadState(state), Command::StepFrame],
+        );
+        assert_eq!(emu.frame_count(), 2);
+        assert_eq!(frame_numbers(&outputs.frames), [3, 2]);
+    }
+
+    #[test]
+    fn audio_is_published_for_every_frame_run() {
+        let (_, outputs) = run_commands(Emulator::new(), vec![Command::Pause, Command::StepFrame, Command::StepFrame]);
+        // 280896 cycles per frame at 512 cycles per sample pair
+        for frame in 1..=2 {
+            let chunk = outputs.audio.try_recv().expect("no audio for frame");
+            assert_eq!(chunk.frame, frame);
+            assert!((2 * 548..=2 * 549).contains(&chunk.samples.len()), "{}", chunk.samples.len());
+        }
+    }
+
+    #[test]
+    fn running_frames_are_paced_to_the_refresh_rate() {
+        let started = Instant::now();
+        let runner = Emulator::new().run_async();
+        let mut frame = runner.frames().recv_timeout(Duration::from_secs(10)).expect("no frame produced");
+        while frame.number < 6 {
+            frame = runner.frames().recv_timeout(Duration::from_secs(10)).expect("frames stopped");
+        }
+        // Frame n cannot start before n - 1 frame periods have passed
+        assert!(started.elapsed() >= FRAME_TIME * (frame.number as u32 - 1));
+
+        let emu = runner.shutdown();
+        assert!(emu.frame_count() >= frame.number);
+    }
+}
@@ -0,0 +1,203 @@
+use std::io::{Error, ErrorKind};
+use std::path::Path;
+
+const ELF_MAGIC: &[u8; 4] = b"\x7FELF";
+const ELFCLASS32: u8 = 1;
+const ELFDATA2LSB: u8 = 1;
+const SHT_SYMTAB: u32 = 2;
+const SYMBOL_SIZE: usize = 16;
+
+// Symbol types worth annotating addresses with
+const STT_NOTYPE: u8 = 0;
+const STT_OBJECT: u8 = 1;
+const STT_FUNC: u8 = 2;
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Symbol {
+    pub name: String,
+    pub addr: u32,
+    pub size: u32,
+}
+
+/// Address-sorted symbols extracted from an ELF build of the running ROM.
+#[derive(Default)]
+pub struct SymbolTable {
+    symbols: Vec<Symbol>,
+}
+
+fn invalid(msg: &str) -> Error {
+    Error::new(ErrorKind::InvalidData, msg.to_string())
+}
+
+fn le16(data: &[u8], at: usize) -> Result<u16, Error> {
+    data.get(at..at + 2)
+        .map(|b| u16::from_le_bytes([b[0], b[1]]))
+        .ok_or_else(|| invalid("elf: truncated file"))
+}
+
+fn le32(data: &[u8], at: usize) -> Result<u32, Error> {
+    data.get(at..at + 4)
+        .map(|b| u32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+        .ok_or_else(|| invalid("elf: truncated file"))
+}
+
+impl SymbolTable {
+    pub fn new() -> Self { Self::default() }
+
+    pub fn load(path: &Path) -> Result<Self, Error> {
+        Self::from_elf(&std::fs::read(path)?)
+    }
+
+    pub fn from_elf(data: &[u8]) -> Result<Self, Error> {
+        if data.get(0..4) != Some(ELF_MAGIC) {
+            return Err(invalid("elf: bad magic"));
+        }
+        if data.get(4) != Some(&ELFCLASS32) || data.get(5) != Some(&ELFDATA2LSB) {
+            return Err(invalid("elf: only 32-bit little-endian files are supported"));
+        }
+        let shoff = le32(data, 0x20)? as usize;
+        let shentsize = le16(data, 0x2E)? as usize;
+        let shnum = le16(data, 0x30)? as usize;
+        let section = |i: usize| shoff + i * shentsize;
+
+        let mut symbols = Vec::new();
+        for i in 0..shnum {
+            let sh = section(i);
+            if le32(data, sh + 4)? != SHT_SYMTAB {
+                continue;
+            }
+            let offset = le32(data, sh + 16)? as usize;
+            let size = le32(data, sh + 20)? as usize;
+            let strtab = section(le32(data, sh + 24)? as usize);
+            let str_offset = le32(data, strtab + 16)? as usize;
+            let str_size = le32(data, strtab + 20)? as usize;
+            let strings = data
+                .get(str_offset..str_offset + str_size)
+                .ok_or_else(|| invalid("elf: truncated string table"))?;
+
+            for entry in (offset..offset + size).step_by(SYMBOL_SIZE) {
+                let name_off = le32(data, entry)? as usize;
+                let value = le32(data, entry + 4)?;
+                let sym_size = le32(data, entry + 8)?;
+                let kind = data.get(entry + 12).ok_or_else(|| invalid("elf: truncated symbol"))? & 0xF;
+                if !matches!(kind, STT_NOTYPE | STT_OBJECT | STT_FUNC) || name_off == 0 {
+                    continue;
+                }
+                let name = strings
+                    .get(name_off..)
+                    .and_then(|s| s.split(|&b| b == 0).next())
+                    .map(|s| String::from_utf8_lossy(s).into_owned())
+                    .unwrap_or_default();
+                // Skip ARM mapping symbols ($a, $t, $d) and empty names
+                if name.is_empty() || name.starts_with('$') {
+                    continue;
+                }
+                // Thumb function addresses carry the interworking bit
+                let addr = if kind == STT_FUNC { value & !1 } else { value };
+                symbols.push(Symbol { name, addr, size: sym_size });
+            }
+        }
+
+        symbols.sort_by_key(|s| s.addr);
+        log::info!("Loaded {} symbols", symbols.len());
+        Ok(Self { symbols })
+    }
+
+    pub fn len(&self) -> usize { self.symbols.len() }
+    pub fn is_empty(&self) -> bool { self.symbols.is_empty() }
+
+    pub fn address_of(&self, name: &str) -> Option<u32> {
+        self.symbols.iter().find(|s| s.name == name).map(|s| s.addr)
+    }
+
+    /// Finds the symbol covering `addr` and the offset into it.
+    pub fn lookup(&self, addr: u32) -> Option<(&Symbol, u32)> {
+        let idx = self.symbols.partition_point(|s| s.addr <= addr).checked_sub(1)?;
+        let symbol = &self.symbols[idx];
+        let offset = addr - symbol.addr;
+        if symbol.size != 0 && offset >= symbol.size {
+            return None;
+        }
+        Some((symbol, offset))
+    }
+
+    /// Formats `addr` as `name+0xoffset` when a symbol covers it.
+    pub fn format_addr(&self, addr: u32) -> String {
+        match self.lookup(addr) {
+            Some((symbol, 0)) => symbol.name.clone(),
+            Some((symbol, offset)) => format!("{}+{:#x}", symbol.name, offset),
+            None => format!("{:#010x}", addr),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Builds an ELF with a null section, a symbol table and its string table
+    fn build_elf(symbols: &[(&str, u32, u32, u8)]) -> Vec<u8> {
+        let mut strtab = vec![0u8];
+        let mut symtab = vec![0u8; SYMBOL_SIZE];
+        for (name, value, size, info) in symbols {
+            symtab.extend_from_slice(&(strtab.len() as u32).to_le_bytes());
+            symtab.extend_from_slice(&value.to_le_bytes());
+            symtab.extend_from_slice(&size.to_le_bytes());
+            symtab.extend_from_slice(&[*info, 0, 1, 0]);
+            strtab.extend_from_slice(name.as_bytes());
+            strtab.push(0);
+        }
+
+        let symtab_off = 52;
+        let strtab_off = symtab_off + symtab.len();
+        let shoff = strtab_off + strtab.len();
+
+        let mut elf = vec![0u8; 52];
+        elf[0..4].copy_from_slice(ELF_MAGIC);
+        elf[4] = ELFCLASS32;
+        elf[5] = ELFDATA2LSB;
+        elf[0x20..0x24].copy_from_slice(&(shoff as u32).to_le_bytes());
+        elf[0x2E..0x30].copy_from_slice(&40u16.to_le_bytes());
+        elf[0x30..0x32].copy_from_slice(&3u16.to_le_bytes());
+        elf.extend_from_slice(&symtab);
+        elf.extend_from_slice(&strtab);
+
+        let mut section = |kind: u32, offset: usize, size: usize, link: u32| {
+            let mut sh = [0u8; 40];
+            sh[4..8].copy_from_slice(&kind.to_le_bytes());
+            sh[16..20].copy_from_slice(&(offset as u32).to_le_bytes());
+            sh[20..24].copy_from_slice(&(size as u32).to_le_bytes());
+            sh[24..28].copy_from_slice(&link.to_le_bytes());
+            elf.extend_from_slice(&sh);
+        };
+        section(0, 0, 0, 0);
+        section(SHT_SYMTAB, symtab_off, symtab.len(), 2);
+        section(3, strtab_off, strtab.len(), 0);
+        elf
+    }
+
+    #[test]
+    fn resolves_symbols_from_elf() {
+        let elf = build_elf(&[
+            ("crt0.s", 0, 0, 0x04),                  // STT_FILE
+            ("main", 0x0800_0100, 0x40, 0x12),       // global func
+            ("thumb_helper", 0x0800_0201, 0x10, 0x12),
+            ("$t", 0x0800_0200, 0, 0x00),
+            ("frame_counter", 0x0300_0000, 4, 0x11), // global object
+        ]);
+        let symbols = SymbolTable::from_elf(&elf).unwrap();
+
+        assert_eq!(symbols.len(), 3);
+        assert_eq!(symbols.address_of("main"), Some(0x0800_0100));
+        assert_eq!(symbols.format_addr(0x0800_0120), "main+0x20");
+        assert_eq!(symbols.format_addr(0x0800_0200), "thumb_helper");
+        assert_eq!(symbols.format_addr(0x0800_0140), "0x08000140");
+        assert_eq!(symbols.lookup(0x0300_0002).map(|(s, _)| s.name.as_str()), Some("frame_counter"));
+    }
+
+    #[test]
+    fn rejects_non_elf_data() {
+        assert!(SymbolTable::from_elf(b"not an elf").is_err());
+        assert!(SymbolTable::from_elf(b"\x7FELF").is_err(), "truncated header");
+    }
+}
@@ -0,0 +1,253 @@
+use crate::timing::{Event, Scheduler};
+
+pub const TIMER_BASE: u32 = 0x0400_0100;
+pub const TIMER_END: u32 = 0x0400_010F;
+
+const TIMER_ENABLE: u16 = 1 << 7;
+const TIMER_IRQ: u16 = 1 << 6;
+const TIMER_CASCADE: u16 = 1 << 2;
+
+/// Everything one overflow event set off: the timer itself and any count-up
+/// timers above it that it carried into.
+#[derive(Copy, Clone, Debug, Default, PartialEq, Eq)]
+pub struct Overflow {
+    /// Bit n is set when timer n overflowed
+    pub timers: u8,
+    /// IF bits to raise
+    pub irq: u16,
+}
+
+impl Overflow {
+    pub fn includes(&self, idx: usize) -> bool { self.timers & (1 << idx) != 0 }
+}
+
+#[derive(Default, Clone, Copy)]
+pub struct Timer {
+    pub reload: u16,
+    pub cnt_h: u16,
+    // Counter value at `started_at`; it advances one step per prescaler period from there
+    counter: u16,
+    started_at: u64,
+}
+
+impl Timer {
+    pub fn enabled(&self) -> bool { (self.cnt_h & TIMER_ENABLE) != 0 }
+    pub fn irq_enabled(&self) -> bool { (self.cnt_h & TIMER_IRQ) != 0 }
+    pub fn cascade(&self) -> bool { (self.cnt_h & TIMER_CASCADE) != 0 }
+    pub fn counter(&self) -> u16 { self.counter }
+
+    pub fn prescaler(&self) -> u64 {
+        match self.cnt_h & 0x3 {
+            0 => 1,
+            1 => 64,
+            2 => 256,
+            _ => 1024,
+        }
+    }
+
+    fn counter_at(&self, now: u64) -> u16 {
+        if !self.enabled() || self.cascade() {
+            return self.counter;
+        }
+        let steps = (now - self.started_at) / self.prescaler();
+        self.counter.wrapping_add(steps as u16)
+    }
+
+    fn cycles_to_overflow(&self) -> u64 {
+        (0x1_0000 - self.counter as u64) * self.prescaler()
+    }
+}
+
+#[derive(Default, Clone)]
+pub struct Timers {
+    pub timers: [Timer; 4],
+}
+
+impl Timers {
+    pub fn new() -> Self { Self::default() }
+
+    /// Reads a timer register at cycle `now`; the counter is derived from the
+    /// cycles elapsed since it was last reloaded rather than ticked every cycle.
+    pub fn read8(&self, addr: u32, now: u64) -> u8 {
+        let offset = addr - TIMER_BASE;
+        let timer = &self.timers[(offset / 4) as usize];
+        let value = if offset & 2 == 0 { timer.counter_at(now) } else { timer.cnt_h };
+        (value >> ((offset & 1) * 8)) as u8
+    }
+
+    pub fn read16(&self, addr: u32, now: u64) -> u16 {
+        let offset = addr - TIMER_BASE;
+        let timer = &self.timers[(offset / 4) as usize];
+        if offset & 2 == 0 { timer.counter_at(now) } else { timer.cnt_h }
+    }
+
+    pub fn write16(&mut self, addr: u32, value: u16, scheduler: &mut Scheduler) {
+        let offset = addr - TIMER_BASE;
+        if offset & 2 == 0 {
+            self.timers[(offset / 4) as usize].reload = value;
+        } else {
+            // Only the low byte of TMxCNT_H is implemented
+            self.write8(addr, value as u8, scheduler);
+        }
+    }
+
+    pub fn write8(&mut self, addr: u32, value: u8, scheduler: &mut Scheduler) {
+        let offset = addr - TIMER_BASE;
+        let idx = (offset / 4) as usize;
+        let timer = &mut self.timers[idx];
+        match offset % 4 {
+            0 => timer.reload = (timer.reload & 0xFF00) | value as u16,
+            1 => timer.reload = (timer.reload & 0x00FF) | ((value as u16) << 8),
+            2 => {
+                let was_enabled = timer.enabled();
+                timer.counter = timer.counter_at(scheduler.now());
+                // Timer 0 has no lower timer to count up from
+                let mask = if idx == 0 { 0xC3 } else { 0xC7 };
+                timer.cnt_h = (timer.cnt_h & 0xFF00) | (value as u16 & mask);
+                if timer.enabled() && !was_enabled {
+                    timer.counter = timer.reload;
+                }
+                timer.started_at = scheduler.now();
+                Self::reschedule(idx, timer, scheduler);
+            }
+            _ => {}
+        }
+    }
+
+    // Overflow time depends on the counter, reload and prescaler, so any
+    // control write replaces the pending event
+    fn reschedule(idx: usize, timer: &Timer, scheduler: &mut Scheduler) {
+        scheduler.cancel(Event::TimerOverflow(idx));
+        if timer.enabled() && !timer.cascade() {
+            scheduler.schedule_at(timer.started_at + timer.cycles_to_overflow(), Event::TimerOverflow(idx));
+        }
+    }
+
+    /// Handles the overflow event of timer `idx` due at cycle `at`, re-arming it
+    /// from its reload value.
+    pub fn overflow(&mut self, idx: usize, at: u64, scheduler: &mut Scheduler) -> Overflow {
+        let timer = &mut self.timers[idx];
+        timer.counter = timer.reload;
+        timer.started_at = at;
+        Self::reschedule(idx, timer, scheduler);
+        let mut overflow = Overflow { timers: 1 << idx, irq: if timer.irq_enabled() { 1 << (3 + idx) } else { 0 } };
+
+        // A count-up timer ignores its prescaler and ticks once per overflow of the timer below
+        if let Some(next) = self.timers.get_mut(idx + 1)
+            && next.enabled()
+            && next.cascade()
+        {
+            next.counter = next.counter.wrapping_add(1);
+            if next.counter == 0 {
+                let carried = self.overflow(idx + 1, at, scheduler);
+                overflow.timers |= carried.timers;
+                overflow.irq |= carried.irq;
+            }
+        }
+        overflow
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bus::{Bus, BusAccess};
+
+    #[test]
+    fn prescaler_1_overflow_fires_at_computed_cycle_and_rearms() {
+        let mut bus = Bus::new();
+        bus.scheduler.advance(100);
+        bus.write16(TIMER_BASE, 0xFFF0);
+        bus.write16(TIMER_BASE + 2, TIMER_ENABLE | TIMER_IRQ);
+        assert_eq!(bus.scheduler.next_event_at(), Some(116));
+
+        bus.scheduler.advance_to(115);
+        assert_eq!(bus.scheduler.pop_due(), None);
+        bus.scheduler.advance_to(116);
+        assert_eq!(bus.scheduler.pop_due(), Some((116, Event::TimerOverflow(0))));
+
+        bus.timer_overflow(0, 116);
+        assert_eq!(bus.io.if_ & 0x0008, 0x0008);
+        assert_eq!(bus.scheduler.next_event_at(), Some(132));
+    }
+
+    #[test]
+    fn control_write_recomputes_overflow() {
+        let mut bus = Bus::new();
+        bus.write16(TIMER_BASE + 4, 0xFF00);
+        bus.write16(TIMER_BASE + 6, TIMER_ENABLE | 1);
+        assert_eq!(bus.scheduler.next_event_at(), Some(256 * 64));
+
+        bus.write16(TIMER_BASE + 6, 0);
+        assert_eq!(bus.scheduler.next_event_at(), None);
+    }
+
+    #[test]
+    fn cascade_timer_counts_lower_overflows_only() {
+        let mut bus = Bus::new();
+        // Timer 1: count-up with the slowest prescaler selected, which must be ignored
+        bus.write16(TIMER_BASE + 4, 0xFFFD);
+        bus.write16(TIMER_BASE + 6, TIMER_ENABLE | TIMER_IRQ | TIMER_CASCADE | 3);
+        assert_eq!(bus.scheduler.next_event_at(), None);
+
+        // Timer 0 overflows every 16 cycles
+        bus.write16(TIMER_BASE, 0xFFF0);
+        bus.write16(TIMER_BASE + 2, TIMER_ENABLE);
+
+        let overflows = 5;
+        for _ in 0..overflows {
+            let at = bus.scheduler.next_event_at().unwrap();
+            bus.scheduler.advance_to(at);
+            while let Some((at, Event::TimerOverflow(idx))) = bus.scheduler.pop_due() {
+                bus.timer_overflow(idx, at);
+            }
+        }
+
+        // 0xFFFD + 3 wraps to the reload value, then two more ticks
+        assert_eq!(bus.read16(TIMER_BASE + 4), 0xFFFD + 2);
+        assert_eq!(bus.io.if_ & 0x0010, 0x0010);
+        assert_eq!(bus.io.if_ & 0x0008, 0);
+    }
+
+    #[test]
+    fn cascaded_overflows_clock_the_fifo_of_their_timer() {
+        let mut bus = Bus::new();
+        // DMA1 feeds FIFO A, which plays on timer 1
+        bus.write32(0x0400_00BC, 0x0200_0000);
+        bus.write32(0x0400_00C0, 0x0400_00A0);
+        bus.write16(0x0400_00C6, (1 << 15) | (1 << 10) | (1 << 9) | (3 << 12));
+        bus.write16(0x0400_0082, 1 << 10);
+
+        bus.write16(TIMER_BASE + 4, 0xFFFF);
+        bus.write16(TIMER_BASE + 6, TIMER_ENABLE | TIMER_CASCADE);
+        bus.write16(TIMER_BASE + 2, TIMER_ENABLE);
+
+        let overflow = bus.io.timers.overflow(0, 0, &mut bus.scheduler);
+        assert_eq!(overflow.timers, 0b11);
+        assert!(overflow.includes(1) && !overflow.includes(2));
+
+        // The empty FIFO asks for a refill as soon as timer 1 plays from it
+        bus.write16(TIMER_BASE + 4, 0xFFFF);
+        bus.write16(TIMER_BASE + 6, 0);
+        bus.write16(TIMER_BASE + 6, TIMER_ENABLE | TIMER_CASCADE);
+        bus.timer_overflow(0, 0);
+        assert_eq!(bus.io.dma.channels[1].internal_src(), 0x0200_0010);
+    }
+
+    #[test]
+    fn counter_read_reflects_elapsed_cycles() {
+        let mut bus = Bus::new();
+        bus.scheduler.advance(1000);
+        bus.write16(TIMER_BASE + 8, 0x1000);
+        bus.write16(TIMER_BASE + 10, TIMER_ENABLE | 1);
+        assert_eq!(bus.read16(TIMER_BASE + 8), 0x1000);
+
+        bus.scheduler.advance(64 * 10 + 5);
+        assert_eq!(bus.read16(TIMER_BASE + 8), 0x100A);
+
+        // Stopping the timer freezes the counter at its live value
+        bus.write16(TIMER_BASE + 10, 1);
+        bus.scheduler.advance(64 * 100);
+        assert_eq!(bus.read16(TIMER_BASE + 8), 0x100A);
+    }
+}
@@ -1,6 +1,91 @@
-#[derive(Default)]
-pub struct Timing;
+use std::cmp::Reverse;
+use std::collections::BinaryHeap;
 
-impl Timing {
-    pub fn new() -> Self { Self }
+#[derive(Copy, Clone, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Event {
+    /// Start of the visible part of a scanline
+    HDraw(usize),
+    HBlank(usize),
+    TimerOverflow(usize),
+}
+
+/// Queue of future events keyed by the cycle they fire on. Events due on the
+/// same cycle fire in the order they were scheduled, so runs are deterministic.
+#[derive(Default, Clone)]
+pub struct Scheduler {
+    now: u64,
+    seq: u64,
+    queue: BinaryHeap<Reverse<(u64, u64, Event)>>,
+}
+
+impl Scheduler {
+    pub fn new() -> Self { Self::default() }
+
+    pub fn now(&self) -> u64 { self.now }
+
+    pub fn schedule(&mut self, delay: u64, event: Event) {
+        self.schedule_at(self.now + delay, event);
+    }
+
+    pub fn schedule_at(&mut self, at: u64, event: Event) {
+        self.queue.push(Reverse((at, self.seq, event)));
+        self.seq += 1;
+    }
+
+    pub fn cancel(&mut self, event: Event) {
+        self.queue.retain(|Reverse((_, _, e))| *e != event);
+    }
+
+    pub fn next_event_at(&self) -> Option<u64> {
+        self.queue.peek().map(|Reverse((at, ..))| *at)
+    }
+
+    pub fn advance(&mut self, cycles: u64) { self.now += cycles; }
+
+    pub fn advance_to(&mut self, at: u64) { self.now = self.now.max(at); }
+
+    /// Pops the next event whose cycle has been reached, with the cycle it was due on.
+    pub fn pop_due(&mut self) -> Option<(u64, Event)> {
+        match self.queue.peek() {
+            Some(Reverse((at, ..))) if *at <= self.now => {
+                self.queue.pop().map(|Reverse((at, _, event))| (at, event))
+            }
+            _ => None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn events_fire_in_cycle_order() {
+        let mut scheduler = Scheduler::new();
+        scheduler.schedule(1232, Event::HDraw(1));
+        scheduler.schedule(960, Event::HBlank(0));
+        assert_eq!(scheduler.next_event_at(), Some(960));
+
+        scheduler.advance(959);
+        assert_eq!(scheduler.pop_due(), None);
+
+        scheduler.advance_to(2000);
+        assert_eq!(scheduler.pop_due(), Some((960, Event::HBlank(0))));
+        assert_eq!(scheduler.pop_due(), Some((1232, Event::HDraw(1))));
+        assert_eq!(scheduler.pop_due(), None);
+    }
+
+    #[test]
+    fn same_cycle_events_keep_schedule_order_and_cancel() {
+        let mut scheduler = Scheduler::new();
+        scheduler.schedule(10, Event::HDraw(5));
+        scheduler.schedule(10, Event::HBlank(2));
+        scheduler.schedule(10, Event::HDraw(3));
+        scheduler.cancel(Event::HDraw(3));
+
+        scheduler.advance(10);
+        assert_eq!(scheduler.pop_due(), Some((10, Event::HDraw(5))));
+        assert_eq!(scheduler.pop_due(), Some((10, Event::HBlank(2))));
+        assert_eq!(scheduler.pop_due(), None);
+    }
 }
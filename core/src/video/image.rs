@@ -0,0 +1,101 @@
+use std::io::Error;
+use std::path::Path;
+
+use super::bgr555_to_rgba8888;
+
+/// An 8-bit RGBA image produced by the graphics debug views.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct RgbaImage {
+    pub width: usize,
+    pub height: usize,
+    pub pixels: Vec<u8>,
+}
+
+impl RgbaImage {
+    /// A fully transparent image.
+    pub fn new(width: usize, height: usize) -> Self {
+        Self { width, height, pixels: vec![0; width * height * 4] }
+    }
+
+    pub fn pixel(&self, x: usize, y: usize) -> [u8; 4] {
+        let o = (y * self.width + x) * 4;
+        [self.pixels[o], self.pixels[o + 1], self.pixels[o + 2], self.pixels[o + 3]]
+    }
+
+    pub fn set_pixel(&mut self, x: usize, y: usize, rgba: [u8; 4]) {
+        let o = (y * self.width + x) * 4;
+        self.pixels[o..o + 4].copy_from_slice(&rgba);
+    }
+
+    pub fn set_bgr555(&mut self, x: usize, y: usize, color: u16) {
+        self.set_pixel(x, y, bgr555_to_rgba8888(color));
+    }
+
+    /// Encodes the image as a PNG file.
+    pub fn to_png(&self) -> Vec<u8> {
+        // Every scanline starts with filter type 0 (none)
+        let mut raw = Vec::with_capacity(self.height * (self.width * 4 + 1));
+        for row in self.pixels.chunks(self.width * 4) {
+            raw.push(0);
+            raw.extend_from_slice(row);
+        }
+
+        let mut ihdr = Vec::with_capacity(13);
+        ihdr.extend_from_slice(&(self.width as u32).to_be_bytes());
+        ihdr.extend_from_slice(&(self.height as u32).to_be_bytes());
+        ihdr.extend_from_slice(&[8, 6, 0, 0, 0]); // 8-bit RGBA, no interlace
+
+        let mut png = b"\x89PNG\r\n\x1a\n".to_vec();
+        write_chunk(&mut png, b"IHDR", &ihdr);
+        write_chunk(&mut png, b"IDAT", &miniz_oxide::deflate::compress_to_vec_zlib(&raw, 6));
+        write_chunk(&mut png, b"IEND", &[]);
+        png
+    }
+
+    pub fn save_png(&self, path: &Path) -> Result<(), Error> {
+        std::fs::write(path, self.to_png())
+    }
+}
+
+fn write_chunk(out: &mut Vec<u8>, kind: &[u8; 4], data: &[u8]) {
+    out.extend_from_slice(&(data.len() as u32).to_be_bytes());
+    let start = out.len();
+    out.extend_from_slice(kind);
+    out.extend_from_slice(data);
+    let crc = crc32(&out[start..]);
+    out.extend_from_slice(&crc.to_be_bytes());
+}
+
+fn crc32(data: &[u8]) -> u32 {
+    let mut crc = 0xFFFF_FFFFu32;
+    for &byte in data {
+        crc ^= byte as u32;
+        for _ in 0..8 {
+            crc = if crc & 1 != 0 { (crc >> 1) ^ 0xEDB8_8320 } else { crc >> 1 };
+        }
+    }
+    !crc
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn png_has_valid_structure() {
+        let mut image = RgbaImage::new(2, 1);
+        image.set_bgr555(1, 0, 0x001F);
+        assert_eq!(image.pixel(1, 0), [0xFF, 0, 0, 0xFF]);
+
+        let png = image.to_png();
+        assert_eq!(&png[..8], b"\x89PNG\r\n\x1a\n");
+        assert_eq!(&png[12..16], b"IHDR");
+        assert_eq!(u32::from_be_bytes(png[16..20].try_into().unwrap()), 2);
+        // CRC of the standard empty IEND chunk
+        assert_eq!(&png[png.len() - 4..], &[0xAE, 0x42, 0x60, 0x82]);
+
+        let idat_len = u32::from_be_bytes(png[33..37].try_into().unwrap()) as usize;
+        let raw = miniz_oxide::inflate::decompress_to_vec_zlib(&png[41..41 + idat_len]).unwrap();
+        assert_eq!(raw, [0, 0, 0, 0, 0, 0xFF, 0, 0, 0xFF]);
+    }
+}
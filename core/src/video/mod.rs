@@ -1,3 +1,7 @@
+pub mod image;
+
+pub use image::RgbaImage;
+
 #[derive(Default)]
 pub struct Video;
 
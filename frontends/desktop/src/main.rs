@@ -207,7 +207,7 @@ impl GbaApp {
     fn open_rom(&mut self) {
         if let Some(path) = rfd::FileDialog::new()
             .set_title("Open GBA ROM")
-            .add_filter("Game Boy Advance ROM", &["gba"])
+            .add_filter("Game Boy Advance ROM", &["gba", "zip"])
             .pick_file()
         {
             Self::add_to_recent(&mut self.recent_files, path.clone());